@@ -1,3 +1,7 @@
 package pkg
 
 const ISSUER = "https://edmodoworld.com"
+
+const PLATFORM_URL = "http://localhost:8000"
+
+const KEY_ID = "edmodoworld-1"
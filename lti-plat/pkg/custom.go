@@ -0,0 +1,64 @@
+package pkg
+
+import "strings"
+
+// SubstitutionData is the platform data available to custom parameter substitution.
+type SubstitutionData struct {
+	User         User
+	Course       Course
+	ResourceLink ResourceLink
+}
+
+// variables returns the values of the supported LTI substitution variables. Variables whose value is unknown are left
+// out so that they are not substituted.
+//
+// Ref: https://www.imsglobal.org/spec/lti/v1p3/#customproperty
+func (d SubstitutionData) variables() map[string]string {
+	all := map[string]string{
+		"$User.id":                  d.User.Id,
+		"$User.username":            d.User.Username,
+		"$Person.sourcedId":         d.User.SourcedId,
+		"$Person.name.full":         d.User.FullName(),
+		"$Person.name.given":        d.User.GivenName,
+		"$Person.name.family":       d.User.FamilyName,
+		"$Person.email.primary":     d.User.Email,
+		"$Context.id":               d.Course.Id,
+		"$Context.label":            d.Course.Label,
+		"$Context.title":            d.Course.Title,
+		"$CourseOffering.sourcedId": d.Course.SourcedId,
+		"$CourseOffering.label":     d.Course.Label,
+		"$CourseOffering.title":     d.Course.Title,
+		"$CourseSection.sourcedId":  d.Course.SectionSourcedId,
+		"$CourseSection.label":      d.Course.SectionLabel,
+		"$CourseSection.title":      d.Course.SectionTitle,
+		"$ResourceLink.id":          d.ResourceLink.Id,
+		"$ResourceLink.title":       d.ResourceLink.Title,
+		"$ResourceLink.description": d.ResourceLink.Description,
+	}
+
+	vars := make(map[string]string, len(all))
+	for name, value := range all {
+		if value != "" {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// CustomClaim merges the per-registration and per-resource-link custom parameter templates, with the resource link
+// taking precedence, and substitutes the variables in their values. A value is substituted only when it is exactly a
+// supported variable name; unknown variables and plain values are sent as they are.
+func CustomClaim(data SubstitutionData, templates ...map[string]string) map[string]string {
+	vars := data.variables()
+
+	custom := map[string]string{}
+	for _, template := range templates {
+		for name, value := range template {
+			if substituted, ok := vars[strings.TrimSpace(value)]; ok {
+				value = substituted
+			}
+			custom[name] = value
+		}
+	}
+	return custom
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCustomClaim(t *testing.T) {
+	data := SubstitutionData{
+		User:         Users["pirlo"],
+		Course:       Courses["course-1"],
+		ResourceLink: ResourceLinks["1"],
+	}
+	registration := map[string]string{
+		"user_id":  "$User.id",
+		"email":    "$Person.email.primary",
+		"section":  "$CourseSection.sourcedId",
+		"unknown":  "$Unknown.variable",
+		"chapter":  "0",
+		"fixed":    "value",
+		"guid":     "$ToolPlatformInstance.guid",
+		"resource": "$ResourceLink.title",
+	}
+	resourceLink := map[string]string{
+		"chapter": "1",
+	}
+
+	actual := CustomClaim(data, registration, resourceLink)
+	expected := map[string]string{
+		"user_id":  "pirlo",
+		"email":    "pirlo@edmodoworld.com",
+		"section":  "sis-course-1-a",
+		"unknown":  "$Unknown.variable",
+		"chapter":  "1",
+		"fixed":    "value",
+		"guid":     "$ToolPlatformInstance.guid",
+		"resource": "Chapter 1",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got %#v, wanted %#v", actual, expected)
+	}
+
+	// Variables without a value are left untouched.
+	actual = CustomClaim(SubstitutionData{User: User{Id: "u1"}}, map[string]string{"email": "$Person.email.primary"})
+	if actual["email"] != "$Person.email.primary" {
+		t.Fatalf("got %q, wanted the unsubstituted variable", actual["email"])
+	}
+}
@@ -0,0 +1,125 @@
+package pkg
+
+// User is a platform user that can launch tools.
+type User struct {
+	Id         string
+	Username   string
+	GivenName  string
+	FamilyName string
+	Email      string
+	SourcedId  string
+}
+
+// FullName returns the display name of the user.
+func (u User) FullName() string {
+	if u.GivenName == "" {
+		return u.FamilyName
+	}
+	if u.FamilyName == "" {
+		return u.GivenName
+	}
+	return u.GivenName + " " + u.FamilyName
+}
+
+// Course is a course offering together with the section the resource links are placed in.
+type Course struct {
+	Id               string
+	Label            string
+	Title            string
+	SourcedId        string
+	SectionSourcedId string
+	SectionLabel     string
+	SectionTitle     string
+}
+
+// ResourceLink is a tool placement inside a course. Custom holds the per-resource-link custom parameter templates.
+type ResourceLink struct {
+	Id          string
+	Title       string
+	Description string
+	CourseId    string
+	Custom      map[string]string
+}
+
+// Registration is the platform side of a tool registration. Custom holds the custom parameter templates sent with
+// every launch of the tool.
+type Registration struct {
+	ClientId     string
+	DeploymentId string
+	Custom       map[string]string
+}
+
+var Users = map[string]User{
+	"pirlo": {
+		Id:         "pirlo",
+		Username:   "pirlo",
+		GivenName:  "Andrea",
+		FamilyName: "Pirlo",
+		Email:      "pirlo@edmodoworld.com",
+		SourcedId:  "sis-pirlo",
+	},
+}
+
+var Courses = map[string]Course{
+	"course-1": {
+		Id:               "course-1",
+		Label:            "CS101",
+		Title:            "Introduction to Computing",
+		SourcedId:        "sis-course-1",
+		SectionSourcedId: "sis-course-1-a",
+		SectionLabel:     "CS101-A",
+		SectionTitle:     "Introduction to Computing, Section A",
+	},
+}
+
+var ResourceLinks = map[string]ResourceLink{
+	"1": {
+		Id:          "1",
+		Title:       "Chapter 1",
+		Description: "First chapter of the book",
+		CourseId:    "course-1",
+		Custom: map[string]string{
+			"chapter": "1",
+		},
+	},
+}
+
+var Registrations = map[string]Registration{
+	"clientid": {
+		ClientId:     "clientid",
+		DeploymentId: "1",
+		Custom: map[string]string{
+			"user_id":       "$User.id",
+			"user_email":    "$Person.email.primary",
+			"context_id":    "$Context.id",
+			"resource_name": "$ResourceLink.title",
+			"section":       "$CourseSection.sourcedId",
+		},
+	},
+}
+
+// FindUser returns the user with the given id. Unknown users only carry their id.
+func FindUser(id string) User {
+	if u, ok := Users[id]; ok {
+		return u
+	}
+	return User{Id: id, Username: id}
+}
+
+// FindResourceLink returns the resource link with the given id and the course it belongs to. Unknown resource links
+// only carry their id.
+func FindResourceLink(id string) (ResourceLink, Course) {
+	rl, ok := ResourceLinks[id]
+	if !ok {
+		return ResourceLink{Id: id}, Course{}
+	}
+	return rl, Courses[rl.CourseId]
+}
+
+// FindRegistration returns the registration for the given client id.
+func FindRegistration(clientId string) Registration {
+	if reg, ok := Registrations[clientId]; ok {
+		return reg
+	}
+	return Registration{ClientId: clientId, DeploymentId: "1"}
+}
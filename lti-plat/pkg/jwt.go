@@ -2,7 +2,9 @@ package pkg
 
 import (
 	"crypto/rsa"
+	"encoding/base64"
 	"fmt"
+	"math/big"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,25 +28,37 @@ type LTILaunchPresentation struct {
 	DocumentTarget string `json:"document_target"`
 	Height         int8   `json:"height"`
 	Width          int8   `json:"width"`
-	ReturnUrl      string `json:"return_url"`
+	ReturnUrl      string `json:"return_url,omitempty"`
+}
+
+type LTILis struct {
+	PersonSourcedId         string `json:"person_sourcedid,omitempty"`
+	CourseOfferingSourcedId string `json:"course_offering_sourcedid,omitempty"`
+	CourseSectionSourcedId  string `json:"course_section_sourcedid,omitempty"`
 }
 
 type LTIClaims struct {
 	jwt.Claims
 	Nonce              string                `json:"nonce"`
+	Name               string                `json:"name,omitempty"`
+	GivenName          string                `json:"given_name,omitempty"`
+	FamilyName         string                `json:"family_name,omitempty"`
+	Email              string                `json:"email,omitempty"`
 	DeploymentId       string                `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
 	MessageType        string                `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
 	Roles              []string              `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
 	Context            LTIContext            `json:"https://purl.imsglobal.org/spec/lti/claim/context"`
 	ResourceLink       LTIResourceLink       `json:"https://purl.imsglobal.org/spec/lti/claim/resource_link"`
 	TargetLink         string                `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri"`
-	LaunchPresentation LTILaunchPresentation `json:"https://purl.imsglobal.org/spec/lti/claim/launch_presentation""`
+	LaunchPresentation LTILaunchPresentation `json:"https://purl.imsglobal.org/spec/lti/claim/launch_presentation"`
+	Lis                LTILis                `json:"https://purl.imsglobal.org/spec/lti/claim/lis"`
 	CustomClaim        map[string]string     `json:"https://purl.imsglobal.org/spec/lti/claim/custom"`
 	Version            string                `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
 }
 
 var privateKey *rsa.PrivateKey
 var publicKey *rsa.PublicKey
+var keys = jwt.Keys{}
 
 func init() {
 	var err error
@@ -56,9 +70,14 @@ func init() {
 	if err != nil {
 		fmt.Println(fmt.Sprintf("err when load public key:%v", err))
 	}
+	keys.Register(jwt.RS256, KEY_ID, publicKey, privateKey)
 }
 
 func IdToken(clientId, userId, nonce, resId string) string {
+	user := FindUser(userId)
+	resourceLink, course := FindResourceLink(resId)
+	registration := FindRegistration(clientId)
+
 	claims := LTIClaims{
 		Claims: jwt.Claims{
 			IssuedAt: time.Now().Unix(),
@@ -69,26 +88,71 @@ func IdToken(clientId, userId, nonce, resId string) string {
 			Subject:  userId,
 		},
 		Nonce:        nonce,
+		Name:         user.FullName(),
+		GivenName:    user.GivenName,
+		FamilyName:   user.FamilyName,
+		Email:        user.Email,
 		TargetLink:   "http://localhost:9000/launch",
-		DeploymentId: "1",
+		DeploymentId: registration.DeploymentId,
 		MessageType:  "LtiResourceLinkRequest",
 		Version:      "1.3.0",
-		CustomClaim: map[string]string{
-			"Foo": "bar",
+		CustomClaim: CustomClaim(SubstitutionData{
+			User:         user,
+			Course:       course,
+			ResourceLink: resourceLink,
+		}, registration.Custom, resourceLink.Custom),
+		Context: LTIContext{
+			Id:    course.Id,
+			Label: course.Label,
+			Title: course.Title,
 		},
 		ResourceLink: LTIResourceLink{
-			Id: resId,
+			Id:          resourceLink.Id,
+			Title:       resourceLink.Title,
+			Description: resourceLink.Description,
 		},
 		LaunchPresentation: LTILaunchPresentation{
 			DocumentTarget: "iframe",
+			ReturnUrl:      ReturnUrl(resId),
+		},
+		Lis: LTILis{
+			PersonSourcedId:         user.SourcedId,
+			CourseOfferingSourcedId: course.SourcedId,
+			CourseSectionSourcedId:  course.SectionSourcedId,
 		},
 	}
-	t, _ := jwt.Sign(jwt.RS256, privateKey, claims)
+	t, _ := keys.SignToken(KEY_ID, claims)
 	return string(t)
 }
 
+// JWK is the public part of the platform's signing key, as published in its JWKS.
+type JWK struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySet returns the JWKS that tools use to verify the id_tokens signed by IdToken.
+func KeySet() JWKS {
+	return JWKS{Keys: []JWK{{
+		Kty: "RSA",
+		Alg: jwt.RS256.Name(),
+		Use: "sig",
+		Kid: KEY_ID,
+		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}}}
+}
+
 func decryptToken(token string) *jwt.VerifiedToken {
-	vt, err := jwt.Verify(jwt.RS256, publicKey, []byte(token))
+	vt, err := jwt.VerifyWithHeaderValidator(nil, nil, []byte(token), keys.ValidateHeader)
 	if err != nil {
 		fmt.Printf("veriry token failed:%v", err)
 		return nil
@@ -1,7 +1,10 @@
 package pkg
 
 import (
+	"encoding/base64"
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 )
 
@@ -9,3 +12,20 @@ func TestIdToken(t *testing.T) {
 	token := IdToken("c1", "abc", "123456", "r1")
 	fmt.Println(string(decryptToken(token).Payload))
 }
+
+func TestKeySet(t *testing.T) {
+	keySet := KeySet()
+	if len(keySet.Keys) != 1 || keySet.Keys[0].Kid != KEY_ID {
+		t.Fatalf("got %#v, wanted the key %s", keySet, KEY_ID)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(keySet.Keys[0].N)
+	if err != nil || new(big.Int).SetBytes(n).Cmp(publicKey.N) != 0 {
+		t.Fatalf("published modulus does not match the public key")
+	}
+
+	token := IdToken("c1", "abc", "123456", "r1")
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil || !strings.Contains(string(header), `"kid":"`+KEY_ID+`"`) {
+		t.Fatalf("got header %s, wanted the key ID %s", header, KEY_ID)
+	}
+}
@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ReturnRecord is a tool's return to the platform through the launch_presentation return_url.
+type ReturnRecord struct {
+	Time           time.Time `json:"time"`
+	ResourceLinkId string    `json:"resource_link_id"`
+	Msg            string    `json:"lti_msg,omitempty"`
+	Log            string    `json:"lti_log,omitempty"`
+	ErrorMsg       string    `json:"lti_errormsg,omitempty"`
+	ErrorLog       string    `json:"lti_errorlog,omitempty"`
+	DeepLinkReturn string    `json:"lti_deep_link_return,omitempty"`
+}
+
+var (
+	returnsMu sync.Mutex
+	returns   []ReturnRecord
+)
+
+// ReturnUrl returns the return_url sent in the launch of the given resource link.
+func ReturnUrl(resId string) string {
+	values := url.Values{}
+	values.Set("resource_link_id", resId)
+	return PLATFORM_URL + "/return?" + values.Encode()
+}
+
+// RecordReturn reads the messages sent by a tool on the return_url query and keeps them for inspection.
+func RecordReturn(query url.Values) ReturnRecord {
+	record := ReturnRecord{
+		Time:           time.Now(),
+		ResourceLinkId: query.Get("resource_link_id"),
+		Msg:            query.Get("lti_msg"),
+		Log:            query.Get("lti_log"),
+		ErrorMsg:       query.Get("lti_errormsg"),
+		ErrorLog:       query.Get("lti_errorlog"),
+		DeepLinkReturn: query.Get("lti_deep_link_return"),
+	}
+
+	returnsMu.Lock()
+	defer returnsMu.Unlock()
+	returns = append(returns, record)
+	return record
+}
+
+// Returns returns the recorded returns, oldest first.
+func Returns() []ReturnRecord {
+	returnsMu.Lock()
+	defer returnsMu.Unlock()
+	return append([]ReturnRecord(nil), returns...)
+}
@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRecordReturn(t *testing.T) {
+	returnUrl, err := url.Parse(ReturnUrl("1"))
+	if err != nil {
+		t.Fatalf("parse return url: %v", err)
+	}
+	query := returnUrl.Query()
+	query.Set("lti_msg", "Saved")
+	query.Set("lti_errorlog", "grade sync failed")
+
+	record := RecordReturn(query)
+	if record.ResourceLinkId != "1" || record.Msg != "Saved" || record.ErrorLog != "grade sync failed" {
+		t.Fatalf("unexpected record %#v", record)
+	}
+
+	recorded := Returns()
+	if len(recorded) == 0 || recorded[len(recorded)-1] != record {
+		t.Fatalf("return not recorded: %#v", recorded)
+	}
+}
@@ -30,6 +30,8 @@ func registerRoutes() *gin.Engine {
 	r.GET("certs", certs)
 	r.GET("token", token)
 	r.GET("auth", auth)
+	r.GET("return", ltiReturn)
+	r.GET("returns", ltiReturns)
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.html", gin.H{})
 	})
@@ -61,10 +63,27 @@ func auth(ctx *gin.Context) {
 	})
 }
 
+// ltiReturn shows the messages a tool sends back through the launch_presentation return_url. lti_log and lti_errorlog
+// are only recorded, not shown to the user.
+func ltiReturn(ctx *gin.Context) {
+	record := pkg.RecordReturn(ctx.Request.URL.Query())
+	ctx.HTML(http.StatusOK, "return.html", gin.H{
+		"Msg":            record.Msg,
+		"ErrorMsg":       record.ErrorMsg,
+		"DeepLinkReturn": record.DeepLinkReturn,
+	})
+}
+
+// ltiReturns lists the recorded tool returns for inspection.
+func ltiReturns(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, pkg.Returns())
+}
+
 func token(ctx *gin.Context) {
 	ctx.Status(200)
 }
 
 func certs(ctx *gin.Context) {
-	ctx.Data(http.StatusOK, "text", []byte(pkg.PublicKey))
+	ctx.Header("Cache-Control", "max-age=3600")
+	ctx.JSON(http.StatusOK, pkg.KeySet())
 }
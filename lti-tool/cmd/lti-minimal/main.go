@@ -6,13 +6,16 @@
 // Package main implements a minimal working example of some the LTI library features. For simplicity, all data
 // (registrations, deployments, ...) are nonpersistent and stored in the LTI library's internal nonpersistent store.
 //
-// On startup, the program loads all configuration data from environment variables.
+// On startup, the program loads all configuration data from environment variables. The `migrate' subcommand manages the
+// schema of the SQL datastore instead; run `lti-minimal migrate' for its usage.
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
 	"os"
@@ -21,6 +24,7 @@ import (
 	lti "github.com/macewan-cs/lti-example/pkg"
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
 )
 
 const keyID = "defaultKey"
@@ -37,7 +41,7 @@ func nonpersistentConfig() datastore.Config {
 
 	// Retrieve deployment details from environment variables.
 	deployment := env.DeploymentFromEnvironment()
-	err = nonpersistent.DefaultStore.StoreDeployment(registration.Issuer, deployment)
+	err = nonpersistent.DefaultStore.StoreDeployment(registration.Issuer, registration.ClientID, deployment)
 	if err != nil {
 		log.Fatalf("deployment store error: %v", err)
 	}
@@ -71,27 +75,26 @@ func postLaunchHandler(datastoreConfig datastore.Config) http.HandlerFunc {
 		//}
 		//
 		//// Get membership to demonstrate access to NRPS.
-		//membership, err := nrps.GetMembership()
+		//membership, err := nrps.GetMembership(r.Context(), connector.MembershipOptions{})
 		//if err != nil {
 		//	log.Printf("cannot get membership: %v", err)
 		//	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		//	return
 		//}
 		lc := lti.LaunchCtxFromContext(r.Context())
-		if pre, ok := lc.Token.Get("https://purl.imsglobal.org/spec/lti/claim/launch_presentation");ok {
-			if lp, ok := pre.(map[string]interface{});ok {
-				docTarget := lp["document_target"]
-				if docTarget == "iframe" {
-					fmt.Fprintf(w, `<p>This is the iframe launch!</p>
+		if lc.Message.LaunchPresentation.DocumentTarget == "iframe" {
+			fmt.Fprintf(w, `<p>This is the iframe launch!</p>
+<p>Launch ID from request: %s</p>`, lc.LaunchId)
+		} else {
+			fmt.Fprintf(w, `<p>Launch successful!</p>
 <p>Launch ID from request: %s</p>`, lc.LaunchId)
-					return
-				}
-			}
-
 		}
 
-		fmt.Fprintf(w, `<p>Launch successful!</p>
-<p>Launch ID from request: %s</p>`, lc.LaunchId)
+		// Offer a way back to the platform when the launch provides a return URL.
+		returnURL, err := launch.ReturnURL(lc.Message, launch.ReturnMessage{Msg: "Thanks for visiting the tool."})
+		if err == nil {
+			fmt.Fprintf(w, `<p><a href="%s">Return to the platform</a></p>`, html.EscapeString(returnURL))
+		}
 //
 //		fmt.Fprintf(w, `<p>Launch successful!</p>
 //<p>Launch ID from request: %s</p>
@@ -99,6 +102,16 @@ func postLaunchHandler(datastoreConfig datastore.Config) http.HandlerFunc {
 	}
 }
 
+// pageHandler returns an http.HandlerFunc for a tool page visited after the launch. It must be wrapped by the session
+// middleware, which restores the launch context.
+func pageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lc := lti.LaunchCtxFromContext(r.Context())
+		fmt.Fprintf(w, `<p>Follow-up page for launch %s</p>
+<p>Context: %s</p>`, html.EscapeString(lc.LaunchId), html.EscapeString(lc.Message.Context.Title))
+	}
+}
+
 // logRequest logs a request made to the HTTP server.
 func logRequest(r *http.Request) {
 	encoder := json.NewEncoder(os.Stdout)
@@ -117,6 +130,10 @@ func main() {
 	var httpAddr = flag.String("addr", ":9000", "example app listen address")
 	flag.Parse()
 
+	if flag.Arg(0) == "migrate" {
+		runMigrate(flag.Args()[1:])
+	}
+
 	os.Setenv("REG_ISSUER", "https://edmodoworld.com")
 	os.Setenv("REG_CLIENTID", "clientid")
 	os.Setenv("REG_KEYSETURI", "http://localhost:8000/certs")//get public cert to decrypt jwt token
@@ -129,8 +146,28 @@ func main() {
 	os.Setenv("KEY_PRIVATE", string(key))
 	datastoreConfig := nonpersistentConfig()
 	http.Handle("/login", lti.NewLogin(datastoreConfig))
+
+	// Sessions let pages visited after the launch find their launch. The signing key only needs to live as long as the
+	// nonpersistent sessions it signs.
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		log.Fatalf("session key error: %v", err)
+	}
+	sessions := lti.NewSessionManager(datastoreConfig, sessionKey)
+
 	http.Handle("/launch", lti.NewLaunch(datastoreConfig,
-		postLaunchHandler(datastoreConfig)))
+		sessions.IssueAfterLaunch(postLaunchHandler(datastoreConfig))))
+	http.Handle("/page", sessions.Middleware(pageHandler()))
+
+	// Evict expired launch data, sessions and hand-offs from the nonpersistent store so that it does not grow with every
+	// launch.
+	janitor := datastore.NewJanitor(datastore.DefaultJanitorInterval)
+	janitor.Add("launch data", nonpersistent.DefaultStore.PurgeExpiredLaunchData)
+	janitor.Add("sessions", nonpersistent.DefaultStore.PurgeExpiredSessions)
+	janitor.Add("hand-off codes", nonpersistent.DefaultStore.PurgeExpiredHandoffCodes)
+	janitor.Add("hand-off tokens", nonpersistent.DefaultStore.PurgeExpiredHandoffTokens)
+	janitor.Start()
+	defer janitor.Stop()
 
 	log.Printf("Listening for connections on %s...\n", *httpAddr)
 	err := http.ListenAndServe(*httpAddr,
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	lti "github.com/macewan-cs/lti-example/pkg"
+	dssql "github.com/macewan-cs/lti-example/pkg/datastore/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const migrateUsage = `usage: lti-minimal migrate [-driver name] [-dsn source] up|down|status
+
+Manages the schema of the SQL datastore:
+  up      apply all pending migrations
+  down    revert the most recently applied migration
+  status  list the migrations and whether they have been applied
+
+Only the sqlite3 driver is compiled in; other database/sql drivers must be imported to be used.
+`
+
+// migrate runs the migrate subcommand with its arguments and returns the process exit code.
+func migrate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, migrateUsage) }
+	driver := flags.String("driver", "sqlite3", "database/sql driver name")
+	dsn := flags.String("dsn", "lti.db", "data source name")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	db, err := sql.Open(*driver, *dsn)
+	if err != nil {
+		fmt.Fprintf(stderr, "cannot open database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	config := lti.NewSQLDatastoreConfig()
+	switch *driver {
+	case "sqlite3":
+		config.Dialect = dssql.SQLite
+	case "mysql":
+		config.Dialect = dssql.MySQL
+	}
+	migrator := lti.NewSQLMigrator(db, config)
+	switch flags.Arg(0) {
+	case "up":
+		applied, err := migrator.Up()
+		for _, migration := range applied {
+			fmt.Fprintf(stdout, "applied %d: %s\n", migration.Version, migration.Description)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "migrate up error: %v\n", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(stdout, "no pending migrations")
+		}
+	case "down":
+		reverted, err := migrator.Down()
+		if err != nil {
+			fmt.Fprintf(stderr, "migrate down error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "reverted %d: %s\n", reverted.Version, reverted.Description)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			fmt.Fprintf(stderr, "migrate status error: %v\n", err)
+			return 1
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(stdout, "%4d  %-28s  %s\n", status.Version, applied, status.Description)
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	return 0
+}
+
+// runMigrate runs the migrate subcommand and exits.
+func runMigrate(args []string) {
+	os.Exit(migrate(args, os.Stdout, os.Stderr))
+}
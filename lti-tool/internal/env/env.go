@@ -15,7 +15,7 @@ import (
 // RegistrationFromEnvironment loads the registration details from
 // environment variables. The expected variables include REG_ISSUER,
 // REG_CLIENTID, REG_KEYSETURI, REG_AUTHTOKENURI, REG_AUTHLOGINURI,
-// REG_TARGETLINKURI.
+// REG_TARGETLINKURI, and optionally REG_PROVISIONING.
 func RegistrationFromEnvironment() datastore.Registration {
 	var registration datastore.Registration
 	err := envconfig.Process("reg", &registration)
@@ -7,16 +7,17 @@ package connector
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 )
 
-// AGS implements Assignment & Grades Services functions.
+// AGS implements Assignment & Grades Services functions. The requests of each method to the platform are bound to its
+// `ctx' argument.
 type AGS struct {
 	LineItem  *url.URL
 	LineItems *url.URL
@@ -134,8 +135,8 @@ func (c *Connector) UpgradeAGS() (*AGS, error) {
 
 // PutScore posts a grade (LTI spec uses term 'score') for the launched resource to the platform's gradebook. The
 // useLaunchUserID argument specifies if the launching user's ID is used; supply false to send the user ID embedded in
-// the score argument.
-func (a *AGS) PutScore(s Score, useLaunchUserID bool) error {
+// the score argument. The score is only sent again after a failed attempt if the connector's RetryPolicy allows it.
+func (a *AGS) PutScore(ctx context.Context, s Score, useLaunchUserID bool) error {
 	scopes := []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score"}
 
 	// Make a copy of the lineitem and add the /scores path.
@@ -166,12 +167,13 @@ func (a *AGS) PutScore(s Score, useLaunchUserID bool) error {
 		return fmt.Errorf("could not encode body of score publish request: %w", err)
 	}
 
-	_, _, err = a.Target.makeServiceRequest(ServiceRequest{
+	_, _, err = a.Target.makeServiceRequest(ctx, ServiceRequest{
 		Scopes:      scopes,
 		Method:      http.MethodPost,
 		URI:         scoreURI,
 		Body:        &body,
 		ContentType: "application/vnd.ims.lis.v1.score+json",
+		Idempotent:  a.Target.retry.RetryScores,
 	})
 	if err != nil {
 		return fmt.Errorf("put score make service request error: %w", err)
@@ -181,20 +183,20 @@ func (a *AGS) PutScore(s Score, useLaunchUserID bool) error {
 }
 
 // GetResults gets the launched limeitem's Results for all users enrolled in that lineitem's context (i.e. course).
-func (a *AGS) GetResults() ([]Result, error) {
-	return a.resultsGetter("")
+func (a *AGS) GetResults(ctx context.Context) ([]Result, error) {
+	return a.resultsGetter(ctx, "")
 }
 
 // GetUserResults is the same as GetResults with the addition of a user ID to filter the Results service responses.
-func (a *AGS) GetUserResults(userID string) ([]Result, error) {
+func (a *AGS) GetUserResults(ctx context.Context, userID string) ([]Result, error) {
 	if userID == "" {
 		return []Result{}, errors.New("received empty userID")
 	}
-	return a.resultsGetter(userID)
+	return a.resultsGetter(ctx, userID)
 }
 
 // resultsGetter gets Results service responses, using GetPagedMemberships as a helper.
-func (a *AGS) resultsGetter(userID string) ([]Result, error) {
+func (a *AGS) resultsGetter(ctx context.Context, userID string) ([]Result, error) {
 	var (
 		limit       int
 		hasMore     bool
@@ -203,13 +205,13 @@ func (a *AGS) resultsGetter(userID string) ([]Result, error) {
 		err         error
 	)
 
-	results, hasMore, err = a.GetPagedResults(limit, userID)
+	results, hasMore, err = a.GetPagedResults(ctx, limit, userID)
 	if err != nil {
 		return []Result{}, fmt.Errorf("get paged membership error: %w", err)
 	}
 
 	for hasMore {
-		moreResults, hasMore, err = a.GetPagedResults(limit, userID)
+		moreResults, hasMore, err = a.GetPagedResults(ctx, limit, userID)
 		if err != nil {
 			return []Result{}, fmt.Errorf("get more membership error: %w", err)
 		}
@@ -222,7 +224,7 @@ func (a *AGS) resultsGetter(userID string) ([]Result, error) {
 // GetPagedResults fetches the platform-assigned grades for a lineitem. Note: Platforms are not required to support a
 // Results service 'limit' parameter, see: https://www.imsglobal.org/spec/lti-ags/v2p0/#container-request-filters-0
 // It checks for next page links, fetching and appending them to the output.
-func (a *AGS) GetPagedResults(limit int, userID string) ([]Result, bool, error) {
+func (a *AGS) GetPagedResults(ctx context.Context, limit int, userID string) ([]Result, bool, error) {
 	if limit < 0 {
 		return []Result{}, false, errors.New("invalid paging limit")
 	}
@@ -257,7 +259,7 @@ func (a *AGS) GetPagedResults(limit int, userID string) ([]Result, bool, error)
 	if a.NextPage != nil {
 		s.URI = a.NextPage
 	}
-	headers, body, err := a.Target.makeServiceRequest(s)
+	headers, body, err := a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return []Result{}, false, fmt.Errorf("get results make service request error: %w", err)
 	}
@@ -270,25 +272,16 @@ func (a *AGS) GetPagedResults(limit int, userID string) ([]Result, bool, error)
 	}
 
 	// Get the next page link from the response headers.
-	nextPageLink := headers.Get("link")
-	if nextPageLink == "" || !strings.Contains(nextPageLink, `rel="next"`) {
-		// If there are no further next page links, set the AGS NextPage field to nil.
-		a.NextPage = nil
+	a.NextPage = ParseLinks(s.URI, headers.Values("Link")).URI("next")
+	if a.NextPage == nil {
 		return results, false, nil
 	}
 
-	nextPageString := strings.Trim(nextPageLink, "<>")
-	nextPage, err := url.Parse(nextPageString)
-	if err != nil {
-		return []Result{}, false, fmt.Errorf("could not parse next page URI from response headers: %w", err)
-	}
-	a.NextPage = nextPage
-
 	return results, true, nil
 }
 
 // GetLineItem gets the currently launched AGS lineitem.
-func (a *AGS) GetLineItem() (LineItem, error) {
+func (a *AGS) GetLineItem(ctx context.Context) (LineItem, error) {
 	scopes := []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem.readonly"}
 
 	s := ServiceRequest{
@@ -298,7 +291,7 @@ func (a *AGS) GetLineItem() (LineItem, error) {
 		Accept: "application/vnd.ims.lis.v2.lineitem+json",
 	}
 
-	_, body, err := a.Target.makeServiceRequest(s)
+	_, body, err := a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return LineItem{}, fmt.Errorf("get lineitem make service request error: %w", err)
 	}
@@ -314,7 +307,7 @@ func (a *AGS) GetLineItem() (LineItem, error) {
 }
 
 // GetLineItems gets all the lineitems for the launched context, i.e. all columns in the course gradebook.
-func (a *AGS) GetLineItems() ([]LineItem, error) {
+func (a *AGS) GetLineItems(ctx context.Context) ([]LineItem, error) {
 	scopes := []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem.readonly"}
 
 	s := ServiceRequest{
@@ -324,7 +317,7 @@ func (a *AGS) GetLineItems() ([]LineItem, error) {
 		Accept: "application/vnd.ims.lis.v2.lineitemcontainer+json",
 	}
 
-	_, body, err := a.Target.makeServiceRequest(s)
+	_, body, err := a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return []LineItem{}, fmt.Errorf("get lineitems make service request error: %w", err)
 	}
@@ -341,7 +334,8 @@ func (a *AGS) GetLineItems() ([]LineItem, error) {
 
 // UpdateLineItem sends an encoded LineItem used by the platform to update its definition of the launched lineitem, or
 // the lineitem at the optional notLaunchedLineItemEndpoint parameter if updating the launched lineitem is not desired.
-func (a *AGS) UpdateLineItem(lineItem LineItem, notLaunchedLineItemEndpoint string) (LineItem, error) {
+func (a *AGS) UpdateLineItem(ctx context.Context, lineItem LineItem,
+	notLaunchedLineItemEndpoint string) (LineItem, error) {
 	scopes := []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"}
 
 	var body bytes.Buffer
@@ -369,7 +363,7 @@ func (a *AGS) UpdateLineItem(lineItem LineItem, notLaunchedLineItemEndpoint stri
 		Accept:      "application/vnd.ims.lis.v2.lineitem+json",
 	}
 
-	_, responseBody, err := a.Target.makeServiceRequest(s)
+	_, responseBody, err := a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return LineItem{}, fmt.Errorf("update lineitem make service request error: %w", err)
 	}
@@ -385,7 +379,7 @@ func (a *AGS) UpdateLineItem(lineItem LineItem, notLaunchedLineItemEndpoint stri
 }
 
 // CreateLineItem creates a new gradebook column in the launched context's lineitems container.
-func (a *AGS) CreateLineItem(lineItem LineItem) (LineItem, error) {
+func (a *AGS) CreateLineItem(ctx context.Context, lineItem LineItem) (LineItem, error) {
 	scopes := []string{"https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"}
 
 	var body bytes.Buffer
@@ -403,7 +397,7 @@ func (a *AGS) CreateLineItem(lineItem LineItem) (LineItem, error) {
 		Accept:      "application/vnd.ims.lis.v2.lineitem+json",
 	}
 
-	_, responseBody, err := a.Target.makeServiceRequest(s)
+	_, responseBody, err := a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return LineItem{}, fmt.Errorf("create lineitem make service request error: %w", err)
 	}
@@ -419,7 +413,7 @@ func (a *AGS) CreateLineItem(lineItem LineItem) (LineItem, error) {
 }
 
 // DeleteLineItem removes a lineitem specified by the argument from the context's gradebook.
-func (a *AGS) DeleteLineItem(lineItemToDeleteEndpoint string) error {
+func (a *AGS) DeleteLineItem(ctx context.Context, lineItemToDeleteEndpoint string) error {
 	if lineItemToDeleteEndpoint == "" {
 		return errors.New("received empty lineitem to delete")
 	}
@@ -436,7 +430,7 @@ func (a *AGS) DeleteLineItem(lineItemToDeleteEndpoint string) error {
 		URI:    lineItemToDeleteURI,
 	}
 
-	_, _, err = a.Target.makeServiceRequest(s)
+	_, _, err = a.Target.makeServiceRequest(ctx, s)
 	if err != nil {
 		return fmt.Errorf("update lineitem make service request error: %w", err)
 	}
@@ -19,8 +19,10 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -29,12 +31,16 @@ import (
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
 )
 
 var (
 	// ErrUnsupportedService is returned when the connector cannot be upgraded to either NRPS
 	// or AGS because the platform does not appear to support the service.
 	ErrUnsupportedService = errors.New("platform/LMS does not support the requested service")
+	// ErrNoDifferences is returned when membership differences are requested but the platform has not provided a
+	// differences link.
+	ErrNoDifferences = errors.New("platform/LMS did not provide a membership differences link")
 )
 
 const (
@@ -42,22 +48,35 @@ const (
 	AccessTokenTimeoutSeconds = 3600
 	// ClockSkewAllowanceMinutes determines the JWT IssuedAt clock skew allowance in minutes.
 	ClockSkewAllowanceMinutes = 2
+	// AccessTokenRenewalSeconds determines how long before its expiry time a stored access token is renewed, so that
+	// it does not expire during a service request.
+	AccessTokenRenewalSeconds = 60
 )
 
-// Timeout value for http clients.
-var timeout time.Duration = time.Second * 15
+// DefaultTimeout is the timeout of the HTTP client that a Connector uses unless it is given another client.
+const DefaultTimeout = 15 * time.Second
+
+// defaultClient is shared by the connectors that are not given another client, so that they reuse connections to the
+// platforms.
+var defaultClient = &http.Client{Timeout: DefaultTimeout}
 
 // A Connector implements the base that underpins LTI 1.3 Advantage, i.e. AGS or NRPS.
 type Connector struct {
-	cfg         datastore.Config
-	keyID       string
-	LaunchID    string
-	LaunchToken jwt.Token
-	SigningKey  *rsa.PrivateKey
-	AccessToken datastore.AccessToken
+	cfg           datastore.Config
+	keyID         string
+	client        *http.Client
+	retry         RetryPolicy
+	clientID      string
+	LaunchID      string
+	LaunchToken   jwt.Token
+	LaunchMessage launch.LaunchMessage
+	SigningKey    *rsa.PrivateKey
+	AccessToken   datastore.AccessToken
 }
 
-// A ServiceRequest structures service (AGS & NRPS) connections between tool and platform.
+// A ServiceRequest structures service (AGS & NRPS) connections between tool and platform. Requests with the GET, HEAD,
+// PUT or DELETE method are retried according to the connector's RetryPolicy; Idempotent marks a POST request as safe to
+// retry as well.
 type ServiceRequest struct {
 	Scopes      []string
 	Method      string
@@ -65,15 +84,47 @@ type ServiceRequest struct {
 	Body        io.Reader
 	ContentType string
 	Accept      string
+	Idempotent  bool
+}
+
+// An Option configures a Connector. Options are passed to New.
+type Option func(*Connector)
+
+// WithHTTPClient sets the HTTP client used for the requests to the platform, e.g. to share a client and its connections
+// between connectors. By default, a Connector uses a shared client with a DefaultTimeout timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Connector) {
+		c.client = client
+	}
 }
 
-// New creates a *Connector. To function as expected, a valid launchID must be supplied.
-func New(cfg datastore.Config, launchID, keyID string) (*Connector, error) {
+// WithTransport sets the transport of the HTTP client used for the requests to the platform, e.g. to add
+// instrumentation or to reach a test server. The client keeps the DefaultTimeout timeout.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(c *Connector) {
+		c.client = &http.Client{
+			Transport: transport,
+			Timeout:   DefaultTimeout,
+		}
+	}
+}
+
+// New creates a *Connector. To function as expected, a valid launchID must be supplied. The `options' configure how the
+// connector reaches the platform.
+func New(cfg datastore.Config, launchID, keyID string, options ...Option) (*Connector, error) {
 	connector := Connector{
 		cfg:      cfg,
 		keyID:    keyID,
+		client:   defaultClient,
+		retry:    DefaultRetryPolicy,
 		LaunchID: launchID,
 	}
+	for _, option := range options {
+		option(&connector)
+	}
+	if connector.client == nil {
+		connector.client = defaultClient
+	}
 
 	if connector.cfg.LaunchData == nil {
 		connector.cfg.LaunchData = nonpersistent.DefaultStore
@@ -93,9 +144,10 @@ func New(cfg datastore.Config, launchID, keyID string) (*Connector, error) {
 	return &connector, nil
 }
 
-// ClientID returns the client ID associated with the connector.
+// ClientID returns the client ID associated with the connector, i.e. the client ID that the launch's id_token was
+// issued to.
 func (c *Connector) ClientID() string {
-	return c.LaunchToken.Audience()[0]
+	return c.clientID
 }
 
 // SetSigningKey takes a PEM encoded private key and sets the signing key to the corresponding RSA private key.
@@ -119,8 +171,9 @@ func (c *Connector) SetSigningKey(pemPrivateKey string) error {
 	return nil
 }
 
-// setTokenFromLaunchData populates the Connector's token with stored launch data that is derived from the OIDC id_token
-// payload. That id_token had its authenticity previously verified as part of the launch process.
+// setTokenFromLaunchData populates the Connector's token and typed launch message with stored launch data that is
+// derived from the OIDC id_token payload. That id_token had its authenticity previously verified as part of the launch
+// process.
 func (c *Connector) setLaunchTokenFromLaunchData(launchID string) error {
 	if c.LaunchID == "" {
 		return errors.New("received empty launch ID")
@@ -139,14 +192,26 @@ func (c *Connector) setLaunchTokenFromLaunchData(launchID string) error {
 		return fmt.Errorf("error encoding launch data token: %w", err)
 	}
 
+	launchMessage, err := launch.MessageFromLaunchData(rawLaunchData)
+	if err != nil {
+		return err
+	}
+	// Resolve the client ID like the launch did, so that a token with several audiences finds its registration.
+	clientID, err := launch.AuthorizedClientID(idTokenPayload)
+	if err != nil {
+		return fmt.Errorf("error resolving launch client ID: %w", err)
+	}
+
+	c.clientID = clientID
 	c.LaunchToken = idTokenPayload
+	c.LaunchMessage = launchMessage
 
 	return nil
 }
 
-// getRegistration uses the Connector's LaunchToken issuer to get the associated registration.
+// getRegistration uses the Connector's LaunchToken issuer and client ID to get the associated registration.
 func (c *Connector) getRegistration() (datastore.Registration, error) {
-	registration, err := c.cfg.Registrations.FindRegistrationByIssuerAndClientID(c.LaunchToken.Issuer(), c.LaunchToken.Audience()[0])
+	registration, err := c.cfg.Registrations.FindRegistrationByIssuerAndClientID(c.LaunchToken.Issuer(), c.ClientID())
 	if err != nil {
 		return datastore.Registration{}, err
 	}
@@ -155,13 +220,13 @@ func (c *Connector) getRegistration() (datastore.Registration, error) {
 }
 
 // PlatformKey gets the Platform's public key from the Registration Keyset URI.
-func (c *Connector) PlatformKey() (jwk.Set, error) {
+func (c *Connector) PlatformKey(ctx context.Context) (jwk.Set, error) {
 	registration, err := c.getRegistration()
 	if err != nil {
 		return nil, err
 	}
 
-	keyset, err := jwk.Fetch(context.Background(), registration.KeysetURI.String())
+	keyset, err := jwk.Fetch(ctx, registration.KeysetURI.String(), jwk.WithHTTPClient(c.client))
 	if err != nil {
 		return nil, fmt.Errorf("error fetching keyset: %w", err)
 	}
@@ -177,21 +242,23 @@ func convertInterfaceToStringSlice(input []interface{}) []string {
 	return output
 }
 
-// checkAccessTokenStore looks for a suitable, non-expired access token in storage.
+// checkAccessTokenStore looks for a suitable access token in storage that does not expire within
+// AccessTokenRenewalSeconds.
 func (c *Connector) checkAccessTokenStore(tokenURI, clientID string, scopes []string) (datastore.AccessToken, error) {
 	foundToken, err := c.cfg.AccessTokens.FindAccessToken(tokenURI, clientID, scopes)
 	if err != nil {
 		return datastore.AccessToken{}, fmt.Errorf("suitable access token not found: %w", err)
 	}
-	if foundToken.ExpiryTime.Before(time.Now()) {
-		return datastore.AccessToken{}, errors.New("access token found but has expired")
+	if foundToken.ExpiryTime.Before(time.Now().Add(time.Second * AccessTokenRenewalSeconds)) {
+		return datastore.AccessToken{}, errors.New("access token found but expires soon")
 	}
 
 	return foundToken, nil
 }
 
 // createRequest creates a signed bearer request JWT as part of an *http.Request to be sent to the platform.
-func (c *Connector) createRequest(tokenURI, clientID string, scopes []string) (*http.Request, error) {
+func (c *Connector) createRequest(ctx context.Context, tokenURI, clientID string, scopes []string) (*http.Request,
+	error) {
 	token := jwt.New()
 	token.Set(jwt.IssuerKey, clientID)
 	token.Set(jwt.SubjectKey, clientID)
@@ -225,7 +292,7 @@ func (c *Connector) createRequest(tokenURI, clientID string, scopes []string) (*
 	requestValues.Add("client_assertion", string(signedToken))
 	requestValues.Add("scope", scopeValue)
 	requestBody := strings.NewReader(requestValues.Encode())
-	request, err := http.NewRequest(http.MethodPost, tokenURI, requestBody)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, requestBody)
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request for get access token: %w", err)
 	}
@@ -234,19 +301,23 @@ func (c *Connector) createRequest(tokenURI, clientID string, scopes []string) (*
 	return request, nil
 }
 
-// sendRequest sends the bearer token request to the platform and processes the response.
-func sendRequest(req *http.Request) (datastore.AccessToken, error) {
-	client := &http.Client{Timeout: timeout}
-	response, err := client.Do(req)
+// sendRequest sends the bearer token request to the platform and processes the response. Each attempt gets a request
+// of its own from createRequest, since the platform may reject a client assertion whose JWT ID it has already seen.
+func (c *Connector) sendRequest(ctx context.Context, tokenURI, clientID string, scopes []string) (datastore.AccessToken,
+	error) {
+	// Requesting an access token changes nothing on the platform, so it is safe to retry.
+	response, err := c.doAttempts(ctx, true, func() (*http.Request, error) {
+		return c.createRequest(ctx, tokenURI, clientID, scopes)
+	})
 	if err != nil {
 		return datastore.AccessToken{}, fmt.Errorf("send request error: %w", err)
 	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		return datastore.AccessToken{}, fmt.Errorf("access token request got response status %s",
 			http.StatusText(response.StatusCode))
 	}
 
-	defer response.Body.Close()
 	var responseBody map[string]interface{}
 	err = json.NewDecoder(response.Body).Decode(&responseBody)
 	if err != nil {
@@ -267,44 +338,110 @@ func sendRequest(req *http.Request) (datastore.AccessToken, error) {
 	}
 
 	return datastore.AccessToken{
-		TokenURI:   req.URL.String(),
+		TokenURI:   tokenURI,
 		Token:      responseToken,
 		ExpiryTime: time.Now().Add(expiry),
 	}, nil
 }
 
-// GetAccessToken gets a scoped bearer token for use by a connector.
-func (c *Connector) GetAccessToken(scopes []string) error {
+// GetAccessToken gets a scoped bearer token for use by a connector and sets it as the connector's AccessToken. A
+// stored token whose scopes include `scopes' is reused until shortly before it expires. The request to the platform,
+// if any, is bound to `ctx'.
+func (c *Connector) GetAccessToken(ctx context.Context, scopes []string) error {
+	token, err := c.accessToken(ctx, scopes)
+	if err != nil {
+		return err
+	}
+
+	c.AccessToken = token
+	return nil
+}
+
+// accessToken returns a stored access token for `scopes', or requests a new one from the platform.
+func (c *Connector) accessToken(ctx context.Context, scopes []string) (datastore.AccessToken, error) {
 	registration, err := c.getRegistration()
 	if err != nil {
-		return fmt.Errorf("get registration for access token: %w", err)
+		return datastore.AccessToken{}, fmt.Errorf("get registration for access token: %w", err)
 	}
 
 	storedToken, err := c.checkAccessTokenStore(registration.AuthTokenURI.String(), registration.ClientID, scopes)
 	if err == nil {
-		c.AccessToken = storedToken
-		return nil
+		return storedToken, nil
 	}
 
-	request, err := c.createRequest(registration.AuthTokenURI.String(), registration.ClientID, scopes)
-	if err != nil {
-		return fmt.Errorf("create request for access token: %w", err)
+	return c.requestAccessToken(ctx, registration, scopes)
+}
+
+// A tokenRequest is a pending access token request to a platform, shared by all who need the same token meanwhile.
+type tokenRequest struct {
+	done  chan struct{}
+	token datastore.AccessToken
+	err   error
+}
+
+var (
+	tokenRequestsMu sync.Mutex
+	tokenRequests   = make(map[string]*tokenRequest)
+)
+
+// requestAccessToken requests a new access token from the platform and stores it. Concurrent requests for the same
+// token URI, client ID and scopes, e.g. from connectors in several goroutines, are coalesced: only the first is sent,
+// and the others wait for its token.
+func (c *Connector) requestAccessToken(ctx context.Context, registration datastore.Registration,
+	scopes []string) (datastore.AccessToken, error) {
+	sorted := make([]string, len(scopes))
+	copy(sorted, scopes)
+	sort.Strings(sorted)
+	key := registration.AuthTokenURI.String() + "\n" + registration.ClientID + "\n" + strings.Join(sorted, " ")
+
+	for {
+		tokenRequestsMu.Lock()
+		pending, waiting := tokenRequests[key]
+		if !waiting {
+			pending = &tokenRequest{done: make(chan struct{})}
+			tokenRequests[key] = pending
+		}
+		tokenRequestsMu.Unlock()
+
+		if !waiting {
+			pending.token, pending.err = c.sendAccessTokenRequest(ctx, registration, scopes)
+			tokenRequestsMu.Lock()
+			delete(tokenRequests, key)
+			tokenRequestsMu.Unlock()
+			close(pending.done)
+			return pending.token, pending.err
+		}
+
+		select {
+		case <-ctx.Done():
+			return datastore.AccessToken{}, fmt.Errorf("wait for access token: %w", ctx.Err())
+		case <-pending.done:
+		}
+		// A request given up by its sender says nothing about the platform, so send another.
+		if errors.Is(pending.err, context.Canceled) || errors.Is(pending.err, context.DeadlineExceeded) {
+			continue
+		}
+		return pending.token, pending.err
 	}
-	responseToken, err := sendRequest(request)
+}
+
+// sendAccessTokenRequest sends an access token request to the platform and stores the token it responds with.
+func (c *Connector) sendAccessTokenRequest(ctx context.Context, registration datastore.Registration,
+	scopes []string) (datastore.AccessToken, error) {
+	responseToken, err := c.sendRequest(ctx, registration.AuthTokenURI.String(), registration.ClientID, scopes)
 	if err != nil {
-		return fmt.Errorf("send request for access token: %w", err)
+		return datastore.AccessToken{}, fmt.Errorf("send request for access token: %w", err)
 	}
 	responseToken.ClientID = registration.ClientID
 	responseToken.Scopes = scopes
 
 	c.cfg.AccessTokens.StoreAccessToken(responseToken)
-	c.AccessToken = responseToken
 
-	return nil
+	return responseToken, nil
 }
 
-// makeServiceRequest makes direct tool to platform requests.
-func (c *Connector) makeServiceRequest(s ServiceRequest) (http.Header, io.ReadCloser, error) {
+// makeServiceRequest makes direct tool to platform requests, bound to `ctx'.
+func (c *Connector) makeServiceRequest(ctx context.Context, s ServiceRequest) (http.Header, io.ReadCloser, error) {
 	if len(s.Scopes) == 0 {
 		return nil, nil, errors.New("empty scope for service request")
 	}
@@ -316,28 +453,52 @@ func (c *Connector) makeServiceRequest(s ServiceRequest) (http.Header, io.ReadCl
 		s.Accept = "application/json"
 	}
 
-	err := c.GetAccessToken(s.Scopes)
-	if err != nil {
-		return nil, nil, fmt.Errorf("get access token for service request: %w", err)
-	}
-
-	request, err := http.NewRequest(s.Method, s.URI.String(), s.Body)
+	request, err := http.NewRequestWithContext(ctx, s.Method, s.URI.String(), s.Body)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not create http request for service request: %w", err)
 	}
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AccessToken.Token))
 	request.Header.Set("Accept", s.Accept)
 	request.Header.Set("Content-Type", s.ContentType)
 
-	client := &http.Client{Timeout: timeout}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, nil, fmt.Errorf("make service request client error: %w", err)
+	for attempt := 1; ; attempt++ {
+		token, err := c.accessToken(ctx, s.Scopes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get access token for service request: %w", err)
+		}
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Token))
+
+		response, err := c.do(request, s.Idempotent || isIdempotent(s.Method))
+		if err != nil {
+			return nil, nil, fmt.Errorf("make service request client error: %w", err)
+		}
+
+		// A token that the platform revoked before its expiry time is forgotten, and the request is sent once more
+		// with a new token, if its body can be sent again.
+		if response.StatusCode == http.StatusUnauthorized && attempt == 1 &&
+			(request.Body == nil || request.GetBody != nil) {
+			response.Body.Close()
+			err = c.cfg.AccessTokens.DeleteAccessToken(token)
+			if err != nil {
+				return nil, nil, fmt.Errorf("delete rejected access token: %w", err)
+			}
+
+			request = request.Clone(ctx)
+			if request.GetBody != nil {
+				request.Body, err = request.GetBody()
+				if err != nil {
+					return nil, nil, fmt.Errorf("could not recreate service request body: %w", err)
+				}
+			}
+			continue
+		}
+
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			response.Body.Close()
+			return nil, nil, fmt.Errorf("service request got response status %s",
+				http.StatusText(response.StatusCode))
+		}
+
+		c.AccessToken = token
+		return response.Header, response.Body, nil
 	}
-
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		return nil, nil, fmt.Errorf("service request got response status %s", http.StatusText(response.StatusCode))
-	}
-
-	return response.Header, response.Body, nil
 }
@@ -0,0 +1,289 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+)
+
+// A testPlatform issues access tokens, serves a membership and accepts scores, recording the requests it receives and
+// the client assertions of access token requests. It responds with 503 Service Unavailable to the number of requests
+// to a path given in `unavailable', and rejects the access tokens in `revoked'.
+type testPlatform struct {
+	mu          sync.Mutex
+	requests    []string
+	assertions  []string
+	handler     func(w http.ResponseWriter, r *http.Request)
+	unavailable map[string]int
+	retryAfter  string
+	tokens      int
+	tokenDelay  time.Duration
+	revoked     map[string]bool
+}
+
+func (p *testPlatform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/token" {
+		p.assertions = append(p.assertions, r.PostFormValue("client_assertion"))
+	}
+	handler := p.handler
+	unavailable := p.unavailable[r.URL.Path] > 0
+	if unavailable {
+		p.unavailable[r.URL.Path]--
+	}
+	p.mu.Unlock()
+
+	if unavailable {
+		if p.retryAfter != "" {
+			w.Header().Set("Retry-After", p.retryAfter)
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Path == "/token" {
+		time.Sleep(p.tokenDelay)
+		p.mu.Lock()
+		p.tokens++
+		token := fmt.Sprintf("token-%d", p.tokens)
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600}`, token)
+		return
+	}
+
+	p.mu.Lock()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	authorized := strings.HasPrefix(token, "token-") && !p.revoked[token]
+	p.mu.Unlock()
+	if !authorized {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/memberships":
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.ims.lti-nrps.v2.membershipcontainer+json")
+		fmt.Fprint(w, `{"id": "memberships-1", "context": {"id": "course-1"},
+			"members": [{"status": "Active", "user_id": "user-1", "roles": ["Learner"]}]}`)
+	case "/lineitems/1/scores":
+		var score Score
+		if err := json.NewDecoder(r.Body).Decode(&score); err != nil || score.UserID != "user-1" {
+			http.Error(w, "invalid score", http.StatusBadRequest)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *testPlatform) requestLog() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+// newTestConnector stores a registration and a launch for the platform served at `serverURL', and returns a connector
+// for the launch with a fresh signing key.
+func newTestConnector(t *testing.T, serverURL string, options ...Option) *Connector {
+	t.Helper()
+
+	store := nonpersistent.New()
+	tokenURI, _ := url.Parse(serverURL + "/token")
+	keysetURI, _ := url.Parse(serverURL + "/keyset")
+	authLoginURI, _ := url.Parse(serverURL + "/auth")
+	targetLinkURI, _ := url.Parse("https://tool.tld/launch")
+	err := store.StoreRegistration(datastore.Registration{
+		Issuer:        serverURL,
+		ClientID:      "client-1",
+		AuthTokenURI:  tokenURI,
+		AuthLoginURI:  authLoginURI,
+		KeysetURI:     keysetURI,
+		TargetLinkURI: targetLinkURI,
+	})
+	if err != nil {
+		t.Fatalf("cannot store registration: %v", err)
+	}
+
+	launchData, err := json.Marshal(map[string]interface{}{
+		"iss": serverURL,
+		"sub": "user-1",
+		"aud": "client-1",
+		"https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice": map[string]interface{}{
+			"context_memberships_url": serverURL + "/memberships",
+			"service_versions":        []string{"2.0"},
+		},
+		"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint": map[string]interface{}{
+			"lineitem":  serverURL + "/lineitems/1",
+			"lineitems": serverURL + "/lineitems",
+			"scope":     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot encode launch data: %v", err)
+	}
+	store.StoreLaunchData("launch-1", launchData)
+
+	cfg := datastore.Config{
+		LaunchData:    store,
+		Registrations: store,
+		AccessTokens:  store,
+	}
+	connector, err := New(cfg, "launch-1", "key-1", options...)
+	if err != nil {
+		t.Fatalf("cannot create connector: %v", err)
+	}
+	connector.SigningKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate signing key: %v", err)
+	}
+
+	return connector
+}
+
+// A recordingTransport counts the requests it forwards to its base transport.
+type recordingTransport struct {
+	base     http.RoundTripper
+	mu       sync.Mutex
+	requests int
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requests++
+	t.mu.Unlock()
+	return t.base.RoundTrip(r)
+}
+
+// Test that the connector uses the given HTTP client or transport for all its requests.
+func TestHTTPClientOptions(t *testing.T) {
+	platform := &testPlatform{}
+	server := httptest.NewTLSServer(platform)
+	defer server.Close()
+
+	// The test server's certificate is only trusted by its own client.
+	connector := newTestConnector(t, server.URL, WithHTTPClient(server.Client()))
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+	membership, err := nrps.GetMembership(context.Background(), MembershipOptions{})
+	if err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if len(membership.Members) != 1 || membership.Members[0].UserID != "user-1" {
+		t.Fatalf("unexpected membership %+v", membership)
+	}
+
+	transport := &recordingTransport{base: server.Client().Transport}
+	connector = newTestConnector(t, server.URL, WithTransport(transport))
+	nrps, err = connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if transport.requests != 2 {
+		t.Fatalf("got %d requests through the transport, wanted an access token and a membership request",
+			transport.requests)
+	}
+}
+
+// Test that service calls are cancelled with their context.
+func TestServiceRequestContext(t *testing.T) {
+	cancelled := make(chan struct{})
+	platform := &testPlatform{handler: func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	platform.mu.Lock()
+	handler := platform.handler
+	platform.handler = func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		handler(w, r)
+	}
+	platform.mu.Unlock()
+	_, err = nrps.GetMembership(ctx, MembershipOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, wanted context.Canceled", err)
+	}
+	<-cancelled
+
+	// An access token is not requested with a context that is already done.
+	connector = newTestConnector(t, server.URL)
+	if err = connector.GetAccessToken(ctx, []string{"scope-1"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, wanted context.Canceled", err)
+	}
+	if requests := platform.requestLog(); len(requests) != 2 {
+		t.Fatalf("got requests %v, wanted only those of the first connector", requests)
+	}
+}
+
+// Test that the connector uses the authorized party of a launch with several audiences as its client ID.
+func TestClientIDAuthorizedParty(t *testing.T) {
+	store := nonpersistent.New()
+	uri, _ := url.Parse("https://platform.tld/token")
+	err := store.StoreRegistration(datastore.Registration{
+		Issuer:        "https://platform.tld",
+		ClientID:      "client-1",
+		AuthTokenURI:  uri,
+		AuthLoginURI:  uri,
+		KeysetURI:     uri,
+		TargetLinkURI: uri,
+	})
+	if err != nil {
+		t.Fatalf("cannot store registration: %v", err)
+	}
+	launchData, _ := json.Marshal(map[string]interface{}{
+		"iss": "https://platform.tld",
+		"sub": "user-1",
+		"aud": []string{"client-0", "client-1"},
+		"azp": "client-1",
+	})
+	store.StoreLaunchData("launch-1", launchData)
+
+	connector, err := New(datastore.Config{LaunchData: store, Registrations: store}, "launch-1", "key-1")
+	if err != nil {
+		t.Fatalf("cannot create connector: %v", err)
+	}
+	if clientID := connector.ClientID(); clientID != "client-1" {
+		t.Fatalf("got client ID %q, wanted the authorized party client-1", clientID)
+	}
+	registration, err := connector.getRegistration()
+	if err != nil || registration.ClientID != "client-1" {
+		t.Fatalf("got registration %q and error %v, wanted client-1", registration.ClientID, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"net/url"
+	"strings"
+)
+
+// A Link is a link of an HTTP Link header, e.g. the next page of a paged service response. Rel holds its relation
+// types in lower case, and Params its other parameters, keyed by their lower-case names.
+//
+// Source: https://datatracker.ietf.org/doc/html/rfc8288
+type Link struct {
+	URI    *url.URL
+	Rel    []string
+	Params map[string]string
+}
+
+// Links are the links of one or more Link headers.
+type Links []Link
+
+// URI returns the URI of the first link with the relation type `rel', or nil if there is none.
+func (links Links) URI(rel string) *url.URL {
+	rel = strings.ToLower(rel)
+	for _, link := range links {
+		for _, linkRel := range link.Rel {
+			if linkRel == rel {
+				return link.URI
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseLinks parses the values of Link headers, each of which may hold several comma-separated links. Relative URIs
+// are resolved against `base', the URI of the request. Links that cannot be parsed are skipped.
+func ParseLinks(base *url.URL, values []string) Links {
+	var links Links
+	for _, value := range values {
+		p := linkParser{s: value}
+		for {
+			link, ok, more := p.link()
+			if ok {
+				if base != nil {
+					link.URI = base.ResolveReference(link.URI)
+				}
+				links = append(links, link)
+			}
+			if !more {
+				break
+			}
+		}
+	}
+
+	return links
+}
+
+// A linkParser scans the links of a single Link header value.
+type linkParser struct {
+	s   string
+	pos int
+}
+
+// link parses the next link. It reports whether the link is valid and whether the value has more links after it. An
+// invalid link is skipped up to the next comma outside of quotes and angle brackets.
+func (p *linkParser) link() (link Link, ok bool, more bool) {
+	p.skip(" \t,")
+	if p.pos >= len(p.s) {
+		return Link{}, false, false
+	}
+
+	if p.s[p.pos] != '<' {
+		return Link{}, false, p.skipToNextLink()
+	}
+	end := strings.IndexByte(p.s[p.pos:], '>')
+	if end < 0 {
+		return Link{}, false, false
+	}
+	uri, err := url.Parse(strings.TrimSpace(p.s[p.pos+1 : p.pos+end]))
+	p.pos += end + 1
+	if err != nil {
+		return Link{}, false, p.skipToNextLink()
+	}
+	link = Link{URI: uri, Params: map[string]string{}}
+
+	hasRel := false
+	for {
+		p.skip(" \t")
+		if p.pos >= len(p.s) {
+			return link, true, false
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+			return link, true, true
+		case ';':
+			p.pos++
+		default:
+			return Link{}, false, p.skipToNextLink()
+		}
+
+		p.skip(" \t")
+		name := strings.ToLower(p.token())
+		if name == "" {
+			continue
+		}
+		value := ""
+		p.skip(" \t")
+		if p.pos < len(p.s) && p.s[p.pos] == '=' {
+			p.pos++
+			p.skip(" \t")
+			value = p.value()
+		}
+
+		// Only the first occurrence of a parameter counts.
+		if name == "rel" {
+			if !hasRel {
+				link.Rel = strings.Fields(strings.ToLower(value))
+				hasRel = true
+			}
+		} else if _, ok := link.Params[name]; !ok {
+			link.Params[name] = value
+		}
+	}
+}
+
+// skip advances past the characters in `chars'.
+func (p *linkParser) skip(chars string) {
+	for p.pos < len(p.s) && strings.IndexByte(chars, p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// token returns the parameter name or unquoted value at the current position.
+func (p *linkParser) token() string {
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(" \t;,=\"", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// value returns the quoted or unquoted parameter value at the current position.
+func (p *linkParser) value() string {
+	if p.pos >= len(p.s) || p.s[p.pos] != '"' {
+		return p.token()
+	}
+
+	var value strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; c {
+		case '\\':
+			if p.pos+1 < len(p.s) {
+				p.pos++
+				value.WriteByte(p.s[p.pos])
+			}
+		case '"':
+			p.pos++
+			return value.String()
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return value.String()
+}
+
+// skipToNextLink advances past the next comma that is outside of quotes and angle brackets, and reports whether there
+// is one.
+func (p *linkParser) skipToNextLink() bool {
+	quoted, bracketed := false, false
+	for ; p.pos < len(p.s); p.pos++ {
+		switch p.s[p.pos] {
+		case '\\':
+			if quoted {
+				p.pos++
+			}
+		case '"':
+			quoted = !quoted
+		case '<':
+			bracketed = !quoted
+		case '>':
+			bracketed = false
+		case ',':
+			if !quoted && !bracketed {
+				p.pos++
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// Test parsing Link headers with several links, parameters and relation types.
+func TestParseLinks(t *testing.T) {
+	base, _ := url.Parse("https://platform.tld/memberships?limit=10")
+
+	// A parsedLink is a Link with its URI as a string.
+	type parsedLink struct {
+		URI    string
+		Rel    []string
+		Params map[string]string
+	}
+
+	tests := []struct {
+		name   string
+		values []string
+		want   []parsedLink
+	}{
+		{
+			name:   "none",
+			values: nil,
+			want:   nil,
+		},
+		{
+			name:   "single",
+			values: []string{`<https://platform.tld/memberships?page=2>; rel="next"`},
+			want: []parsedLink{
+				{URI: "https://platform.tld/memberships?page=2", Rel: []string{"next"}, Params: map[string]string{}},
+			},
+		},
+		{
+			name: "several in one header",
+			values: []string{`<https://platform.tld/memberships?page=2>; rel="next", ` +
+				`<https://platform.tld/memberships?page=1>; rel="first",` +
+				`<https://platform.tld/memberships?since=42>;rel=differences`},
+			want: []parsedLink{
+				{URI: "https://platform.tld/memberships?page=2", Rel: []string{"next"}, Params: map[string]string{}},
+				{URI: "https://platform.tld/memberships?page=1", Rel: []string{"first"}, Params: map[string]string{}},
+				{URI: "https://platform.tld/memberships?since=42", Rel: []string{"differences"},
+					Params: map[string]string{}},
+			},
+		},
+		{
+			name: "several headers",
+			values: []string{
+				`<https://platform.tld/memberships?page=2>; rel="next"`,
+				`<https://platform.tld/memberships?page=5>; rel="last"`,
+			},
+			want: []parsedLink{
+				{URI: "https://platform.tld/memberships?page=2", Rel: []string{"next"}, Params: map[string]string{}},
+				{URI: "https://platform.tld/memberships?page=5", Rel: []string{"last"}, Params: map[string]string{}},
+			},
+		},
+		{
+			name:   "relative",
+			values: []string{`</memberships?page=2>; rel="next"`, `<?since=42>; rel="differences"`},
+			want: []parsedLink{
+				{URI: "https://platform.tld/memberships?page=2", Rel: []string{"next"}, Params: map[string]string{}},
+				{URI: "https://platform.tld/memberships?since=42", Rel: []string{"differences"},
+					Params: map[string]string{}},
+			},
+		},
+		{
+			name: "parameters",
+			values: []string{`<https://platform.tld/a,b>; REL="Next Last"; title="Page; \"two\", of five"; ` +
+				`type=application/json; rel="first"; title="ignored"`},
+			want: []parsedLink{
+				{URI: "https://platform.tld/a,b", Rel: []string{"next", "last"}, Params: map[string]string{
+					"title": `Page; "two", of five`,
+					"type":  "application/json",
+				}},
+			},
+		},
+		{
+			name: "malformed",
+			values: []string{`https://platform.tld/memberships?page=1; rel="first", ` +
+				`<https://platform.tld/memberships?page=2> rel="next", ` +
+				`<https://platform.tld/memberships?page=3>; rel="last", <https://platform.tld/unterminated`},
+			want: []parsedLink{
+				{URI: "https://platform.tld/memberships?page=3", Rel: []string{"last"}, Params: map[string]string{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		links := ParseLinks(base, test.values)
+		var got []parsedLink
+		for _, link := range links {
+			got = append(got, parsedLink{URI: link.URI.String(), Rel: link.Rel, Params: link.Params})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, wanted %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// Test finding links by relation type.
+func TestLinksURI(t *testing.T) {
+	links := ParseLinks(nil, []string{`<https://platform.tld/2>; rel="prev next", <https://platform.tld/3>; rel=next`})
+
+	if uri := links.URI("NEXT"); uri == nil || uri.String() != "https://platform.tld/2" {
+		t.Errorf("got next link %v, wanted the first link with the relation type", uri)
+	}
+	if uri := links.URI("differences"); uri != nil {
+		t.Errorf("got differences link %v, wanted none", uri)
+	}
+}
@@ -6,21 +6,34 @@
 package connector
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
+
+	"github.com/macewan-cs/lti-example/pkg/launch"
 )
 
-// NRPS implements Names & Roles Provisioning Services functions.
+// NRPS implements Names & Roles Provisioning Services functions. The requests of each method to the platform are bound
+// to its `ctx' argument.
+//
+// Differences is the platform's `differences' link from the last membership response, if the platform supports
+// membership differences. Tools that sync course rosters keep it to later get only the changes with
+// GetMembershipDifferences.
 type NRPS struct {
 	Endpoint *url.URL
-	Limit    int
-	NextPage *url.URL
-	Target   *Connector
+
+	// Limit is the number of members per page that the platform is asked for when MembershipOptions.Limit is zero.
+	//
+	// Deprecated: Use MembershipOptions.Limit.
+	Limit int
+
+	NextPage    *url.URL
+	Differences *url.URL
+	Target      *Connector
 }
 
 // A Membership represents a course membership with a brief class description.
@@ -37,7 +50,8 @@ type LTIContext struct {
 	Title string
 }
 
-// A Member represents a participant in a LTI-enabled process.
+// A Member represents a participant in a LTI-enabled process. Message holds the claims of the member's launch
+// messages, which platforms only include when the membership is requested for a resource link.
 type Member struct {
 	Status             string
 	Name               string
@@ -47,8 +61,61 @@ type Member struct {
 	MiddleName         string `json:"middle_name"`
 	Email              string
 	UserID             string `json:"user_id"`
+	LTI11LegacyUserID  string `json:"lti11_legacy_user_id"`
 	LisPersonSourceDid string `json:"lis_person_sourcedid"`
 	Roles              []string
+	Message            []MemberMessage
+}
+
+// A MemberMessage holds the claims that a member would receive when launching the resource link of a membership
+// request, e.g. the member's custom parameter values and the lineitem of the resource link. Claims holds all of the
+// message's claims, keyed by their names, including those without a field of their own.
+//
+// Source: https://www.imsglobal.org/spec/lti-nrps/v2p0#message-section
+type MemberMessage struct {
+	MessageType  string                     `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Custom       launch.CustomClaim         `json:"https://purl.imsglobal.org/spec/lti/claim/custom,omitempty"`
+	AGS          *launch.AGSEndpointClaim   `json:"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint,omitempty"`
+	BasicOutcome *BasicOutcomeClaim         `json:"https://purl.imsglobal.org/spec/lti-bo/claim/basicoutcome,omitempty"`
+	Claims       map[string]json.RawMessage `json:"-"`
+}
+
+// A BasicOutcomeClaim holds the LTI 1.1 Basic Outcomes service of a member's result for a resource link.
+type BasicOutcomeClaim struct {
+	LISResultSourcedID   string `json:"lis_result_sourcedid"`
+	LISOutcomeServiceURL string `json:"lis_outcome_service_url"`
+}
+
+// UnmarshalJSON decodes the claims of a member message, keeping all of them in Claims.
+func (m *MemberMessage) UnmarshalJSON(data []byte) error {
+	// The alias has the fields of a MemberMessage without its UnmarshalJSON method.
+	type memberMessage MemberMessage
+	var message memberMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &message.Claims); err != nil {
+		return err
+	}
+
+	*m = MemberMessage(message)
+	return nil
+}
+
+// MembershipOptions filter and page a membership request.
+//
+// Source: https://www.imsglobal.org/spec/lti-nrps/v2p0#context-membership-service
+type MembershipOptions struct {
+	// Role limits the membership to the members with the role, e.g. launch.RoleLearner.
+	Role string
+
+	// ResourceLinkID limits the membership to the members who can access the resource link, and asks the platform
+	// to include the message section of each member.
+	ResourceLinkID string
+
+	// Limit is the number of members per page that the platform is asked for. Zero leaves the page size to the
+	// platform.
+	Limit int
 }
 
 // UpgradeNRPS provides a Connector upgraded for NRPS calls.
@@ -77,152 +144,213 @@ func (c *Connector) UpgradeNRPS() (*NRPS, error) {
 	}, nil
 }
 
-// GetMembership gets the launched course (referred to as a Context in LTI) membership from the platform. Using
-// GetPagedMemberships as a helper, it checks for next page links, fetching and appending them to the output.
-func (n *NRPS) GetMembership() (Membership, error) {
-	var (
-		limit          int
-		hasMore        bool
-		membership     Membership
-		moreMembership Membership
-		err            error
-	)
+// GetMembership gets the launched course (referred to as a Context in LTI) membership from the platform, filtered
+// by `options'. It checks for next page links, fetching and appending them to the output. For large courses, EachMember
+// avoids holding the whole membership in memory.
+func (n *NRPS) GetMembership(ctx context.Context, options MembershipOptions) (Membership, error) {
+	var membership Membership
+	err := n.eachPage(ctx, options, func(page Membership) error {
+		if membership.ID == "" {
+			membership.ID = page.ID
+			membership.Context = page.Context
+		}
+		membership.Members = append(membership.Members, page.Members...)
+		return nil
+	})
+	if err != nil {
+		return Membership{}, err
+	}
 
-	membership, hasMore, err = n.GetPagedMembership(limit)
+	return membership, nil
+}
+
+// EachMember calls `fn' with each member of the launched course, filtered by `options', fetching the membership one
+// page at a time. It stops at the first error returned by `fn' and returns it.
+func (n *NRPS) EachMember(ctx context.Context, options MembershipOptions, fn func(Member) error) error {
+	return n.eachPage(ctx, options, func(page Membership) error {
+		for _, member := range page.Members {
+			if err := fn(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// eachPage calls `fn' with each page of the membership, filtered by `options'. It stops at the first error returned
+// by `fn' and returns it.
+func (n *NRPS) eachPage(ctx context.Context, options MembershipOptions, fn func(Membership) error) error {
+	pageURI, err := n.membershipURI(options)
 	if err != nil {
-		return Membership{}, fmt.Errorf("get paged membership error: %w", err)
+		return err
 	}
 
-	for hasMore {
-		moreMembership, hasMore, err = n.GetPagedMembership(limit)
+	for pageURI != nil {
+		page, links, err := n.getMembershipPage(ctx, pageURI)
 		if err != nil {
-			return Membership{}, fmt.Errorf("get more membership error: %w", err)
+			return fmt.Errorf("get paged membership error: %w", err)
+		}
+		if differences := links.URI("differences"); differences != nil {
+			n.Differences = differences
+		}
+		if err := fn(page); err != nil {
+			return err
 		}
-		membership.Members = append(membership.Members, moreMembership.Members...)
+		pageURI = links.URI("next")
 	}
 
-	return membership, nil
+	return nil
+}
+
+// GetPagedMembership gets paged Memberships for the launched course, filtered by `options'. Each call gets the page
+// after the previous one, and reports whether there are more.
+func (n *NRPS) GetPagedMembership(ctx context.Context, options MembershipOptions) (Membership, bool, error) {
+	pagedURI := n.NextPage
+	if pagedURI == nil {
+		var err error
+		pagedURI, err = n.membershipURI(options)
+		if err != nil {
+			return Membership{}, false, err
+		}
+	}
+
+	membership, links, err := n.getMembershipPage(ctx, pagedURI)
+	if err != nil {
+		return Membership{}, false, fmt.Errorf("get paged membership error: %w", err)
+	}
+
+	// Keep the differences link, if any, and get the next page link.
+	if differences := links.URI("differences"); differences != nil {
+		n.Differences = differences
+	}
+	n.NextPage = links.URI("next")
+	if n.NextPage == nil {
+		return membership, false, nil
+	}
+
+	return membership, true, nil
 }
 
-// GetPagedMembership gets paged Memberships for the launched course.
-func (n *NRPS) GetPagedMembership(limit int) (Membership, bool, error) {
-	if limit < 0 {
-		return Membership{}, false, errors.New("invalid paging limit")
+// membershipURI returns the URI of the first page of the membership, with the query parameters of `options'.
+func (n *NRPS) membershipURI(options MembershipOptions) (*url.URL, error) {
+	if options.Limit == 0 {
+		options.Limit = n.Limit
+	}
+	if options.Limit < 0 {
+		return nil, errors.New("invalid paging limit")
 	}
-	scopes := []string{"https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"}
 
 	query, err := url.ParseQuery(n.Endpoint.RawQuery)
 	if err != nil {
-		return Membership{}, false, fmt.Errorf("could not parse NRPS query values: %w", err)
+		return nil, fmt.Errorf("could not parse NRPS query values: %w", err)
+	}
+	if options.Role != "" {
+		query.Set("role", options.Role)
+	}
+	if options.ResourceLinkID != "" {
+		query.Set("rlid", options.ResourceLinkID)
 	}
-	if limit != 0 {
-		query.Add("limit", strconv.Itoa(limit))
+	if options.Limit != 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
 	}
 
-	// Set the initial limit query parameter.
 	pagedURI, err := url.Parse(n.Endpoint.String())
 	if err != nil {
-		return Membership{}, false, fmt.Errorf("could not parse NRPS endpoint: %w", err)
+		return nil, fmt.Errorf("could not parse NRPS endpoint: %w", err)
 	}
 	pagedURI.RawQuery = query.Encode()
+
+	return pagedURI, nil
+}
+
+// GetMembershipDifferences gets the members whose status has changed since the membership request that returned the
+// `differences' link, fetching and appending its next pages. Members removed from the course have the status
+// "Deleted". If `differences' is nil, the Differences link of the last membership response is used. Afterwards,
+// Differences holds the platform's link for the changes since this request.
+//
+// Source: https://www.imsglobal.org/spec/lti-nrps/v2p0#membership-differences
+func (n *NRPS) GetMembershipDifferences(ctx context.Context, differences *url.URL) (Membership, error) {
+	if differences == nil {
+		differences = n.Differences
+	}
+	if differences == nil {
+		return Membership{}, ErrNoDifferences
+	}
+
+	var membership Membership
+	for pageURI := differences; pageURI != nil; {
+		page, links, err := n.getMembershipPage(ctx, pageURI)
+		if err != nil {
+			return Membership{}, fmt.Errorf("get membership differences error: %w", err)
+		}
+		if membership.ID == "" {
+			membership.ID = page.ID
+			membership.Context = page.Context
+		}
+		membership.Members = append(membership.Members, page.Members...)
+
+		if link := links.URI("differences"); link != nil {
+			n.Differences = link
+		}
+		pageURI = links.URI("next")
+	}
+
+	return membership, nil
+}
+
+// getMembershipPage gets the membership page at `uri' and the links of its response.
+func (n *NRPS) getMembershipPage(ctx context.Context, uri *url.URL) (Membership, Links, error) {
 	s := ServiceRequest{
-		Scopes: scopes,
+		Scopes: []string{"https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"},
 		Method: http.MethodGet,
-		URI:    pagedURI,
+		URI:    uri,
 		Accept: "application/vnd.ims.lti-nrps.v2.membershipcontainer+json",
 	}
-
-	// If there was a next page set from a previous response, use it.
-	if n.NextPage != nil {
-		s.URI = n.NextPage
-	}
-	headers, body, err := n.Target.makeServiceRequest(s)
+	headers, body, err := n.Target.makeServiceRequest(ctx, s)
 	if err != nil {
-		return Membership{}, false, fmt.Errorf("get paged membership make service request error: %w", err)
+		return Membership{}, nil, fmt.Errorf("membership make service request error: %w", err)
 	}
 
 	defer body.Close()
 	var membership Membership
 	err = json.NewDecoder(body).Decode(&membership)
 	if err != nil {
-		return Membership{}, false, fmt.Errorf("could not decode get paged membership response body: %w", err)
-	}
-
-	// Get the next page link from the response headers.
-	nextPageLink := headers.Get("link")
-	if nextPageLink == "" || !strings.Contains(nextPageLink, `rel="next"`) {
-		// If there are no further next page links, set the NRPS NextPage field to nil.
-		n.NextPage = nil
-		return membership, false, nil
+		return Membership{}, nil, fmt.Errorf("could not decode membership response body: %w", err)
 	}
 
-	nextPageString := strings.Trim(nextPageLink, "<>")
-	nextPage, err := url.Parse(nextPageString)
-	if err != nil {
-		return Membership{}, false, fmt.Errorf("could not parse next page URI from response headers: %w", err)
-	}
-	n.NextPage = nextPage
-
-	return membership, true, nil
+	return membership, ParseLinks(uri, headers.Values("Link")), nil
 }
 
 // GetLaunchingMember returns a Member struct representing the user that performed the launch. Status is not included
 // in the launch message.
 func (n *NRPS) GetLaunchingMember() (Member, error) {
-	var launchingMember Member
+	message := n.Target.LaunchMessage
 
-	rawLaunchEmail, ok := n.Target.LaunchToken.Get("email")
-	if !ok {
+	if message.Email == "" {
 		return Member{}, errors.New("launching member email not found")
 	}
-	launchEmail, ok := rawLaunchEmail.(string)
-	if !ok {
-		return Member{}, errors.New("could not assert launching member email")
-	}
-	launchingMember.Email = launchEmail
-
-	rawFamilyName, ok := n.Target.LaunchToken.Get("family_name")
-	if !ok {
-		return Member{}, errors.New("launching member family name not found")
-	}
-	familyName, ok := rawFamilyName.(string)
-	if !ok {
-		return Member{}, errors.New("could not assert launching member family name")
-	}
-	launchingMember.FamilyName = familyName
-
-	rawGivenName, ok := n.Target.LaunchToken.Get("given_name")
-	if !ok {
+	if message.FamilyName == "" {
 		return Member{}, errors.New("launching member family name not found")
 	}
-	givenName, ok := rawGivenName.(string)
-	if !ok {
-		return Member{}, errors.New("could not assert launching member family name")
+	if message.GivenName == "" {
+		return Member{}, errors.New("launching member given name not found")
 	}
-	launchingMember.GivenName = givenName
-
-	rawName, ok := n.Target.LaunchToken.Get("name")
-	if !ok {
+	if message.Name == "" {
 		return Member{}, errors.New("launching member name not found")
 	}
-	name, ok := rawName.(string)
-	if !ok {
-		return Member{}, errors.New("could not assert launching member name")
-	}
-	launchingMember.Name = name
-
-	rawRoles, ok := n.Target.LaunchToken.Get("https://purl.imsglobal.org/spec/lti/claim/roles")
-	if !ok {
+	if message.Roles == nil {
 		return Member{}, errors.New("launching member roles not found")
 	}
-	rolesInterfaces, ok := rawRoles.([]interface{})
-	if !ok {
-		return Member{}, errors.New("could not assert launching member roles")
-	}
-	launchingRoles := convertInterfaceToStringSlice(rolesInterfaces)
-	launchingMember.Roles = launchingRoles
-
-	launchingMember.UserID = n.Target.LaunchToken.Subject()
 
-	return launchingMember, nil
+	return Member{
+		Name:               message.Name,
+		Picture:            message.Picture,
+		GivenName:          message.GivenName,
+		FamilyName:         message.FamilyName,
+		MiddleName:         message.MiddleName,
+		Email:              message.Email,
+		UserID:             message.Subject,
+		LisPersonSourceDid: message.LIS.PersonSourcedID,
+		Roles:              message.Roles,
+	}, nil
 }
@@ -0,0 +1,308 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/macewan-cs/lti-example/pkg/launch"
+)
+
+// pagedMemberships serves a membership in pages of one member, with next, first and differences links. Requests for
+// differences, i.e. with a `since' parameter, get the members in `changes'.
+func pagedMemberships(changes map[string][]string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		since, page := query.Get("since"), query.Get("page")
+		if page == "" {
+			page = "1"
+		}
+
+		var members []string
+		if since == "" {
+			members = []string{"Active user-1", "Active user-2", "Inactive user-3"}
+		} else {
+			members = changes[since]
+		}
+
+		index := 0
+		fmt.Sscan(page, &index)
+		links := fmt.Sprintf(`</memberships?since=%s&page=1>; rel="first"`, since)
+		if index < len(members) {
+			links = fmt.Sprintf(`</memberships?since=%s&page=%d>; rel="next", `, since, index+1) + links
+		} else {
+			links += fmt.Sprintf(`, <http://%s/memberships?since=sync-%s>; rel="differences"`, r.Host, since)
+		}
+		w.Header().Add("Link", links)
+		w.Header().Add("Link", `<https://platform.tld/terms>; rel="terms-of-service"`)
+		w.Header().Set("Content-Type", "application/vnd.ims.lti-nrps.v2.membershipcontainer+json")
+
+		var status, userID string
+		if index >= 1 && index <= len(members) {
+			fmt.Sscan(members[index-1], &status, &userID)
+		}
+		fmt.Fprintf(w, `{"id": "memberships-1", "context": {"id": "course-1"},
+			"members": [{"status": %q, "user_id": %q, "roles": ["Learner"]}]}`, status, userID)
+	}
+}
+
+// memberStatuses returns the status and user ID of each member of `membership'.
+func memberStatuses(membership Membership) []string {
+	var statuses []string
+	for _, member := range membership.Members {
+		statuses = append(statuses, member.Status+" "+member.UserID)
+	}
+	return statuses
+}
+
+// Test that the membership pages are followed through Link headers with several links.
+func TestGetMembershipPages(t *testing.T) {
+	platform := &testPlatform{handler: pagedMemberships(nil)}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	membership, err := nrps.GetMembership(context.Background(), MembershipOptions{})
+	if err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	want := []string{"Active user-1", "Active user-2", "Inactive user-3"}
+	if got := memberStatuses(membership); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got members %v, wanted %v", got, want)
+	}
+	if nrps.NextPage != nil {
+		t.Fatalf("got next page %v after the last page, wanted none", nrps.NextPage)
+	}
+	if nrps.Differences == nil || nrps.Differences.String() != server.URL+"/memberships?since=sync-" {
+		t.Fatalf("got differences link %v, wanted the link of the last page", nrps.Differences)
+	}
+}
+
+// Test that membership differences are fetched from the differences link, following their pages.
+func TestGetMembershipDifferences(t *testing.T) {
+	platform := &testPlatform{handler: pagedMemberships(map[string][]string{
+		"sync-":      {"Deleted user-2", "Active user-4"},
+		"sync-sync-": {"Inactive user-1"},
+	})}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	_, err = nrps.GetMembershipDifferences(context.Background(), nil)
+	if !errors.Is(err, ErrNoDifferences) {
+		t.Fatalf("got %v before a membership request, wanted ErrNoDifferences", err)
+	}
+
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	previousSync := nrps.Differences
+
+	differences, err := nrps.GetMembershipDifferences(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("cannot get membership differences: %v", err)
+	}
+	want := []string{"Deleted user-2", "Active user-4"}
+	if got := memberStatuses(differences); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got differences %v, wanted %v", got, want)
+	}
+	if differences.ID != "memberships-1" || differences.Context.ID != "course-1" {
+		t.Fatalf("got membership %q of context %q, wanted memberships-1 of course-1", differences.ID,
+			differences.Context.ID)
+	}
+
+	differences, err = nrps.GetMembershipDifferences(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("cannot get membership differences: %v", err)
+	}
+	want = []string{"Inactive user-1"}
+	if got := memberStatuses(differences); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got differences %v since the last sync, wanted %v", got, want)
+	}
+
+	// A stored differences link can be given explicitly.
+	differences, err = nrps.GetMembershipDifferences(context.Background(), previousSync)
+	if err != nil {
+		t.Fatalf("cannot get membership differences: %v", err)
+	}
+	want = []string{"Deleted user-2", "Active user-4"}
+	if got := memberStatuses(differences); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got differences %v since the earlier sync, wanted %v", got, want)
+	}
+}
+
+// Test that the membership options are sent as query parameters of the first page.
+func TestMembershipOptions(t *testing.T) {
+	var queries []string
+	handler := pagedMemberships(nil)
+	platform := &testPlatform{handler: func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		handler(w, r)
+	}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	options := MembershipOptions{Role: launch.RoleLearner, ResourceLinkID: "link-1", Limit: 1}
+	if _, err = nrps.GetMembership(context.Background(), options); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if len(queries) == 0 {
+		t.Fatal("got no membership requests")
+	}
+	query, _ := url.ParseQuery(queries[0])
+	want := url.Values{
+		"role":  {launch.RoleLearner},
+		"rlid":  {"link-1"},
+		"limit": {"1"},
+	}
+	if !reflect.DeepEqual(query, want) {
+		t.Fatalf("got query %v, wanted %v", query, want)
+	}
+
+	// The deprecated NRPS.Limit applies when the options set no limit.
+	queries = nil
+	nrps.Limit = 2
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if query, _ := url.ParseQuery(queries[0]); query.Get("limit") != "2" {
+		t.Fatalf("got query %v, wanted the NRPS limit", query)
+	}
+	nrps.Limit = 0
+
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{Limit: -1}); err == nil {
+		t.Fatal("got no error for a negative limit")
+	}
+}
+
+// Test decoding the message section and the LTI 1.1 user ID of members.
+func TestMemberMessage(t *testing.T) {
+	platform := &testPlatform{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.ims.lti-nrps.v2.membershipcontainer+json")
+		fmt.Fprint(w, `{"id": "memberships-1", "context": {"id": "course-1"}, "members": [{
+			"status": "Active", "user_id": "user-1", "lti11_legacy_user_id": "legacy-1", "roles": ["Learner"],
+			"message": [{
+				"https://purl.imsglobal.org/spec/lti/claim/message_type": "LtiResourceLinkRequest",
+				"https://purl.imsglobal.org/spec/lti/claim/custom": {"country": "Canada"},
+				"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint": {
+					"scope": ["https://purl.imsglobal.org/spec/lti-ags/scope/score"],
+					"lineitem": "https://platform.tld/lineitems/1"
+				},
+				"https://purl.imsglobal.org/spec/lti-bo/claim/basicoutcome": {
+					"lis_result_sourcedid": "result-1",
+					"lis_outcome_service_url": "https://platform.tld/outcomes"
+				},
+				"https://platform.tld/claim/extension": {"enrolled": true}
+			}]
+		}]}`)
+	}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	membership, err := nrps.GetMembership(context.Background(), MembershipOptions{ResourceLinkID: "link-1"})
+	if err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if len(membership.Members) != 1 || len(membership.Members[0].Message) != 1 {
+		t.Fatalf("got membership %+v, wanted one member with one message", membership)
+	}
+	member := membership.Members[0]
+	if member.LTI11LegacyUserID != "legacy-1" {
+		t.Errorf("got LTI 1.1 user ID %q, wanted legacy-1", member.LTI11LegacyUserID)
+	}
+
+	message := member.Message[0]
+	if message.MessageType != "LtiResourceLinkRequest" {
+		t.Errorf("got message type %q, wanted LtiResourceLinkRequest", message.MessageType)
+	}
+	if message.Custom["country"] != "Canada" {
+		t.Errorf("got custom values %v, wanted country Canada", message.Custom)
+	}
+	if message.AGS == nil || message.AGS.LineItem != "https://platform.tld/lineitems/1" {
+		t.Errorf("got AGS claim %+v, wanted lineitem https://platform.tld/lineitems/1", message.AGS)
+	}
+	if message.BasicOutcome == nil || message.BasicOutcome.LISResultSourcedID != "result-1" {
+		t.Errorf("got basic outcome claim %+v, wanted sourcedid result-1", message.BasicOutcome)
+	}
+	if string(message.Claims["https://platform.tld/claim/extension"]) != `{"enrolled": true}` {
+		t.Errorf("got claims %v, wanted the extension claim", message.Claims)
+	}
+}
+
+// Test that members are streamed page by page, and that an error of the callback stops the iteration.
+func TestEachMember(t *testing.T) {
+	var pages int
+	handler := pagedMemberships(nil)
+	platform := &testPlatform{handler: func(w http.ResponseWriter, r *http.Request) {
+		pages++
+		handler(w, r)
+	}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	nrps, err := connector.UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+
+	var members []string
+	err = nrps.EachMember(context.Background(), MembershipOptions{}, func(member Member) error {
+		members = append(members, member.Status+" "+member.UserID)
+		if pages != len(members) {
+			return fmt.Errorf("got member %d after fetching %d pages", len(members), pages)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot iterate over members: %v", err)
+	}
+	want := []string{"Active user-1", "Active user-2", "Inactive user-3"}
+	if !reflect.DeepEqual(members, want) {
+		t.Fatalf("got members %v, wanted %v", members, want)
+	}
+
+	pages = 0
+	errStop := errors.New("stop")
+	err = nrps.EachMember(context.Background(), MembershipOptions{}, func(member Member) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("got %v, wanted the callback's error", err)
+	}
+	if pages != 1 {
+		t.Fatalf("got %d pages after the callback failed, wanted 1", pages)
+	}
+}
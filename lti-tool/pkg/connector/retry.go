@@ -0,0 +1,204 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/backoff/v2"
+)
+
+// A RetryPolicy controls how a Connector retries the requests to the platform that time out, or that the platform
+// throttles (429 Too Many Requests) or cannot serve at the moment (502 Bad Gateway, 503 Service Unavailable and 504
+// Gateway Timeout). Only idempotent requests are retried: access token requests, and service requests with the GET,
+// HEAD, PUT or DELETE method. Score POSTs are only retried if RetryScores is set.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a request, including the first. A value of one or less
+	// disables retries.
+	MaxAttempts int
+
+	// MinInterval is the delay before the first retry. Each further delay is Multiplier times the previous one, up to
+	// MaxInterval, and is randomized by up to JitterFactor of its length, e.g. 0.2 for 20%, so that tools throttled at
+	// the same time do not retry in lockstep.
+	MinInterval  time.Duration
+	MaxInterval  time.Duration
+	Multiplier   float64
+	JitterFactor float64
+
+	// MaxRetryAfter is the longest delay requested by a platform's Retry-After header that the Connector waits for.
+	// When the platform asks for a longer delay, the request fails without further attempts.
+	MaxRetryAfter time.Duration
+
+	// RetryScores allows score POSTs to be retried. A retried score may be recorded twice by the platform, which is
+	// harmless for most tools since the latest score replaces the earlier ones.
+	RetryScores bool
+}
+
+// DefaultRetryPolicy is the RetryPolicy of a Connector unless it is given another one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   4,
+	MinInterval:   500 * time.Millisecond,
+	MaxInterval:   30 * time.Second,
+	Multiplier:    2,
+	JitterFactor:  0.2,
+	MaxRetryAfter: time.Minute,
+}
+
+// WithRetryPolicy sets the policy for retrying throttled and failed requests to the platform. By default, a Connector
+// uses the DefaultRetryPolicy. The intervals, multiplier and longest Retry-After delay left zero in `policy' take their
+// values from the DefaultRetryPolicy, so that, e.g., RetryPolicy{MaxAttempts: 5} does not retry without waiting.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Connector) {
+		if policy.MinInterval == 0 {
+			policy.MinInterval = DefaultRetryPolicy.MinInterval
+		}
+		if policy.MaxInterval == 0 {
+			policy.MaxInterval = DefaultRetryPolicy.MaxInterval
+		}
+		if policy.Multiplier == 0 {
+			policy.Multiplier = DefaultRetryPolicy.Multiplier
+		}
+		if policy.MaxRetryAfter == 0 {
+			policy.MaxRetryAfter = DefaultRetryPolicy.MaxRetryAfter
+		}
+		c.retry = policy
+	}
+}
+
+// do sends the request with the connector's client. If `idempotent', a request that times out or is throttled by the
+// platform is retried according to the connector's retry policy, waiting for the delay requested by the platform's
+// Retry-After header, if any, or else for an exponentially growing delay. The response of the last attempt is
+// returned. Waiting is cut short when the request's context is done.
+func (c *Connector) do(request *http.Request, idempotent bool) (*http.Response, error) {
+	if request.Body != nil && request.GetBody == nil {
+		idempotent = false
+	}
+
+	attempt := 0
+	return c.doAttempts(request.Context(), idempotent, func() (*http.Request, error) {
+		attempt++
+		if attempt == 1 {
+			return request, nil
+		}
+		retried := request.Clone(request.Context())
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("retry %s %s: %w", request.Method, request.URL, err)
+			}
+			retried.Body = body
+		}
+		return retried, nil
+	})
+}
+
+// doAttempts sends a request built by `newRequest' for each attempt, retrying like do until `ctx' is done. Requests
+// that must not be sent twice as they are, e.g. those carrying a single-use client assertion, are built anew for every
+// attempt.
+func (c *Connector) doAttempts(ctx context.Context, idempotent bool, newRequest func() (*http.Request, error)) (
+	*http.Response, error) {
+	attempts := c.retry.MaxAttempts
+	if !idempotent || attempts < 1 {
+		attempts = 1
+	}
+	intervals := backoff.NewExponentialInterval(
+		backoff.WithMinInterval(c.retry.MinInterval),
+		backoff.WithMaxInterval(c.retry.MaxInterval),
+		backoff.WithMultiplier(c.retry.Multiplier),
+		backoff.WithJitterFactor(c.retry.JitterFactor),
+	)
+
+	for attempt := 1; ; attempt++ {
+		request, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		response, err := c.client.Do(request)
+		if attempt >= attempts || !shouldRetry(request, response, err) {
+			return response, err
+		}
+
+		delay := intervals.Next()
+		if response != nil {
+			retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+			if ok && retryAfter > c.retry.MaxRetryAfter {
+				return response, nil
+			}
+			if ok {
+				delay = retryAfter
+			}
+			// Drain the body so that the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("retry %s %s: %w", request.Method, request.URL, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry reports whether the attempt of `request' that returned `response' or `err' failed for a reason that a
+// later attempt may not have, i.e. the platform throttled the request or was unavailable, or the request timed out.
+func shouldRetry(request *http.Request, response *http.Response, err error) bool {
+	if err != nil {
+		// A request whose own context is done cannot succeed anymore.
+		if request.Context().Err() != nil {
+			return false
+		}
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isIdempotent reports whether requests with `method' can safely be sent more than once.
+func isIdempotent(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, which is either a number of seconds or an HTTP
+// date. A date in the past is no delay.
+func parseRetryAfter(retryAfter string, now time.Time) (time.Duration, bool) {
+	retryAfter = strings.TrimSpace(retryAfter)
+	if retryAfter == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseUint(retryAfter, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(retryAfter)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// testRetryPolicy retries quickly, so that the tests do not wait.
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:   3,
+	MinInterval:   time.Millisecond,
+	MaxInterval:   10 * time.Millisecond,
+	Multiplier:    2,
+	MaxRetryAfter: time.Second,
+}
+
+// Test that the intervals of a partial policy default to those of the DefaultRetryPolicy.
+func TestRetryPolicyDefaults(t *testing.T) {
+	c := &Connector{}
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 5, RetryScores: true})(c)
+
+	want := DefaultRetryPolicy
+	want.MaxAttempts = 5
+	want.JitterFactor = 0
+	want.RetryScores = true
+	if c.retry != want {
+		t.Fatalf("got %+v, wanted %+v", c.retry, want)
+	}
+}
+
+// Test retrying throttled access token and service requests.
+func TestRetry(t *testing.T) {
+	platform := &testPlatform{unavailable: map[string]int{"/token": 1, "/memberships": 2}, retryAfter: "0"}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	nrps, err := newTestConnector(t, server.URL, WithRetryPolicy(testRetryPolicy)).UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+	if requests := platform.requestLog(); len(requests) != 5 {
+		t.Fatalf("got requests %v, wanted two token and three membership requests", requests)
+	}
+
+	// The request fails once the attempts are exhausted.
+	platform.unavailable["/memberships"] = 3
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err == nil {
+		t.Fatalf("got no error, wanted the last attempt's error")
+	}
+	if requests := platform.requestLog(); len(requests) != 8 {
+		t.Fatalf("got %d requests, wanted three more membership requests", len(requests))
+	}
+
+	// A delay longer than the policy allows is not waited for.
+	platform.unavailable["/memberships"] = 1
+	platform.retryAfter = "3600"
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err == nil {
+		t.Fatalf("got no error, wanted the platform's error")
+	}
+	if requests := platform.requestLog(); len(requests) != 9 {
+		t.Fatalf("got %d requests, wanted a single membership request", len(requests))
+	}
+}
+
+// Test that each attempt of an access token request is sent with a client assertion of its own.
+func TestRetryClientAssertion(t *testing.T) {
+	platform := &testPlatform{unavailable: map[string]int{"/token": 2}, retryAfter: "0"}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL, WithRetryPolicy(testRetryPolicy))
+	if err := connector.GetAccessToken(context.Background(), []string{"scope-1"}); err != nil {
+		t.Fatalf("cannot get access token: %v", err)
+	}
+
+	tokenIDs := map[string]bool{}
+	for _, assertion := range platform.assertions {
+		token, err := jwt.ParseString(assertion)
+		if err != nil {
+			t.Fatalf("cannot parse client assertion %q: %v", assertion, err)
+		}
+		tokenIDs[token.JwtID()] = true
+	}
+	if len(platform.assertions) != 3 || len(tokenIDs) != 3 {
+		t.Fatalf("got %d client assertions with %d JWT IDs, wanted three of each", len(platform.assertions),
+			len(tokenIDs))
+	}
+}
+
+// Test that score POSTs are only retried when the policy allows it.
+func TestRetryScores(t *testing.T) {
+	platform := &testPlatform{unavailable: map[string]int{}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	for _, retryScores := range []bool{false, true} {
+		policy := testRetryPolicy
+		policy.RetryScores = retryScores
+		ags, err := newTestConnector(t, server.URL, WithRetryPolicy(policy)).UpgradeAGS()
+		if err != nil {
+			t.Fatalf("cannot upgrade connector: %v", err)
+		}
+
+		platform.unavailable["/lineitems/1/scores"] = 1
+		err = ags.PutScore(context.Background(), Score{ScoreGiven: 1, ScoreMaximum: 1}, true)
+		if retryScores && err != nil {
+			t.Errorf("got %v, wanted the score to be sent again", err)
+		}
+		if !retryScores && err == nil {
+			t.Errorf("got no error, wanted the score not to be sent again")
+		}
+	}
+}
+
+// Test that waiting for a retry ends with the request's context.
+func TestRetryContext(t *testing.T) {
+	platform := &testPlatform{unavailable: map[string]int{"/token": 1}, retryAfter: "1"}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := newTestConnector(t, server.URL, WithRetryPolicy(testRetryPolicy)).GetAccessToken(ctx, []string{"scope-1"})
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("got %v after %v, wanted the wait to end with the context", err, time.Since(start))
+	}
+}
+
+// Test the delays requested by Retry-After headers.
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		retryAfter string
+		delay      time.Duration
+		ok         bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"Sun, 01 Aug 2021 12:00:30 GMT", 30 * time.Second, true},
+		{"Sun, 01 Aug 2021 11:00:00 GMT", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.retryAfter, now)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("%q: got %v %v, wanted %v %v", test.retryAfter, delay, ok, test.delay, test.ok)
+		}
+	}
+}
+
+// Test which methods are retried by default.
+func TestIsIdempotent(t *testing.T) {
+	for method, idempotent := range map[string]bool{
+		http.MethodGet:    true,
+		"put":             true,
+		http.MethodDelete: true,
+		http.MethodPost:   false,
+		http.MethodPatch:  false,
+	} {
+		if got := isIdempotent(method); got != idempotent {
+			t.Errorf("%s: got %v, wanted %v", method, got, idempotent)
+		}
+	}
+}
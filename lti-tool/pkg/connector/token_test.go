@@ -0,0 +1,127 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package connector
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+)
+
+// Test that stored access tokens are renewed shortly before they expire, and serve requests for fewer scopes.
+func TestAccessTokenRenewal(t *testing.T) {
+	platform := &testPlatform{}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	connector := newTestConnector(t, server.URL)
+	stored := datastore.AccessToken{
+		TokenURI:   server.URL + "/token",
+		ClientID:   "client-1",
+		Scopes:     []string{"scope-1", "scope-2"},
+		Token:      "stored-1",
+		ExpiryTime: time.Now().Add(time.Second * AccessTokenRenewalSeconds / 2),
+	}
+	connector.cfg.AccessTokens.StoreAccessToken(stored)
+
+	if err := connector.GetAccessToken(context.Background(), []string{"scope-1"}); err != nil {
+		t.Fatalf("cannot get access token: %v", err)
+	}
+	if connector.AccessToken.Token != "token-1" {
+		t.Fatalf("got token %s, wanted the one about to expire to be renewed", connector.AccessToken.Token)
+	}
+
+	stored.ExpiryTime = time.Now().Add(time.Hour)
+	connector.cfg.AccessTokens.StoreAccessToken(stored)
+	if err := connector.GetAccessToken(context.Background(), []string{"scope-2"}); err != nil {
+		t.Fatalf("cannot get access token: %v", err)
+	}
+	if connector.AccessToken.Token != "stored-1" {
+		t.Fatalf("got token %s, wanted the stored token covering more scopes", connector.AccessToken.Token)
+	}
+	if platform.tokens != 1 {
+		t.Fatalf("got %d token requests, wanted 1", platform.tokens)
+	}
+}
+
+// Test that a token rejected by the platform is replaced once.
+func TestAccessTokenRevoked(t *testing.T) {
+	platform := &testPlatform{revoked: map[string]bool{}}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	nrps, err := newTestConnector(t, server.URL).UpgradeNRPS()
+	if err != nil {
+		t.Fatalf("cannot upgrade connector: %v", err)
+	}
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership: %v", err)
+	}
+
+	platform.mu.Lock()
+	platform.revoked["token-1"] = true
+	platform.mu.Unlock()
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err != nil {
+		t.Fatalf("cannot get membership after revocation: %v", err)
+	}
+	if nrps.Target.AccessToken.Token != "token-2" {
+		t.Fatalf("got token %s, wanted a new token", nrps.Target.AccessToken.Token)
+	}
+
+	// A new token that is rejected as well is not replaced again.
+	platform.mu.Lock()
+	platform.revoked["token-2"] = true
+	platform.revoked["token-3"] = true
+	platform.mu.Unlock()
+	if _, err = nrps.GetMembership(context.Background(), MembershipOptions{}); err == nil {
+		t.Fatalf("got no error, wanted the platform's rejection")
+	}
+	if platform.tokens != 3 {
+		t.Fatalf("got %d token requests, wanted 3", platform.tokens)
+	}
+}
+
+// Test that concurrent requests for the same access token are sent to the platform once.
+func TestAccessTokenCoalescing(t *testing.T) {
+	platform := &testPlatform{tokenDelay: 50 * time.Millisecond}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	first := newTestConnector(t, server.URL)
+	tokens := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		connector, err := New(first.cfg, first.LaunchID, first.keyID)
+		if err != nil {
+			t.Fatalf("cannot create connector: %v", err)
+		}
+		connector.SigningKey = first.SigningKey
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := connector.GetAccessToken(context.Background(), []string{"scope-1"}); err != nil {
+				t.Errorf("cannot get access token: %v", err)
+				return
+			}
+			tokens[i] = connector.AccessToken.Token
+		}(i)
+	}
+	wg.Wait()
+
+	if platform.tokens != 1 {
+		t.Fatalf("got %d token requests, wanted 1", platform.tokens)
+	}
+	for _, token := range tokens {
+		if token != "token-1" {
+			t.Fatalf("got tokens %v, wanted all to share token-1", tokens)
+		}
+	}
+}
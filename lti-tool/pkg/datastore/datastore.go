@@ -19,12 +19,16 @@ import (
 type Config struct {
 	Registrations RegistrationStorer
 	Nonces        NonceStorer
+	Replays       ReplayStorer
 	LaunchData    LaunchDataStorer
 	AccessTokens  AccessTokenStorer
+	Sessions      SessionStorer
+	Handoffs      HandoffStorer
 }
 
 // A Registration is the details of a link between a Platform and a Tool. There can be multiple deployments per
-// registration. Each Registration is uniquely identified by the ClientID.
+// registration. Each Registration is uniquely identified by the ClientID. Provisioning is the registration's policy
+// for launches through deployments that have not been stored.
 type Registration struct {
 	Issuer        string
 	ClientID      string
@@ -32,12 +36,64 @@ type Registration struct {
 	AuthLoginURI  *url.URL
 	KeysetURI     *url.URL
 	TargetLinkURI *url.URL
+	Provisioning  ProvisioningPolicy
 }
 
-// A Deployment contains that details that identify the platform-tool integration for a message.
+// A ProvisioningPolicy decides what happens when a launch with a valid signature from a registered issuer and client ID
+// names an unknown deployment ID. Platforms add deployments whenever the tool is installed in another place, and the
+// policy spares adding each one by hand.
+type ProvisioningPolicy string
+
+const (
+	// ProvisionNone rejects launches through unknown deployments. It is the default.
+	ProvisionNone ProvisioningPolicy = ""
+
+	// ProvisionAutomatic trusts the deployment on first use: it is stored and the launch proceeds.
+	ProvisionAutomatic ProvisioningPolicy = "automatic"
+
+	// ProvisionPending stores the deployment pending approval and rejects launches through it until it is approved.
+	ProvisionPending ProvisioningPolicy = "pending"
+)
+
+// A Deployment contains that details that identify the platform-tool integration for a message. A deployment belongs to
+// a single registration: platforms such as Canvas share one issuer across many client IDs, and a deployment ID is only
+// valid for launches to its own client.
 // Source: http://www.imsglobal.org/spec/lti/v1p3/#lti-deployment-id-claim.
+//
+// Name labels the deployment, e.g. with the customer it was made for. A Disabled deployment rejects all launches, and
+// a deployment with AllowedContextIDs only accepts launches from those contexts (courses). Features are per-deployment
+// feature flags and Metadata holds free-form values for the tool's own use.
+//
+// Deployments provisioned on first use record when they were FirstSeen; it is zero for deployments stored by hand. A
+// Pending deployment rejects launches until it is approved by clearing the flag.
 type Deployment struct {
-	DeploymentID string
+	DeploymentID      string
+	Name              string
+	Disabled          bool
+	AllowedContextIDs []string
+	Features          map[string]bool
+	Metadata          map[string]string
+	Pending           bool
+	FirstSeen         time.Time
+}
+
+// AllowsContext reports whether the deployment accepts launches from the context identified by `contextID'. A
+// deployment without AllowedContextIDs accepts every context.
+func (d Deployment) AllowsContext(contextID string) bool {
+	if len(d.AllowedContextIDs) == 0 {
+		return true
+	}
+	for _, allowed := range d.AllowedContextIDs {
+		if allowed == contextID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature reports whether the feature flag `name' is set for the deployment.
+func (d Deployment) HasFeature(name string) bool {
+	return d.Features[name]
 }
 
 // An AccessToken is the scoped bearer token used for direct communication between the platform and tool.
@@ -49,6 +105,24 @@ type AccessToken struct {
 	ExpiryTime time.Time `json:"expiryTime"`
 }
 
+// HasScopes reports whether the access token's scopes include all of `scopes'.
+func (t AccessToken) HasScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		found := false
+		for _, tokenScope := range t.Scopes {
+			if tokenScope == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 var maximumDeploymentIDLength = 255
 
 // ValidateDeploymentID validates a deployment ID.
@@ -67,8 +141,26 @@ var (
 	// ErrRegistrationNotFound is the error returned when a registration cannot be found.
 	ErrRegistrationNotFound = errors.New("registration not found")
 
-	// ErrDeploymentNotFound is the error returned when an issuer/deploymentID cannot be found.
+	// ErrRegistrationExists is the error returned when storing a registration would overwrite a different one with the
+	// same issuer and client ID, and the store does not allow registrations to be updated.
+	ErrRegistrationExists = errors.New("registration exists")
+
+	// ErrAmbiguousRegistration is the error returned when a registration is looked up by issuer alone and the issuer
+	// has several registrations, which only a client ID can tell apart.
+	ErrAmbiguousRegistration = errors.New("issuer has several registrations")
+
+	// ErrDeploymentNotFound is the error returned when an issuer/clientID/deploymentID cannot be found.
 	ErrDeploymentNotFound = errors.New("deployment not found")
+
+	// ErrDeploymentPending is the error returned when launching through a provisioned deployment that has not been
+	// approved.
+	ErrDeploymentPending = errors.New("deployment is pending approval")
+
+	// ErrDeploymentDisabled is the error returned when launching through a deployment that has been disabled.
+	ErrDeploymentDisabled = errors.New("deployment is disabled")
+
+	// ErrContextNotAllowed is the error returned when launching from a context that the deployment does not allow.
+	ErrContextNotAllowed = errors.New("context not allowed for deployment")
 )
 
 // A RegistrationStorer manages the storage and retrieval of LTI registrations & deployments.
@@ -77,16 +169,56 @@ type RegistrationStorer interface {
 	StoreRegistration(Registration) error
 
 	// FindRegistrationByIssuerAndClientID retrieves a previously-stored registration using the `issuer' and
-	// `clientID' fields. If the registration cannot be found, it returns ErrRegistrationNotFound.
+	// `clientID' fields. If the registration cannot be found, it returns ErrRegistrationNotFound. The `clientID' may
+	// be empty, in which case it returns ErrAmbiguousRegistration if the issuer has several registrations.
 	FindRegistrationByIssuerAndClientID(issuer string, clientID string) (Registration, error)
 
-	// StoreDeployment stores a deployment for later retrieval.
-	StoreDeployment(issuer string, deployment Deployment) error
+	// ListRegistrations returns the stored registrations ordered by issuer and client ID. A non-empty `issuer' limits
+	// them to the registrations of that issuer.
+	ListRegistrations(issuer string) ([]Registration, error)
+
+	// UpdateRegistration replaces the stored registration with the same issuer and client ID, e.g. after the
+	// platform rotated its keyset URI. If the registration cannot be found, it returns ErrRegistrationNotFound.
+	UpdateRegistration(Registration) error
 
-	// FindDeployment retrieves a previously-stored deployment using the `issuer' and `deploymentID'. Its primary
-	// purpose is to validate the supplied deployment ID. If the deployment cannot be found, it returns
+	// DeleteRegistration removes the registration identified by the `issuer' and `clientID', together with its
+	// deployments. If the registration cannot be found, it returns ErrRegistrationNotFound.
+	DeleteRegistration(issuer string, clientID string) error
+
+	// StoreDeployment stores a deployment of the registration identified by the `issuer' and `clientID' for later
+	// retrieval.
+	StoreDeployment(issuer string, clientID string, deployment Deployment) error
+
+	// FindDeployment retrieves a previously-stored deployment using the `issuer', `clientID' and `deploymentID'. Its
+	// primary purpose is to validate the supplied deployment ID. If the deployment cannot be found, it returns
 	// ErrDeploymentNotFound.
-	FindDeployment(issuer string, deploymentID string) (Deployment, error)
+	FindDeployment(issuer string, clientID string, deploymentID string) (Deployment, error)
+
+	// ListDeployments returns the stored deployments of the registration identified by the `issuer' and `clientID',
+	// ordered by deployment ID.
+	ListDeployments(issuer string, clientID string) ([]Deployment, error)
+
+	// UpdateDeployment replaces the stored deployment of the registration with the same deployment ID. If the
+	// deployment cannot be found, it returns ErrDeploymentNotFound.
+	UpdateDeployment(issuer string, clientID string, deployment Deployment) error
+
+	// DeleteDeployment removes the deployment identified by the `issuer', `clientID' and `deploymentID', e.g. when a
+	// platform retires the deployment. If the deployment cannot be found, it returns ErrDeploymentNotFound.
+	DeleteDeployment(issuer string, clientID string, deploymentID string) error
+}
+
+// DefaultNonceMaxAge is how long a nonce stays valid unless it is stored with another MaxAge. It bounds the time
+// between the login redirect and the launch.
+const DefaultNonceMaxAge = 10 * time.Minute
+
+// A Nonce is issued during the login flow and must be returned, once, in the launch id_token. TargetLinkURI is the
+// target_link_uri of the login request; IssuedAt and MaxAge bound how long the nonce can be used. A zero IssuedAt is
+// taken as the time the nonce is stored and a zero MaxAge as DefaultNonceMaxAge.
+type Nonce struct {
+	Value         string
+	TargetLinkURI string
+	IssuedAt      time.Time
+	MaxAge        time.Duration
 }
 
 var (
@@ -96,28 +228,47 @@ var (
 	// ErrNonceTargetLinkURIMismatch is the error returned when a nonce is found but there's a mismatch in the
 	// target URI.
 	ErrNonceTargetLinkURIMismatch = errors.New("nonce found with mismatched target link uri")
+
+	// ErrNonceExpired is the error returned when a nonce is found but has outlived its maximum age.
+	ErrNonceExpired = errors.New("nonce has expired")
 )
 
 // A NonceStorer manages the storage and retrieval of LTI nonces.
 type NonceStorer interface {
 	// StoreNonce stores a nonce for later retrieval.
-	StoreNonce(nonce string, targetLinkURI string) error
+	StoreNonce(nonce Nonce) error
 
-	// TestAndClearNonce tests for the existance of a nonce. If the nonce is found and the target URI matches, it
-	// removes/clears the nonce and returns nil. Otherwise, it returns one of the ErrNonce errors.
+	// TestAndClearNonce tests for the existance of a nonce. If the nonce is found, has not expired and the target URI
+	// matches, it removes/clears the nonce and returns nil. Otherwise, it returns one of the ErrNonce errors. Found
+	// nonces are cleared even when they are rejected.
 	TestAndClearNonce(nonce string, targetLinkURI string) error
 }
 
-// ErrLaunchDataNotFound is the error returned when cached launch data cannot be found.
+// ErrTokenReplayed is the error returned when an id_token is presented again before it expires.
+var ErrTokenReplayed = errors.New("id_token has already been used")
+
+// A ReplayStorer remembers the id_tokens that have been used to launch, so that a captured id_token cannot be
+// replayed while it is still valid. Tokens are identified by their issuer and JWT ID (jti) claim.
+type ReplayStorer interface {
+	// TestAndSetTokenID records the token identified by `issuer' and `tokenID' as used until `expiresAt'. If the
+	// token was already recorded and has not expired, it returns ErrTokenReplayed.
+	TestAndSetTokenID(issuer string, tokenID string, expiresAt time.Time) error
+}
+
+// ErrLaunchDataNotFound is the error returned when cached launch data cannot be found, including when it has expired.
 var ErrLaunchDataNotFound = errors.New("launch data not found")
 
+// DefaultLaunchDataTTL is how long launch data is kept unless a store is configured otherwise. It bounds how long a
+// tool session or hand-off token can restore the launch context.
+const DefaultLaunchDataTTL = 24 * time.Hour
+
 // A LaunchDataStorer manages the storage and retrieval of LTI launch data.
 type LaunchDataStorer interface {
 	// StoreLaunchData stores the JSON launch data associated with the supplied launch ID.
 	StoreLaunchData(launchID string, launchData json.RawMessage) error
 
 	// FindLaunchData retrieves previously-stored launch data using the `launchID'. If the launch data cannot be
-	// found, it returns ErrLaunchDataNotFound.
+	// found or has outlived the store's TTL, it returns ErrLaunchDataNotFound.
 	FindLaunchData(launchID string) (json.RawMessage, error)
 }
 
@@ -132,7 +283,90 @@ type AccessTokenStorer interface {
 	// StoreAccessToken stores an access token.
 	StoreAccessToken(token AccessToken) error
 
-	// FindAccessToken retrieves a previously-stored access token. If the access token cannot be found, it returns
-	// ErrAccessTokenNotFound.
+	// FindAccessToken retrieves a previously-stored access token whose scopes include `scopes', so that a token
+	// covering several scopes also serves requests for fewer of them. If several tokens qualify, the one that expires
+	// last is returned. If no access token can be found, it returns ErrAccessTokenNotFound; if only expired ones can,
+	// it returns ErrAccessTokenExpired.
 	FindAccessToken(tokenURI, clientID string, scopes []string) (AccessToken, error)
+
+	// DeleteAccessToken deletes the access token stored for the token URI, client ID and scopes of `token', e.g.
+	// because the platform revoked it. The stored token is only deleted if it is still `token.Token', so that a newer
+	// token is kept.
+	DeleteAccessToken(token AccessToken) error
+}
+
+// A Session binds a tool session, issued after a successful launch, to the launch ID. It lets requests that follow the
+// launch find their launch data.
+type Session struct {
+	ID        string    `json:"id"`
+	LaunchID  string    `json:"launchID"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ErrSessionNotFound is the error returned when a session cannot be found.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionExpired is the error returned when a session has expired.
+var ErrSessionExpired = errors.New("session has expired")
+
+// A SessionStorer manages the storage and retrieval of tool sessions.
+type SessionStorer interface {
+	// StoreSession stores a session, replacing any session with the same ID.
+	StoreSession(session Session) error
+
+	// FindSession retrieves a previously-stored session using the `sessionID'. If the session cannot be found, it
+	// returns ErrSessionNotFound; if it has expired, it returns ErrSessionExpired.
+	FindSession(sessionID string) (Session, error)
+
+	// DeleteSession removes a session. Deleting a session that does not exist is not an error.
+	DeleteSession(sessionID string) error
+}
+
+// A HandoffCode is a short-lived, single-use code that lets a frontend served from another origin claim a launch.
+type HandoffCode struct {
+	Code      string    `json:"code"`
+	LaunchID  string    `json:"launchID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// A HandoffToken is the scoped access token a frontend receives in exchange for a HandoffCode.
+type HandoffToken struct {
+	Token     string    `json:"token"`
+	LaunchID  string    `json:"launchID"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var (
+	// ErrHandoffCodeNotFound is the error returned when a hand-off code cannot be found, including when it has
+	// already been used.
+	ErrHandoffCodeNotFound = errors.New("hand-off code not found")
+
+	// ErrHandoffCodeExpired is the error returned when a hand-off code has expired.
+	ErrHandoffCodeExpired = errors.New("hand-off code has expired")
+
+	// ErrHandoffTokenNotFound is the error returned when a hand-off access token cannot be found.
+	ErrHandoffTokenNotFound = errors.New("hand-off token not found")
+
+	// ErrHandoffTokenExpired is the error returned when a hand-off access token has expired.
+	ErrHandoffTokenExpired = errors.New("hand-off token has expired")
+)
+
+// A HandoffStorer manages the storage and retrieval of hand-off codes and the access tokens they are exchanged for.
+type HandoffStorer interface {
+	// StoreHandoffCode stores a hand-off code.
+	StoreHandoffCode(code HandoffCode) error
+
+	// TestAndClearHandoffCode retrieves and removes a hand-off code in a single step, so that a code can be
+	// exchanged only once. If the code cannot be found, it returns ErrHandoffCodeNotFound; if it has expired, it
+	// returns ErrHandoffCodeExpired.
+	TestAndClearHandoffCode(code string) (HandoffCode, error)
+
+	// StoreHandoffToken stores a hand-off access token.
+	StoreHandoffToken(token HandoffToken) error
+
+	// FindHandoffToken retrieves a previously-stored hand-off access token. If the token cannot be found, it
+	// returns ErrHandoffTokenNotFound; if it has expired, it returns ErrHandoffTokenExpired.
+	FindHandoffToken(token string) (HandoffToken, error)
 }
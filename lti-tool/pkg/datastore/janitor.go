@@ -0,0 +1,163 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package datastore
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultJanitorInterval is how often a Janitor purges expired entries unless configured otherwise.
+const DefaultJanitorInterval = 10 * time.Minute
+
+// A PurgeFunc removes the entries of a store that expired before `now' and returns the number of entries removed.
+type PurgeFunc func(now time.Time) (int, error)
+
+// JanitorStats holds the counters of a single purge function, suitable for monitoring.
+type JanitorStats struct {
+	Runs      int64
+	Purged    int64
+	Errors    int64
+	LastRun   time.Time
+	LastError error
+}
+
+type janitorTask struct {
+	name  string
+	purge PurgeFunc
+	stats JanitorStats
+}
+
+// A Janitor periodically runs purge functions in the background to evict expired entries from stores.
+type Janitor struct {
+	interval time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	tasks []*janitorTask
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewJanitor returns a *Janitor that runs its purge functions every `interval'. A non-positive interval is replaced by
+// DefaultJanitorInterval.
+func NewJanitor(interval time.Duration) *Janitor {
+	if interval <= 0 {
+		interval = DefaultJanitorInterval
+	}
+
+	return &Janitor{
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Add registers a purge function under `name', which identifies its counters in Stats.
+func (j *Janitor) Add(name string, purge PurgeFunc) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.tasks = append(j.tasks, &janitorTask{name: name, purge: purge})
+}
+
+// Start runs the purge functions every interval in a background goroutine until Stop is called. Calling Start on a
+// running Janitor has no effect.
+func (j *Janitor) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.stop != nil {
+		return
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.Run()
+			case <-stop:
+				return
+			}
+		}
+	}(j.stop, j.done)
+}
+
+// Stop halts the background goroutine started by Start and waits for a run in progress to finish.
+func (j *Janitor) Stop() {
+	j.mu.Lock()
+	stop, done := j.stop, j.done
+	j.stop, j.done = nil, nil
+	j.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// Run runs every purge function once and updates their counters.
+func (j *Janitor) Run() {
+	j.mu.Lock()
+	tasks := make([]*janitorTask, len(j.tasks))
+	copy(tasks, j.tasks)
+	j.mu.Unlock()
+
+	for _, task := range tasks {
+		now := j.now()
+		purged, err := task.purge(now)
+
+		j.mu.Lock()
+		task.stats.Runs++
+		task.stats.Purged += int64(purged)
+		task.stats.LastRun = now
+		task.stats.LastError = err
+		if err != nil {
+			task.stats.Errors++
+		}
+		j.mu.Unlock()
+	}
+}
+
+// Stats returns a snapshot of the counters of every purge function, keyed by name.
+func (j *Janitor) Stats() map[string]JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats := make(map[string]JanitorStats, len(j.tasks))
+	for _, task := range j.tasks {
+		stats[task.name] = task.stats
+	}
+	return stats
+}
+
+// SweepInterval is how often stores that purge themselves sweep out their expired entries.
+const SweepInterval = time.Minute
+
+// A Sweeper rate-limits the self-purging of expired entries by stores, between the runs of a Janitor. Its zero value
+// is ready for use.
+type Sweeper struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// Due reports whether a sweep should run at time `now' and, if so, records it as the time of the last sweep.
+func (sw *Sweeper) Due(now time.Time) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if now.Sub(sw.last) < SweepInterval {
+		return false
+	}
+	sw.last = now
+	return true
+}
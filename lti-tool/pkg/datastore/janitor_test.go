@@ -0,0 +1,70 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test that runs update the counters of every purge function.
+func TestJanitorRun(t *testing.T) {
+	janitor := NewJanitor(time.Hour)
+	now := time.Now()
+	janitor.now = func() time.Time { return now }
+
+	janitor.Add("launch data", func(before time.Time) (int, error) {
+		if !before.Equal(now) {
+			t.Errorf("got purge time %v, wanted %v", before, now)
+		}
+		return 3, nil
+	})
+	purgeErr := errors.New("database unavailable")
+	janitor.Add("sessions", func(time.Time) (int, error) {
+		return 0, purgeErr
+	})
+
+	janitor.Run()
+	janitor.Run()
+
+	stats := janitor.Stats()
+	if launchData := stats["launch data"]; launchData.Runs != 2 || launchData.Purged != 6 || launchData.Errors != 0 {
+		t.Errorf("unexpected launch data stats %#v", launchData)
+	}
+	if sessions := stats["sessions"]; sessions.Runs != 2 || sessions.Errors != 2 || sessions.LastError != purgeErr {
+		t.Errorf("unexpected session stats %#v", sessions)
+	}
+}
+
+// Test that a started janitor purges in the background until stopped.
+func TestJanitorStartAndStop(t *testing.T) {
+	janitor := NewJanitor(time.Millisecond)
+	purged := make(chan struct{}, 1)
+	janitor.Add("launch data", func(time.Time) (int, error) {
+		select {
+		case purged <- struct{}{}:
+		default:
+		}
+		return 1, nil
+	})
+
+	janitor.Start()
+	janitor.Start()
+	select {
+	case <-purged:
+	case <-time.After(time.Second):
+		t.Fatal("janitor did not run in the background")
+	}
+	janitor.Stop()
+	janitor.Stop()
+
+	runs := janitor.Stats()["launch data"].Runs
+	time.Sleep(5 * time.Millisecond)
+	if janitor.Stats()["launch data"].Runs != runs {
+		t.Fatal("janitor kept running after stop")
+	}
+}
@@ -24,8 +24,21 @@ type Store struct {
 	Registrations *sync.Map
 	Deployments   *sync.Map
 	Nonces        *sync.Map
+	TokenIDs      *sync.Map
 	LaunchData    *sync.Map
 	AccessTokens  *sync.Map
+	Sessions      *sync.Map
+	HandoffCodes  *sync.Map
+	HandoffTokens *sync.Map
+
+	// LaunchDataTTL is how long launch data is kept after it is stored. A zero LaunchDataTTL keeps launch data
+	// forever.
+	LaunchDataTTL time.Duration
+
+	tokenIDsMu     sync.Mutex
+	accessTokensMu sync.Mutex
+	nonceSweep     datastore.Sweeper
+	tokenIDSweep   datastore.Sweeper
 }
 
 // DefaultStore provides a single default datastore as a package variable so that other LTI functions can
@@ -38,8 +51,13 @@ func New() *Store {
 		Registrations: &sync.Map{},
 		Deployments:   &sync.Map{},
 		Nonces:        &sync.Map{},
+		TokenIDs:      &sync.Map{},
 		LaunchData:    &sync.Map{},
 		AccessTokens:  &sync.Map{},
+		Sessions:      &sync.Map{},
+		HandoffCodes:  &sync.Map{},
+		HandoffTokens: &sync.Map{},
+		LaunchDataTTL: datastore.DefaultLaunchDataTTL,
 	}
 }
 
@@ -49,88 +67,212 @@ func registrationIndex(issuer, clientID string) string {
 
 // StoreRegistration stores a Registration in-memory.
 func (s *Store) StoreRegistration(reg datastore.Registration) error {
-	// Store the registration both with and without the client ID: later, the registration can be retrieved with or
-	// without it. See FindRegistrationByIssuerAndClientID for further details.
-	s.Registrations.Store(reg.Issuer, reg)
 	s.Registrations.Store(registrationIndex(reg.Issuer, reg.ClientID), reg)
 	return nil
 }
 
-func deploymentIndex(issuer, deploymentID string) string {
-	return issuer + "/" + deploymentID
+// ListRegistrations returns the in-memory registrations, optionally limited to those of `issuer', ordered by issuer
+// and client ID.
+func (s *Store) ListRegistrations(issuer string) ([]datastore.Registration, error) {
+	registrations := []datastore.Registration{}
+	s.Registrations.Range(func(key, value interface{}) bool {
+		reg := value.(datastore.Registration)
+		if issuer == "" || reg.Issuer == issuer {
+			registrations = append(registrations, reg)
+		}
+		return true
+	})
+
+	sort.Slice(registrations, func(i, j int) bool {
+		if registrations[i].Issuer != registrations[j].Issuer {
+			return registrations[i].Issuer < registrations[j].Issuer
+		}
+		return registrations[i].ClientID < registrations[j].ClientID
+	})
+	return registrations, nil
 }
 
-// StoreDeployment stores a deployment ID in-memory.
-func (s *Store) StoreDeployment(issuer string, d datastore.Deployment) error {
+// UpdateRegistration replaces an in-memory Registration with the same issuer and client ID.
+func (s *Store) UpdateRegistration(reg datastore.Registration) error {
+	index := registrationIndex(reg.Issuer, reg.ClientID)
+	if _, ok := s.Registrations.Load(index); !ok {
+		return datastore.ErrRegistrationNotFound
+	}
+
+	s.Registrations.Store(index, reg)
+	return nil
+}
+
+// DeleteRegistration removes an in-memory Registration.
+func (s *Store) DeleteRegistration(issuer, clientID string) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+
+	index := registrationIndex(issuer, clientID)
+	if _, ok := s.Registrations.Load(index); !ok {
+		return datastore.ErrRegistrationNotFound
+	}
+
+	deployments, err := s.ListDeployments(issuer, clientID)
+	if err != nil {
+		return err
+	}
+	for _, d := range deployments {
+		s.Deployments.Delete(deploymentIndex(issuer, clientID, d.DeploymentID))
+	}
+
+	s.Registrations.Delete(index)
+	return nil
+}
+
+func deploymentIndex(issuer, clientID, deploymentID string) string {
+	return registrationIndex(issuer, clientID) + "/" + deploymentID
+}
+
+// StoreDeployment stores a deployment ID of the registration identified by `issuer' and `clientID' in-memory.
+func (s *Store) StoreDeployment(issuer, clientID string, d datastore.Deployment) error {
 	if issuer == "" {
 		return errors.New("received empty issuer argument")
 	}
+	if clientID == "" {
+		return errors.New("received empty client ID argument")
+	}
 	if err := datastore.ValidateDeploymentID(d.DeploymentID); err != nil {
 		return fmt.Errorf("received invalid deployment ID: %w", err)
 	}
 
-	s.Deployments.Store(deploymentIndex(issuer, d.DeploymentID), d)
+	s.Deployments.Store(deploymentIndex(issuer, clientID, d.DeploymentID), d)
 	return nil
 }
 
 // FindRegistrationByIssuerAndClientID looks up and returns either a Registration by the issuer or the datastore error
-// ErrRegistrationNotFound.
+// ErrRegistrationNotFound. Without a client ID, it returns ErrAmbiguousRegistration if the issuer has several
+// registrations.
 func (s *Store) FindRegistrationByIssuerAndClientID(issuer, clientID string) (datastore.Registration, error) {
 	if issuer == "" {
 		return datastore.Registration{}, errors.New("received empty issuer argument")
 	}
 
-	index := issuer
 	if clientID != "" {
 		// Use the client ID to disambiguate multiple registrations for an issuer.  The (optional) client ID
 		// parameter can disambiguate between multiple registrations from a single issuer.
 		//
 		// Source: http://www.imsglobal.org/spec/lti/v1p3/#client_id-login-parameter
-		index = registrationIndex(issuer, clientID)
+		registration, ok := s.Registrations.Load(registrationIndex(issuer, clientID))
+		if !ok {
+			return datastore.Registration{}, datastore.ErrRegistrationNotFound
+		}
+		return registration.(datastore.Registration), nil
 	}
 
-	registration, ok := s.Registrations.Load(index)
-	if !ok {
+	registrations, err := s.ListRegistrations(issuer)
+	if err != nil {
+		return datastore.Registration{}, err
+	}
+	switch len(registrations) {
+	case 0:
 		return datastore.Registration{}, datastore.ErrRegistrationNotFound
+	case 1:
+		return registrations[0], nil
+	default:
+		return datastore.Registration{}, datastore.ErrAmbiguousRegistration
 	}
-
-	return registration.(datastore.Registration), nil
 }
 
-// FindDeployment looks up and returns either a Deployment by the issuer and deployment ID or the datastore error
-// ErrDeploymentNotFound.
-func (s *Store) FindDeployment(issuer, deploymentID string) (datastore.Deployment, error) {
+// FindDeployment looks up and returns either a Deployment by the issuer, client ID and deployment ID or the datastore
+// error ErrDeploymentNotFound.
+func (s *Store) FindDeployment(issuer, clientID, deploymentID string) (datastore.Deployment, error) {
 	if issuer == "" {
 		return datastore.Deployment{}, errors.New("received empty issuer argument")
 	}
+	if clientID == "" {
+		return datastore.Deployment{}, errors.New("received empty client ID argument")
+	}
 	if err := datastore.ValidateDeploymentID(deploymentID); err != nil {
 		return datastore.Deployment{}, fmt.Errorf("received invalid deployment ID: %w", err)
 	}
 
-	deployment, ok := s.Deployments.Load(deploymentIndex(issuer, deploymentID))
+	deployment, ok := s.Deployments.Load(deploymentIndex(issuer, clientID, deploymentID))
 	if !ok {
 		return datastore.Deployment{}, datastore.ErrDeploymentNotFound
 	}
 	return deployment.(datastore.Deployment), nil
 }
 
+// ListDeployments returns the in-memory deployments of the registration identified by `issuer' and `clientID', ordered
+// by deployment ID.
+func (s *Store) ListDeployments(issuer, clientID string) ([]datastore.Deployment, error) {
+	if issuer == "" {
+		return nil, errors.New("received empty issuer argument")
+	}
+
+	deployments := []datastore.Deployment{}
+	s.Deployments.Range(func(key, value interface{}) bool {
+		// Compare whole indexes: issuers are URLs, so an issuer may be a prefix of another issuer's index.
+		d := value.(datastore.Deployment)
+		if key.(string) == deploymentIndex(issuer, clientID, d.DeploymentID) {
+			deployments = append(deployments, d)
+		}
+		return true
+	})
+
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].DeploymentID < deployments[j].DeploymentID
+	})
+	return deployments, nil
+}
+
+// UpdateDeployment replaces an in-memory Deployment of the registration with the same deployment ID.
+func (s *Store) UpdateDeployment(issuer, clientID string, d datastore.Deployment) error {
+	if _, err := s.FindDeployment(issuer, clientID, d.DeploymentID); err != nil {
+		return err
+	}
+
+	s.Deployments.Store(deploymentIndex(issuer, clientID, d.DeploymentID), d)
+	return nil
+}
+
+// DeleteDeployment removes an in-memory Deployment.
+func (s *Store) DeleteDeployment(issuer, clientID, deploymentID string) error {
+	if _, err := s.FindDeployment(issuer, clientID, deploymentID); err != nil {
+		return err
+	}
+
+	s.Deployments.Delete(deploymentIndex(issuer, clientID, deploymentID))
+	return nil
+}
+
 // StoreNonce stores a Nonce in-memory. Since the nonce and target_link_uri values have similarly scoped verifications
-// required, use the the unique nonce value as a key to store the target_link_uri value. This is used to verify the OIDC
-// login request target_link_uri is the same as the claim of the same name in the launch id_token.
-func (s *Store) StoreNonce(nonce, targetLinkURI string) error {
-	if nonce == "" {
+// required, use the the unique nonce value as a key to store the nonce. This is used to verify the OIDC login request
+// target_link_uri is the same as the claim of the same name in the launch id_token. Storing a nonce also sweeps out
+// expired nonces from abandoned logins, at most once per minute.
+func (s *Store) StoreNonce(nonce datastore.Nonce) error {
+	if nonce.Value == "" {
 		return errors.New("received empty nonce argument")
 	}
-	if targetLinkURI == "" {
-		return errors.New("received empty issuer argument")
+	if nonce.TargetLinkURI == "" {
+		return errors.New("received empty target link uri argument")
+	}
+
+	now := time.Now()
+	if nonce.IssuedAt.IsZero() {
+		nonce.IssuedAt = now
+	}
+	if nonce.MaxAge <= 0 {
+		nonce.MaxAge = datastore.DefaultNonceMaxAge
 	}
 
-	s.Nonces.Store(nonce, targetLinkURI)
+	if s.nonceSweep.Due(now) {
+		s.PurgeExpiredNonces(now)
+	}
+	s.Nonces.Store(nonce.Value, nonce)
 	return nil
 }
 
-// TestAndClearNonce looks up a nonce, clears the entry if found, and returns whether it was found via the error
-// return. If the nonce wasn't found, it returns the datastore error ErrNonceNotFound. If it was found, it returns nil.
+// TestAndClearNonce looks up a nonce, clears the entry if found, and returns whether it was valid via the error return.
+// If the nonce wasn't found, it returns the datastore error ErrNonceNotFound; if it is stale, ErrNonceExpired. If it
+// was found and valid, it returns nil.
 func (s *Store) TestAndClearNonce(nonce, targetLinkURI string) error {
 	if nonce == "" {
 		return errors.New("received empty nonce argument")
@@ -139,20 +281,103 @@ func (s *Store) TestAndClearNonce(nonce, targetLinkURI string) error {
 		return errors.New("received empty target link uri argument")
 	}
 
-	checkURI, ok := s.Nonces.Load(nonce)
+	storeValue, ok := s.Nonces.LoadAndDelete(nonce)
 	if !ok {
 		return datastore.ErrNonceNotFound
 	}
+	storedNonce := storeValue.(datastore.Nonce)
 
-	s.Nonces.Delete(nonce)
-
-	if checkURI != targetLinkURI {
+	if nonceExpired(storedNonce, time.Now()) {
+		return datastore.ErrNonceExpired
+	}
+	if storedNonce.TargetLinkURI != targetLinkURI {
 		return datastore.ErrNonceTargetLinkURIMismatch
 	}
 
 	return nil
 }
 
+func nonceExpired(nonce datastore.Nonce, now time.Time) bool {
+	return !nonce.IssuedAt.Add(nonce.MaxAge).After(now)
+}
+
+// PurgeExpiredNonces removes the nonces that expired before `now' and returns the number of nonces removed. The store
+// purges itself when nonces are stored, but PurgeExpiredNonces can also be run by a datastore.Janitor.
+func (s *Store) PurgeExpiredNonces(now time.Time) (int, error) {
+	purged := 0
+	s.Nonces.Range(func(key, value interface{}) bool {
+		if nonceExpired(value.(datastore.Nonce), now) {
+			s.Nonces.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
+}
+
+func tokenIDIndex(issuer, tokenID string) string {
+	return issuer + "/" + tokenID
+}
+
+// TestAndSetTokenID records an id_token as used until it expires. If the token is already recorded and unexpired, it
+// returns ErrTokenReplayed. Recording a token also sweeps out expired tokens, at most once per minute.
+func (s *Store) TestAndSetTokenID(issuer, tokenID string, expiresAt time.Time) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+	if tokenID == "" {
+		return errors.New("received empty token ID argument")
+	}
+
+	now := time.Now()
+	if s.tokenIDSweep.Due(now) {
+		s.PurgeExpiredTokenIDs(now)
+	}
+
+	index := tokenIDIndex(issuer, tokenID)
+
+	s.tokenIDsMu.Lock()
+	storeValue, ok := s.TokenIDs.Load(index)
+	if ok && storeValue.(time.Time).After(now) {
+		s.tokenIDsMu.Unlock()
+		return datastore.ErrTokenReplayed
+	}
+	s.TokenIDs.Store(index, expiresAt)
+	s.tokenIDsMu.Unlock()
+
+	return nil
+}
+
+// PurgeExpiredTokenIDs removes the recorded id_tokens that expired before `now' and returns the number removed.
+func (s *Store) PurgeExpiredTokenIDs(now time.Time) (int, error) {
+	// Hold the lock so that a token recorded again during the purge is not removed.
+	s.tokenIDsMu.Lock()
+	defer s.tokenIDsMu.Unlock()
+
+	purged := 0
+	s.TokenIDs.Range(func(key, value interface{}) bool {
+		if !value.(time.Time).After(now) {
+			s.TokenIDs.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
+}
+
+// launchDataEntry is the launch data held in-memory together with its creation time.
+type launchDataEntry struct {
+	launchData json.RawMessage
+	createdAt  time.Time
+}
+
+// expired reports whether the entry has outlived the store's TTL at time `now'.
+func (s *Store) expired(entry launchDataEntry, now time.Time) bool {
+	return s.LaunchDataTTL > 0 && !entry.createdAt.Add(s.LaunchDataTTL).After(now)
+}
+
 // StoreLaunchData stores the launch data, i.e. the id_token JWT.
 func (s *Store) StoreLaunchData(launchID string, launchData json.RawMessage) error {
 	if launchID == "" {
@@ -162,27 +387,56 @@ func (s *Store) StoreLaunchData(launchID string, launchData json.RawMessage) err
 		return errors.New("received empty launchData argument")
 	}
 
-	s.LaunchData.Store(launchID, launchData)
+	s.LaunchData.Store(launchID, launchDataEntry{launchData: launchData, createdAt: time.Now()})
 	return nil
 }
 
-// FindLaunchData retrieves a cached launchData.
+// FindLaunchData retrieves a cached launchData. Expired launch data is removed and reported as ErrLaunchDataNotFound.
 func (s *Store) FindLaunchData(launchID string) (json.RawMessage, error) {
 	if launchID == "" {
 		return nil, errors.New("received empty launchID argument")
 	}
 
-	launchData, ok := s.LaunchData.Load(launchID)
+	storeValue, ok := s.LaunchData.Load(launchID)
 	if !ok {
 		return nil, datastore.ErrLaunchDataNotFound
 	}
-	return launchData.(json.RawMessage), nil
+	entry := storeValue.(launchDataEntry)
+	if s.expired(entry, time.Now()) {
+		s.LaunchData.Delete(launchID)
+		return nil, datastore.ErrLaunchDataNotFound
+	}
+
+	return entry.launchData, nil
+}
+
+// PurgeExpiredLaunchData removes the launch data that expired before `now' and returns the number of entries removed.
+// It is a datastore.PurgeFunc meant to be run by a datastore.Janitor.
+func (s *Store) PurgeExpiredLaunchData(now time.Time) (int, error) {
+	purged := 0
+	s.LaunchData.Range(func(key, value interface{}) bool {
+		if s.expired(value.(launchDataEntry), now) {
+			s.LaunchData.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
 }
 
 func accessTokenIndex(tokenURI, clientID string, scopes []string) string {
 	return tokenURI + clientID + strings.Join(scopes[:], " ")
 }
 
+// sortedScopes returns a sorted copy of `scopes'.
+func sortedScopes(scopes []string) []string {
+	sorted := make([]string, len(scopes))
+	copy(sorted, scopes)
+	sort.Strings(sorted)
+	return sorted
+}
+
 // StoreAccessToken stores bearer tokens for potential reuse.
 func (s *Store) StoreAccessToken(token datastore.AccessToken) error {
 	if token.TokenURI == "" {
@@ -202,18 +456,16 @@ func (s *Store) StoreAccessToken(token datastore.AccessToken) error {
 		return errors.New("received empty expiry time")
 	}
 
-	sort.Strings(token.Scopes)
-
-	storeValue, err := json.Marshal(token)
-	if err != nil {
-		return fmt.Errorf("error encoding access token to store: %w", err)
-	}
+	token.Scopes = sortedScopes(token.Scopes)
 
-	s.AccessTokens.Store(accessTokenIndex(token.TokenURI, token.ClientID, token.Scopes), storeValue)
+	s.accessTokensMu.Lock()
+	defer s.accessTokensMu.Unlock()
+	s.AccessTokens.Store(accessTokenIndex(token.TokenURI, token.ClientID, token.Scopes), token)
 	return nil
 }
 
-// FindAccessToken retrieves bearer tokens for potential reuse.
+// FindAccessToken retrieves bearer tokens for potential reuse. A token whose scopes include `scopes' qualifies, and the
+// one that expires last is returned.
 func (s *Store) FindAccessToken(tokenURI, clientID string, scopes []string) (datastore.AccessToken, error) {
 	if tokenURI == "" {
 		return datastore.AccessToken{}, errors.New("received empty tokenURI")
@@ -225,24 +477,212 @@ func (s *Store) FindAccessToken(tokenURI, clientID string, scopes []string) (dat
 		return datastore.AccessToken{}, errors.New("received empty scopes")
 	}
 
-	index := accessTokenIndex(tokenURI, clientID, scopes)
-	storeValue, ok := s.AccessTokens.Load(index)
-	if !ok {
+	var (
+		found   datastore.AccessToken
+		expired bool
+		now     = time.Now()
+	)
+	s.AccessTokens.Range(func(key, value interface{}) bool {
+		token, ok := value.(datastore.AccessToken)
+		if !ok || token.TokenURI != tokenURI || token.ClientID != clientID || !token.HasScopes(scopes) {
+			return true
+		}
+		if token.ExpiryTime.Before(now) {
+			expired = true
+			return true
+		}
+		if token.ExpiryTime.After(found.ExpiryTime) {
+			found = token
+		}
+		return true
+	})
+
+	if found.Token == "" {
+		if expired {
+			return datastore.AccessToken{}, datastore.ErrAccessTokenExpired
+		}
 		return datastore.AccessToken{}, datastore.ErrAccessTokenNotFound
 	}
-	storeBytes, ok := storeValue.([]byte)
+	found.Scopes = sortedScopes(found.Scopes)
+
+	return found, nil
+}
+
+// DeleteAccessToken deletes the bearer token stored for the token URI, client ID and scopes of `token', if it is still
+// `token.Token'.
+func (s *Store) DeleteAccessToken(token datastore.AccessToken) error {
+	index := accessTokenIndex(token.TokenURI, token.ClientID, sortedScopes(token.Scopes))
+
+	s.accessTokensMu.Lock()
+	defer s.accessTokensMu.Unlock()
+	value, ok := s.AccessTokens.Load(index)
 	if !ok {
-		return datastore.AccessToken{}, errors.New("could not assert access token")
+		return nil
+	}
+	if stored, ok := value.(datastore.AccessToken); ok && stored.Token == token.Token {
+		s.AccessTokens.Delete(index)
 	}
 
-	var accessToken datastore.AccessToken
-	err := json.Unmarshal(storeBytes, &accessToken)
-	if err != nil {
-		return datastore.AccessToken{}, fmt.Errorf("could not decode access token: %w", err)
+	return nil
+}
+
+// StoreSession stores a tool session in-memory.
+func (s *Store) StoreSession(session datastore.Session) error {
+	if session.ID == "" {
+		return errors.New("received empty session ID")
+	}
+	if session.LaunchID == "" {
+		return errors.New("received empty launch ID")
 	}
-	if accessToken.ExpiryTime.Before(time.Now()) {
-		return datastore.AccessToken{}, datastore.ErrAccessTokenExpired
+	if session.ExpiresAt.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	s.Sessions.Store(session.ID, session)
+	return nil
+}
+
+// FindSession retrieves a tool session. Expired sessions are removed and reported as ErrSessionExpired.
+func (s *Store) FindSession(sessionID string) (datastore.Session, error) {
+	if sessionID == "" {
+		return datastore.Session{}, errors.New("received empty session ID")
 	}
 
-	return accessToken, nil
+	storeValue, ok := s.Sessions.Load(sessionID)
+	if !ok {
+		return datastore.Session{}, datastore.ErrSessionNotFound
+	}
+	session := storeValue.(datastore.Session)
+	if session.ExpiresAt.Before(time.Now()) {
+		s.Sessions.Delete(sessionID)
+		return datastore.Session{}, datastore.ErrSessionExpired
+	}
+
+	return session, nil
+}
+
+// DeleteSession removes a tool session.
+func (s *Store) DeleteSession(sessionID string) error {
+	if sessionID == "" {
+		return errors.New("received empty session ID")
+	}
+
+	s.Sessions.Delete(sessionID)
+	return nil
+}
+
+// PurgeExpiredSessions removes the sessions that expired before `now' and returns the number of sessions removed. It
+// is a datastore.PurgeFunc meant to be run by a datastore.Janitor.
+func (s *Store) PurgeExpiredSessions(now time.Time) (int, error) {
+	purged := 0
+	s.Sessions.Range(func(key, value interface{}) bool {
+		if value.(datastore.Session).ExpiresAt.Before(now) {
+			s.Sessions.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
+}
+
+// StoreHandoffCode stores a hand-off code in-memory.
+func (s *Store) StoreHandoffCode(code datastore.HandoffCode) error {
+	if code.Code == "" {
+		return errors.New("received empty hand-off code")
+	}
+	if code.LaunchID == "" {
+		return errors.New("received empty launch ID")
+	}
+	if code.ExpiresAt.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	s.HandoffCodes.Store(code.Code, code)
+	return nil
+}
+
+// TestAndClearHandoffCode looks up a hand-off code and removes it in a single step.
+func (s *Store) TestAndClearHandoffCode(code string) (datastore.HandoffCode, error) {
+	if code == "" {
+		return datastore.HandoffCode{}, errors.New("received empty hand-off code")
+	}
+
+	storeValue, ok := s.HandoffCodes.LoadAndDelete(code)
+	if !ok {
+		return datastore.HandoffCode{}, datastore.ErrHandoffCodeNotFound
+	}
+	handoffCode := storeValue.(datastore.HandoffCode)
+	if handoffCode.ExpiresAt.Before(time.Now()) {
+		return datastore.HandoffCode{}, datastore.ErrHandoffCodeExpired
+	}
+
+	return handoffCode, nil
+}
+
+// PurgeExpiredHandoffCodes removes the hand-off codes that expired before `now' and returns the number of codes
+// removed. It is a datastore.PurgeFunc meant to be run by a datastore.Janitor, since codes that are never exchanged
+// are otherwise kept forever.
+func (s *Store) PurgeExpiredHandoffCodes(now time.Time) (int, error) {
+	purged := 0
+	s.HandoffCodes.Range(func(key, value interface{}) bool {
+		if value.(datastore.HandoffCode).ExpiresAt.Before(now) {
+			s.HandoffCodes.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
+}
+
+// StoreHandoffToken stores a hand-off access token in-memory.
+func (s *Store) StoreHandoffToken(token datastore.HandoffToken) error {
+	if token.Token == "" {
+		return errors.New("received empty hand-off token")
+	}
+	if token.LaunchID == "" {
+		return errors.New("received empty launch ID")
+	}
+	if token.ExpiresAt.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	s.HandoffTokens.Store(token.Token, token)
+	return nil
+}
+
+// FindHandoffToken retrieves a hand-off access token. Expired tokens are removed and reported as
+// ErrHandoffTokenExpired.
+func (s *Store) FindHandoffToken(token string) (datastore.HandoffToken, error) {
+	if token == "" {
+		return datastore.HandoffToken{}, errors.New("received empty hand-off token")
+	}
+
+	storeValue, ok := s.HandoffTokens.Load(token)
+	if !ok {
+		return datastore.HandoffToken{}, datastore.ErrHandoffTokenNotFound
+	}
+	handoffToken := storeValue.(datastore.HandoffToken)
+	if handoffToken.ExpiresAt.Before(time.Now()) {
+		s.HandoffTokens.Delete(token)
+		return datastore.HandoffToken{}, datastore.ErrHandoffTokenExpired
+	}
+
+	return handoffToken, nil
+}
+
+// PurgeExpiredHandoffTokens removes the hand-off access tokens that expired before `now' and returns the number of
+// tokens removed. It is a datastore.PurgeFunc meant to be run by a datastore.Janitor.
+func (s *Store) PurgeExpiredHandoffTokens(now time.Time) (int, error) {
+	purged := 0
+	s.HandoffTokens.Range(func(key, value interface{}) bool {
+		if value.(datastore.HandoffToken).ExpiresAt.Before(now) {
+			s.HandoffTokens.Delete(key)
+			purged++
+		}
+		return true
+	})
+
+	return purged, nil
 }
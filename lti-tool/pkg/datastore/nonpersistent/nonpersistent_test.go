@@ -6,6 +6,8 @@
 package nonpersistent
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"reflect"
 	"testing"
@@ -76,27 +78,33 @@ func TestStoreAndFindRegistrationByIssuer(t *testing.T) {
 
 func TestStoreAndFindDeploymentByDeploymentID(t *testing.T) {
 	issuer := "test-issuer"
+	clientID := "test-client"
 	deploymentID := "1"
 	expected := datastore.Deployment{DeploymentID: deploymentID}
 
 	npStore := New()
 
-	err := npStore.StoreDeployment("", datastore.Deployment{DeploymentID: deploymentID})
+	err := npStore.StoreDeployment("", clientID, datastore.Deployment{DeploymentID: deploymentID})
 	if err == nil {
 		t.Error("error not reported for empty issuer")
 	}
 
-	err = npStore.StoreDeployment(issuer, datastore.Deployment{DeploymentID: ""})
+	err = npStore.StoreDeployment(issuer, "", datastore.Deployment{DeploymentID: deploymentID})
+	if err == nil {
+		t.Error("error not reported for empty client ID")
+	}
+
+	err = npStore.StoreDeployment(issuer, clientID, datastore.Deployment{DeploymentID: ""})
 	if err == nil {
 		t.Error("error not reported for empty deployment ID")
 	}
 
-	err = npStore.StoreDeployment(issuer, datastore.Deployment{DeploymentID: deploymentID})
+	err = npStore.StoreDeployment(issuer, clientID, datastore.Deployment{DeploymentID: deploymentID})
 	if err != nil {
 		t.Fatalf("store deployment error: %v", err)
 	}
 
-	actual, err := npStore.FindDeployment(issuer, deploymentID)
+	actual, err := npStore.FindDeployment(issuer, clientID, deploymentID)
 	if err != nil {
 		t.Fatalf("find deployment error: %v", err)
 	}
@@ -106,58 +114,278 @@ func TestStoreAndFindDeploymentByDeploymentID(t *testing.T) {
 		t.Fatal("found deployment does not match stored deployment")
 	}
 
-	_, err = npStore.FindDeployment("", deploymentID)
+	_, err = npStore.FindDeployment("", clientID, deploymentID)
 	if err == nil {
 		t.Error("error not reported for empty issuer")
 	}
 
-	_, err = npStore.FindDeployment(issuer, "")
+	_, err = npStore.FindDeployment(issuer, clientID, "")
 	if err == nil {
 		t.Error("error not reported for invalid deployment ID")
 	}
 
-	_, err = npStore.FindDeployment(issuer, "unknown"+deploymentID)
+	_, err = npStore.FindDeployment(issuer, clientID, "unknown"+deploymentID)
 	if err != datastore.ErrDeploymentNotFound {
 		t.Error("unexpected error value for nonexistent deployment")
 	}
+
+	// A deployment is only valid for the client it was stored for.
+	_, err = npStore.FindDeployment(issuer, "other-client", deploymentID)
+	if err != datastore.ErrDeploymentNotFound {
+		t.Error("deployment found for another client of the issuer")
+	}
+}
+
+// Test listing, updating and deleting registrations, and the lookup of an issuer with several registrations.
+func TestRegistrationLifecycle(t *testing.T) {
+	keysetURI, _ := url.Parse("https://domain.tld/keyset")
+	rotatedKeysetURI, _ := url.Parse("https://domain.tld/keyset/rotated")
+	first := datastore.Registration{Issuer: "https://issuer", ClientID: "a", KeysetURI: keysetURI}
+	second := datastore.Registration{Issuer: "https://issuer", ClientID: "b", KeysetURI: keysetURI}
+	other := datastore.Registration{Issuer: "https://other-issuer", ClientID: "a", KeysetURI: keysetURI}
+
+	npStore := New()
+	for _, reg := range []datastore.Registration{second, other, first} {
+		if err := npStore.StoreRegistration(reg); err != nil {
+			t.Fatalf("store registration error: %v", err)
+		}
+	}
+
+	all, err := npStore.ListRegistrations("")
+	if err != nil {
+		t.Fatalf("list registrations error: %v", err)
+	}
+	if !reflect.DeepEqual(all, []datastore.Registration{first, second, other}) {
+		t.Fatalf("got %v, wanted registrations ordered by issuer and client ID", all)
+	}
+
+	issuerRegistrations, err := npStore.ListRegistrations(first.Issuer)
+	if err != nil {
+		t.Fatalf("list registrations error: %v", err)
+	}
+	if len(issuerRegistrations) != 2 {
+		t.Fatalf("got %d registrations for issuer, wanted 2", len(issuerRegistrations))
+	}
+
+	_, err = npStore.FindRegistrationByIssuerAndClientID(first.Issuer, "")
+	if err != datastore.ErrAmbiguousRegistration {
+		t.Fatalf("got %v, wanted ErrAmbiguousRegistration", err)
+	}
+	found, err := npStore.FindRegistrationByIssuerAndClientID(other.Issuer, "")
+	if err != nil || found != other {
+		t.Fatalf("got %v and error %v, wanted the issuer's only registration", found, err)
+	}
+
+	rotated := first
+	rotated.KeysetURI = rotatedKeysetURI
+	if err := npStore.UpdateRegistration(rotated); err != nil {
+		t.Fatalf("update registration error: %v", err)
+	}
+	found, err = npStore.FindRegistrationByIssuerAndClientID(first.Issuer, first.ClientID)
+	if err != nil || found.KeysetURI != rotatedKeysetURI {
+		t.Fatalf("got %v and error %v, wanted the updated registration", found, err)
+	}
+
+	unknown := first
+	unknown.ClientID = "unknown"
+	if err := npStore.UpdateRegistration(unknown); err != datastore.ErrRegistrationNotFound {
+		t.Fatalf("update of unknown registration: got %v, wanted ErrRegistrationNotFound", err)
+	}
+
+	if err := npStore.DeleteRegistration(second.Issuer, second.ClientID); err != nil {
+		t.Fatalf("delete registration error: %v", err)
+	}
+	if err := npStore.DeleteRegistration(second.Issuer, second.ClientID); err != datastore.ErrRegistrationNotFound {
+		t.Fatalf("second delete: got %v, wanted ErrRegistrationNotFound", err)
+	}
+	found, err = npStore.FindRegistrationByIssuerAndClientID(first.Issuer, "")
+	if err != nil || found.ClientID != first.ClientID {
+		t.Fatalf("got %v and error %v, wanted the remaining registration", found, err)
+	}
+}
+
+// Test listing, updating and deleting deployments.
+func TestDeploymentLifecycle(t *testing.T) {
+	npStore := New()
+	for _, id := range []string{"2", "1"} {
+		if err := npStore.StoreDeployment("https://issuer", "a", datastore.Deployment{DeploymentID: id}); err != nil {
+			t.Fatalf("store deployment error: %v", err)
+		}
+	}
+	// Neither another client of the issuer nor an issuer whose index shares a prefix may share the deployments.
+	if err := npStore.StoreDeployment("https://issuer", "b", datastore.Deployment{DeploymentID: "3"}); err != nil {
+		t.Fatalf("store deployment error: %v", err)
+	}
+	if err := npStore.StoreDeployment("https://issuer/a", "2", datastore.Deployment{DeploymentID: "4"}); err != nil {
+		t.Fatalf("store deployment error: %v", err)
+	}
+
+	deployments, err := npStore.ListDeployments("https://issuer", "a")
+	if err != nil {
+		t.Fatalf("list deployments error: %v", err)
+	}
+	expected := []datastore.Deployment{{DeploymentID: "1"}, {DeploymentID: "2"}}
+	if !reflect.DeepEqual(deployments, expected) {
+		t.Fatalf("got %v, wanted %v", deployments, expected)
+	}
+
+	if _, err := npStore.ListDeployments("", "a"); err == nil {
+		t.Error("error not reported for empty issuer")
+	}
+
+	if err := npStore.UpdateDeployment("https://issuer", "a", datastore.Deployment{DeploymentID: "1"}); err != nil {
+		t.Fatalf("update deployment error: %v", err)
+	}
+	err = npStore.UpdateDeployment("https://issuer", "a", datastore.Deployment{DeploymentID: "unknown"})
+	if err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("update of unknown deployment: got %v, wanted ErrDeploymentNotFound", err)
+	}
+
+	if err := npStore.DeleteDeployment("https://issuer", "a", "1"); err != nil {
+		t.Fatalf("delete deployment error: %v", err)
+	}
+	if _, err := npStore.FindDeployment("https://issuer", "a", "1"); err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("got %v, wanted ErrDeploymentNotFound after delete", err)
+	}
+	if err := npStore.DeleteDeployment("https://issuer", "a", "1"); err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("second delete: got %v, wanted ErrDeploymentNotFound", err)
+	}
+
+	// Deleting a registration deletes its deployments.
+	keysetURI, _ := url.Parse("https://domain.tld/keyset")
+	if err := npStore.StoreRegistration(datastore.Registration{
+		Issuer:    "https://issuer",
+		ClientID:  "a",
+		KeysetURI: keysetURI,
+	}); err != nil {
+		t.Fatalf("store registration error: %v", err)
+	}
+	if err := npStore.DeleteRegistration("https://issuer", "a"); err != nil {
+		t.Fatalf("delete registration error: %v", err)
+	}
+	if _, err := npStore.FindDeployment("https://issuer", "a", "2"); err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("got %v, wanted ErrDeploymentNotFound after deleting the registration", err)
+	}
+	if _, err := npStore.FindDeployment("https://issuer", "b", "3"); err != nil {
+		t.Fatalf("deployment of another registration deleted: %v", err)
+	}
 }
 
 func TestStoreAndTestAndClearNonce(t *testing.T) {
-	issuer := "test-issuer"
+	targetLinkURI := "https://tool.tld/launch"
 	nonce := "dGVzdC1ub25jZQ=="
 
 	npStore := New()
 
-	err := npStore.StoreNonce("", issuer)
+	err := npStore.StoreNonce(datastore.Nonce{TargetLinkURI: targetLinkURI})
 	if err == nil {
 		t.Error("error not reported for empty nonce")
 	}
 
-	err = npStore.StoreNonce(nonce, "")
+	err = npStore.StoreNonce(datastore.Nonce{Value: nonce})
 	if err == nil {
-		t.Error("error not report for empty issuer")
+		t.Error("error not report for empty target link uri")
 	}
 
-	err = npStore.StoreNonce(nonce, issuer)
+	err = npStore.StoreNonce(datastore.Nonce{Value: nonce, TargetLinkURI: targetLinkURI})
 	if err != nil {
 		t.Fatalf("store nonce error: %v", err)
 	}
 
-	err = npStore.TestAndClearNonce(nonce, issuer)
+	err = npStore.TestAndClearNonce(nonce, targetLinkURI)
 	if err != nil {
 		t.Fatalf("test and clear nonce error: %v", err)
 	}
 
 	// Test the double-clearing of the nonce.
-	err = npStore.TestAndClearNonce(nonce, issuer)
+	err = npStore.TestAndClearNonce(nonce, targetLinkURI)
 	if err != datastore.ErrNonceNotFound {
 		t.Fatalf("test and clear nonce error: %v", err)
 	}
 
-	err = npStore.TestAndClearNonce("unknown"+nonce, issuer)
+	err = npStore.TestAndClearNonce("unknown"+nonce, targetLinkURI)
 	if err != datastore.ErrNonceNotFound {
 		t.Error("unexpected error value for nonexistent nonce")
 	}
+
+	npStore.StoreNonce(datastore.Nonce{Value: nonce, TargetLinkURI: targetLinkURI})
+	err = npStore.TestAndClearNonce(nonce, "https://tool.tld/other")
+	if err != datastore.ErrNonceTargetLinkURIMismatch {
+		t.Errorf("got %v, wanted ErrNonceTargetLinkURIMismatch", err)
+	}
+}
+
+func TestNonceExpiry(t *testing.T) {
+	targetLinkURI := "https://tool.tld/launch"
+	npStore := New()
+
+	err := npStore.StoreNonce(datastore.Nonce{
+		Value:         "stale",
+		TargetLinkURI: targetLinkURI,
+		IssuedAt:      time.Now().Add(-time.Hour),
+		MaxAge:        time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("store nonce error: %v", err)
+	}
+	err = npStore.TestAndClearNonce("stale", targetLinkURI)
+	if err != datastore.ErrNonceExpired {
+		t.Fatalf("got %v, wanted ErrNonceExpired", err)
+	}
+
+	// Nonces from abandoned logins are purged.
+	npStore.StoreNonce(datastore.Nonce{
+		Value:         "abandoned",
+		TargetLinkURI: targetLinkURI,
+		IssuedAt:      time.Now().Add(-2 * datastore.DefaultNonceMaxAge),
+	})
+	npStore.StoreNonce(datastore.Nonce{Value: "fresh", TargetLinkURI: targetLinkURI})
+	purged, err := npStore.PurgeExpiredNonces(time.Now())
+	if err != nil {
+		t.Fatalf("purge nonces error: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("got %d purged nonces, wanted 1", purged)
+	}
+	if err := npStore.TestAndClearNonce("fresh", targetLinkURI); err != nil {
+		t.Fatalf("unexpired nonce was purged: %v", err)
+	}
+}
+
+func TestTestAndSetTokenID(t *testing.T) {
+	issuer := "https://platform.tld"
+	npStore := New()
+
+	err := npStore.TestAndSetTokenID(issuer, "", time.Now().Add(time.Hour))
+	if err == nil {
+		t.Error("error not reported for empty token ID")
+	}
+
+	err = npStore.TestAndSetTokenID(issuer, "jti-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("test and set token ID error: %v", err)
+	}
+	err = npStore.TestAndSetTokenID(issuer, "jti-1", time.Now().Add(time.Hour))
+	if err != datastore.ErrTokenReplayed {
+		t.Fatalf("got %v, wanted ErrTokenReplayed", err)
+	}
+
+	// The same token ID from another issuer is a different token.
+	err = npStore.TestAndSetTokenID("https://other.tld", "jti-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("test and set token ID error for other issuer: %v", err)
+	}
+
+	// Expired tokens are forgotten.
+	npStore.TestAndSetTokenID(issuer, "jti-2", time.Now().Add(-time.Minute))
+	err = npStore.TestAndSetTokenID(issuer, "jti-2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("got %v, wanted expired token to be accepted", err)
+	}
+	purged, _ := npStore.PurgeExpiredTokenIDs(time.Now().Add(2 * time.Hour))
+	if purged != 3 {
+		t.Fatalf("got %d purged token IDs, wanted 3", purged)
+	}
 }
 
 func TestStoreAccessToken(t *testing.T) {
@@ -265,3 +493,273 @@ func TestFindAccessToken(t *testing.T) {
 		t.Fatal("found token does not match test token")
 	}
 }
+
+// Test that a token covering more scopes is found, and that deleting a token keeps a newer one.
+func TestFindSupersetAndDeleteAccessToken(t *testing.T) {
+	token := datastore.AccessToken{
+		TokenURI:   "https://domain.tld/token",
+		ClientID:   "abcdef123456",
+		Scopes:     []string{"https://scope/2", "https://scope/1"},
+		Token:      "token-1",
+		ExpiryTime: time.Now().Add(time.Hour),
+	}
+	npStore := New()
+	npStore.StoreAccessToken(token)
+	narrow := token
+	narrow.Scopes = []string{"https://scope/1"}
+	narrow.Token = "token-2"
+	narrow.ExpiryTime = time.Now().Add(time.Minute)
+	npStore.StoreAccessToken(narrow)
+
+	found, err := npStore.FindAccessToken(token.TokenURI, token.ClientID, []string{"https://scope/1"})
+	if err != nil || found.Token != "token-1" {
+		t.Fatalf("got %#v, %v, wanted the token that expires last", found, err)
+	}
+	if token.Scopes[0] != "https://scope/2" {
+		t.Fatalf("scopes of the stored token were sorted in place")
+	}
+	_, err = npStore.FindAccessToken(token.TokenURI, token.ClientID, []string{"https://scope/3"})
+	if err != datastore.ErrAccessTokenNotFound {
+		t.Fatalf("got %v, wanted ErrAccessTokenNotFound", err)
+	}
+
+	stale := token
+	stale.Token = "token-0"
+	npStore.DeleteAccessToken(stale)
+	if _, err = npStore.FindAccessToken(token.TokenURI, token.ClientID, token.Scopes); err != nil {
+		t.Fatalf("got %v, wanted the newer token to be kept", err)
+	}
+	npStore.DeleteAccessToken(token)
+	if _, err = npStore.FindAccessToken(token.TokenURI, token.ClientID, token.Scopes); err != datastore.ErrAccessTokenNotFound {
+		t.Fatalf("got %v, wanted ErrAccessTokenNotFound", err)
+	}
+}
+
+func TestStoreFindAndDeleteSession(t *testing.T) {
+	session := datastore.Session{
+		ID:        "session-1",
+		LaunchID:  "launch-1",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	npStore := New()
+
+	err := npStore.StoreSession(datastore.Session{LaunchID: "launch-1", ExpiresAt: session.ExpiresAt})
+	if err == nil {
+		t.Error("error not reported for empty session ID")
+	}
+
+	err = npStore.StoreSession(session)
+	if err != nil {
+		t.Fatalf("store session error: %v", err)
+	}
+
+	actual, err := npStore.FindSession(session.ID)
+	if err != nil {
+		t.Fatalf("find session error: %v", err)
+	}
+	if actual != session {
+		t.Fatal("found session does not match stored session")
+	}
+
+	err = npStore.DeleteSession(session.ID)
+	if err != nil {
+		t.Fatalf("delete session error: %v", err)
+	}
+	_, err = npStore.FindSession(session.ID)
+	if err != datastore.ErrSessionNotFound {
+		t.Fatalf("got %v, wanted ErrSessionNotFound", err)
+	}
+
+	session.ExpiresAt = time.Now().Add(-time.Minute)
+	npStore.StoreSession(session)
+	_, err = npStore.FindSession(session.ID)
+	if err != datastore.ErrSessionExpired {
+		t.Fatalf("got %v, wanted ErrSessionExpired", err)
+	}
+}
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	npStore := New()
+	for i, expiresAt := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Minute),
+		time.Now().Add(-time.Hour)} {
+		err := npStore.StoreSession(datastore.Session{
+			ID:        fmt.Sprintf("session-%d", i),
+			LaunchID:  "launch-1",
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatalf("store session error: %v", err)
+		}
+	}
+
+	purged, err := npStore.PurgeExpiredSessions(time.Now())
+	if err != nil {
+		t.Fatalf("purge sessions error: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("got %d purged sessions, wanted 2", purged)
+	}
+	if _, err := npStore.FindSession("session-0"); err != nil {
+		t.Fatalf("find session error: %v", err)
+	}
+}
+
+func TestStoreAndTestAndClearHandoffCode(t *testing.T) {
+	code := datastore.HandoffCode{
+		Code:      "code-1",
+		LaunchID:  "launch-1",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	npStore := New()
+
+	err := npStore.StoreHandoffCode(datastore.HandoffCode{LaunchID: "launch-1", ExpiresAt: code.ExpiresAt})
+	if err == nil {
+		t.Error("error not reported for empty hand-off code")
+	}
+
+	err = npStore.StoreHandoffCode(code)
+	if err != nil {
+		t.Fatalf("store hand-off code error: %v", err)
+	}
+
+	actual, err := npStore.TestAndClearHandoffCode(code.Code)
+	if err != nil {
+		t.Fatalf("test and clear hand-off code error: %v", err)
+	}
+	if actual != code {
+		t.Fatal("found hand-off code does not match stored hand-off code")
+	}
+
+	_, err = npStore.TestAndClearHandoffCode(code.Code)
+	if err != datastore.ErrHandoffCodeNotFound {
+		t.Fatalf("got %v, wanted ErrHandoffCodeNotFound for a used code", err)
+	}
+
+	code.ExpiresAt = time.Now().Add(-time.Minute)
+	npStore.StoreHandoffCode(code)
+	_, err = npStore.TestAndClearHandoffCode(code.Code)
+	if err != datastore.ErrHandoffCodeExpired {
+		t.Fatalf("got %v, wanted ErrHandoffCodeExpired", err)
+	}
+}
+
+func TestStoreAndFindHandoffToken(t *testing.T) {
+	token := datastore.HandoffToken{
+		Token:     "token-1",
+		LaunchID:  "launch-1",
+		Scopes:    []string{"launch"},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	npStore := New()
+
+	err := npStore.StoreHandoffToken(token)
+	if err != nil {
+		t.Fatalf("store hand-off token error: %v", err)
+	}
+
+	actual, err := npStore.FindHandoffToken(token.Token)
+	if err != nil {
+		t.Fatalf("find hand-off token error: %v", err)
+	}
+	if !reflect.DeepEqual(actual, token) {
+		t.Fatal("found hand-off token does not match stored hand-off token")
+	}
+
+	token.Token = "token-2"
+	token.ExpiresAt = time.Now().Add(-time.Minute)
+	npStore.StoreHandoffToken(token)
+	_, err = npStore.FindHandoffToken(token.Token)
+	if err != datastore.ErrHandoffTokenExpired {
+		t.Fatalf("got %v, wanted ErrHandoffTokenExpired", err)
+	}
+	_, err = npStore.FindHandoffToken(token.Token)
+	if err != datastore.ErrHandoffTokenNotFound {
+		t.Fatalf("got %v, wanted ErrHandoffTokenNotFound after expiry", err)
+	}
+}
+
+func TestPurgeExpiredHandoffs(t *testing.T) {
+	npStore := New()
+	for i, expiresAt := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Minute),
+		time.Now().Add(-time.Hour)} {
+		npStore.StoreHandoffCode(datastore.HandoffCode{
+			Code:      fmt.Sprintf("code-%d", i),
+			LaunchID:  "launch-1",
+			ExpiresAt: expiresAt,
+		})
+		npStore.StoreHandoffToken(datastore.HandoffToken{
+			Token:     fmt.Sprintf("token-%d", i),
+			LaunchID:  "launch-1",
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	purged, err := npStore.PurgeExpiredHandoffCodes(time.Now())
+	if err != nil {
+		t.Fatalf("purge hand-off codes error: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("got %d purged codes, wanted 2", purged)
+	}
+	purged, err = npStore.PurgeExpiredHandoffTokens(time.Now())
+	if err != nil {
+		t.Fatalf("purge hand-off tokens error: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("got %d purged tokens, wanted 2", purged)
+	}
+
+	if _, err := npStore.FindHandoffToken("token-0"); err != nil {
+		t.Fatalf("find hand-off token error: %v", err)
+	}
+	if _, err := npStore.TestAndClearHandoffCode("code-0"); err != nil {
+		t.Fatalf("test and clear hand-off code error: %v", err)
+	}
+}
+
+func TestStoreFindAndPurgeLaunchData(t *testing.T) {
+	launchData := json.RawMessage(`{"sub":"user-1"}`)
+	npStore := New()
+
+	err := npStore.StoreLaunchData("launch-1", launchData)
+	if err != nil {
+		t.Fatalf("store launch data error: %v", err)
+	}
+	npStore.LaunchData.Store("launch-old", launchDataEntry{
+		launchData: launchData,
+		createdAt:  time.Now().Add(-2 * datastore.DefaultLaunchDataTTL),
+	})
+	npStore.LaunchData.Store("launch-older", launchDataEntry{
+		launchData: launchData,
+		createdAt:  time.Now().Add(-3 * datastore.DefaultLaunchDataTTL),
+	})
+
+	actual, err := npStore.FindLaunchData("launch-1")
+	if err != nil {
+		t.Fatalf("find launch data error: %v", err)
+	}
+	if string(actual) != string(launchData) {
+		t.Fatalf("got %s, wanted %s", actual, launchData)
+	}
+
+	_, err = npStore.FindLaunchData("launch-old")
+	if err != datastore.ErrLaunchDataNotFound {
+		t.Fatalf("got %v, wanted ErrLaunchDataNotFound for expired launch data", err)
+	}
+
+	purged, err := npStore.PurgeExpiredLaunchData(time.Now())
+	if err != nil {
+		t.Fatalf("purge launch data error: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("got %d purged entries, wanted 1", purged)
+	}
+
+	// Without a TTL, launch data is kept forever.
+	npStore.LaunchDataTTL = 0
+	purged, _ = npStore.PurgeExpiredLaunchData(time.Now().Add(100 * datastore.DefaultLaunchDataTTL))
+	if purged != 0 {
+		t.Fatalf("got %d purged entries, wanted none without a TTL", purged)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package sql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Dialect adapts the Store's queries to a SQL database.
+type Dialect interface {
+	// Placeholder returns the bind parameter for the n-th (1-based) argument of a query.
+	Placeholder(n int) string
+
+	// QuoteIdentifier quotes a table or column name.
+	QuoteIdentifier(name string) string
+
+	// Upsert returns a statement that inserts a row of `columns' into `table' or, if a row with the same `keys'
+	// exists, updates its remaining columns. The statement takes the values of `columns', in order, as arguments. All
+	// names are already quoted. An empty statement means the database has no upsert syntax: the Store then looks the
+	// row up and updates or inserts it.
+	Upsert(table string, columns []string, keys []string) string
+}
+
+var (
+	// PostgreSQL is the dialect of PostgreSQL databases. It is the default dialect.
+	PostgreSQL Dialect = postgreSQLDialect{}
+
+	// SQLite is the dialect of SQLite databases, version 3.24 or later.
+	SQLite Dialect = sqliteDialect{}
+
+	// MySQL is the dialect of MySQL and MariaDB databases.
+	MySQL Dialect = mySQLDialect{}
+)
+
+type postgreSQLDialect struct{}
+
+func (postgreSQLDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgreSQLDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (d postgreSQLDialect) Upsert(table string, columns []string, keys []string) string {
+	return onConflictUpsert(d, table, columns, keys)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (sqliteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (d sqliteDialect) Upsert(table string, columns []string, keys []string) string {
+	return onConflictUpsert(d, table, columns, keys)
+}
+
+type mySQLDialect struct{}
+
+func (mySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (mySQLDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (d mySQLDialect) Upsert(table string, columns []string, keys []string) string {
+	updates := []string{}
+	for _, column := range nonKeyColumns(columns, keys) {
+		updates = append(updates, column+` = VALUES(`+column+`)`)
+	}
+	if len(updates) == 0 {
+		// Nothing to update: turn the duplicate insert into a no-op.
+		updates = append(updates, keys[0]+` = `+keys[0])
+	}
+
+	return insert(d, table, columns) + `
+                   ON DUPLICATE KEY UPDATE ` + strings.Join(updates, ", ")
+}
+
+// onConflictUpsert returns the INSERT ... ON CONFLICT upsert shared by PostgreSQL and SQLite.
+func onConflictUpsert(d Dialect, table string, columns []string, keys []string) string {
+	updates := []string{}
+	for _, column := range nonKeyColumns(columns, keys) {
+		updates = append(updates, column+` = excluded.`+column)
+	}
+
+	q := insert(d, table, columns) + `
+                   ON CONFLICT (` + strings.Join(keys, ", ") + `)`
+	if len(updates) == 0 {
+		return q + ` DO NOTHING`
+	}
+	return q + ` DO UPDATE SET ` + strings.Join(updates, ", ")
+}
+
+// insert returns an INSERT statement of `columns' into `table'.
+func insert(d Dialect, table string, columns []string) string {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = d.Placeholder(i + 1)
+	}
+
+	return `INSERT INTO ` + table + ` (` + strings.Join(columns, ",") + `)
+                   VALUES (` + strings.Join(placeholders, ", ") + `)`
+}
+
+func nonKeyColumns(columns []string, keys []string) []string {
+	nonKeys := []string{}
+	for _, column := range columns {
+		isKey := false
+		for _, key := range keys {
+			if column == key {
+				isKey = true
+				break
+			}
+		}
+		if !isKey {
+			nonKeys = append(nonKeys, column)
+		}
+	}
+	return nonKeys
+}
+
+var placeholderPattern = regexp.MustCompile(`\$[0-9]+`)
+
+// rebind rewrites the PostgreSQL-style placeholders ($1, $2, ...) of a query into the placeholders of the dialect.
+func rebind(d Dialect, q string) string {
+	if _, ok := d.(postgreSQLDialect); ok {
+		return q
+	}
+
+	return placeholderPattern.ReplaceAllStringFunc(q, func(placeholder string) string {
+		n, _ := strconv.Atoi(placeholder[1:])
+		return d.Placeholder(n)
+	})
+}
+
+// assignments returns `column = placeholder' terms for `columns', numbering the placeholders from `first', joined by
+// `separator'.
+func assignments(columns []string, first int, separator string) string {
+	terms := make([]string, len(columns))
+	for i, column := range columns {
+		terms[i] = column + ` = $` + strconv.Itoa(first+i)
+	}
+	return strings.Join(terms, separator)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package sql
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+)
+
+// Test the placeholders and identifier quoting of the built-in dialects.
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		dialect     Dialect
+		placeholder string
+		name        string
+		quoted      string
+		rebound     string
+	}{
+		{PostgreSQL, "$2", `a"b`, `"a""b"`, `WHERE "x" = $1 AND "y" = $2`},
+		{SQLite, "?", `a"b`, `"a""b"`, `WHERE "x" = ? AND "y" = ?`},
+		{MySQL, "?", "a`b", "`a``b`", `WHERE "x" = ? AND "y" = ?`},
+	}
+
+	for _, test := range tests {
+		if got := test.dialect.Placeholder(2); got != test.placeholder {
+			t.Errorf("%T: got placeholder %s, wanted %s", test.dialect, got, test.placeholder)
+		}
+		if got := test.dialect.QuoteIdentifier(test.name); got != test.quoted {
+			t.Errorf("%T: got identifier %s, wanted %s", test.dialect, got, test.quoted)
+		}
+		if got := rebind(test.dialect, `WHERE "x" = $1 AND "y" = $2`); got != test.rebound {
+			t.Errorf("%T: got query %s, wanted %s", test.dialect, got, test.rebound)
+		}
+	}
+}
+
+// Test the upsert statements of the built-in dialects.
+func TestDialectUpsert(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		keys    []string
+		upsert  string
+	}{
+		{PostgreSQL, []string{"k"},
+			"INSERT INTO t (k,v) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET v = excluded.v"},
+		{PostgreSQL, []string{"k", "v"},
+			"INSERT INTO t (k,v) VALUES ($1, $2) ON CONFLICT (k, v) DO NOTHING"},
+		{SQLite, []string{"k"},
+			"INSERT INTO t (k,v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v"},
+		{MySQL, []string{"k"},
+			"INSERT INTO t (k,v) VALUES (?, ?) ON DUPLICATE KEY UPDATE v = VALUES(v)"},
+		{MySQL, []string{"k", "v"},
+			"INSERT INTO t (k,v) VALUES (?, ?) ON DUPLICATE KEY UPDATE k = k"},
+	}
+
+	for _, test := range tests {
+		got := strings.Join(strings.Fields(test.dialect.Upsert("t", []string{"k", "v"}, test.keys)), " ")
+		if got != test.upsert {
+			t.Errorf("%T with keys %v: got %s, wanted %s", test.dialect, test.keys, got, test.upsert)
+		}
+	}
+}
+
+// Store registrations and deployments repeatedly, both with upsert statements and with the fallback for dialects
+// without them.
+func testUpsert(t *testing.T, db *sql.DB, config Config) {
+	_, err := NewMigrator(db, config).Up()
+	if err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+
+	store := New(db, config)
+	registration := newRegistrationForTesting(t)
+	for i := 0; i < 2; i++ {
+		err = store.StoreRegistration(registration)
+		if err != nil {
+			t.Fatalf("cannot store registration: %v", err)
+		}
+		err = store.StoreDeployment(registration.Issuer, registration.ClientID, datastore.Deployment{DeploymentID: "1"})
+		if err != nil {
+			t.Fatalf("cannot store deployment: %v", err)
+		}
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM deployment`).Scan(&count)
+	if err != nil {
+		t.Fatalf("cannot count deployments: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d deployments, wanted 1", count)
+	}
+
+	updated := newRegistrationForTesting(t)
+	updated.KeysetURI = mustParse(t, "http://updated")
+	err = store.StoreRegistration(updated)
+	if err != nil {
+		t.Fatalf("cannot update registration: %v", err)
+	}
+	found, err := store.FindRegistrationByIssuerAndClientID(updated.Issuer, updated.ClientID)
+	if err != nil {
+		t.Fatalf("cannot find registration: %v", err)
+	}
+	if found.KeysetURI.String() != "http://updated" {
+		t.Fatalf("got keyset URI %s, wanted http://updated", found.KeysetURI)
+	}
+
+	config.RejectRegistrationUpdates = true
+	store = New(db, config)
+	err = store.StoreRegistration(updated)
+	if err != nil {
+		t.Fatalf("storing an identical registration: got %v, wanted no error", err)
+	}
+	err = store.StoreRegistration(registration)
+	if err != datastore.ErrRegistrationExists {
+		t.Fatalf("got %v, wanted ErrRegistrationExists", err)
+	}
+
+	other := newRegistrationForTesting(t)
+	other.ClientID = "other"
+	err = store.StoreRegistration(other)
+	if err != nil {
+		t.Fatalf("cannot store new registration: %v", err)
+	}
+}
+
+func TestUpsertSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	testUpsert(t, db, config)
+}
+
+func TestUpsertFallback(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// SQLite without the upsert statements, as for the `ramsql' driver, whose parser cannot handle them.
+	config := NewConfig()
+	config.Dialect = ramsqlDialect{SQLite}
+	testUpsert(t, db, config)
+}
@@ -0,0 +1,753 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoMigrationApplied is the error returned when reverting a migration and none has been applied.
+var ErrNoMigrationApplied = errors.New("no migration applied")
+
+// A Migration is a versioned change to the database schema. Up applies the change and Down reverts it; each runs in
+// its own transaction together with the update of the migration table. Note that some databases, such as MySQL,
+// commit DDL statements implicitly, so a failed migration may have to be cleaned up by hand.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+	Down        func(tx *sql.Tx) error
+}
+
+// A MigrationStatus reports whether a migration has been applied and, if so, when.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// exec returns a migration step that executes the statements in order.
+func exec(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			_, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migrations returns the schema migrations for every table used by the Store, using the table and field names in
+// `config', quoted for its dialect. The DDL sticks to types shared by PostgreSQL, MySQL and SQLite: keys are
+// VARCHAR(255), long values TEXT, and times are stored as BIGINT Unix seconds.
+func Migrations(config Config) []Migration {
+	quote := config.dialect().QuoteIdentifier
+	dep := config.DeploymentFields
+	nonce, launchData := config.NonceFields, config.LaunchDataFields
+	accessToken, replay := config.AccessTokenFields, config.ReplayFields
+	handoffCode, handoffToken := config.HandoffCodeFields, config.HandoffTokenFields
+
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create registration and deployment tables",
+			Up: exec(
+				registrationTable(config),
+				`CREATE TABLE `+quote(config.DeploymentTable)+` (
+                   `+quote(dep.Issuer)+` VARCHAR(255) NOT NULL,
+                   `+quote(dep.DeploymentID)+` VARCHAR(255) NOT NULL,
+                   PRIMARY KEY (`+quote(dep.Issuer)+`, `+quote(dep.DeploymentID)+`)
+                 )`,
+			),
+			Down: exec(
+				`DROP TABLE `+quote(config.DeploymentTable),
+				`DROP TABLE `+quote(config.RegistrationTable),
+			),
+		},
+		{
+			Version:     2,
+			Description: "create nonce, launch data, access token and id_token replay tables",
+			Up: exec(
+				`CREATE TABLE `+quote(config.NonceTable)+` (
+                   `+quote(nonce.Nonce)+` VARCHAR(255) NOT NULL,
+                   `+quote(nonce.TargetLinkURI)+` TEXT NOT NULL,
+                   `+quote(nonce.IssuedAt)+` BIGINT NOT NULL,
+                   `+quote(nonce.ExpiresAt)+` BIGINT NOT NULL,
+                   PRIMARY KEY (`+quote(nonce.Nonce)+`)
+                 )`,
+				`CREATE TABLE `+quote(config.LaunchDataTable)+` (
+                   `+quote(launchData.LaunchID)+` VARCHAR(255) NOT NULL,
+                   `+quote(launchData.LaunchData)+` TEXT NOT NULL,
+                   `+quote(launchData.CreatedAt)+` BIGINT NOT NULL,
+                   PRIMARY KEY (`+quote(launchData.LaunchID)+`)
+                 )`,
+				// Scope lists can be too long for a portable key, so StoreAccessToken replaces tokens itself.
+				`CREATE TABLE `+quote(config.AccessTokenTable)+` (
+                   `+quote(accessToken.TokenURI)+` VARCHAR(255) NOT NULL,
+                   `+quote(accessToken.ClientID)+` VARCHAR(255) NOT NULL,
+                   `+quote(accessToken.Scopes)+` TEXT NOT NULL,
+                   `+quote(accessToken.Token)+` TEXT NOT NULL,
+                   `+quote(accessToken.ExpiryTime)+` BIGINT NOT NULL
+                 )`,
+				`CREATE TABLE `+quote(config.ReplayTable)+` (
+                   `+quote(replay.Issuer)+` VARCHAR(255) NOT NULL,
+                   `+quote(replay.TokenID)+` VARCHAR(255) NOT NULL,
+                   `+quote(replay.ExpiresAt)+` BIGINT NOT NULL,
+                   PRIMARY KEY (`+quote(replay.Issuer)+`, `+quote(replay.TokenID)+`)
+                 )`,
+			),
+			Down: exec(
+				`DROP TABLE `+quote(config.ReplayTable),
+				`DROP TABLE `+quote(config.AccessTokenTable),
+				`DROP TABLE `+quote(config.LaunchDataTable),
+				`DROP TABLE `+quote(config.NonceTable),
+			),
+		},
+		{
+			Version:     3,
+			Description: "create hand-off code and token tables",
+			Up: exec(
+				`CREATE TABLE `+quote(config.HandoffCodeTable)+` (
+                   `+quote(handoffCode.Code)+` VARCHAR(255) NOT NULL,
+                   `+quote(handoffCode.LaunchID)+` VARCHAR(255) NOT NULL,
+                   `+quote(handoffCode.ExpiresAt)+` BIGINT NOT NULL,
+                   PRIMARY KEY (`+quote(handoffCode.Code)+`)
+                 )`,
+				`CREATE TABLE `+quote(config.HandoffTokenTable)+` (
+                   `+quote(handoffToken.Token)+` VARCHAR(255) NOT NULL,
+                   `+quote(handoffToken.LaunchID)+` VARCHAR(255) NOT NULL,
+                   `+quote(handoffToken.Scopes)+` TEXT NOT NULL,
+                   `+quote(handoffToken.ExpiresAt)+` BIGINT NOT NULL,
+                   PRIMARY KEY (`+quote(handoffToken.Token)+`)
+                 )`,
+			),
+			Down: exec(
+				`DROP TABLE `+quote(config.HandoffTokenTable),
+				`DROP TABLE `+quote(config.HandoffCodeTable),
+			),
+		},
+		{
+			Version:     4,
+			Description: "scope deployments to registrations",
+			Up:          scopeDeployments(config),
+			Down:        unscopeDeployments(config),
+		},
+		{
+			Version:     5,
+			Description: "add deployment name, disabled flag, allowed contexts, features and metadata",
+			Up:          addDeploymentPolicy(config),
+			Down:        removeDeploymentPolicy(config),
+		},
+		{
+			Version:     6,
+			Description: "add registration provisioning policy and deployment pending flag and first-seen time",
+			Up:          addProvisioning(config),
+			Down:        removeProvisioning(config),
+		},
+	}
+}
+
+// scopeDeployments returns the migration step that adds the client ID of their registration to deployments. A
+// deployment whose issuer has a single registration is assigned to it. The others keep an empty client ID, which no
+// launch matches, until they are stored again for the right registration; Store.ListDeployments lists them.
+func scopeDeployments(config Config) func(tx *sql.Tx) error {
+	quote := config.dialect().QuoteIdentifier
+	reg, dep := config.RegistrationFields, config.DeploymentFields
+	table := quote(config.DeploymentTable)
+
+	return func(tx *sql.Tx) error {
+		err := addColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 4), 4)(tx)
+		if err != nil {
+			return err
+		}
+
+		registrations, err := selectRows(tx, `SELECT `+quote(reg.Issuer)+`,`+quote(reg.ClientID)+`
+                                                FROM `+quote(config.RegistrationTable), 2)
+		if err != nil {
+			return err
+		}
+		clientIDs := make(map[string][]string)
+		for _, registration := range registrations {
+			clientIDs[registration[0]] = append(clientIDs[registration[0]], registration[1])
+		}
+		q := rebind(config.dialect(), `UPDATE `+table+`
+                                          SET `+quote(dep.ClientID)+` = $1
+                                        WHERE `+quote(dep.Issuer)+` = $2`)
+		for issuer, ids := range clientIDs {
+			if len(ids) == 1 {
+				_, err = tx.Exec(q, ids[0], issuer)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return replacePrimaryKey(tx, config, config.DeploymentTable, tableColumns(config, deploymentColumns, 4),
+			deploymentKeys(config, 4))
+	}
+}
+
+// unscopeDeployments returns the migration step that reverts scopeDeployments, keeping each deployment ID once per
+// issuer.
+func unscopeDeployments(config Config) func(tx *sql.Tx) error {
+	quote := config.dialect().QuoteIdentifier
+	dep := config.DeploymentFields
+	table := quote(config.DeploymentTable)
+
+	return func(tx *sql.Tx) error {
+		deployments, err := selectRows(tx, `SELECT `+quote(dep.Issuer)+`,`+quote(dep.ClientID)+`,`+quote(dep.DeploymentID)+`
+                                              FROM `+table, 3)
+		if err != nil {
+			return err
+		}
+		q := rebind(config.dialect(), `DELETE FROM `+table+`
+                                        WHERE `+quote(dep.Issuer)+` = $1
+                                          AND `+quote(dep.ClientID)+` = $2
+                                          AND `+quote(dep.DeploymentID)+` = $3`)
+		seen := make(map[[2]string]bool)
+		for _, deployment := range deployments {
+			key := [2]string{deployment[0], deployment[2]}
+			if seen[key] {
+				_, err = tx.Exec(q, deployment[0], deployment[1], deployment[2])
+				if err != nil {
+					return err
+				}
+			}
+			seen[key] = true
+		}
+
+		err = replacePrimaryKey(tx, config, config.DeploymentTable, tableColumns(config, deploymentColumns, 3),
+			deploymentKeys(config, 3))
+		if err != nil {
+			return err
+		}
+		if _, ok := alterPrimaryKey(config, config.DeploymentTable, nil); !ok {
+			// The rebuilt table has no client ID column.
+			return nil
+		}
+		return dropColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 3), 4)(tx)
+	}
+}
+
+// addDeploymentPolicy returns the migration step that adds the name, disabled flag, allowed context IDs, features and
+// metadata to deployments. Existing deployments are enabled, unnamed and unrestricted.
+func addDeploymentPolicy(config Config) func(tx *sql.Tx) error {
+	return addColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 5), 5)
+}
+
+// removeDeploymentPolicy returns the migration step that reverts addDeploymentPolicy.
+func removeDeploymentPolicy(config Config) func(tx *sql.Tx) error {
+	return dropColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 4), 5)
+}
+
+// addProvisioning returns the migration step that adds the provisioning policy to registrations and the pending flag
+// and first-seen time to deployments. Existing registrations do not provision deployments, and existing deployments
+// are approved with an unknown first-seen time.
+func addProvisioning(config Config) func(tx *sql.Tx) error {
+	reg := config.RegistrationFields
+
+	return func(tx *sql.Tx) error {
+		err := addColumns(config, config.RegistrationTable, registrationColumns, []string{reg.Issuer, reg.ClientID}, 6)(tx)
+		if err != nil {
+			return err
+		}
+		return addColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 6), 6)(tx)
+	}
+}
+
+// removeProvisioning returns the migration step that reverts addProvisioning. Deployments pending approval are
+// removed rather than enabled.
+func removeProvisioning(config Config) func(tx *sql.Tx) error {
+	quote := config.dialect().QuoteIdentifier
+	reg, dep := config.RegistrationFields, config.DeploymentFields
+	table := quote(config.DeploymentTable)
+
+	return func(tx *sql.Tx) error {
+		// Delete the pending deployments one by one, as some drivers delete a single row per statement.
+		pending, err := selectRows(tx, `SELECT `+quote(dep.Issuer)+`,`+quote(dep.ClientID)+`,`+quote(dep.DeploymentID)+`
+                                          FROM `+table+`
+                                         WHERE `+quote(dep.Pending)+` = 1`, 3)
+		if err != nil {
+			return err
+		}
+		q := rebind(config.dialect(), `DELETE FROM `+table+`
+                                        WHERE `+quote(dep.Issuer)+` = $1
+                                          AND `+quote(dep.ClientID)+` = $2
+                                          AND `+quote(dep.DeploymentID)+` = $3`)
+		for _, deployment := range pending {
+			_, err = tx.Exec(q, deployment[0], deployment[1], deployment[2])
+			if err != nil {
+				return err
+			}
+		}
+
+		err = dropColumns(config, config.DeploymentTable, deploymentColumns, deploymentKeys(config, 5), 6)(tx)
+		if err != nil {
+			return err
+		}
+		return dropColumns(config, config.RegistrationTable, registrationColumns, []string{reg.Issuer, reg.ClientID}, 6)(tx)
+	}
+}
+
+// addColumn returns the statement that adds the NOT NULL column `column' of `columnType' with the default value
+// `value', an SQL literal, to `table'.
+func addColumn(config Config, table, column, columnType, value string) string {
+	quote := config.dialect().QuoteIdentifier
+	return `ALTER TABLE ` + quote(table) + ` ADD COLUMN ` + quote(column) + ` ` + columnType + ` NOT NULL DEFAULT ` + value
+}
+
+// dropColumn returns the statement that drops `column' from `table'. SQLite drops columns as of version 3.35.
+func dropColumn(config Config, table, column string) string {
+	quote := config.dialect().QuoteIdentifier
+	return `ALTER TABLE ` + quote(table) + ` DROP COLUMN ` + quote(column)
+}
+
+// textDefault returns `value' as the default value of a TEXT column. MySQL only accepts an expression as the default
+// of a TEXT column, as of version 8.0.13, whereas SQLite does not accept an expression when adding a column.
+func textDefault(config Config, value string) string {
+	literal := `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+	if _, ok := config.dialect().(mySQLDialect); ok {
+		return `(` + literal + `)`
+	}
+	return literal
+}
+
+// A column describes a column that a migration adds to a table: its unquoted name, its type, and its value in the
+// rows that exist when it is added.
+type column struct {
+	name  string
+	kind  string
+	value string
+}
+
+// literal returns the value of `c' as the default value of the column.
+func (c column) literal(config Config) string {
+	switch c.kind {
+	case "BIGINT":
+		return c.value
+	case "TEXT":
+		return textDefault(config, c.value)
+	}
+	return `'` + strings.ReplaceAll(c.value, `'`, `''`) + `'`
+}
+
+// deploymentColumns returns the columns that migration `version' adds to the deployment table.
+func deploymentColumns(config Config, version int) []column {
+	dep := config.DeploymentFields
+
+	switch version {
+	case 1:
+		return []column{{dep.Issuer, "VARCHAR(255)", ""}, {dep.DeploymentID, "VARCHAR(255)", ""}}
+	case 4:
+		return []column{{dep.ClientID, "VARCHAR(255)", ""}}
+	case 5:
+		return []column{
+			{dep.Name, "TEXT", ""},
+			{dep.Disabled, "BIGINT", "0"},
+			{dep.AllowedContextIDs, "TEXT", "[]"},
+			{dep.Features, "TEXT", "{}"},
+			{dep.Metadata, "TEXT", "{}"},
+		}
+	case 6:
+		return []column{{dep.Pending, "BIGINT", "0"}, {dep.FirstSeen, "BIGINT", "0"}}
+	}
+	return nil
+}
+
+// registrationColumns returns the columns that migration `version' adds to the registration table.
+func registrationColumns(config Config, version int) []column {
+	reg := config.RegistrationFields
+
+	switch version {
+	case 1:
+		return []column{
+			{reg.Issuer, "VARCHAR(255)", ""},
+			{reg.ClientID, "VARCHAR(255)", ""},
+			{reg.AuthTokenURI, "TEXT", ""},
+			{reg.AuthLoginURI, "TEXT", ""},
+			{reg.KeysetURI, "TEXT", ""},
+			{reg.TargetLinkURI, "TEXT", ""},
+		}
+	case 6:
+		return []column{{reg.Provisioning, "VARCHAR(255)", ""}}
+	}
+	return nil
+}
+
+// deploymentKeys returns the primary key of the deployment table as of migration `version'.
+func deploymentKeys(config Config, version int) []string {
+	dep := config.DeploymentFields
+	if version < 4 {
+		return []string{dep.Issuer, dep.DeploymentID}
+	}
+	return []string{dep.Issuer, dep.ClientID, dep.DeploymentID}
+}
+
+// tableColumns returns the columns of a table as of migration `version', given the columns that each migration adds
+// to it.
+func tableColumns(config Config, columns func(Config, int) []column, version int) []column {
+	var all []column
+	for v := 1; v <= version; v++ {
+		all = append(all, columns(config, v)...)
+	}
+	return all
+}
+
+// alterColumns reports whether the database can add and drop columns in place. Migrations rebuild the tables of other
+// databases, such as those of test drivers that cannot parse ALTER TABLE.
+func alterColumns(config Config) bool {
+	switch config.dialect().(type) {
+	case postgreSQLDialect, mySQLDialect, sqliteDialect:
+		return true
+	}
+	return false
+}
+
+// addColumns returns the migration step that adds the columns of migration `version' to `table', whose primary key
+// is then the unquoted `keys'. The table is altered if the database can, and rebuilt otherwise.
+func addColumns(config Config, table string, columns func(Config, int) []column, keys []string,
+	version int) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		added := columns(config, version)
+		if !alterColumns(config) {
+			return rebuildTable(tx, config, table, tableColumns(config, columns, version-1), added, keys)
+		}
+
+		for _, c := range added {
+			_, err := tx.Exec(addColumn(config, table, c.name, c.kind, c.literal(config)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dropColumns returns the migration step that drops the columns of migration `version' from `table', whose primary
+// key is then the unquoted `keys'. The table is altered if the database can, and rebuilt otherwise.
+func dropColumns(config Config, table string, columns func(Config, int) []column, keys []string,
+	version int) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if !alterColumns(config) {
+			return rebuildTable(tx, config, table, tableColumns(config, columns, version-1), nil, keys)
+		}
+
+		dropped := columns(config, version)
+		for i := len(dropped) - 1; i >= 0; i-- {
+			_, err := tx.Exec(dropColumn(config, table, dropped[i].name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// alterPrimaryKey returns the statement that replaces the primary key of `table' with the unquoted `keys', and reports
+// whether the database can alter a primary key in place. PostgreSQL's key is expected to have its default name.
+func alterPrimaryKey(config Config, table string, keys []string) (string, bool) {
+	dialect := config.dialect()
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = dialect.QuoteIdentifier(key)
+	}
+	add := `ADD PRIMARY KEY (` + strings.Join(quoted, ", ") + `)`
+
+	switch dialect.(type) {
+	case postgreSQLDialect:
+		return `ALTER TABLE ` + dialect.QuoteIdentifier(table) + `
+                DROP CONSTRAINT ` + dialect.QuoteIdentifier(table+"_pkey") + `, ` + add, true
+	case mySQLDialect:
+		return `ALTER TABLE ` + dialect.QuoteIdentifier(table) + ` DROP PRIMARY KEY, ` + add, true
+	}
+	return "", false
+}
+
+// replacePrimaryKey replaces the primary key of `table', whose columns are `columns', with the unquoted `keys'.
+// Databases that cannot alter a primary key, such as SQLite, rebuild the table instead.
+func replacePrimaryKey(tx *sql.Tx, config Config, table string, columns []column, keys []string) error {
+	if q, ok := alterPrimaryKey(config, table, keys); ok {
+		return exec(q)(tx)
+	}
+	return rebuildTable(tx, config, table, columns, nil, keys)
+}
+
+// rebuildTable recreates `table' with `columns', followed by the `added' columns, and the unquoted primary key
+// `keys'. The rows of the table are read, the table is dropped and created again, and the rows are written back with
+// the values of `columns' and the values of the `added' columns. SQLite runs the rebuild within the migration's
+// transaction, but indexes added to the table are lost.
+func rebuildTable(tx *sql.Tx, config Config, table string, columns, added []column, keys []string) error {
+	dialect := config.dialect()
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	rows, err := selectColumns(tx, config, table, names)
+	if err != nil {
+		return err
+	}
+
+	all := append(append([]column{}, columns...), added...)
+	quoted := make([]string, len(all))
+	definitions := make([]string, len(all))
+	for i, c := range all {
+		quoted[i] = dialect.QuoteIdentifier(c.name)
+		definitions[i] = quoted[i] + ` ` + c.kind + ` NOT NULL`
+	}
+	quotedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		quotedKeys[i] = dialect.QuoteIdentifier(key)
+	}
+	definitions = append(definitions, `PRIMARY KEY (`+strings.Join(quotedKeys, ", ")+`)`)
+
+	err = exec(
+		`DROP TABLE `+dialect.QuoteIdentifier(table),
+		`CREATE TABLE `+dialect.QuoteIdentifier(table)+` (`+strings.Join(definitions, ", ")+`)`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	q := insert(dialect, dialect.QuoteIdentifier(table), quoted)
+	for _, row := range rows {
+		args := stringValues(row)
+		for _, c := range added {
+			args = append(args, c.value)
+		}
+		_, err = tx.Exec(q, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registrationTable returns the DDL of the registration table as created by the first migration.
+func registrationTable(config Config) string {
+	quote := config.dialect().QuoteIdentifier
+	reg := config.RegistrationFields
+
+	return `CREATE TABLE ` + quote(config.RegistrationTable) + ` (
+                   ` + quote(reg.Issuer) + ` VARCHAR(255) NOT NULL,
+                   ` + quote(reg.ClientID) + ` VARCHAR(255) NOT NULL,
+                   ` + quote(reg.AuthTokenURI) + ` TEXT NOT NULL,
+                   ` + quote(reg.AuthLoginURI) + ` TEXT NOT NULL,
+                   ` + quote(reg.KeysetURI) + ` TEXT NOT NULL,
+                   ` + quote(reg.TargetLinkURI) + ` TEXT NOT NULL,
+                   PRIMARY KEY (` + quote(reg.Issuer) + `, ` + quote(reg.ClientID) + `)
+                 )`
+}
+
+// selectColumns returns the values of the unquoted string `columns' of every row of `table'.
+func selectColumns(tx *sql.Tx, config Config, table string, columns []string) ([][]string, error) {
+	quote := config.dialect().QuoteIdentifier
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quote(column)
+	}
+
+	return selectRows(tx, `SELECT `+strings.Join(quoted, ",")+`
+                             FROM `+quote(table), len(columns))
+}
+
+// stringValues returns `values' as arguments of a statement.
+func stringValues(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// selectRows runs a query selecting `n' string columns and returns the values of each row.
+func selectRows(tx *sql.Tx, q string, n int) ([][]string, error) {
+	rows, err := tx.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values [][]string
+	for rows.Next() {
+		row := make([]string, n)
+		dest := make([]interface{}, n)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
+
+// A Migrator applies and reverts the schema migrations of the Store, recording the applied versions in the migration
+// table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	table      string
+	version    string
+	appliedAt  string
+	migrations []Migration
+}
+
+// NewMigrator returns a *Migrator for the migrations of the Store configured by `config'. Additional migrations, e.g.
+// for a tool's own tables, can be passed as `extra'; their versions must not clash with the Store's.
+func NewMigrator(db *sql.DB, config Config, extra ...Migration) *Migrator {
+	migrations := append(Migrations(config), extra...)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	dialect := config.dialect()
+	return &Migrator{
+		db:         db,
+		dialect:    dialect,
+		table:      dialect.QuoteIdentifier(config.MigrationTable),
+		version:    dialect.QuoteIdentifier(config.MigrationFields.Version),
+		appliedAt:  dialect.QuoteIdentifier(config.MigrationFields.AppliedAt),
+		migrations: migrations,
+	}
+}
+
+// Up applies every pending migration in version order and returns the migrations applied. It stops at the first
+// migration that fails.
+func (m *Migrator) Up() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		q := `INSERT INTO ` + m.table + ` (` + m.version + `,` + m.appliedAt + `)
+                   VALUES ($1, $2)`
+		err = m.run(migration, migration.Up, q, migration.Version, time.Now().Unix())
+		if err != nil {
+			return done, err
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// Down reverts the most recently applied migration and returns it. If no migration has been applied, it returns
+// ErrNoMigrationApplied.
+func (m *Migrator) Down() (Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		q := `DELETE FROM ` + m.table + `
+               WHERE ` + m.version + ` = $1`
+		err = m.run(migration, migration.Down, q, migration.Version)
+		if err != nil {
+			return Migration{}, err
+		}
+		return migration, nil
+	}
+
+	return Migration{}, ErrNoMigrationApplied
+}
+
+// Status reports, in version order, whether each migration has been applied.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Applied:     ok,
+			AppliedAt:   appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+// run executes a migration step and the matching update of the migration table in one transaction.
+func (m *Migrator) run(migration Migration, step func(tx *sql.Tx) error, q string, args ...interface{}) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = step(tx)
+	if err == nil {
+		_, err = tx.Exec(rebind(m.dialect, q), args...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+	}
+
+	return tx.Commit()
+}
+
+// applied creates the migration table if needed and returns the applied versions with their application times.
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	// Probe for the table rather than use CREATE TABLE IF NOT EXISTS, which not every supported driver handles.
+	var count int
+	err := m.db.QueryRow(`SELECT COUNT(*) FROM ` + m.table).Scan(&count)
+	if err != nil {
+		_, err = m.db.Exec(`CREATE TABLE ` + m.table + ` (
+                              ` + m.version + ` BIGINT NOT NULL,
+                              ` + m.appliedAt + ` BIGINT NOT NULL,
+                              PRIMARY KEY (` + m.version + `)
+                            )`)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create migration table: %w", err)
+		}
+	}
+
+	rows, err := m.db.Query(`SELECT ` + m.version + `,` + m.appliedAt + `
+                               FROM ` + m.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version, appliedAt int64
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[int(version)] = time.Unix(appliedAt, 0)
+	}
+
+	return applied, rows.Err()
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Apply and revert all migrations, checking the store against the migrated schema.
+func testMigrator(t *testing.T, db *sql.DB, config Config) {
+	migrator := NewMigrator(db, config)
+	migrations := Migrations(config)
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("got %d applied migrations, wanted %d", len(applied), len(migrations))
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("migration status error: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Errorf("migration %d not reported as applied", status.Version)
+		}
+	}
+
+	// Applying again is a no-op.
+	applied, err = migrator.Up()
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("got %d migrations and error %v, wanted none applied twice", len(applied), err)
+	}
+
+	store := New(db, config)
+	registration := newRegistrationForTesting(t)
+	if err := store.StoreRegistration(registration); err != nil {
+		t.Fatalf("cannot store registration in migrated schema: %v", err)
+	}
+	if err := store.StoreNonce(datastore.Nonce{Value: "nonce-1", TargetLinkURI: "https://tool.tld"}); err != nil {
+		t.Fatalf("cannot store nonce in migrated schema: %v", err)
+	}
+	if err := store.TestAndSetTokenID("https://platform.tld", "jti-1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("cannot record token ID in migrated schema: %v", err)
+	}
+	if err := store.StoreHandoffCode(datastore.HandoffCode{
+		Code:      "code-1",
+		LaunchID:  "launch-1",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}); err != nil {
+		t.Fatalf("cannot store hand-off code in migrated schema: %v", err)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		reverted, err := migrator.Down()
+		if err != nil {
+			t.Fatalf("migrate down error: %v", err)
+		}
+		if reverted.Version != migrations[i].Version {
+			t.Fatalf("got reverted version %d, wanted %d", reverted.Version, migrations[i].Version)
+		}
+	}
+	_, err = migrator.Down()
+	if err != ErrNoMigrationApplied {
+		t.Fatalf("got %v, wanted ErrNoMigrationApplied", err)
+	}
+
+	statuses, err = migrator.Status()
+	if err != nil {
+		t.Fatalf("migration status error: %v", err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Errorf("migration %d still reported as applied", status.Version)
+		}
+	}
+
+	// The reverted schema can be applied again.
+	applied, err = migrator.Up()
+	if err != nil || len(applied) != len(migrations) {
+		t.Fatalf("got %d migrations and error %v, wanted all reapplied", len(applied), err)
+	}
+}
+
+func TestMigratorRamsql(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestMigratorRamsql")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	testMigrator(t, db, newRamsqlConfig())
+}
+
+func TestMigratorSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	// Every connection to :memory: opens a new database.
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	testMigrator(t, db, config)
+}
+
+// Test that additional migrations run in version order with the Store's own.
+func TestMigratorExtra(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestMigratorExtra")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	migrator := NewMigrator(db, newRamsqlConfig(), Migration{
+		Version:     100,
+		Description: "create course table",
+		Up:          exec(`CREATE TABLE course (course_id VARCHAR(255) NOT NULL, PRIMARY KEY (course_id))`),
+		Down:        exec(`DROP TABLE course`),
+	})
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	if last := applied[len(applied)-1]; last.Version != 100 {
+		t.Fatalf("got last applied version %d, wanted 100", last.Version)
+	}
+	mustExec(t, db, `INSERT INTO course (course_id) VALUES ('course-1')`)
+}
+
+// Test that scoping deployments to registrations assigns each deployment to the only registration of its issuer and
+// leaves the others unassigned, that existing deployments stay enabled, and that reverting removes the deployments
+// pending approval.
+func testScopeDeployments(t *testing.T, db *sql.DB, config Config) {
+	migrator := NewMigrator(db, config)
+	migrator.migrations = migrator.migrations[:3]
+	_, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+
+	insertRegistration := `INSERT INTO registration
+                                      (issuer, client_id, auth_token_uri, auth_login_uri, keyset_uri, target_link_uri)
+                               VALUES ('%s', '%s', 'http://c', 'http://d', 'http://e', 'http://f')`
+	mustExec(t, db, fmt.Sprintf(insertRegistration, "single", "client"))
+	mustExec(t, db, fmt.Sprintf(insertRegistration, "shared", "client-1"))
+	mustExec(t, db, fmt.Sprintf(insertRegistration, "shared", "client-2"))
+	mustExec(t, db, `INSERT INTO deployment (issuer, deployment_id) VALUES ('single', '1')`)
+	mustExec(t, db, `INSERT INTO deployment (issuer, deployment_id) VALUES ('shared', '2')`)
+
+	applied, err := NewMigrator(db, config).Up()
+	if err != nil || len(applied) != 3 || applied[0].Version != 4 {
+		t.Fatalf("got %v and error %v, wanted migrations 4 to 6 applied", applied, err)
+	}
+
+	store := New(db, config)
+	deployment, err := store.FindDeployment("single", "client", "1")
+	if err != nil {
+		t.Fatalf("cannot find backfilled deployment: %v", err)
+	}
+	if deployment.Disabled || deployment.Pending || !deployment.AllowsContext("any") {
+		t.Fatalf("got %#v, wanted an approved, enabled and unrestricted deployment", deployment)
+	}
+	for _, clientID := range []string{"client-1", "client-2"} {
+		_, err = store.FindDeployment("shared", clientID, "2")
+		if err != datastore.ErrDeploymentNotFound {
+			t.Fatalf("got %v for ambiguous deployment, wanted ErrDeploymentNotFound", err)
+		}
+	}
+	unassigned, err := store.ListDeployments("shared", "")
+	if err != nil || len(unassigned) != 1 {
+		t.Fatalf("got %v and error %v, wanted the unassigned deployment", unassigned, err)
+	}
+
+	err = store.StoreDeployment("single", "client", datastore.Deployment{DeploymentID: "3", Pending: true})
+	if err != nil {
+		t.Fatalf("cannot store pending deployment: %v", err)
+	}
+
+	for _, version := range []int{6, 5, 4} {
+		reverted, err := NewMigrator(db, config).Down()
+		if err != nil || reverted.Version != version {
+			t.Fatalf("got %d and error %v, wanted migration %d reverted", reverted.Version, err, version)
+		}
+	}
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM deployment`).Scan(&count)
+	if err != nil || count != 2 {
+		t.Fatalf("got %d deployments and error %v after reverting, wanted 2", count, err)
+	}
+}
+
+func TestScopeDeploymentsRamsql(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestScopeDeploymentsRamsql")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	testScopeDeployments(t, db, newRamsqlConfig())
+}
+
+func TestScopeDeploymentsSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	testScopeDeployments(t, db, config)
+}
+
+// Test the statements that alter tables in the migrations for each dialect.
+func TestAlterStatements(t *testing.T) {
+	tests := []struct {
+		dialect    Dialect
+		addColumn  string
+		primaryKey string
+	}{
+		{PostgreSQL,
+			`ALTER TABLE "deployment" ADD COLUMN "features" TEXT NOT NULL DEFAULT '{}'`,
+			`ALTER TABLE "deployment" DROP CONSTRAINT "deployment_pkey", ADD PRIMARY KEY ("issuer", "client_id")`},
+		{MySQL,
+			"ALTER TABLE `deployment` ADD COLUMN `features` TEXT NOT NULL DEFAULT ('{}')",
+			"ALTER TABLE `deployment` DROP PRIMARY KEY, ADD PRIMARY KEY (`issuer`, `client_id`)"},
+		{SQLite,
+			`ALTER TABLE "deployment" ADD COLUMN "features" TEXT NOT NULL DEFAULT '{}'`,
+			""},
+	}
+
+	for _, test := range tests {
+		config := NewConfig()
+		config.Dialect = test.dialect
+
+		got := addColumn(config, "deployment", "features", "TEXT", textDefault(config, "{}"))
+		if got != test.addColumn {
+			t.Errorf("%T: got %s, wanted %s", test.dialect, got, test.addColumn)
+		}
+
+		got, ok := alterPrimaryKey(config, "deployment", []string{"issuer", "client_id"})
+		got = strings.Join(strings.Fields(got), " ")
+		if got != test.primaryKey || ok != (test.primaryKey != "") {
+			t.Errorf("%T: got %s (%t), wanted %s", test.dialect, got, ok, test.primaryKey)
+		}
+
+		if !alterColumns(config) {
+			t.Errorf("%T: got the tables rebuilt, wanted columns altered", test.dialect)
+		}
+	}
+
+	if alterColumns(newRamsqlConfig()) {
+		t.Error("got columns altered for the ramsql dialect, wanted the tables rebuilt")
+	}
+}
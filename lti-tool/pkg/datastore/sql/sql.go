@@ -3,15 +3,20 @@
 // This source code is licensed under the MIT-style license found in
 // the LICENSE file in the root directory of this source tree.
 
-// Package sql implements a persistent SQL data store. It implements the RegistrationStorer interface.
+// Package sql implements a persistent SQL data store. It implements the RegistrationStorer, NonceStorer,
+// LaunchDataStorer, AccessTokenStorer, ReplayStorer and HandoffStorer interfaces, so that tools running as several
+// replicas can share all of their LTI data.
 package sql
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 )
@@ -24,25 +29,122 @@ type RegistrationFields struct {
 	AuthLoginURI  string
 	KeysetURI     string
 	TargetLinkURI string
+	Provisioning  string
 }
 
-// DeploymentFields provides the database column names for fields in the datastore.Deployment structure.
+// DeploymentFields provides the database column names for fields in the datastore.Deployment structure, and for the
+// issuer and client ID of the registration it belongs to.
 type DeploymentFields struct {
-	Issuer       string
-	DeploymentID string
+	Issuer            string
+	ClientID          string
+	DeploymentID      string
+	Name              string
+	Disabled          string
+	AllowedContextIDs string
+	Features          string
+	Metadata          string
+	Pending           string
+	FirstSeen         string
 }
 
-// Config represents the table and field names necessary for storing/retrieving registrations and deployments within the
-// database.
+// NonceFields provides the database column names for fields in the datastore.Nonce structure. The nonce's maximum age
+// is stored as its expiry time.
+type NonceFields struct {
+	Nonce         string
+	TargetLinkURI string
+	IssuedAt      string
+	ExpiresAt     string
+}
+
+// LaunchDataFields provides the database column names for launch data, i.e. the launch ID, the id_token payload and
+// its creation time.
+type LaunchDataFields struct {
+	LaunchID   string
+	LaunchData string
+	CreatedAt  string
+}
+
+// AccessTokenFields provides the database column names for fields in the datastore.AccessToken structure.
+type AccessTokenFields struct {
+	TokenURI   string
+	ClientID   string
+	Scopes     string
+	Token      string
+	ExpiryTime string
+}
+
+// ReplayFields provides the database column names for the id_tokens recorded for replay protection.
+type ReplayFields struct {
+	Issuer    string
+	TokenID   string
+	ExpiresAt string
+}
+
+// MigrationFields provides the database column names of the migration table, which records the applied schema
+// migrations.
+type MigrationFields struct {
+	Version   string
+	AppliedAt string
+}
+
+// HandoffCodeFields provides the database column names for fields in the datastore.HandoffCode structure.
+type HandoffCodeFields struct {
+	Code      string
+	LaunchID  string
+	ExpiresAt string
+}
+
+// HandoffTokenFields provides the database column names for fields in the datastore.HandoffToken structure.
+type HandoffTokenFields struct {
+	Token     string
+	LaunchID  string
+	Scopes    string
+	ExpiresAt string
+}
+
+// Config represents the table and field names necessary for storing/retrieving registrations, deployments, nonces,
+// launch data, access tokens, used id_tokens and hand-offs within the database, and for recording the applied schema
+// migrations. LaunchDataTTL is how long launch data is kept; a zero LaunchDataTTL keeps it forever.
+//
+// Dialect adapts the queries to the database; a nil Dialect is treated as PostgreSQL. Storing a registration replaces
+// an existing one with the same issuer and client ID unless RejectRegistrationUpdates is set, in which case it fails
+// with datastore.ErrRegistrationExists.
 type Config struct {
+	Dialect                   Dialect
+	RejectRegistrationUpdates bool
+
 	RegistrationTable  string
 	RegistrationFields RegistrationFields
 	DeploymentTable    string
 	DeploymentFields   DeploymentFields
+	NonceTable         string
+	NonceFields        NonceFields
+	LaunchDataTable    string
+	LaunchDataFields   LaunchDataFields
+	LaunchDataTTL      time.Duration
+	AccessTokenTable   string
+	AccessTokenFields  AccessTokenFields
+	ReplayTable        string
+	ReplayFields       ReplayFields
+	HandoffCodeTable   string
+	HandoffCodeFields  HandoffCodeFields
+	HandoffTokenTable  string
+	HandoffTokenFields HandoffTokenFields
+	MigrationTable     string
+	MigrationFields    MigrationFields
+}
+
+// dialect returns the configured Dialect, defaulting to PostgreSQL.
+func (c Config) dialect() Dialect {
+	if c.Dialect == nil {
+		return PostgreSQL
+	}
+	return c.Dialect
 }
 
 type registrationIdentifiers struct {
 	table    string
+	columns  []string
 	fields   string
 	issuer   string
 	clientID string
@@ -50,21 +152,84 @@ type registrationIdentifiers struct {
 
 type deploymentIdentifiers struct {
 	table        string
+	columns      []string
+	fields       string
 	issuer       string
+	clientID     string
 	deploymentID string
 }
 
+type nonceIdentifiers struct {
+	table         string
+	nonce         string
+	targetLinkURI string
+	issuedAt      string
+	expiresAt     string
+}
+
+type launchDataIdentifiers struct {
+	table      string
+	launchID   string
+	launchData string
+	createdAt  string
+	ttl        time.Duration
+}
+
+type accessTokenIdentifiers struct {
+	table      string
+	tokenURI   string
+	clientID   string
+	scopes     string
+	token      string
+	expiryTime string
+}
+
+type replayIdentifiers struct {
+	table     string
+	issuer    string
+	tokenID   string
+	expiresAt string
+}
+
+type handoffCodeIdentifiers struct {
+	table     string
+	code      string
+	launchID  string
+	expiresAt string
+}
+
+type handoffTokenIdentifiers struct {
+	table     string
+	token     string
+	launchID  string
+	scopes    string
+	expiresAt string
+}
+
 // Store implements a persistent SQL-based datastore.
 type Store struct {
 	*sql.DB
 
+	dialect                   Dialect
+	rejectRegistrationUpdates bool
+
 	registration registrationIdentifiers
 	deployment   deploymentIdentifiers
+	nonce        nonceIdentifiers
+	launchData   launchDataIdentifiers
+	accessToken  accessTokenIdentifiers
+	replay       replayIdentifiers
+	handoffCode  handoffCodeIdentifiers
+	handoffToken handoffTokenIdentifiers
+
+	nonceSweep  datastore.Sweeper
+	replaySweep datastore.Sweeper
 }
 
 // NewConfig returns a new configuration struct with default table and field names for the SQL database.
 func NewConfig() Config {
 	return Config{
+		Dialect:           PostgreSQL,
 		RegistrationTable: "registration",
 		RegistrationFields: RegistrationFields{
 			Issuer:        "issuer",
@@ -73,70 +238,273 @@ func NewConfig() Config {
 			AuthLoginURI:  "auth_login_uri",
 			KeysetURI:     "keyset_uri",
 			TargetLinkURI: "target_link_uri",
+			Provisioning:  "provisioning",
 		},
 		DeploymentTable: "deployment",
 		DeploymentFields: DeploymentFields{
-			Issuer:       "issuer",
-			DeploymentID: "deployment_id",
+			Issuer:            "issuer",
+			ClientID:          "client_id",
+			DeploymentID:      "deployment_id",
+			Name:              "name",
+			Disabled:          "disabled",
+			AllowedContextIDs: "allowed_context_ids",
+			Features:          "features",
+			Metadata:          "metadata",
+			Pending:           "pending",
+			FirstSeen:         "first_seen",
+		},
+		NonceTable: "nonce",
+		NonceFields: NonceFields{
+			Nonce:         "nonce",
+			TargetLinkURI: "target_link_uri",
+			IssuedAt:      "issued_at",
+			ExpiresAt:     "expires_at",
+		},
+		LaunchDataTable: "launch_data",
+		LaunchDataFields: LaunchDataFields{
+			LaunchID:   "launch_id",
+			LaunchData: "launch_data",
+			CreatedAt:  "created_at",
+		},
+		LaunchDataTTL:    datastore.DefaultLaunchDataTTL,
+		AccessTokenTable: "access_token",
+		AccessTokenFields: AccessTokenFields{
+			TokenURI:   "token_uri",
+			ClientID:   "client_id",
+			Scopes:     "scopes",
+			Token:      "token",
+			ExpiryTime: "expiry_time",
+		},
+		ReplayTable: "token_replay",
+		ReplayFields: ReplayFields{
+			Issuer:    "issuer",
+			TokenID:   "token_id",
+			ExpiresAt: "expires_at",
+		},
+		HandoffCodeTable: "handoff_code",
+		HandoffCodeFields: HandoffCodeFields{
+			Code:      "code",
+			LaunchID:  "launch_id",
+			ExpiresAt: "expires_at",
+		},
+		HandoffTokenTable: "handoff_token",
+		HandoffTokenFields: HandoffTokenFields{
+			Token:     "token",
+			LaunchID:  "launch_id",
+			Scopes:    "scopes",
+			ExpiresAt: "expires_at",
+		},
+		MigrationTable: "schema_migrations",
+		MigrationFields: MigrationFields{
+			Version:   "version",
+			AppliedAt: "applied_at",
 		},
 	}
 }
 
-// New returns a Store that satisifes the datastore.RegistrationStorer and datastore.DeploymentStorer interfaces.
+// New returns a Store that satisifes the datastore.RegistrationStorer, datastore.NonceStorer,
+// datastore.LaunchDataStorer, datastore.AccessTokenStorer, datastore.ReplayStorer and datastore.HandoffStorer
+// interfaces.
 func New(database *sql.DB, config Config) *Store {
+	dialect := config.dialect()
+	quote := dialect.QuoteIdentifier
+	registrationColumns := []string{
+		// The columns must be listed in this order to
+		// match their use with in the SQL queries.
+		quote(config.RegistrationFields.Issuer),
+		quote(config.RegistrationFields.ClientID),
+		quote(config.RegistrationFields.AuthTokenURI),
+		quote(config.RegistrationFields.AuthLoginURI),
+		quote(config.RegistrationFields.KeysetURI),
+		quote(config.RegistrationFields.TargetLinkURI),
+		quote(config.RegistrationFields.Provisioning),
+	}
+	deploymentColumns := []string{
+		// The keys come first; the remaining columns are the fields of the datastore.Deployment, in the order in
+		// which queryDeployments scans them.
+		quote(config.DeploymentFields.Issuer),
+		quote(config.DeploymentFields.ClientID),
+		quote(config.DeploymentFields.DeploymentID),
+		quote(config.DeploymentFields.Name),
+		quote(config.DeploymentFields.Disabled),
+		quote(config.DeploymentFields.AllowedContextIDs),
+		quote(config.DeploymentFields.Features),
+		quote(config.DeploymentFields.Metadata),
+		quote(config.DeploymentFields.Pending),
+		quote(config.DeploymentFields.FirstSeen),
+	}
+
 	return &Store{
-		DB: database,
+		DB:                        database,
+		dialect:                   dialect,
+		rejectRegistrationUpdates: config.RejectRegistrationUpdates,
 		registration: registrationIdentifiers{
-			table: config.RegistrationTable,
-			fields: strings.Join([]string{
-				// The strings must be joined in this order to
-				// match their use with in the SQL queries.
-				config.RegistrationFields.Issuer,
-				config.RegistrationFields.ClientID,
-				config.RegistrationFields.AuthTokenURI,
-				config.RegistrationFields.AuthLoginURI,
-				config.RegistrationFields.KeysetURI,
-				config.RegistrationFields.TargetLinkURI,
-			}, ","),
-			issuer:   config.RegistrationFields.Issuer,
-			clientID: config.RegistrationFields.ClientID,
+			table:    quote(config.RegistrationTable),
+			columns:  registrationColumns,
+			fields:   strings.Join(registrationColumns, ","),
+			issuer:   quote(config.RegistrationFields.Issuer),
+			clientID: quote(config.RegistrationFields.ClientID),
 		},
 		deployment: deploymentIdentifiers{
-			table:        config.DeploymentTable,
-			issuer:       config.DeploymentFields.Issuer,
-			deploymentID: config.DeploymentFields.DeploymentID,
+			table:        quote(config.DeploymentTable),
+			columns:      deploymentColumns,
+			fields:       strings.Join(deploymentColumns[2:], ","),
+			issuer:       quote(config.DeploymentFields.Issuer),
+			clientID:     quote(config.DeploymentFields.ClientID),
+			deploymentID: quote(config.DeploymentFields.DeploymentID),
+		},
+		nonce: nonceIdentifiers{
+			table:         quote(config.NonceTable),
+			nonce:         quote(config.NonceFields.Nonce),
+			targetLinkURI: quote(config.NonceFields.TargetLinkURI),
+			issuedAt:      quote(config.NonceFields.IssuedAt),
+			expiresAt:     quote(config.NonceFields.ExpiresAt),
+		},
+		launchData: launchDataIdentifiers{
+			table:      quote(config.LaunchDataTable),
+			launchID:   quote(config.LaunchDataFields.LaunchID),
+			launchData: quote(config.LaunchDataFields.LaunchData),
+			createdAt:  quote(config.LaunchDataFields.CreatedAt),
+			ttl:        config.LaunchDataTTL,
+		},
+		accessToken: accessTokenIdentifiers{
+			table:      quote(config.AccessTokenTable),
+			tokenURI:   quote(config.AccessTokenFields.TokenURI),
+			clientID:   quote(config.AccessTokenFields.ClientID),
+			scopes:     quote(config.AccessTokenFields.Scopes),
+			token:      quote(config.AccessTokenFields.Token),
+			expiryTime: quote(config.AccessTokenFields.ExpiryTime),
+		},
+		replay: replayIdentifiers{
+			table:     quote(config.ReplayTable),
+			issuer:    quote(config.ReplayFields.Issuer),
+			tokenID:   quote(config.ReplayFields.TokenID),
+			expiresAt: quote(config.ReplayFields.ExpiresAt),
+		},
+		handoffCode: handoffCodeIdentifiers{
+			table:     quote(config.HandoffCodeTable),
+			code:      quote(config.HandoffCodeFields.Code),
+			launchID:  quote(config.HandoffCodeFields.LaunchID),
+			expiresAt: quote(config.HandoffCodeFields.ExpiresAt),
+		},
+		handoffToken: handoffTokenIdentifiers{
+			table:     quote(config.HandoffTokenTable),
+			token:     quote(config.HandoffTokenFields.Token),
+			launchID:  quote(config.HandoffTokenFields.LaunchID),
+			scopes:    quote(config.HandoffTokenFields.Scopes),
+			expiresAt: quote(config.HandoffTokenFields.ExpiresAt),
 		},
 	}
 }
 
-// StoreRegistration stores a registration in the SQL database.
-func (s *Store) StoreRegistration(reg datastore.Registration) error {
-	tx, err := s.DB.Begin()
+// rebind rewrites the placeholders of a query for the Store's dialect.
+func (s *Store) rebind(q string) string {
+	return rebind(s.dialect, q)
+}
+
+// upsert inserts a row of `columns' into `table' or, if a row with the same `keys' exists, updates its remaining
+// columns. The arguments are the values of `columns', in order. Dialects without upsert syntax fall back to looking
+// the row up within the transaction.
+func (s *Store) upsert(tx *sql.Tx, table string, columns, keys []string, args ...interface{}) error {
+	if q := s.dialect.Upsert(table, columns, keys); q != "" {
+		_, err := tx.Exec(q, args...)
+		return err
+	}
+
+	err := s.update(tx, table, columns, keys, args...)
+	if err == errRowNotFound {
+		_, err = tx.Exec(insert(s.dialect, table, columns), args...)
+	}
+	return err
+}
+
+// errRowNotFound is returned by update and delete when no row has the given keys.
+var errRowNotFound = errors.New("row not found")
+
+// update sets the non-key `columns' of the row of `table' with the same `keys', or returns errRowNotFound. The
+// arguments are the values of `columns', in order.
+func (s *Store) update(tx *sql.Tx, table string, columns, keys []string, args ...interface{}) error {
+	values := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		values[column] = args[i]
+	}
+	keyArgs := []interface{}{}
+	for _, key := range keys {
+		keyArgs = append(keyArgs, values[key])
+	}
+
+	// Count the row first: some databases report only the rows whose values changed as affected.
+	var count int
+	q := `SELECT COUNT(*)
+                FROM ` + table + `
+               WHERE ` + assignments(keys, 1, " AND ")
+	err := tx.QueryRow(s.rebind(q), keyArgs...).Scan(&count)
 	if err != nil {
 		return err
 	}
+	if count == 0 {
+		return errRowNotFound
+	}
 
-	authTokenURI := reg.AuthTokenURI.String()
-	authLoginURI := reg.AuthLoginURI.String()
-	keysetURI := reg.KeysetURI.String()
-	targetLinkURI := reg.TargetLinkURI.String()
+	nonKeys := nonKeyColumns(columns, keys)
+	if len(nonKeys) == 0 {
+		return nil
+	}
+	updateArgs := []interface{}{}
+	for _, column := range nonKeys {
+		updateArgs = append(updateArgs, values[column])
+	}
 
-	q := `INSERT INTO ` + s.registration.table + ` (` + s.registration.fields + `)
-                   VALUES ($1, $2, $3, $4, $5, $6)`
-	result, err := tx.Exec(q, reg.Issuer, reg.ClientID, authTokenURI, authLoginURI,
-		keysetURI, targetLinkURI)
+	q = `UPDATE ` + table + `
+                 SET ` + assignments(nonKeys, 1, ", ") + `
+               WHERE ` + assignments(keys, len(nonKeys)+1, " AND ")
+	_, err = tx.Exec(s.rebind(q), append(updateArgs, keyArgs...)...)
+	return err
+}
+
+// An execer executes statements, either directly on the database or within a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// delete removes the row of `table' with the given values of `keys', or returns errRowNotFound.
+func (s *Store) delete(db execer, table string, keys []string, args ...interface{}) error {
+	q := `DELETE FROM ` + table + `
+               WHERE ` + assignments(keys, 1, " AND ")
+	result, err := db.Exec(s.rebind(q), args...)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		tx.Rollback()
+		return err
+	}
+	if rowsAffected == 0 {
+		return errRowNotFound
+	}
+	return nil
+}
+
+// StoreRegistration stores a registration in the SQL database. An existing registration with the same issuer and
+// client ID is replaced, unless the Store rejects registration updates: storing a registration that differs from the
+// existing one then returns datastore.ErrRegistrationExists.
+func (s *Store) StoreRegistration(reg datastore.Registration) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
 		return err
 	}
 
-	if rowsAffected != 1 {
+	args := []interface{}{reg.Issuer, reg.ClientID, reg.AuthTokenURI.String(), reg.AuthLoginURI.String(),
+		reg.KeysetURI.String(), reg.TargetLinkURI.String(), string(reg.Provisioning)}
+
+	if s.rejectRegistrationUpdates {
+		err = s.insertRegistration(tx, args)
+	} else {
+		keys := []string{s.registration.issuer, s.registration.clientID}
+		err = s.upsert(tx, s.registration.table, s.registration.columns, keys, args...)
+	}
+	if err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -149,7 +517,34 @@ func (s *Store) StoreRegistration(reg datastore.Registration) error {
 	return nil
 }
 
-// FindRegistrationByIssuerAndClientID retrieves a registration from the SQL database.
+// insertRegistration inserts a registration unless one with the same issuer and client ID exists. Inserting a
+// registration identical to the existing one has no effect.
+func (s *Store) insertRegistration(tx *sql.Tx, args []interface{}) error {
+	q := `SELECT ` + s.registration.fields + `
+                FROM ` + s.registration.table + `
+               WHERE ` + s.registration.issuer + ` = $1
+                 AND ` + s.registration.clientID + ` = $2`
+	existing := make([]string, len(args))
+	err := tx.QueryRow(s.rebind(q), args[0], args[1]).Scan(&existing[0], &existing[1], &existing[2], &existing[3],
+		&existing[4], &existing[5], &existing[6])
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(insert(s.dialect, s.registration.table, s.registration.columns), args...)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range args {
+		if existing[i] != args[i] {
+			return datastore.ErrRegistrationExists
+		}
+	}
+	return nil
+}
+
+// FindRegistrationByIssuerAndClientID retrieves a registration from the SQL database. Without a client ID, it returns
+// datastore.ErrAmbiguousRegistration if the issuer has several registrations.
 func (s *Store) FindRegistrationByIssuerAndClientID(issuer, clientID string) (datastore.Registration, error) {
 	if issuer == "" {
 		return datastore.Registration{}, errors.New("received empty issuer argument")
@@ -169,68 +564,171 @@ func (s *Store) FindRegistrationByIssuerAndClientID(issuer, clientID string) (da
 		qArgs = append(qArgs, clientID)
 	}
 
-	var (
-		reg                                                  datastore.Registration
-		authTokenURI, authLoginURI, keysetURI, targetLinkURI string
-	)
-	err := s.DB.QueryRow(q, qArgs...).Scan(&reg.Issuer, &reg.ClientID, &authTokenURI, &authLoginURI,
-		&keysetURI, &targetLinkURI)
+	registrations, err := s.queryRegistrations(q, qArgs...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return datastore.Registration{}, datastore.ErrRegistrationNotFound
-		}
 		return datastore.Registration{}, err
 	}
+	switch len(registrations) {
+	case 0:
+		return datastore.Registration{}, datastore.ErrRegistrationNotFound
+	case 1:
+		return registrations[0], nil
+	default:
+		return datastore.Registration{}, datastore.ErrAmbiguousRegistration
+	}
+}
+
+// ListRegistrations retrieves the registrations from the SQL database, optionally limited to those of `issuer',
+// ordered by issuer and client ID.
+func (s *Store) ListRegistrations(issuer string) ([]datastore.Registration, error) {
+	q := `SELECT ` + s.registration.fields + `
+                FROM ` + s.registration.table
+	qArgs := []interface{}{}
+	if issuer != "" {
+		q += `
+               WHERE ` + s.registration.issuer + ` = $1`
+		qArgs = append(qArgs, issuer)
+	}
 
-	reg.AuthTokenURI, err = url.Parse(authTokenURI)
+	registrations, err := s.queryRegistrations(q, qArgs...)
 	if err != nil {
-		return datastore.Registration{}, err
+		return nil, err
 	}
-	reg.AuthLoginURI, err = url.Parse(authLoginURI)
+
+	// Sort here rather than in the query: not every supported driver orders rows reliably.
+	sort.Slice(registrations, func(i, j int) bool {
+		if registrations[i].Issuer != registrations[j].Issuer {
+			return registrations[i].Issuer < registrations[j].Issuer
+		}
+		return registrations[i].ClientID < registrations[j].ClientID
+	})
+	return registrations, nil
+}
+
+// queryRegistrations runs a query selecting the registration fields and returns the registrations found.
+func (s *Store) queryRegistrations(q string, args ...interface{}) ([]datastore.Registration, error) {
+	rows, err := s.DB.Query(s.rebind(q), args...)
 	if err != nil {
-		return datastore.Registration{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	registrations := []datastore.Registration{}
+	for rows.Next() {
+		var (
+			reg                                                  datastore.Registration
+			authTokenURI, authLoginURI, keysetURI, targetLinkURI string
+			provisioning                                         string
+		)
+		err = rows.Scan(&reg.Issuer, &reg.ClientID, &authTokenURI, &authLoginURI, &keysetURI, &targetLinkURI,
+			&provisioning)
+		if err != nil {
+			return nil, err
+		}
+
+		reg.AuthTokenURI, err = url.Parse(authTokenURI)
+		if err != nil {
+			return nil, err
+		}
+		reg.AuthLoginURI, err = url.Parse(authLoginURI)
+		if err != nil {
+			return nil, err
+		}
+		reg.KeysetURI, err = url.Parse(keysetURI)
+		if err != nil {
+			return nil, err
+		}
+		reg.TargetLinkURI, err = url.Parse(targetLinkURI)
+		if err != nil {
+			return nil, err
+		}
+		reg.Provisioning = datastore.ProvisioningPolicy(provisioning)
+
+		registrations = append(registrations, reg)
 	}
-	reg.KeysetURI, err = url.Parse(keysetURI)
+
+	return registrations, rows.Err()
+}
+
+// UpdateRegistration replaces the registration with the same issuer and client ID in the SQL database.
+func (s *Store) UpdateRegistration(reg datastore.Registration) error {
+	tx, err := s.DB.Begin()
 	if err != nil {
-		return datastore.Registration{}, err
+		return err
+	}
+
+	keys := []string{s.registration.issuer, s.registration.clientID}
+	err = s.update(tx, s.registration.table, s.registration.columns, keys, reg.Issuer, reg.ClientID,
+		reg.AuthTokenURI.String(), reg.AuthLoginURI.String(), reg.KeysetURI.String(), reg.TargetLinkURI.String(),
+		string(reg.Provisioning))
+	if err == errRowNotFound {
+		err = datastore.ErrRegistrationNotFound
 	}
-	reg.TargetLinkURI, err = url.Parse(targetLinkURI)
 	if err != nil {
-		return datastore.Registration{}, err
+		tx.Rollback()
+		return err
 	}
 
-	return reg, nil
+	return tx.Commit()
 }
 
-// StoreDeployment stores a deployment in the SQL database.
-func (s *Store) StoreDeployment(issuer string, d datastore.Deployment) error {
+// DeleteRegistration removes a registration and its deployments from the SQL database.
+func (s *Store) DeleteRegistration(issuer, clientID string) error {
 	if issuer == "" {
 		return errors.New("received empty issuer argument")
 	}
-	if err := datastore.ValidateDeploymentID(d.DeploymentID); err != nil {
-		return fmt.Errorf("received invalid deployment ID: %v", err)
-	}
 
 	tx, err := s.DB.Begin()
 	if err != nil {
 		return err
 	}
 
-	q := `INSERT INTO ` + s.deployment.table + ` (` + s.deployment.issuer + `,` + s.deployment.deploymentID + `)
-                   VALUES ($1, $2)`
-	result, err := tx.Exec(q, issuer, d.DeploymentID)
+	keys := []string{s.registration.issuer, s.registration.clientID}
+	err = s.delete(tx, s.registration.table, keys, issuer, clientID)
+	if err == errRowNotFound {
+		err = datastore.ErrRegistrationNotFound
+	}
+	if err == nil {
+		q := `DELETE FROM ` + s.deployment.table + `
+               WHERE ` + s.deployment.issuer + ` = $1
+                 AND ` + s.deployment.clientID + ` = $2`
+		_, err = tx.Exec(s.rebind(q), issuer, clientID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	return tx.Commit()
+}
+
+// StoreDeployment stores a deployment of the registration identified by `issuer' and `clientID' in the SQL database,
+// replacing an existing deployment with the same deployment ID. The allowed context IDs, features and metadata are
+// stored as JSON, and the first-seen time as Unix seconds.
+func (s *Store) StoreDeployment(issuer, clientID string, d datastore.Deployment) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+	if clientID == "" {
+		return errors.New("received empty client ID argument")
+	}
+	if err := datastore.ValidateDeploymentID(d.DeploymentID); err != nil {
+		return fmt.Errorf("received invalid deployment ID: %v", err)
+	}
+
+	args, err := deploymentArgs(issuer, clientID, d)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	if rowsAffected != 1 {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	keys := s.deployment.columns[:3]
+	err = s.upsert(tx, s.deployment.table, s.deployment.columns, keys, args...)
+	if err != nil {
 		tx.Rollback()
 		return err
 	}
@@ -243,28 +741,743 @@ func (s *Store) StoreDeployment(issuer string, d datastore.Deployment) error {
 	return nil
 }
 
-// FindDeployment looks up and returns either a Deployment by the issuer and deployment ID or the datastore error
-// ErrDeploymentNotFound.
-func (s *Store) FindDeployment(issuer, deploymentID string) (datastore.Deployment, error) {
+// deploymentArgs returns the values of the deployment columns for a deployment. Empty lists and maps are stored as `[]'
+// and `{}' rather than JSON null, which some drivers mistake for SQL NULL.
+func deploymentArgs(issuer, clientID string, d datastore.Deployment) ([]interface{}, error) {
+	allowedContextIDs, features, metadata := []byte("[]"), []byte("{}"), []byte("{}")
+	var err error
+	if len(d.AllowedContextIDs) > 0 {
+		allowedContextIDs, err = json.Marshal(d.AllowedContextIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(d.Features) > 0 {
+		features, err = json.Marshal(d.Features)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(d.Metadata) > 0 {
+		metadata, err = json.Marshal(d.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var disabled, pending, firstSeen int64
+	if d.Disabled {
+		disabled = 1
+	}
+	if d.Pending {
+		pending = 1
+	}
+	if !d.FirstSeen.IsZero() {
+		firstSeen = d.FirstSeen.Unix()
+	}
+
+	return []interface{}{issuer, clientID, d.DeploymentID, d.Name, disabled, string(allowedContextIDs),
+		string(features), string(metadata), pending, firstSeen}, nil
+}
+
+// FindDeployment looks up and returns either a Deployment by the issuer, client ID and deployment ID or the datastore
+// error ErrDeploymentNotFound.
+func (s *Store) FindDeployment(issuer, clientID, deploymentID string) (datastore.Deployment, error) {
 	if issuer == "" {
 		return datastore.Deployment{}, errors.New("received empty issuer argument")
 	}
+	if clientID == "" {
+		return datastore.Deployment{}, errors.New("received empty client ID argument")
+	}
 	if err := datastore.ValidateDeploymentID(deploymentID); err != nil {
 		return datastore.Deployment{}, fmt.Errorf("received invalid deployment ID: %v", err)
 	}
 
-	q := `SELECT ` + s.deployment.deploymentID + `
+	q := `SELECT ` + s.deployment.fields + `
                 FROM ` + s.deployment.table + `
                WHERE ` + s.deployment.issuer + ` = $1
-                 AND ` + s.deployment.deploymentID + ` = $2`
-	deployment := datastore.Deployment{}
-	err := s.DB.QueryRow(q, issuer, deploymentID).Scan(&deployment.DeploymentID)
+                 AND ` + s.deployment.clientID + ` = $2
+                 AND ` + s.deployment.deploymentID + ` = $3`
+	deployments, err := s.queryDeployments(q, issuer, clientID, deploymentID)
+	if err != nil {
+		return datastore.Deployment{}, err
+	}
+	if len(deployments) == 0 {
+		return datastore.Deployment{}, datastore.ErrDeploymentNotFound
+	}
+
+	return deployments[0], nil
+}
+
+// ListDeployments retrieves the deployments of the registration identified by `issuer' and `clientID' from the SQL
+// database, ordered by deployment ID. An empty `clientID' lists the deployments that the migration scoping
+// deployments to registrations could not assign to a single registration of their issuer.
+func (s *Store) ListDeployments(issuer, clientID string) ([]datastore.Deployment, error) {
+	if issuer == "" {
+		return nil, errors.New("received empty issuer argument")
+	}
+
+	q := `SELECT ` + s.deployment.fields + `
+                FROM ` + s.deployment.table + `
+               WHERE ` + s.deployment.issuer + ` = $1
+                 AND ` + s.deployment.clientID + ` = $2`
+	deployments, err := s.queryDeployments(q, issuer, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].DeploymentID < deployments[j].DeploymentID
+	})
+	return deployments, nil
+}
+
+// queryDeployments runs a query selecting the deployment fields and returns the deployments found.
+func (s *Store) queryDeployments(q string, args ...interface{}) ([]datastore.Deployment, error) {
+	rows, err := s.DB.Query(s.rebind(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := []datastore.Deployment{}
+	for rows.Next() {
+		var (
+			d                                     datastore.Deployment
+			disabled, pending, firstSeen          int64
+			allowedContextIDs, features, metadata string
+		)
+		err = rows.Scan(&d.DeploymentID, &d.Name, &disabled, &allowedContextIDs, &features, &metadata, &pending,
+			&firstSeen)
+		if err != nil {
+			return nil, err
+		}
+
+		d.Disabled = disabled != 0
+		d.Pending = pending != 0
+		if firstSeen != 0 {
+			d.FirstSeen = time.Unix(firstSeen, 0)
+		}
+		err = json.Unmarshal([]byte(allowedContextIDs), &d.AllowedContextIDs)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(features), &d.Features)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(metadata), &d.Metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		// Return empty lists and maps as nil, as they were most likely stored.
+		if len(d.AllowedContextIDs) == 0 {
+			d.AllowedContextIDs = nil
+		}
+		if len(d.Features) == 0 {
+			d.Features = nil
+		}
+		if len(d.Metadata) == 0 {
+			d.Metadata = nil
+		}
+
+		deployments = append(deployments, d)
+	}
+
+	return deployments, rows.Err()
+}
+
+// UpdateDeployment replaces the deployment of the registration with the same deployment ID in the SQL database.
+func (s *Store) UpdateDeployment(issuer, clientID string, d datastore.Deployment) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+	if err := datastore.ValidateDeploymentID(d.DeploymentID); err != nil {
+		return fmt.Errorf("received invalid deployment ID: %v", err)
+	}
+
+	args, err := deploymentArgs(issuer, clientID, d)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	keys := s.deployment.columns[:3]
+	err = s.update(tx, s.deployment.table, s.deployment.columns, keys, args...)
+	if err == errRowNotFound {
+		err = datastore.ErrDeploymentNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteDeployment removes a deployment from the SQL database. An empty `clientID' removes a deployment that is not
+// assigned to a registration; see ListDeployments.
+func (s *Store) DeleteDeployment(issuer, clientID, deploymentID string) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+	if err := datastore.ValidateDeploymentID(deploymentID); err != nil {
+		return fmt.Errorf("received invalid deployment ID: %v", err)
+	}
+
+	keys := []string{s.deployment.issuer, s.deployment.clientID, s.deployment.deploymentID}
+	err := s.delete(s.DB, s.deployment.table, keys, issuer, clientID, deploymentID)
+	if err == errRowNotFound {
+		return datastore.ErrDeploymentNotFound
+	}
+	return err
+}
+
+// StoreNonce stores a nonce in the SQL database. Its issue and expiry times are stored as Unix seconds. Storing a
+// nonce also purges the expired nonces of abandoned logins, at most once per minute.
+func (s *Store) StoreNonce(nonce datastore.Nonce) error {
+	if nonce.Value == "" {
+		return errors.New("received empty nonce argument")
+	}
+	if nonce.TargetLinkURI == "" {
+		return errors.New("received empty target link uri argument")
+	}
+
+	now := time.Now()
+	if nonce.IssuedAt.IsZero() {
+		nonce.IssuedAt = now
+	}
+	if nonce.MaxAge <= 0 {
+		nonce.MaxAge = datastore.DefaultNonceMaxAge
+	}
+
+	if s.nonceSweep.Due(now) {
+		// A failed purge does not fail the login; the next sweep, or the Janitor, purges the nonces.
+		s.PurgeExpiredNonces(now)
+	}
+
+	q := `INSERT INTO ` + s.nonce.table + ` (` + s.nonce.nonce + `,` + s.nonce.targetLinkURI + `,` +
+		s.nonce.issuedAt + `,` + s.nonce.expiresAt + `)
+                   VALUES ($1, $2, $3, $4)`
+	_, err := s.DB.Exec(s.rebind(q), nonce.Value, nonce.TargetLinkURI, nonce.IssuedAt.Unix(),
+		nonce.IssuedAt.Add(nonce.MaxAge).Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TestAndClearNonce looks up a nonce in the SQL database and deletes it. Only the launch whose DELETE removes the row
+// may use the nonce, so when concurrent launches present the same nonce, all but one get ErrNonceNotFound. Stale
+// nonces return ErrNonceExpired and nonces issued for another target link URI return ErrNonceTargetLinkURIMismatch.
+func (s *Store) TestAndClearNonce(nonce, targetLinkURI string) error {
+	if nonce == "" {
+		return errors.New("received empty nonce argument")
+	}
+	if targetLinkURI == "" {
+		return errors.New("received empty target link uri argument")
+	}
+
+	q := `SELECT ` + s.nonce.targetLinkURI + `,` + s.nonce.expiresAt + `
+                FROM ` + s.nonce.table + `
+               WHERE ` + s.nonce.nonce + ` = $1`
+	var (
+		checkURI  string
+		expiresAt int64
+	)
+	err := s.DB.QueryRow(s.rebind(q), nonce).Scan(&checkURI, &expiresAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return datastore.Deployment{}, datastore.ErrRegistrationNotFound
+			return datastore.ErrNonceNotFound
 		}
-		return datastore.Deployment{}, err
+		return err
+	}
+
+	q = `DELETE FROM ` + s.nonce.table + `
+               WHERE ` + s.nonce.nonce + ` = $1`
+	result, err := s.DB.Exec(s.rebind(q), nonce)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != 1 {
+		// Another launch cleared the nonce first.
+		return datastore.ErrNonceNotFound
+	}
+
+	if !time.Unix(expiresAt, 0).After(time.Now()) {
+		return datastore.ErrNonceExpired
+	}
+	if checkURI != targetLinkURI {
+		return datastore.ErrNonceTargetLinkURIMismatch
+	}
+
+	return nil
+}
+
+// PurgeExpiredNonces removes the nonces that expired before `now' and returns the number of rows removed.
+func (s *Store) PurgeExpiredNonces(now time.Time) (int, error) {
+	q := `DELETE FROM ` + s.nonce.table + `
+               WHERE ` + s.nonce.expiresAt + ` <= $1`
+	result, err := s.DB.Exec(s.rebind(q), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+// StoreLaunchData stores the launch data, i.e. the id_token payload, in the SQL database. The creation time is stored
+// as Unix seconds.
+func (s *Store) StoreLaunchData(launchID string, launchData json.RawMessage) error {
+	if launchID == "" {
+		return errors.New("received empty launchID argument")
+	}
+	if len(launchData) == 0 {
+		return errors.New("received empty launchData argument")
+	}
+
+	q := `INSERT INTO ` + s.launchData.table + ` (` + s.launchData.launchID + `,` + s.launchData.launchData + `,` +
+		s.launchData.createdAt + `)
+                   VALUES ($1, $2, $3)`
+	_, err := s.DB.Exec(s.rebind(q), launchID, string(launchData), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FindLaunchData retrieves launch data from the SQL database. Launch data that has outlived the configured TTL is
+// reported as ErrLaunchDataNotFound; it is left for PurgeExpiredLaunchData to remove.
+func (s *Store) FindLaunchData(launchID string) (json.RawMessage, error) {
+	if launchID == "" {
+		return nil, errors.New("received empty launchID argument")
+	}
+
+	q := `SELECT ` + s.launchData.launchData + `,` + s.launchData.createdAt + `
+                FROM ` + s.launchData.table + `
+               WHERE ` + s.launchData.launchID + ` = $1`
+	var (
+		launchData string
+		createdAt  int64
+	)
+	err := s.DB.QueryRow(s.rebind(q), launchID).Scan(&launchData, &createdAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, datastore.ErrLaunchDataNotFound
+		}
+		return nil, err
+	}
+
+	if s.launchData.ttl > 0 && !time.Unix(createdAt, 0).Add(s.launchData.ttl).After(time.Now()) {
+		return nil, datastore.ErrLaunchDataNotFound
+	}
+
+	return json.RawMessage(launchData), nil
+}
+
+// PurgeExpiredLaunchData removes the launch data that expired before `now' and returns the number of rows removed. It
+// is a datastore.PurgeFunc meant to be run by a datastore.Janitor. With a zero TTL, nothing is removed.
+func (s *Store) PurgeExpiredLaunchData(now time.Time) (int, error) {
+	if s.launchData.ttl <= 0 {
+		return 0, nil
+	}
+
+	q := `DELETE FROM ` + s.launchData.table + `
+               WHERE ` + s.launchData.createdAt + ` <= $1`
+	result, err := s.DB.Exec(s.rebind(q), now.Add(-s.launchData.ttl).Unix())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+// sortedScopes returns the scopes sorted and space-separated, as they are stored in the access token table.
+func sortedScopes(scopes []string) string {
+	sorted := make([]string, len(scopes))
+	copy(sorted, scopes)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+// StoreAccessToken stores an access token in the SQL database, replacing any token previously stored for the same
+// token URI, client ID and scopes. The expiry time is stored as Unix seconds.
+func (s *Store) StoreAccessToken(token datastore.AccessToken) error {
+	if token.TokenURI == "" {
+		return errors.New("received empty tokenURI")
+	}
+	if token.ClientID == "" {
+		return errors.New("received empty clientID")
+	}
+	if len(token.Scopes) == 0 {
+		return errors.New("received empty scopes")
+	}
+	if token.Token == "" {
+		return errors.New("received empty accessToken")
+	}
+	if token.ExpiryTime.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	scopes := sortedScopes(token.Scopes)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	q := `DELETE FROM ` + s.accessToken.table + `
+               WHERE ` + s.accessToken.tokenURI + ` = $1
+                 AND ` + s.accessToken.clientID + ` = $2
+                 AND ` + s.accessToken.scopes + ` = $3`
+	_, err = tx.Exec(s.rebind(q), token.TokenURI, token.ClientID, scopes)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	q = `INSERT INTO ` + s.accessToken.table + ` (` + s.accessToken.tokenURI + `,` + s.accessToken.clientID + `,` +
+		s.accessToken.scopes + `,` + s.accessToken.token + `,` + s.accessToken.expiryTime + `)
+                   VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(s.rebind(q), token.TokenURI, token.ClientID, scopes, token.Token, token.ExpiryTime.Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindAccessToken retrieves an access token from the SQL database. A token whose scopes include `scopes' qualifies,
+// regardless of their order, and the one that expires last is returned.
+func (s *Store) FindAccessToken(tokenURI, clientID string, scopes []string) (datastore.AccessToken, error) {
+	if tokenURI == "" {
+		return datastore.AccessToken{}, errors.New("received empty tokenURI")
+	}
+	if clientID == "" {
+		return datastore.AccessToken{}, errors.New("received empty clientID")
+	}
+	if len(scopes) == 0 {
+		return datastore.AccessToken{}, errors.New("received empty scopes")
+	}
+
+	// Scope lists are stored as sorted, space-separated strings, so superset matching is done here.
+	q := `SELECT ` + s.accessToken.scopes + `,` + s.accessToken.token + `,` + s.accessToken.expiryTime + `
+                FROM ` + s.accessToken.table + `
+               WHERE ` + s.accessToken.tokenURI + ` = $1
+                 AND ` + s.accessToken.clientID + ` = $2`
+	rows, err := s.DB.Query(s.rebind(q), tokenURI, clientID)
+	if err != nil {
+		return datastore.AccessToken{}, err
+	}
+	defer rows.Close()
+
+	var (
+		found   datastore.AccessToken
+		expired bool
+		now     = time.Now()
+	)
+	for rows.Next() {
+		var (
+			accessToken = datastore.AccessToken{TokenURI: tokenURI, ClientID: clientID}
+			foundScopes string
+			expiryTime  int64
+		)
+		err = rows.Scan(&foundScopes, &accessToken.Token, &expiryTime)
+		if err != nil {
+			return datastore.AccessToken{}, err
+		}
+		accessToken.Scopes = strings.Fields(foundScopes)
+		accessToken.ExpiryTime = time.Unix(expiryTime, 0)
+
+		if !accessToken.HasScopes(scopes) {
+			continue
+		}
+		if accessToken.ExpiryTime.Before(now) {
+			expired = true
+			continue
+		}
+		if accessToken.ExpiryTime.After(found.ExpiryTime) {
+			found = accessToken
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return datastore.AccessToken{}, err
+	}
+
+	if found.Token == "" {
+		if expired {
+			return datastore.AccessToken{}, datastore.ErrAccessTokenExpired
+		}
+		return datastore.AccessToken{}, datastore.ErrAccessTokenNotFound
+	}
+
+	return found, nil
+}
+
+// DeleteAccessToken deletes the access token stored in the SQL database for the token URI, client ID and scopes of
+// `token', if it is still `token.Token'.
+func (s *Store) DeleteAccessToken(token datastore.AccessToken) error {
+	q := `DELETE FROM ` + s.accessToken.table + `
+               WHERE ` + s.accessToken.tokenURI + ` = $1
+                 AND ` + s.accessToken.clientID + ` = $2
+                 AND ` + s.accessToken.scopes + ` = $3
+                 AND ` + s.accessToken.token + ` = $4`
+	_, err := s.DB.Exec(s.rebind(q), token.TokenURI, token.ClientID, sortedScopes(token.Scopes), token.Token)
+	return err
+}
+
+// TestAndSetTokenID records an id_token as used in the SQL database until it expires. If the token is already recorded
+// and unexpired, it returns ErrTokenReplayed. The table must have a primary key on the issuer and token ID columns:
+// of two concurrent launches with the same id_token, only one can insert it, and the insert of the other fails on the
+// key and is reported as a replay. Recording a token also purges expired tokens, at most once per minute.
+func (s *Store) TestAndSetTokenID(issuer, tokenID string, expiresAt time.Time) error {
+	if issuer == "" {
+		return errors.New("received empty issuer argument")
+	}
+	if tokenID == "" {
+		return errors.New("received empty token ID argument")
+	}
+
+	now := time.Now()
+	if s.replaySweep.Due(now) {
+		// A failed purge does not fail the launch; the next sweep, or the Janitor, purges the tokens.
+		s.PurgeExpiredTokenIDs(now)
+	}
+
+	// Forget the token if it is recorded but has expired and has not been purged yet.
+	q := `DELETE FROM ` + s.replay.table + `
+               WHERE ` + s.replay.issuer + ` = $1
+                 AND ` + s.replay.tokenID + ` = $2
+                 AND ` + s.replay.expiresAt + ` <= $3`
+	_, err := s.DB.Exec(s.rebind(q), issuer, tokenID, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	q = `INSERT INTO ` + s.replay.table + ` (` + s.replay.issuer + `,` + s.replay.tokenID + `,` + s.replay.expiresAt + `)
+                   VALUES ($1, $2, $3)`
+	_, err = s.DB.Exec(s.rebind(q), issuer, tokenID, expiresAt.Unix())
+	if err != nil {
+		// The error of a duplicate key differs between drivers, so look the token up to tell a replay apart.
+		q = `SELECT COUNT(*)
+                   FROM ` + s.replay.table + `
+                  WHERE ` + s.replay.issuer + ` = $1
+                    AND ` + s.replay.tokenID + ` = $2`
+		var count int
+		if s.DB.QueryRow(s.rebind(q), issuer, tokenID).Scan(&count) == nil && count > 0 {
+			return datastore.ErrTokenReplayed
+		}
+		return err
+	}
+
+	return nil
+}
+
+// PurgeExpiredTokenIDs removes the recorded id_tokens that expired before `now' and returns the number of rows
+// removed.
+func (s *Store) PurgeExpiredTokenIDs(now time.Time) (int, error) {
+	q := `DELETE FROM ` + s.replay.table + `
+               WHERE ` + s.replay.expiresAt + ` <= $1`
+	result, err := s.DB.Exec(s.rebind(q), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+// StoreHandoffCode stores a hand-off code in the SQL database. The expiry time is stored as Unix seconds.
+func (s *Store) StoreHandoffCode(code datastore.HandoffCode) error {
+	if code.Code == "" {
+		return errors.New("received empty hand-off code")
+	}
+	if code.LaunchID == "" {
+		return errors.New("received empty launch ID")
+	}
+	if code.ExpiresAt.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	q := `INSERT INTO ` + s.handoffCode.table + ` (` + s.handoffCode.code + `,` + s.handoffCode.launchID + `,` +
+		s.handoffCode.expiresAt + `)
+                   VALUES ($1, $2, $3)`
+	_, err := s.DB.Exec(s.rebind(q), code.Code, code.LaunchID, code.ExpiresAt.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TestAndClearHandoffCode retrieves and deletes a hand-off code from the SQL database. Only the request whose DELETE
+// removes the row may use the code, so concurrent exchanges of the same code cannot both succeed.
+func (s *Store) TestAndClearHandoffCode(code string) (datastore.HandoffCode, error) {
+	if code == "" {
+		return datastore.HandoffCode{}, errors.New("received empty hand-off code")
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return datastore.HandoffCode{}, err
+	}
+
+	q := `SELECT ` + s.handoffCode.launchID + `,` + s.handoffCode.expiresAt + `
+                FROM ` + s.handoffCode.table + `
+               WHERE ` + s.handoffCode.code + ` = $1`
+	var (
+		handoffCode = datastore.HandoffCode{Code: code}
+		expiresAt   int64
+	)
+	err = tx.QueryRow(s.rebind(q), code).Scan(&handoffCode.LaunchID, &expiresAt)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return datastore.HandoffCode{}, datastore.ErrHandoffCodeNotFound
+		}
+		return datastore.HandoffCode{}, err
+	}
+
+	q = `DELETE FROM ` + s.handoffCode.table + `
+               WHERE ` + s.handoffCode.code + ` = $1`
+	result, err := tx.Exec(s.rebind(q), code)
+	if err != nil {
+		tx.Rollback()
+		return datastore.HandoffCode{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return datastore.HandoffCode{}, err
+	}
+	if rowsAffected != 1 {
+		// Another exchange removed the code first.
+		tx.Rollback()
+		return datastore.HandoffCode{}, datastore.ErrHandoffCodeNotFound
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return datastore.HandoffCode{}, err
+	}
+
+	handoffCode.ExpiresAt = time.Unix(expiresAt, 0)
+	if handoffCode.ExpiresAt.Before(time.Now()) {
+		return datastore.HandoffCode{}, datastore.ErrHandoffCodeExpired
+	}
+
+	return handoffCode, nil
+}
+
+// PurgeExpiredHandoffCodes removes the hand-off codes that expired before `now' and returns the number of rows
+// removed. It is a datastore.PurgeFunc meant to be run by a datastore.Janitor, since codes that are never exchanged
+// are otherwise kept forever.
+func (s *Store) PurgeExpiredHandoffCodes(now time.Time) (int, error) {
+	q := `DELETE FROM ` + s.handoffCode.table + `
+               WHERE ` + s.handoffCode.expiresAt + ` < $1`
+	result, err := s.DB.Exec(s.rebind(q), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
+
+// StoreHandoffToken stores a hand-off access token in the SQL database. Scopes are stored space-separated and the
+// expiry time as Unix seconds.
+func (s *Store) StoreHandoffToken(token datastore.HandoffToken) error {
+	if token.Token == "" {
+		return errors.New("received empty hand-off token")
+	}
+	if token.LaunchID == "" {
+		return errors.New("received empty launch ID")
+	}
+	if token.ExpiresAt.IsZero() {
+		return errors.New("received empty expiry time")
+	}
+
+	q := `INSERT INTO ` + s.handoffToken.table + ` (` + s.handoffToken.token + `,` + s.handoffToken.launchID + `,` +
+		s.handoffToken.scopes + `,` + s.handoffToken.expiresAt + `)
+                   VALUES ($1, $2, $3, $4)`
+	_, err := s.DB.Exec(s.rebind(q), token.Token, token.LaunchID, strings.Join(token.Scopes, " "), token.ExpiresAt.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// FindHandoffToken retrieves a hand-off access token from the SQL database.
+func (s *Store) FindHandoffToken(token string) (datastore.HandoffToken, error) {
+	if token == "" {
+		return datastore.HandoffToken{}, errors.New("received empty hand-off token")
+	}
+
+	q := `SELECT ` + s.handoffToken.launchID + `,` + s.handoffToken.scopes + `,` + s.handoffToken.expiresAt + `
+                FROM ` + s.handoffToken.table + `
+               WHERE ` + s.handoffToken.token + ` = $1`
+	var (
+		handoffToken = datastore.HandoffToken{Token: token}
+		scopes       string
+		expiresAt    int64
+	)
+	err := s.DB.QueryRow(s.rebind(q), token).Scan(&handoffToken.LaunchID, &scopes, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return datastore.HandoffToken{}, datastore.ErrHandoffTokenNotFound
+		}
+		return datastore.HandoffToken{}, err
+	}
+
+	handoffToken.Scopes = strings.Fields(scopes)
+	handoffToken.ExpiresAt = time.Unix(expiresAt, 0)
+	if handoffToken.ExpiresAt.Before(time.Now()) {
+		return datastore.HandoffToken{}, datastore.ErrHandoffTokenExpired
+	}
+
+	return handoffToken, nil
+}
+
+// PurgeExpiredHandoffTokens removes the hand-off access tokens that expired before `now' and returns the number of
+// rows removed. It is a datastore.PurgeFunc meant to be run by a datastore.Janitor.
+func (s *Store) PurgeExpiredHandoffTokens(now time.Time) (int, error) {
+	q := `DELETE FROM ` + s.handoffToken.table + `
+               WHERE ` + s.handoffToken.expiresAt + ` < $1`
+	result, err := s.DB.Exec(s.rebind(q), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
 	}
 
-	return deployment, nil
+	return int(rowsAffected), nil
 }
@@ -7,9 +7,14 @@ package sql
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 	_ "github.com/mlhoyt/ramsql/driver"
@@ -18,6 +23,7 @@ import (
 func TestNewConfig(t *testing.T) {
 	actualConfig := NewConfig()
 	expectedConfig := Config{
+		Dialect:           PostgreSQL,
 		RegistrationTable: "registration",
 		RegistrationFields: RegistrationFields{
 			Issuer:        "issuer",
@@ -26,11 +32,66 @@ func TestNewConfig(t *testing.T) {
 			AuthLoginURI:  "auth_login_uri",
 			KeysetURI:     "keyset_uri",
 			TargetLinkURI: "target_link_uri",
+			Provisioning:  "provisioning",
 		},
 		DeploymentTable: "deployment",
 		DeploymentFields: DeploymentFields{
-			Issuer:       "issuer",
-			DeploymentID: "deployment_id",
+			Issuer:            "issuer",
+			ClientID:          "client_id",
+			DeploymentID:      "deployment_id",
+			Name:              "name",
+			Disabled:          "disabled",
+			AllowedContextIDs: "allowed_context_ids",
+			Features:          "features",
+			Metadata:          "metadata",
+			Pending:           "pending",
+			FirstSeen:         "first_seen",
+		},
+		NonceTable: "nonce",
+		NonceFields: NonceFields{
+			Nonce:         "nonce",
+			TargetLinkURI: "target_link_uri",
+			IssuedAt:      "issued_at",
+			ExpiresAt:     "expires_at",
+		},
+		LaunchDataTable: "launch_data",
+		LaunchDataFields: LaunchDataFields{
+			LaunchID:   "launch_id",
+			LaunchData: "launch_data",
+			CreatedAt:  "created_at",
+		},
+		LaunchDataTTL:    datastore.DefaultLaunchDataTTL,
+		AccessTokenTable: "access_token",
+		AccessTokenFields: AccessTokenFields{
+			TokenURI:   "token_uri",
+			ClientID:   "client_id",
+			Scopes:     "scopes",
+			Token:      "token",
+			ExpiryTime: "expiry_time",
+		},
+		ReplayTable: "token_replay",
+		ReplayFields: ReplayFields{
+			Issuer:    "issuer",
+			TokenID:   "token_id",
+			ExpiresAt: "expires_at",
+		},
+		HandoffCodeTable: "handoff_code",
+		HandoffCodeFields: HandoffCodeFields{
+			Code:      "code",
+			LaunchID:  "launch_id",
+			ExpiresAt: "expires_at",
+		},
+		HandoffTokenTable: "handoff_token",
+		HandoffTokenFields: HandoffTokenFields{
+			Token:     "token",
+			LaunchID:  "launch_id",
+			Scopes:    "scopes",
+			ExpiresAt: "expires_at",
+		},
+		MigrationTable: "schema_migrations",
+		MigrationFields: MigrationFields{
+			Version:   "version",
+			AppliedAt: "applied_at",
 		},
 	}
 
@@ -63,6 +124,22 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// ramsqlDialect is the PostgreSQL dialect without upsert statements, which the `ramsql' driver cannot parse.
+type ramsqlDialect struct {
+	Dialect
+}
+
+func (ramsqlDialect) Upsert(table string, columns []string, keys []string) string {
+	return ""
+}
+
+// newRamsqlConfig returns the default configuration with a dialect suitable for the `ramsql' driver.
+func newRamsqlConfig() Config {
+	config := NewConfig()
+	config.Dialect = ramsqlDialect{PostgreSQL}
+	return config
+}
+
 func mustExec(t *testing.T, db *sql.DB, query string) {
 	_, err := db.Exec(query)
 	if err != nil {
@@ -105,10 +182,11 @@ func TestStoreRegistration(t *testing.T) {
                            auth_login_uri text,
                            keyset_uri text,
                            target_link_uri text,
+                           provisioning text,
                            PRIMARY KEY (issuer, client_id)
                          )`)
 
-	store := New(db, NewConfig())
+	store := New(db, newRamsqlConfig())
 	registration := newRegistrationForTesting(t)
 
 	err = store.StoreRegistration(registration)
@@ -135,10 +213,11 @@ func TestStoreAndFindRegistrationByIssuerAndClientID(t *testing.T) {
                            auth_login_uri text,
                            keyset_uri text,
                            target_link_uri text,
+                           provisioning text,
                            PRIMARY KEY (issuer, client_id)
                          )`)
 
-	store := New(db, NewConfig())
+	store := New(db, newRamsqlConfig())
 	registration := newRegistrationForTesting(t)
 
 	err = store.StoreRegistration(registration)
@@ -174,20 +253,33 @@ func TestStoreDeployment(t *testing.T) {
 	// The `ramsql' driver does not handle a unique constraint involving two columns.
 	mustExec(t, db, `CREATE TABLE deployment (
                            issuer text,
-                           deployment_id text
+                           client_id text,
+                           deployment_id text,
+                           name text,
+                           disabled bigint,
+                           allowed_context_ids text,
+                           features text,
+                           metadata text,
+                           pending bigint,
+                           first_seen bigint
                          )`)
 
-	store := New(db, NewConfig())
+	store := New(db, newRamsqlConfig())
 
-	err = store.StoreDeployment("a", datastore.Deployment{DeploymentID: "b"})
+	err = store.StoreDeployment("a", "c", datastore.Deployment{DeploymentID: "b"})
 	if err != nil {
 		t.Fatalf("cannot store deployment")
 	}
 
-	err = store.StoreDeployment("", datastore.Deployment{DeploymentID: "b"})
+	err = store.StoreDeployment("", "c", datastore.Deployment{DeploymentID: "b"})
 	if err == nil {
 		t.Errorf("issuer not validated")
 	}
+
+	err = store.StoreDeployment("a", "", datastore.Deployment{DeploymentID: "b"})
+	if err == nil {
+		t.Errorf("client ID not validated")
+	}
 }
 
 func TestFindDeployment(t *testing.T) {
@@ -200,17 +292,25 @@ func TestFindDeployment(t *testing.T) {
 	// The `ramsql' driver does not handle a unique constraint involving two columns.
 	mustExec(t, db, `CREATE TABLE deployment (
                            issuer text,
-                           deployment_id text
+                           client_id text,
+                           deployment_id text,
+                           name text,
+                           disabled bigint,
+                           allowed_context_ids text,
+                           features text,
+                           metadata text,
+                           pending bigint,
+                           first_seen bigint
                          )`)
 
-	store := New(db, NewConfig())
+	store := New(db, newRamsqlConfig())
 
-	err = store.StoreDeployment("a", datastore.Deployment{DeploymentID: "b"})
+	err = store.StoreDeployment("a", "c", datastore.Deployment{DeploymentID: "b"})
 	if err != nil {
 		t.Fatalf("cannot store deployment")
 	}
 
-	deployment, err := store.FindDeployment("a", "b")
+	deployment, err := store.FindDeployment("a", "c", "b")
 	if err != nil {
 		t.Fatalf("cannot find deployment: %v", err)
 	}
@@ -218,30 +318,636 @@ func TestFindDeployment(t *testing.T) {
 		t.Fatalf("got %#v, wanted %#v", deployment.DeploymentID, "b")
 	}
 
-	deployment, err = store.FindDeployment("unknown", "b")
+	deployment, err = store.FindDeployment("unknown", "c", "b")
 	if err == nil {
 		t.Fatalf("unexpectedly found deployment: %#v", deployment)
 	}
 
-	deployment, err = store.FindDeployment("a", "unknown")
+	deployment, err = store.FindDeployment("a", "c", "unknown")
 	if err == nil {
 		t.Fatalf("unexpectedly found deployment: %#v", deployment)
 	}
 
-	deployment, err = store.FindDeployment("unknown", "unknown")
+	deployment, err = store.FindDeployment("unknown", "c", "unknown")
 	if err == nil {
 		t.Fatalf("unexpectedly found deployment: %#v", deployment)
 	}
 
-	_, err = store.FindDeployment("", "b")
+	deployment, err = store.FindDeployment("a", "unknown", "b")
+	if err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("got deployment %#v and error %v for another client, wanted ErrDeploymentNotFound", deployment, err)
+	}
+
+	_, err = store.FindDeployment("", "c", "b")
 	if err == nil {
 		// It should probably be checking for a specific error.
 		t.Fatalf("issuer not validated")
 	}
 
-	_, err = store.FindDeployment("a", "")
+	_, err = store.FindDeployment("a", "c", "")
 	if err == nil {
 		// It should probably be checking for a specific error.
 		t.Fatalf("deployment ID not validated")
 	}
 }
+
+// Test listing, updating and deleting registrations and deployments in a migrated schema.
+func testLifecycle(t *testing.T, db *sql.DB, config Config) {
+	_, err := NewMigrator(db, config).Up()
+	if err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	store := New(db, config)
+
+	first := newRegistrationForTesting(t)
+	second := newRegistrationForTesting(t)
+	second.ClientID = "c"
+	other := newRegistrationForTesting(t)
+	other.Issuer = "b"
+	for _, reg := range []datastore.Registration{second, other, first} {
+		if err := store.StoreRegistration(reg); err != nil {
+			t.Fatalf("cannot store registration: %v", err)
+		}
+	}
+
+	all, err := store.ListRegistrations("")
+	if err != nil {
+		t.Fatalf("cannot list registrations: %v", err)
+	}
+	if !reflect.DeepEqual(all, []datastore.Registration{first, second, other}) {
+		t.Fatalf("got %v, wanted registrations ordered by issuer and client ID", all)
+	}
+	issuerRegistrations, err := store.ListRegistrations(first.Issuer)
+	if err != nil || len(issuerRegistrations) != 2 {
+		t.Fatalf("got %d registrations and error %v, wanted 2", len(issuerRegistrations), err)
+	}
+
+	_, err = store.FindRegistrationByIssuerAndClientID(first.Issuer, "")
+	if err != datastore.ErrAmbiguousRegistration {
+		t.Fatalf("got %v, wanted ErrAmbiguousRegistration", err)
+	}
+
+	rotated := first
+	rotated.KeysetURI = mustParse(t, "http://rotated")
+	rotated.Provisioning = datastore.ProvisionPending
+	if err := store.UpdateRegistration(rotated); err != nil {
+		t.Fatalf("cannot update registration: %v", err)
+	}
+	found, err := store.FindRegistrationByIssuerAndClientID(first.Issuer, first.ClientID)
+	if err != nil || found.KeysetURI.String() != "http://rotated" || found.Provisioning != datastore.ProvisionPending {
+		t.Fatalf("got %v and error %v, wanted the updated registration", found, err)
+	}
+	unknown := first
+	unknown.ClientID = "unknown"
+	if err := store.UpdateRegistration(unknown); err != datastore.ErrRegistrationNotFound {
+		t.Fatalf("update of unknown registration: got %v, wanted ErrRegistrationNotFound", err)
+	}
+
+	if err := store.DeleteRegistration(second.Issuer, second.ClientID); err != nil {
+		t.Fatalf("cannot delete registration: %v", err)
+	}
+	if err := store.DeleteRegistration(second.Issuer, second.ClientID); err != datastore.ErrRegistrationNotFound {
+		t.Fatalf("second delete: got %v, wanted ErrRegistrationNotFound", err)
+	}
+	found, err = store.FindRegistrationByIssuerAndClientID(first.Issuer, "")
+	if err != nil || found.ClientID != first.ClientID {
+		t.Fatalf("got %v and error %v, wanted the remaining registration", found, err)
+	}
+
+	for _, id := range []string{"2", "1"} {
+		if err := store.StoreDeployment("a", "b", datastore.Deployment{DeploymentID: id}); err != nil {
+			t.Fatalf("cannot store deployment: %v", err)
+		}
+	}
+	deployments, err := store.ListDeployments("a", "b")
+	if err != nil {
+		t.Fatalf("cannot list deployments: %v", err)
+	}
+	expected := []datastore.Deployment{{DeploymentID: "1"}, {DeploymentID: "2"}}
+	if !reflect.DeepEqual(deployments, expected) {
+		t.Fatalf("got %v, wanted %v", deployments, expected)
+	}
+
+	updated := datastore.Deployment{
+		DeploymentID:      "1",
+		Name:              "Customer",
+		Disabled:          true,
+		AllowedContextIDs: []string{"course-1", "course 2"},
+		Features:          map[string]bool{"grades": true},
+		Metadata:          map[string]string{"contract": "2021-22"},
+		Pending:           true,
+		FirstSeen:         time.Unix(1630000000, 0),
+	}
+	if err := store.UpdateDeployment("a", "b", updated); err != nil {
+		t.Fatalf("cannot update deployment: %v", err)
+	}
+	foundDeployment, err := store.FindDeployment("a", "b", "1")
+	if err != nil {
+		t.Fatalf("cannot find deployment: %v", err)
+	}
+	if !reflect.DeepEqual(foundDeployment, updated) {
+		t.Fatalf("got %#v, wanted %#v", foundDeployment, updated)
+	}
+	err = store.UpdateDeployment("a", "b", datastore.Deployment{DeploymentID: "unknown"})
+	if err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("update of unknown deployment: got %v, wanted ErrDeploymentNotFound", err)
+	}
+
+	if err := store.DeleteDeployment("a", "b", "1"); err != nil {
+		t.Fatalf("cannot delete deployment: %v", err)
+	}
+	if err := store.DeleteDeployment("a", "b", "1"); err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("second delete: got %v, wanted ErrDeploymentNotFound", err)
+	}
+
+	// Deleting a registration deletes its deployments but not those of the issuer's other clients. Only one
+	// deployment is left, as the `ramsql' driver deletes a single matching row.
+	if err := store.StoreDeployment("b", "b", datastore.Deployment{DeploymentID: "1"}); err != nil {
+		t.Fatalf("cannot store deployment: %v", err)
+	}
+	if err := store.DeleteRegistration(first.Issuer, first.ClientID); err != nil {
+		t.Fatalf("cannot delete registration: %v", err)
+	}
+	if _, err := store.FindDeployment("a", "b", "2"); err != datastore.ErrDeploymentNotFound {
+		t.Fatalf("got %v, wanted ErrDeploymentNotFound after deleting the registration", err)
+	}
+	if _, err := store.FindDeployment("b", "b", "1"); err != nil {
+		t.Fatalf("deployment of another registration deleted: %v", err)
+	}
+}
+
+func TestLifecycleSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	testLifecycle(t, db, config)
+}
+
+func TestStoreAndTestAndClearNonce(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestStoreAndTestAndClearNonce")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE nonce (
+                           nonce text,
+                           target_link_uri text,
+                           issued_at bigint,
+                           expires_at bigint,
+                           PRIMARY KEY (nonce)
+                         )`)
+
+	store := New(db, NewConfig())
+	targetLinkURI := "https://tool.tld/launch"
+
+	err = store.StoreNonce(datastore.Nonce{Value: "nonce-1", TargetLinkURI: targetLinkURI})
+	if err != nil {
+		t.Fatalf("cannot store nonce: %v", err)
+	}
+	err = store.TestAndClearNonce("nonce-1", targetLinkURI)
+	if err != nil {
+		t.Fatalf("cannot test and clear nonce: %v", err)
+	}
+	err = store.TestAndClearNonce("nonce-1", targetLinkURI)
+	if err != datastore.ErrNonceNotFound {
+		t.Fatalf("got %v, wanted ErrNonceNotFound for a cleared nonce", err)
+	}
+
+	store.StoreNonce(datastore.Nonce{Value: "nonce-2", TargetLinkURI: targetLinkURI})
+	err = store.TestAndClearNonce("nonce-2", "https://tool.tld/other")
+	if err != datastore.ErrNonceTargetLinkURIMismatch {
+		t.Fatalf("got %v, wanted ErrNonceTargetLinkURIMismatch", err)
+	}
+
+	store.StoreNonce(datastore.Nonce{
+		Value:         "nonce-3",
+		TargetLinkURI: targetLinkURI,
+		IssuedAt:      time.Now().Add(-time.Hour),
+		MaxAge:        time.Minute,
+	})
+	err = store.TestAndClearNonce("nonce-3", targetLinkURI)
+	if err != datastore.ErrNonceExpired {
+		t.Fatalf("got %v, wanted ErrNonceExpired", err)
+	}
+}
+
+// Test that only one of several concurrent launches presenting the same nonce can clear it.
+func TestTestAndClearNonceConcurrently(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestTestAndClearNonceConcurrently")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE nonce (
+                           nonce text,
+                           target_link_uri text,
+                           issued_at bigint,
+                           expires_at bigint,
+                           PRIMARY KEY (nonce)
+                         )`)
+
+	store := New(db, NewConfig())
+	targetLinkURI := "https://tool.tld/launch"
+	err = store.StoreNonce(datastore.Nonce{Value: "nonce-1", TargetLinkURI: targetLinkURI})
+	if err != nil {
+		t.Fatalf("cannot store nonce: %v", err)
+	}
+
+	const launches = 8
+	var (
+		wg      sync.WaitGroup
+		cleared int32
+	)
+	for i := 0; i < launches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if store.TestAndClearNonce("nonce-1", targetLinkURI) == nil {
+				atomic.AddInt32(&cleared, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cleared != 1 {
+		t.Fatalf("nonce cleared by %d launches, wanted 1", cleared)
+	}
+}
+
+func TestStoreAndFindAccessToken(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestStoreAndFindAccessToken")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE access_token (
+                           token_uri text,
+                           client_id text,
+                           scopes text,
+                           token text,
+                           expiry_time bigint,
+                           PRIMARY KEY (token_uri, client_id, scopes)
+                         )`)
+
+	store := New(db, NewConfig())
+	token := datastore.AccessToken{
+		TokenURI:   "https://platform.tld/token",
+		ClientID:   "abcdef123456",
+		Scopes:     []string{"https://scope/2", "https://scope/1"},
+		Token:      "token-1",
+		ExpiryTime: time.Now().Add(time.Hour),
+	}
+
+	err = store.StoreAccessToken(token)
+	if err != nil {
+		t.Fatalf("cannot store access token: %v", err)
+	}
+
+	// Stored tokens are replaced.
+	token.Token = "token-2"
+	err = store.StoreAccessToken(token)
+	if err != nil {
+		t.Fatalf("cannot replace access token: %v", err)
+	}
+
+	foundToken, err := store.FindAccessToken(token.TokenURI, token.ClientID, []string{"https://scope/1", "https://scope/2"})
+	if err != nil {
+		t.Fatalf("cannot find access token: %v", err)
+	}
+	if foundToken.Token != "token-2" || foundToken.ExpiryTime.Unix() != token.ExpiryTime.Unix() {
+		t.Fatalf("got %#v, wanted %#v", foundToken, token)
+	}
+
+	_, err = store.FindAccessToken(token.TokenURI, token.ClientID, []string{"https://scope/3"})
+	if err != datastore.ErrAccessTokenNotFound {
+		t.Fatalf("got %v, wanted ErrAccessTokenNotFound", err)
+	}
+
+	// A token covering more scopes serves requests for fewer of them.
+	foundToken, err = store.FindAccessToken(token.TokenURI, token.ClientID, []string{"https://scope/2"})
+	if err != nil || foundToken.Token != "token-2" {
+		t.Fatalf("got %#v, %v, wanted the token covering more scopes", foundToken, err)
+	}
+
+	// Only the token that is still stored is deleted.
+	err = store.DeleteAccessToken(datastore.AccessToken{TokenURI: token.TokenURI, ClientID: token.ClientID,
+		Scopes: token.Scopes, Token: "token-1"})
+	if err != nil {
+		t.Fatalf("cannot delete access token: %v", err)
+	}
+	if _, err = store.FindAccessToken(token.TokenURI, token.ClientID, token.Scopes); err != nil {
+		t.Fatalf("got %v, wanted the newer token to be kept", err)
+	}
+	if err = store.DeleteAccessToken(foundToken); err != nil {
+		t.Fatalf("cannot delete access token: %v", err)
+	}
+	if _, err = store.FindAccessToken(token.TokenURI, token.ClientID, token.Scopes); err != datastore.ErrAccessTokenNotFound {
+		t.Fatalf("got %v, wanted ErrAccessTokenNotFound", err)
+	}
+
+	token.ClientID = "expired"
+	token.ExpiryTime = time.Now().Add(-time.Minute)
+	store.StoreAccessToken(token)
+	_, err = store.FindAccessToken(token.TokenURI, token.ClientID, token.Scopes)
+	if err != datastore.ErrAccessTokenExpired {
+		t.Fatalf("got %v, wanted ErrAccessTokenExpired", err)
+	}
+}
+
+func TestStoreFindAndPurgeLaunchData(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestStoreFindAndPurgeLaunchData")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE launch_data (
+                           launch_id text,
+                           launch_data text,
+                           created_at bigint,
+                           PRIMARY KEY (launch_id)
+                         )`)
+
+	store := New(db, NewConfig())
+	launchData := json.RawMessage(`{"sub":"user-1"}`)
+
+	err = store.StoreLaunchData("launch-1", launchData)
+	if err != nil {
+		t.Fatalf("cannot store launch data: %v", err)
+	}
+	mustExec(t, db, fmt.Sprintf(`INSERT INTO launch_data (launch_id, launch_data, created_at)
+                                            VALUES ('launch-old', '{}', %d)`,
+		time.Now().Add(-2*datastore.DefaultLaunchDataTTL).Unix()))
+
+	foundLaunchData, err := store.FindLaunchData("launch-1")
+	if err != nil {
+		t.Fatalf("cannot find launch data: %v", err)
+	}
+	if string(foundLaunchData) != string(launchData) {
+		t.Fatalf("got %s, wanted %s", foundLaunchData, launchData)
+	}
+
+	_, err = store.FindLaunchData("launch-old")
+	if err != datastore.ErrLaunchDataNotFound {
+		t.Fatalf("got %v, wanted ErrLaunchDataNotFound for expired launch data", err)
+	}
+
+	purged, err := store.PurgeExpiredLaunchData(time.Now())
+	if err != nil {
+		t.Fatalf("cannot purge launch data: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("got %d purged rows, wanted 1", purged)
+	}
+	_, err = store.FindLaunchData("launch-1")
+	if err != nil {
+		t.Fatalf("unexpired launch data was purged: %v", err)
+	}
+}
+
+func TestTestAndSetTokenID(t *testing.T) {
+	// The `ramsql' driver does not enforce a primary key of two columns, which replay detection relies on.
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	if _, err = NewMigrator(db, config).Up(); err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	store := New(db, config)
+	issuer := "https://platform.tld"
+
+	err = store.TestAndSetTokenID(issuer, "jti-1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("cannot test and set token ID: %v", err)
+	}
+	err = store.TestAndSetTokenID(issuer, "jti-1", time.Now().Add(time.Hour))
+	if err != datastore.ErrTokenReplayed {
+		t.Fatalf("got %v, wanted ErrTokenReplayed", err)
+	}
+
+	// Expired tokens are forgotten.
+	store.TestAndSetTokenID(issuer, "jti-2", time.Now().Add(-time.Minute))
+	err = store.TestAndSetTokenID(issuer, "jti-2", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("got %v, wanted expired token to be accepted", err)
+	}
+
+	store.TestAndSetTokenID(issuer, "jti-3", time.Now().Add(-time.Minute))
+	purged, err := store.PurgeExpiredTokenIDs(time.Now())
+	if err != nil {
+		t.Fatalf("cannot purge token IDs: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("got %d purged rows, wanted 1", purged)
+	}
+	err = store.TestAndSetTokenID(issuer, "jti-1", time.Now().Add(time.Hour))
+	if err != datastore.ErrTokenReplayed {
+		t.Fatalf("got %v, wanted unexpired token to be kept", err)
+	}
+}
+
+// Test that of concurrent launches with the same id_token, one records it and the others are rejected as replays.
+func TestTestAndSetTokenIDConcurrently(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	if _, err = NewMigrator(db, config).Up(); err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	store := New(db, config)
+
+	const launches = 8
+	var (
+		wg       sync.WaitGroup
+		recorded int32
+		replayed int32
+	)
+	for i := 0; i < launches; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch store.TestAndSetTokenID("https://platform.tld", "jti-1", time.Now().Add(time.Hour)) {
+			case nil:
+				atomic.AddInt32(&recorded, 1)
+			case datastore.ErrTokenReplayed:
+				atomic.AddInt32(&replayed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if recorded != 1 || replayed != launches-1 {
+		t.Fatalf("got %d recorded and %d replayed launches, wanted 1 and %d", recorded, replayed, launches-1)
+	}
+}
+
+func TestStoreAndTestAndClearHandoffCode(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestStoreAndTestAndClearHandoffCode")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE handoff_code (
+                           code text,
+                           launch_id text,
+                           expires_at bigint,
+                           PRIMARY KEY (code)
+                         )`)
+
+	store := New(db, NewConfig())
+	code := datastore.HandoffCode{
+		Code:      "code-1",
+		LaunchID:  "launch-1",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+
+	err = store.StoreHandoffCode(code)
+	if err != nil {
+		t.Fatalf("cannot store hand-off code: %v", err)
+	}
+
+	foundCode, err := store.TestAndClearHandoffCode(code.Code)
+	if err != nil {
+		t.Fatalf("cannot test and clear hand-off code: %v", err)
+	}
+	if foundCode.LaunchID != code.LaunchID || foundCode.ExpiresAt.Unix() != code.ExpiresAt.Unix() {
+		t.Fatalf("got %#v, wanted %#v", foundCode, code)
+	}
+
+	_, err = store.TestAndClearHandoffCode(code.Code)
+	if err != datastore.ErrHandoffCodeNotFound {
+		t.Fatalf("got %v, wanted ErrHandoffCodeNotFound for a used code", err)
+	}
+
+	code.Code = "code-2"
+	code.ExpiresAt = time.Now().Add(-time.Minute)
+	store.StoreHandoffCode(code)
+	_, err = store.TestAndClearHandoffCode(code.Code)
+	if err != datastore.ErrHandoffCodeExpired {
+		t.Fatalf("got %v, wanted ErrHandoffCodeExpired", err)
+	}
+}
+
+func TestStoreAndFindHandoffToken(t *testing.T) {
+	db, err := sql.Open("ramsql", "TestStoreAndFindHandoffToken")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	mustExec(t, db, `CREATE TABLE handoff_token (
+                           token text,
+                           launch_id text,
+                           scopes text,
+                           expires_at bigint,
+                           PRIMARY KEY (token)
+                         )`)
+
+	store := New(db, NewConfig())
+	token := datastore.HandoffToken{
+		Token:     "token-1",
+		LaunchID:  "launch-1",
+		Scopes:    []string{"launch", "grades"},
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	err = store.StoreHandoffToken(token)
+	if err != nil {
+		t.Fatalf("cannot store hand-off token: %v", err)
+	}
+
+	foundToken, err := store.FindHandoffToken(token.Token)
+	if err != nil {
+		t.Fatalf("cannot find hand-off token: %v", err)
+	}
+	if foundToken.LaunchID != token.LaunchID || !reflect.DeepEqual(foundToken.Scopes, token.Scopes) {
+		t.Fatalf("got %#v, wanted %#v", foundToken, token)
+	}
+
+	_, err = store.FindHandoffToken("unknown")
+	if err != datastore.ErrHandoffTokenNotFound {
+		t.Fatalf("got %v, wanted ErrHandoffTokenNotFound", err)
+	}
+}
+
+// Test that expired hand-off codes and tokens are purged, including codes that were never exchanged.
+func TestPurgeExpiredHandoffs(t *testing.T) {
+	// The `ramsql' driver deletes only one row per DELETE statement.
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := NewConfig()
+	config.Dialect = SQLite
+	if _, err = NewMigrator(db, config).Up(); err != nil {
+		t.Fatalf("migrate up error: %v", err)
+	}
+	store := New(db, config)
+
+	for i, expiresAt := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Minute),
+		time.Now().Add(-time.Hour)} {
+		err = store.StoreHandoffCode(datastore.HandoffCode{
+			Code:      fmt.Sprintf("code-%d", i),
+			LaunchID:  "launch-1",
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatalf("cannot store hand-off code: %v", err)
+		}
+		err = store.StoreHandoffToken(datastore.HandoffToken{
+			Token:     fmt.Sprintf("token-%d", i),
+			LaunchID:  "launch-1",
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatalf("cannot store hand-off token: %v", err)
+		}
+	}
+
+	purged, err := store.PurgeExpiredHandoffCodes(time.Now())
+	if err != nil {
+		t.Fatalf("cannot purge hand-off codes: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("got %d purged codes, wanted 2", purged)
+	}
+	purged, err = store.PurgeExpiredHandoffTokens(time.Now())
+	if err != nil {
+		t.Fatalf("cannot purge hand-off tokens: %v", err)
+	}
+	if purged != 2 {
+		t.Fatalf("got %d purged tokens, wanted 2", purged)
+	}
+
+	if _, err = store.FindHandoffToken("token-0"); err != nil {
+		t.Fatalf("cannot find unexpired hand-off token: %v", err)
+	}
+	if _, err = store.TestAndClearHandoffCode("code-0"); err != nil {
+		t.Fatalf("cannot test and clear unexpired hand-off code: %v", err)
+	}
+}
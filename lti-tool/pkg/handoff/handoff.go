@@ -0,0 +1,371 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+// Package handoff hands a launch over to a frontend served from another origin, such as a single-page application.
+// After a successful launch, the user agent is redirected to the frontend with a short-lived, single-use code. The
+// frontend exchanges the code at a JSON endpoint for a scoped access token and the typed launch claims, and then
+// presents the token as a bearer token on its API requests.
+package handoff
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
+)
+
+const (
+	// DefaultCodeTTL is the hand-off code lifetime unless configured otherwise. Codes are meant to be exchanged
+	// immediately after the redirect.
+	DefaultCodeTTL = time.Minute
+
+	// DefaultTokenTTL is the access token lifetime unless configured otherwise.
+	DefaultTokenTTL = time.Hour
+
+	// ScopeLaunch is the scope granted unless configured otherwise. It allows reading the launch.
+	ScopeLaunch = "launch"
+)
+
+// ErrNoToken is the error returned when a request carries no bearer token.
+var ErrNoToken = errors.New("bearer token not found in request")
+
+// Config holds the settings of a Handoff.
+type Config struct {
+	// FrontendURL is where the user agent is redirected after a launch. The hand-off code is added as the `code'
+	// query parameter.
+	FrontendURL string
+
+	// CodeTTL and TokenTTL are the lifetimes of hand-off codes and access tokens.
+	CodeTTL  time.Duration
+	TokenTTL time.Duration
+
+	// Scopes are granted to every access token.
+	Scopes []string
+
+	// AllowedOrigins are the frontend origins (e.g. "https://app.tld") allowed to call the exchange endpoint and the
+	// protected API from the browser. Requests from other origins get no CORS headers.
+	AllowedOrigins []string
+
+	// Claims decodes extension claims for the exchange response and when the launch context is restored. If nil, the
+	// launch package's DefaultClaimRegistry is used.
+	Claims *launch.ClaimRegistry
+}
+
+// NewConfig returns a new hand-off configuration with default settings and the given frontend URL.
+func NewConfig(frontendURL string) Config {
+	return Config{
+		FrontendURL: frontendURL,
+		CodeTTL:     DefaultCodeTTL,
+		TokenTTL:    DefaultTokenTTL,
+		Scopes:      []string{ScopeLaunch},
+	}
+}
+
+// A Handoff issues hand-off codes after launches, exchanges them for access tokens and restores the launch context of
+// API requests carrying one of those tokens.
+type Handoff struct {
+	cfg      Config
+	handoffs datastore.HandoffStorer
+	launches datastore.LaunchDataStorer
+	now      func() time.Time
+}
+
+// An ExchangeRequest is the JSON body posted to the exchange endpoint.
+type ExchangeRequest struct {
+	Code string `json:"code"`
+}
+
+// An ExchangeResponse is the JSON body returned by the exchange endpoint.
+type ExchangeResponse struct {
+	AccessToken string                 `json:"access_token"`
+	TokenType   string                 `json:"token_type"`
+	ExpiresIn   int64                  `json:"expires_in"`
+	Scope       string                 `json:"scope"`
+	Launch      launch.LaunchMessage   `json:"launch"`
+	Claims      map[string]interface{} `json:"claims,omitempty"`
+}
+
+type tokenContextKeyType string
+
+const tokenContextKey = tokenContextKeyType("HandoffToken")
+
+// New creates a *Handoff. If the passed datastore.Config has zero-value Handoffs or LaunchData stores, fall back on the
+// in-memory nonpersistent.DefaultStore. Zero-value lifetimes and scopes in `cfg' are replaced by their defaults.
+func New(dsCfg datastore.Config, cfg Config) *Handoff {
+	handoff := Handoff{
+		cfg:      cfg,
+		handoffs: dsCfg.Handoffs,
+		launches: dsCfg.LaunchData,
+		now:      time.Now,
+	}
+
+	if handoff.handoffs == nil {
+		handoff.handoffs = nonpersistent.DefaultStore
+	}
+	if handoff.launches == nil {
+		handoff.launches = nonpersistent.DefaultStore
+	}
+	if handoff.cfg.CodeTTL <= 0 {
+		handoff.cfg.CodeTTL = DefaultCodeTTL
+	}
+	if handoff.cfg.TokenTTL <= 0 {
+		handoff.cfg.TokenTTL = DefaultTokenTTL
+	}
+	if len(handoff.cfg.Scopes) == 0 {
+		handoff.cfg.Scopes = []string{ScopeLaunch}
+	}
+
+	return &handoff
+}
+
+// IssueCode creates a hand-off code for the launch and returns it. Only a hash of the code is stored.
+func (h *Handoff) IssueCode(launchID string) (string, error) {
+	if launchID == "" {
+		return "", errors.New("received empty launch ID")
+	}
+
+	code, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	err = h.handoffs.StoreHandoffCode(datastore.HandoffCode{
+		Code:      hash(code),
+		LaunchID:  launchID,
+		ExpiresAt: h.now().Add(h.cfg.CodeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// RedirectAfterLaunch is the handler run after a successful launch. It is meant to be passed as the `next' argument of
+// launch.New. It issues a hand-off code and redirects the user agent to the configured frontend URL.
+func (h *Handoff) RedirectAfterLaunch(w http.ResponseWriter, r *http.Request) {
+	lc, ok := r.Context().Value(launch.ContextKey).(launch.LaunchContext)
+	if !ok || lc.LaunchId == "" {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	frontendURL, err := url.Parse(h.cfg.FrontendURL)
+	if err != nil || h.cfg.FrontendURL == "" {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	code, err := h.IssueCode(lc.LaunchId)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	query := frontendURL.Query()
+	query.Set("code", code)
+	frontendURL.RawQuery = query.Encode()
+
+	// 303 so that the user agent follows the redirect from the launch POST with a GET.
+	http.Redirect(w, r, frontendURL.String(), http.StatusSeeOther)
+}
+
+// Exchange redeems a hand-off code, posted as an ExchangeRequest, for an access token and the launch claims. Each code
+// can be exchanged only once. Unknown, used or expired codes get a 400 Bad Request response.
+func (h *Handoff) Exchange(w http.ResponseWriter, r *http.Request) {
+	if h.cors(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request ExchangeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	handoffCode, err := h.handoffs.TestAndClearHandoffCode(hash(request.Code))
+	if err != nil || !handoffCode.ExpiresAt.After(h.now()) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	lc, err := launch.RestoreLaunchContext(h.launches, h.cfg.Claims, handoffCode.LaunchID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	err = h.handoffs.StoreHandoffToken(datastore.HandoffToken{
+		Token:     hash(accessToken),
+		LaunchID:  handoffCode.LaunchID,
+		Scopes:    h.cfg.Scopes,
+		ExpiresAt: h.now().Add(h.cfg.TokenTTL),
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ExchangeResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(h.cfg.TokenTTL / time.Second),
+		Scope:       strings.Join(h.cfg.Scopes, " "),
+		Launch:      lc.Message,
+		Claims:      lc.Claims,
+	})
+}
+
+// Middleware restores the launch context of requests carrying a valid bearer access token. Requests without a valid
+// token get a 401 Unauthorized response.
+func (h *Handoff) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.cors(w, r) {
+			return
+		}
+
+		token, err := h.tokenFromRequest(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		lc, err := launch.RestoreLaunchContext(h.launches, h.cfg.Claims, token.LaunchID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := launch.ContextWithLaunchContext(r.Context(), lc)
+		ctx = context.WithValue(ctx, tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope wraps a handler protected by Middleware so that only tokens granted `scope' may use it. Other requests
+// get a 403 Forbidden response.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := TokenFromContext(r.Context())
+		if !ok || !hasScope(token, scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TokenFromContext returns the access token attached to a request context by Middleware. The Token field holds the
+// stored hash rather than the bearer token itself.
+func TokenFromContext(ctx context.Context) (datastore.HandoffToken, bool) {
+	token, ok := ctx.Value(tokenContextKey).(datastore.HandoffToken)
+	return token, ok
+}
+
+// tokenFromRequest finds and checks the bearer access token carried by the request.
+func (h *Handoff) tokenFromRequest(r *http.Request) (datastore.HandoffToken, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return datastore.HandoffToken{}, ErrNoToken
+	}
+	bearer := strings.TrimSpace(authorization[len("Bearer "):])
+	if bearer == "" {
+		return datastore.HandoffToken{}, ErrNoToken
+	}
+
+	token, err := h.handoffs.FindHandoffToken(hash(bearer))
+	if err != nil {
+		return datastore.HandoffToken{}, err
+	}
+	if !token.ExpiresAt.After(h.now()) {
+		return datastore.HandoffToken{}, datastore.ErrHandoffTokenExpired
+	}
+
+	return token, nil
+}
+
+// cors sets the CORS headers for requests from an allowed origin. It answers preflight requests itself and reports
+// whether it did so.
+func (h *Handoff) cors(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !h.originAllowed(origin) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (h *Handoff) originAllowed(origin string) bool {
+	for _, allowed := range h.cfg.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScope(token datastore.HandoffToken, scope string) bool {
+	for _, granted := range token.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// randomString returns 32 random bytes, base64url-encoded, for use as a code or token.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hash returns the hex-encoded SHA-256 hash of a code or token. Only hashes are stored, so a leaked datastore does not
+// leak usable codes or tokens.
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
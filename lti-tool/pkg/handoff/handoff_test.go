@@ -0,0 +1,180 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package handoff
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
+)
+
+const testLaunchID = "lti1p3-launch-test"
+
+// Set up a hand-off backed by a fresh nonpersistent store holding one launch.
+func newHandoffForTesting(t *testing.T) *Handoff {
+	store := nonpersistent.New()
+	err := store.StoreLaunchData(testLaunchID, json.RawMessage(`{
+  "iss": "https://platform.tld/instance",
+  "sub": "user-1",
+  "aud": "abcdef123456",
+  "https://purl.imsglobal.org/spec/lti/claim/context": {"id": "course-1"}
+}`))
+	if err != nil {
+		t.Fatalf("store launch data error: %v", err)
+	}
+
+	cfg := NewConfig("https://app.tld/start?view=main")
+	cfg.AllowedOrigins = []string{"https://app.tld"}
+	return New(datastore.Config{Handoffs: store, LaunchData: store}, cfg)
+}
+
+// Run the launch redirect and return the hand-off code from the frontend URL.
+func redirectForTesting(t *testing.T, handoff *Handoff) string {
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", nil)
+	r = r.WithContext(launch.ContextWithLaunchContext(r.Context(), launch.LaunchContext{LaunchId: testLaunchID}))
+	w := httptest.NewRecorder()
+	handoff.RedirectAfterLaunch(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, wanted %d", w.Code, http.StatusSeeOther)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("redirect location parse error: %v", err)
+	}
+	if location.Host != "app.tld" || location.Query().Get("view") != "main" {
+		t.Fatalf("unexpected redirect location %s", location)
+	}
+	return location.Query().Get("code")
+}
+
+func exchangeForTesting(handoff *Handoff, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/handoff", strings.NewReader(`{"code":"`+code+`"}`))
+	r.Header.Set("Origin", "https://app.tld")
+	w := httptest.NewRecorder()
+	handoff.Exchange(w, r)
+	return w
+}
+
+// Test the redirect, the single-use exchange and the protected API.
+func TestRedirectExchangeAndMiddleware(t *testing.T) {
+	handoff := newHandoffForTesting(t)
+	code := redirectForTesting(t, handoff)
+	if code == "" {
+		t.Fatal("hand-off code not added to frontend url")
+	}
+
+	w := exchangeForTesting(handoff, code)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, wanted %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.tld" {
+		t.Errorf("cors header not set for allowed origin")
+	}
+	var response ExchangeResponse
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatalf("exchange response decode error: %v", err)
+	}
+	if response.AccessToken == "" || response.TokenType != "Bearer" || response.Scope != ScopeLaunch {
+		t.Fatalf("unexpected exchange response %#v", response)
+	}
+	if response.Launch.Context.ID != "course-1" {
+		t.Fatalf("got context %q, wanted typed launch claims", response.Launch.Context.ID)
+	}
+
+	// Codes can be exchanged only once.
+	if w := exchangeForTesting(handoff, code); w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, wanted used code to be rejected", w.Code)
+	}
+
+	handler := handoff.Middleware(RequireScope(ScopeLaunch, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lc := r.Context().Value(launch.ContextKey).(launch.LaunchContext)
+		w.Write([]byte(lc.LaunchId))
+	})))
+	for _, test := range []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer " + response.AccessToken, http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"Bearer " + code, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "https://tool.tld/api/launch", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("authorization %q: got %d, wanted %d", test.authorization, w.Code, test.status)
+		}
+	}
+
+	// Scopes that were not granted are refused.
+	r := httptest.NewRequest(http.MethodGet, "https://tool.tld/api/grades", nil)
+	r.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	w = httptest.NewRecorder()
+	handoff.Middleware(RequireScope("grades", http.NotFoundHandler())).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, wanted %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// Test that expired codes and tokens are refused.
+func TestExpiry(t *testing.T) {
+	handoff := newHandoffForTesting(t)
+	now := time.Now()
+	handoff.now = func() time.Time { return now }
+
+	code := redirectForTesting(t, handoff)
+	now = now.Add(DefaultCodeTTL * 2)
+	if w := exchangeForTesting(handoff, code); w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, wanted expired code to be rejected", w.Code)
+	}
+
+	now = time.Now()
+	w := exchangeForTesting(handoff, redirectForTesting(t, handoff))
+	var response ExchangeResponse
+	json.NewDecoder(w.Body).Decode(&response)
+
+	now = now.Add(DefaultTokenTTL * 2)
+	r := httptest.NewRequest(http.MethodGet, "https://tool.tld/api/launch", nil)
+	r.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	w = httptest.NewRecorder()
+	handoff.Middleware(http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, wanted expired token to be rejected", w.Code)
+	}
+}
+
+// Test the CORS preflight for allowed and other origins.
+func TestPreflight(t *testing.T) {
+	handoff := newHandoffForTesting(t)
+
+	for origin, allowed := range map[string]bool{"https://app.tld": true, "https://evil.tld": false} {
+		r := httptest.NewRequest(http.MethodOptions, "https://tool.tld/handoff", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		handoff.Exchange(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("origin %s: got allowed %v, wanted %v", origin, got, allowed)
+		}
+		if allowed && w.Code != http.StatusNoContent {
+			t.Errorf("origin %s: got status %d, wanted %d", origin, w.Code, http.StatusNoContent)
+		}
+	}
+}
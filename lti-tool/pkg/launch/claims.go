@@ -0,0 +1,109 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrRequiredClaimMissing is the error returned when a claim registered as required is absent from the id_token.
+	ErrRequiredClaimMissing = errors.New("required claim not found in request")
+
+	// ErrRequiredClaimMalformed is the error returned when a claim registered as required cannot be decoded into its
+	// registered type.
+	ErrRequiredClaimMalformed = errors.New("required claim improperly formatted")
+)
+
+// A ClaimRegistry maps extension claim URIs, such as vendor-specific claims sent by Canvas or Moodle, to Go types. A
+// Launch decodes the registered claims found in the id_token and attaches them to the launch context.
+type ClaimRegistry struct {
+	mu     sync.RWMutex
+	claims map[string]registeredClaim
+}
+
+type registeredClaim struct {
+	claimType reflect.Type
+	required  bool
+}
+
+// DefaultClaimRegistry is the registry used by a Launch unless another one is set with SetClaimRegistry.
+var DefaultClaimRegistry = NewClaimRegistry()
+
+// NewClaimRegistry returns an empty claim registry.
+func NewClaimRegistry() *ClaimRegistry {
+	return &ClaimRegistry{
+		claims: map[string]registeredClaim{},
+	}
+}
+
+// RegisterClaim registers a claim with the DefaultClaimRegistry.
+func RegisterClaim(uri string, prototype interface{}, required bool) error {
+	return DefaultClaimRegistry.Register(uri, prototype, required)
+}
+
+// Register associates the claim `uri' with the type of `prototype', typically the zero value of a struct. Decoded
+// claims have the same type as the prototype. When `required' is true, launches without the claim, or with a claim
+// that does not decode into the type, fail.
+func (c *ClaimRegistry) Register(uri string, prototype interface{}, required bool) error {
+	if uri == "" {
+		return errors.New("received empty claim URI")
+	}
+	if prototype == nil {
+		return errors.New("received nil claim prototype")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.claims[uri] = registeredClaim{
+		claimType: reflect.TypeOf(prototype),
+		required:  required,
+	}
+
+	return nil
+}
+
+// Decode decodes the registered claims found in launch data, i.e. the id_token payload. It returns the decoded values
+// keyed by claim URI. Optional claims that are missing or malformed are left out of the result.
+func (c *ClaimRegistry) Decode(launchData json.RawMessage) (map[string]interface{}, error) {
+	var rawClaims map[string]json.RawMessage
+	err := json.Unmarshal(launchData, &rawClaims)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode launch data claims: %w", err)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	claims := map[string]interface{}{}
+	for uri, registered := range c.claims {
+		rawClaim, ok := rawClaims[uri]
+		if !ok || string(rawClaim) == "null" {
+			if registered.required {
+				return nil, fmt.Errorf("%w: %s", ErrRequiredClaimMissing, uri)
+			}
+			continue
+		}
+
+		value := reflect.New(registered.claimType)
+		err := json.Unmarshal(rawClaim, value.Interface())
+		if err != nil {
+			if registered.required {
+				return nil, fmt.Errorf("%w: %s: %v", ErrRequiredClaimMalformed, uri, err)
+			}
+			continue
+		}
+
+		claims[uri] = value.Elem().Interface()
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type canvasClaim struct {
+	CourseID string `json:"canvas_course_id"`
+	UserID   string `json:"canvas_user_id"`
+}
+
+const canvasClaimURI = "https://canvas.instructure.com/lti/claim"
+
+// Test decoding registered extension claims.
+func TestClaimRegistryDecode(t *testing.T) {
+	launchData := json.RawMessage(`{
+  "iss": "https://platform.tld/instance",
+  "https://canvas.instructure.com/lti/claim": {"canvas_course_id": "42", "canvas_user_id": "7"},
+  "https://moodle.tld/claim/malformed": "not-an-object"
+}`)
+
+	registry := NewClaimRegistry()
+	err := registry.Register(canvasClaimURI, canvasClaim{}, true)
+	if err != nil {
+		t.Fatalf("register claim error: %v", err)
+	}
+	err = registry.Register("https://moodle.tld/claim/malformed", canvasClaim{}, false)
+	if err != nil {
+		t.Fatalf("register claim error: %v", err)
+	}
+	err = registry.Register("https://moodle.tld/claim/absent", canvasClaim{}, false)
+	if err != nil {
+		t.Fatalf("register claim error: %v", err)
+	}
+
+	claims, err := registry.Decode(launchData)
+	if err != nil {
+		t.Fatalf("decode claims error: %v", err)
+	}
+
+	lc := LaunchContext{Claims: claims}
+	claim, ok := lc.Claim(canvasClaimURI)
+	if !ok {
+		t.Fatal("registered claim not decoded")
+	}
+	canvas, ok := claim.(canvasClaim)
+	if !ok {
+		t.Fatalf("got claim type %T, wanted canvasClaim", claim)
+	}
+	if canvas.CourseID != "42" || canvas.UserID != "7" {
+		t.Errorf("got %#v, wanted course 42 and user 7", canvas)
+	}
+	if len(claims) != 1 {
+		t.Errorf("optional missing or malformed claims should be left out, got %#v", claims)
+	}
+
+	registry.Register("https://moodle.tld/claim/absent", canvasClaim{}, true)
+	_, err = registry.Decode(launchData)
+	if !errors.Is(err, ErrRequiredClaimMissing) {
+		t.Errorf("got %v, wanted ErrRequiredClaimMissing", err)
+	}
+
+	registry = NewClaimRegistry()
+	registry.Register("https://moodle.tld/claim/malformed", canvasClaim{}, true)
+	_, err = registry.Decode(launchData)
+	if !errors.Is(err, ErrRequiredClaimMalformed) {
+		t.Errorf("got %v, wanted ErrRequiredClaimMalformed", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
+)
+
+// causes maps the errors of the datastore and of this package to the launch errors reported for them.
+var causes = []struct {
+	err    error
+	report *ltierror.Error
+}{
+	{datastore.ErrRegistrationNotFound, ltierror.ErrUnknownRegistration},
+	{ErrKeyNotFound, ltierror.ErrSignatureInvalid},
+	{ErrMissingExpiration, ltierror.ErrInvalidToken},
+	{ErrTokenExpired, ltierror.ErrInvalidToken},
+	{ErrTokenNotYetValid, ltierror.ErrInvalidToken},
+	{ErrMissingIssuedAt, ltierror.ErrInvalidToken},
+	{ErrTokenIssuedInFuture, ltierror.ErrInvalidToken},
+	{ErrTokenTooOld, ltierror.ErrInvalidToken},
+	{ErrMissingAudience, ltierror.ErrInvalidToken},
+	{ErrMissingAuthorizedParty, ltierror.ErrInvalidToken},
+	{ErrAuthorizedPartyMismatch, ltierror.ErrInvalidToken},
+	{datastore.ErrNonceNotFound, ltierror.ErrNonceInvalid},
+	{datastore.ErrNonceTargetLinkURIMismatch, ltierror.ErrNonceInvalid},
+	{datastore.ErrNonceExpired, ltierror.ErrNonceInvalid},
+	{datastore.ErrTokenReplayed, ltierror.ErrNonceReplay},
+	{datastore.ErrDeploymentNotFound, ltierror.ErrUnknownDeployment},
+	{datastore.ErrDeploymentPending, ltierror.ErrDeploymentPending},
+	{datastore.ErrDeploymentDisabled, ltierror.ErrDeploymentDisabled},
+	{datastore.ErrContextNotAllowed, ltierror.ErrContextNotAllowed},
+}
+
+// launchError returns the *ltierror.Error reported for `err', which failed a validation with `statusCode'. An
+// *ltierror.Error, e.g. from a custom Validator, is reported as is, and known causes are reported with their own
+// errors. Any other error is reported as `kind', or as ltierror.ErrInternal if the failure is on the tool's side.
+func launchError(kind *ltierror.Error, statusCode int, err error) *ltierror.Error {
+	var typed *ltierror.Error
+	if errors.As(err, &typed) {
+		report := *typed
+		if report.StatusCode == 0 {
+			report.StatusCode = statusCode
+		}
+		return &report
+	}
+
+	for _, cause := range causes {
+		if errors.Is(err, cause.err) {
+			return cause.report.Wrap(err)
+		}
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		return ltierror.ErrInternal.Wrap(err)
+	}
+	report := kind.Wrap(err)
+	report.StatusCode = statusCode
+	return report
+}
+
+// fail reports a failed launch to the launch's error handler. Once the signature of the id_token has been verified,
+// `rawToken' is trusted and its launch_presentation return_url is used to offer the user a way back to the platform.
+func (l *Launch) fail(w http.ResponseWriter, r *http.Request, kind *ltierror.Error, statusCode int, err error,
+	rawToken []byte, verifiedToken jwt.Token) {
+	report := launchError(kind, statusCode, err)
+
+	if verifiedToken != nil {
+		if launchData, _, err := getLaunchData(rawToken); err == nil {
+			if message, err := MessageFromLaunchData(launchData); err == nil {
+				report.ReturnURL, _ = ReturnURL(message, ReturnMessage{
+					ErrorMsg: report.Description,
+					ErrorLog: report.Code,
+				})
+			}
+		}
+	}
+
+	l.errorHandler(w, r, report)
+}
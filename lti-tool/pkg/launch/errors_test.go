@@ -0,0 +1,156 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
+)
+
+// Test that failed launches are reported to the error handler with their codes.
+func TestLaunchErrors(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	var reported *ltierror.Error
+	handler := WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err *ltierror.Error) {
+		reported = err
+		w.WriteHeader(err.StatusCode)
+	})
+	notAllowed := &ltierror.Error{Code: "course_closed", Description: "The course is closed.",
+		StatusCode: http.StatusForbidden}
+	closedCourse := ValidatorFunc(func(r *http.Request, verifiedToken jwt.Token,
+		registration datastore.Registration) (int, error) {
+		return 0, notAllowed
+	})
+
+	tests := []struct {
+		name       string
+		options    []Option
+		claims     map[string]interface{}
+		request    func(r *http.Request)
+		err        *ltierror.Error
+		statusCode int
+	}{
+		{"state", nil, nil, func(r *http.Request) { r.Form.Set("state", "state-2") }, ltierror.ErrStateMismatch,
+			http.StatusBadRequest},
+		{"nonce", nil, map[string]interface{}{"nonce": "unknown"}, nil, ltierror.ErrNonceInvalid,
+			http.StatusBadRequest},
+		{"deployment", nil, map[string]interface{}{"https://purl.imsglobal.org/spec/lti/claim/deployment_id": "2"},
+			nil, ltierror.ErrUnknownDeployment, http.StatusBadRequest},
+		{"message type", []Option{WithLTIVersions("1.3.1")}, nil, nil, ltierror.ErrUnsupportedMessage,
+			http.StatusBadRequest},
+		{"validator", []Option{WithValidatorsAfter(closedCourse)}, nil, nil, notAllowed, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		reported = nil
+		r := tl.Request(t, test.claims)
+		if test.request != nil {
+			r.ParseForm()
+			test.request(r)
+		}
+		w := httptest.NewRecorder()
+		tl.New(next, append(test.options, handler)...).ServeHTTP(w, r)
+		if reported == nil || !errors.Is(reported, test.err) || reported.StatusCode != test.statusCode {
+			t.Errorf("%s: got %v, wanted %s", test.name, reported, test.err.Code)
+			continue
+		}
+		if w.Code != test.statusCode {
+			t.Errorf("%s: got status %d, wanted %d", test.name, w.Code, test.statusCode)
+		}
+	}
+}
+
+// Test that the error page of a verified launch links back to the platform, and that of an unverified one does not.
+func TestLaunchErrorReturnURL(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	claims := map[string]interface{}{
+		"https://purl.imsglobal.org/spec/lti/claim/deployment_id": "2",
+		"https://purl.imsglobal.org/spec/lti/claim/launch_presentation": map[string]interface{}{
+			"return_url": "https://platform.tld/return?course=1",
+		},
+	}
+	var reported *ltierror.Error
+	handler := func(w http.ResponseWriter, r *http.Request, err *ltierror.Error) {
+		reported = err
+		ltierror.DefaultErrorHandler(w, r, err)
+	}
+	w := httptest.NewRecorder()
+	tl.New(next, WithErrorHandler(handler)).ServeHTTP(w, tl.Request(t, claims))
+	if w.Code != http.StatusBadRequest || reported == nil {
+		t.Fatalf("got %d %s, wanted an error page", w.Code, w.Body)
+	}
+	returnURL, err := url.Parse(reported.ReturnURL)
+	if err != nil {
+		t.Fatalf("return url parse error: %v", err)
+	}
+	query := returnURL.Query()
+	if query.Get("course") != "1" || query.Get("lti_errorlog") != ltierror.ErrUnknownDeployment.Code ||
+		query.Get("lti_errormsg") != ltierror.ErrUnknownDeployment.Description {
+		t.Fatalf("unexpected return url %s", reported.ReturnURL)
+	}
+
+	// Without a verified signature, the return URL cannot be trusted.
+	r := tl.Request(t, claims)
+	r.ParseForm()
+	r.Form.Set("id_token", r.Form.Get("id_token")+"x")
+	w = httptest.NewRecorder()
+	tl.New(next, WithErrorHandler(handler)).ServeHTTP(w, r)
+	if !errors.Is(reported, ltierror.ErrSignatureInvalid) || reported.ReturnURL != "" {
+		t.Fatalf("got %v with return url %q, wanted a signature error without one", reported, reported.ReturnURL)
+	}
+}
+
+// A downLaunchData is a launch data store that cannot be reached.
+type downLaunchData struct{}
+
+func (downLaunchData) StoreLaunchData(launchID string, launchData json.RawMessage) error {
+	return errors.New("store is down")
+}
+
+func (downLaunchData) FindLaunchData(launchID string) (json.RawMessage, error) {
+	return nil, errors.New("store is down")
+}
+
+// Test that a launch whose data cannot be stored fails on the tool's side rather than reaching the next handler.
+func TestLaunchDataStoreError(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+	next := func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler called without stored launch data")
+	}
+
+	var reported *ltierror.Error
+	handler := WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err *ltierror.Error) {
+		reported = err
+		w.WriteHeader(err.StatusCode)
+	})
+	l := New(datastore.Config{
+		Registrations: tl.store,
+		Nonces:        tl.store,
+		Replays:       tl.store,
+		LaunchData:    downLaunchData{},
+	}, next, WithKeySetCache(NewKeySetCache(tl.server.Client())), handler)
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, tl.Request(t, nil))
+	if !errors.Is(reported, ltierror.ErrInternal) || w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d %v, wanted %s", w.Code, reported, ltierror.ErrInternal.Code)
+	}
+}
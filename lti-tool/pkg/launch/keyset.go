@@ -0,0 +1,169 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/httpcc"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var (
+	// ErrKeyNotFound is the error returned when a platform's keyset has no key with the requested key ID, even after
+	// refetching it.
+	ErrKeyNotFound = errors.New("key not found in platform keyset")
+
+	// DefaultKeySetCache is the KeySetCache used by a Launch unless it is given another one.
+	DefaultKeySetCache = NewKeySetCache(nil)
+)
+
+var (
+	// defaultKeySetMaxAge is how long a keyset is fresh when the platform does not send a Cache-Control max-age.
+	defaultKeySetMaxAge = time.Hour
+
+	// minKeySetRefetchInterval limits how often an unknown key ID causes a keyset to be refetched, so that tokens
+	// with made-up key IDs cannot make the tool hammer the platform.
+	minKeySetRefetchInterval = 10 * time.Second
+
+	// maxKeySetStaleness is how long the last-known keys of a platform are used while its keyset cannot be fetched.
+	maxKeySetStaleness = 24 * time.Hour
+
+	// keySetClient fetches keysets unless a KeySetCache is given another client. Launches wait for the fetch, so it
+	// must not hang on an unresponsive platform.
+	keySetClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// A KeySetCache fetches the JWK sets that platforms publish at their registrations' keyset URIs and keeps them for as
+// long as the platforms' Cache-Control headers allow. A KeySetCache is safe for concurrent use.
+type KeySetCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	keysets map[string]*cachedKeySet
+}
+
+// A cachedKeySet is the last keyset fetched from a keyset URI. Its mutex is held while fetching, so that concurrent
+// launches share a single request.
+type cachedKeySet struct {
+	mu        sync.Mutex
+	keys      jwk.Set
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// NewKeySetCache returns a *KeySetCache that fetches keysets with `client'. A nil client means a client with a ten
+// second timeout.
+func NewKeySetCache(client *http.Client) *KeySetCache {
+	if client == nil {
+		client = keySetClient
+	}
+
+	return &KeySetCache{
+		client:  client,
+		keysets: make(map[string]*cachedKeySet),
+	}
+}
+
+// Key returns the key identified by `keyID' in the keyset published at `keysetURI'. An expired keyset is fetched
+// again, as is a keyset without the key, in case the platform rotated its keys; if the key is still missing, it
+// returns ErrKeyNotFound. If the keyset cannot be fetched, the last-known keys are used for up to a day.
+func (c *KeySetCache) Key(keysetURI, keyID string) (jwk.Key, error) {
+	c.mu.Lock()
+	keyset, ok := c.keysets[keysetURI]
+	if !ok {
+		keyset = &cachedKeySet{}
+		c.keysets[keysetURI] = keyset
+	}
+	c.mu.Unlock()
+
+	keyset.mu.Lock()
+	defer keyset.mu.Unlock()
+
+	now := time.Now()
+	if keyset.keys == nil || now.After(keyset.expiresAt) {
+		err := c.fetch(keysetURI, keyset, now)
+		if err != nil {
+			if keyset.keys == nil || now.Sub(keyset.fetchedAt) > maxKeySetStaleness {
+				return nil, err
+			}
+			// Serve the last-known keys, and give the platform some time before trying again.
+			keyset.expiresAt = now.Add(minKeySetRefetchInterval)
+		}
+	}
+
+	key, ok := keyset.keys.LookupKeyID(keyID)
+	if !ok && now.Sub(keyset.fetchedAt) >= minKeySetRefetchInterval {
+		err := c.fetch(keysetURI, keyset, now)
+		if err != nil {
+			return nil, err
+		}
+		key, ok = keyset.keys.LookupKeyID(keyID)
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return key, nil
+}
+
+// fetch retrieves the keyset from `keysetURI' and stores it in `keyset' with its expiry time. On failure, `keyset' is
+// left unchanged.
+func (c *KeySetCache) fetch(keysetURI string, keyset *cachedKeySet, now time.Time) error {
+	resp, err := c.client.Get(keysetURI)
+	if err != nil {
+		return fmt.Errorf("fetch keyset: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch keyset: unexpected status %s", resp.Status)
+	}
+
+	keys, err := jwk.ParseReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("fetch keyset: %w", err)
+	}
+
+	keyset.keys = keys
+	keyset.fetchedAt = now
+	keyset.expiresAt = now.Add(keySetMaxAge(resp.Header.Get("Cache-Control")))
+	return nil
+}
+
+// keySetMaxAge returns how long a keyset is fresh according to the Cache-Control header of its response. Keysets
+// that must not be cached are still kept as the last-known keys, but are fetched again for every launch.
+func keySetMaxAge(cacheControl string) time.Duration {
+	if cacheControl == "" {
+		return defaultKeySetMaxAge
+	}
+
+	// Look at the directives themselves: ResponseDirective.NoCache cannot tell a bare no-cache from its absence.
+	directives, err := httpcc.ParseResponseDirectives(cacheControl)
+	if err != nil {
+		return defaultKeySetMaxAge
+	}
+	maxAge := defaultKeySetMaxAge
+	for _, directive := range directives {
+		switch strings.ToLower(directive.Name) {
+		case httpcc.NoCache, httpcc.NoStore:
+			return 0
+		case httpcc.MaxAge:
+			seconds, err := strconv.ParseUint(directive.Value, 10, 32)
+			if err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return maxAge
+}
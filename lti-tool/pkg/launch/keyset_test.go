@@ -0,0 +1,149 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// A testPlatform publishes a keyset and counts how often it is fetched.
+type testPlatform struct {
+	mu           sync.Mutex
+	keys         jwk.Set
+	cacheControl string
+	down         bool
+	fetches      int
+}
+
+func (p *testPlatform) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fetches++
+	if p.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if p.cacheControl != "" {
+		w.Header().Set("Cache-Control", p.cacheControl)
+	}
+	json.NewEncoder(w).Encode(p.keys)
+}
+
+// addKey adds a new RSA key with the key ID `keyID' to the platform's keyset and returns its private key.
+func (p *testPlatform) addKey(t *testing.T, keyID string) jwk.Key {
+	t.Helper()
+
+	rawKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	privateKey, err := jwk.New(rawKey)
+	if err != nil {
+		t.Fatalf("cannot create private key: %v", err)
+	}
+	privateKey.Set(jwk.KeyIDKey, keyID)
+	publicKey, err := jwk.PublicKeyOf(privateKey)
+	if err != nil {
+		t.Fatalf("cannot create public key: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys == nil {
+		p.keys = jwk.NewSet()
+	}
+	p.keys.Add(publicKey)
+	return privateKey
+}
+
+func (p *testPlatform) fetchCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
+
+// Test that keysets are cached, refetched for unknown key IDs, and kept while the platform is down.
+func TestKeySetCache(t *testing.T) {
+	platform := &testPlatform{}
+	platform.addKey(t, "key-1")
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	cache := NewKeySetCache(server.Client())
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Key(server.URL, "key-1"); err != nil {
+			t.Fatalf("cannot find key: %v", err)
+		}
+	}
+	if fetches := platform.fetchCount(); fetches != 1 {
+		t.Fatalf("got %d fetches, wanted the keyset to be cached", fetches)
+	}
+
+	// A rotated key is found by refetching, but only once the keyset is old enough.
+	platform.addKey(t, "key-2")
+	if _, err := cache.Key(server.URL, "key-2"); err != ErrKeyNotFound {
+		t.Fatalf("got %v, wanted ErrKeyNotFound before the refetch interval", err)
+	}
+	defer func(interval time.Duration) { minKeySetRefetchInterval = interval }(minKeySetRefetchInterval)
+	minKeySetRefetchInterval = 0
+	if _, err := cache.Key(server.URL, "key-2"); err != nil {
+		t.Fatalf("cannot find rotated key: %v", err)
+	}
+	if _, err := cache.Key(server.URL, "unknown"); err != ErrKeyNotFound {
+		t.Fatalf("got %v, wanted ErrKeyNotFound", err)
+	}
+	if fetches := platform.fetchCount(); fetches != 3 {
+		t.Fatalf("got %d fetches, wanted 3", fetches)
+	}
+
+	// Keysets that must not be cached are fetched every time, and the last-known keys are used when that fails.
+	platform.mu.Lock()
+	platform.cacheControl = "no-cache"
+	platform.mu.Unlock()
+	cache = NewKeySetCache(server.Client())
+	if _, err := cache.Key(server.URL, "key-1"); err != nil {
+		t.Fatalf("cannot find key: %v", err)
+	}
+	platform.mu.Lock()
+	platform.down = true
+	platform.mu.Unlock()
+	if _, err := cache.Key(server.URL, "key-1"); err != nil {
+		t.Fatalf("got %v, wanted the last-known key while the platform is down", err)
+	}
+	if _, err := NewKeySetCache(server.Client()).Key(server.URL, "key-1"); err == nil {
+		t.Fatalf("got no error, wanted a fetch error without last-known keys")
+	}
+}
+
+// Test the freshness of keysets according to their Cache-Control headers.
+func TestKeySetMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		maxAge       time.Duration
+	}{
+		{"", defaultKeySetMaxAge},
+		{"public, max-age=300", 5 * time.Minute},
+		{"max-age=300, no-cache", 0},
+		{"no-store", 0},
+		{"max-age=invalid", defaultKeySetMaxAge},
+	}
+
+	for _, test := range tests {
+		if got := keySetMaxAge(test.cacheControl); got != test.maxAge {
+			t.Errorf("%q: got %v, wanted %v", test.cacheControl, got, test.maxAge)
+		}
+	}
+}
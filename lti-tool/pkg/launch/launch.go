@@ -8,27 +8,42 @@ package launch
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lestrrat-go/jwx/jwa"
-	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
 	"github.com/macewan-cs/lti-example/pkg/login"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
 )
 
 // A Launch implements an external application's role in the LTI specification's launch flow.
 type Launch struct {
-	cfg  datastore.Config
-	next http.HandlerFunc
+	cfg    datastore.Config
+	next   http.HandlerFunc
+	claims *ClaimRegistry
+	keys   *KeySetCache
+
+	leeway      time.Duration
+	maxTokenAge time.Duration
+	now         func() time.Time
+
+	messageTypes []string
+	versions     []string
+	before       []Validator
+	after        []Validator
+	errorHandler ltierror.ErrorHandler
 }
 
 // ContextKeyType is used as the key to store the launch ID in the request context.
@@ -43,11 +58,57 @@ var (
 	launchIDPrefix              = "lti1p3-launch-"
 )
 
-// New creates a *Launch, which implements the http.Handler interface for launching a tool.
-func New(cfg datastore.Config, next http.HandlerFunc) *Launch {
+// DefaultLeeway is the clock skew allowed between the platform and the tool when validating the time claims of an
+// id_token, unless a Launch is given another leeway.
+const DefaultLeeway = time.Minute
+
+var (
+	// ErrMissingExpiration is the error returned when an id_token has no expiration time (exp).
+	ErrMissingExpiration = errors.New("id_token has no expiration time")
+
+	// ErrTokenExpired is the error returned when an id_token has expired.
+	ErrTokenExpired = errors.New("id_token has expired")
+
+	// ErrTokenNotYetValid is the error returned when the not-before time (nbf) of an id_token has not been reached.
+	ErrTokenNotYetValid = errors.New("id_token is not valid yet")
+
+	// ErrMissingIssuedAt is the error returned when an id_token has no issue time (iat).
+	ErrMissingIssuedAt = errors.New("id_token has no issue time")
+
+	// ErrTokenIssuedInFuture is the error returned when the issue time of an id_token is in the future.
+	ErrTokenIssuedInFuture = errors.New("id_token is issued in the future")
+
+	// ErrTokenTooOld is the error returned when an id_token was issued longer ago than the launch's maximum token age.
+	ErrTokenTooOld = errors.New("id_token is too old")
+
+	// ErrMissingAudience is the error returned when an id_token has no audience (aud).
+	ErrMissingAudience = errors.New("id_token has no audience")
+
+	// ErrMissingAuthorizedParty is the error returned when an id_token has several audiences but no authorized
+	// party (azp).
+	ErrMissingAuthorizedParty = errors.New("id_token with several audiences has no authorized party")
+
+	// ErrAuthorizedPartyMismatch is the error returned when the authorized party of an id_token is not one of its
+	// audiences, or not the client ID of the registration.
+	ErrAuthorizedPartyMismatch = errors.New("id_token authorized party does not match its audience")
+)
+
+// New creates a *Launch, which implements the http.Handler interface for launching a tool. The `options' adjust the
+// built-in validations and add custom Validators.
+func New(cfg datastore.Config, next http.HandlerFunc, options ...Option) *Launch {
 	launch := Launch{
-		cfg:  cfg,
-		next: next,
+		cfg:          cfg,
+		next:         next,
+		claims:       DefaultClaimRegistry,
+		keys:         DefaultKeySetCache,
+		leeway:       DefaultLeeway,
+		now:          time.Now,
+		messageTypes: []string{MessageTypeResourceLink},
+		versions:     []string{supportedLTIVersion},
+		errorHandler: ltierror.DefaultErrorHandler,
+	}
+	for _, option := range options {
+		option(&launch)
 	}
 
 	if launch.cfg.LaunchData == nil {
@@ -59,10 +120,43 @@ func New(cfg datastore.Config, next http.HandlerFunc) *Launch {
 	if launch.cfg.Nonces == nil {
 		launch.cfg.Nonces = nonpersistent.DefaultStore
 	}
+	if launch.cfg.Replays == nil {
+		launch.cfg.Replays = nonpersistent.DefaultStore
+	}
 
 	return &launch
 }
 
+// SetClaimRegistry sets the registry used to decode extension claims. By default, a Launch uses the
+// DefaultClaimRegistry.
+func (l *Launch) SetClaimRegistry(claims *ClaimRegistry) {
+	l.claims = claims
+}
+
+// SetKeySetCache sets the cache of the platform keysets used to verify id_tokens. By default, a Launch uses the
+// DefaultKeySetCache.
+func (l *Launch) SetKeySetCache(keys *KeySetCache) {
+	l.keys = keys
+}
+
+// SetErrorHandler sets the handler that responds to failed launches. By default, a Launch uses
+// ltierror.DefaultErrorHandler.
+func (l *Launch) SetErrorHandler(handler ltierror.ErrorHandler) {
+	l.errorHandler = handler
+}
+
+// SetLeeway sets the clock skew allowed when validating the expiration, not-before and issue times of id_tokens. By
+// default, a Launch allows DefaultLeeway.
+func (l *Launch) SetLeeway(leeway time.Duration) {
+	l.leeway = leeway
+}
+
+// SetMaxTokenAge sets how long after their issue time id_tokens are accepted, regardless of their expiration time. By
+// default, or with a zero `maxAge', the age of id_tokens is not limited.
+func (l *Launch) SetMaxTokenAge(maxAge time.Duration) {
+	l.maxTokenAge = maxAge
+}
+
 // ServeHTTP performs validations according the OIDC launch flow modified for use by the IMS Global LTI v1p3
 // specifications. State is found in a user agent cookie and the POST body. Nonce is found embedded in the id_token and
 // in a datastore.
@@ -72,66 +166,108 @@ func (l *Launch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		statusCode    int
 		err           error
 		registration  datastore.Registration
+		deployment    datastore.Deployment
 		verifiedToken jwt.Token
 		launchData    json.RawMessage
+		message       LaunchMessage
+		claims        map[string]interface{}
 	)
 
 	if rawToken, statusCode, err = getRawToken(r); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrInvalidRequest, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if registration, statusCode, err = validateRegistration(rawToken, l, r); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrInvalidRequest, statusCode, err, rawToken, verifiedToken)
+		return
+	}
+
+	if verifiedToken, statusCode, err = validateSignature(rawToken, registration, l); err != nil {
+		l.fail(w, r, ltierror.ErrSignatureInvalid, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
-	if verifiedToken, statusCode, err = validateRSASignature(rawToken, registration); err != nil {
-		http.Error(w, err.Error(), statusCode)
+	if statusCode, err = runValidators(l.before, r, verifiedToken, registration); err != nil {
+		l.fail(w, r, ltierror.ErrRejected, statusCode, err, rawToken, verifiedToken)
+		return
+	}
+
+	if statusCode, err = validateTimes(verifiedToken, l, l.now()); err != nil {
+		l.fail(w, r, ltierror.ErrInvalidToken, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if statusCode, err = validateState(r); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrStateMismatch, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if statusCode, err = validateClientID(verifiedToken, registration); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrInvalidToken, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if statusCode, err = validateNonceAndTargetLinkURI(verifiedToken, l); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrNonceInvalid, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
-	if statusCode, err = validateDeploymentID(verifiedToken, l); err != nil {
-		http.Error(w, err.Error(), statusCode)
+	if statusCode, err = validateTokenID(rawToken, verifiedToken, l); err != nil {
+		l.fail(w, r, ltierror.ErrNonceReplay, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
-	if statusCode, err = validateVersionAndMessageType(verifiedToken); err != nil {
-		http.Error(w, err.Error(), statusCode)
+	if deployment, statusCode, err = validateDeploymentID(verifiedToken, registration, l); err != nil {
+		l.fail(w, r, ltierror.ErrUnknownDeployment, statusCode, err, rawToken, verifiedToken)
+		return
+	}
+
+	if statusCode, err = validateVersionAndMessageType(verifiedToken, l); err != nil {
+		l.fail(w, r, ltierror.ErrUnsupportedMessage, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if statusCode, err = validateResourceLink(verifiedToken); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrInvalidClaims, statusCode, err, rawToken, verifiedToken)
+		return
+	}
+
+	if statusCode, err = runValidators(l.after, r, verifiedToken, registration); err != nil {
+		l.fail(w, r, ltierror.ErrRejected, statusCode, err, rawToken, verifiedToken)
 		return
 	}
 
 	if launchData, statusCode, err = getLaunchData(rawToken); err != nil {
-		http.Error(w, err.Error(), statusCode)
+		l.fail(w, r, ltierror.ErrInvalidClaims, statusCode, err, rawToken, verifiedToken)
+		return
+	}
+
+	if message, err = MessageFromLaunchData(launchData); err != nil {
+		l.fail(w, r, ltierror.ErrInvalidClaims, http.StatusBadRequest, err, rawToken, verifiedToken)
+		return
+	}
+
+	if claims, err = l.claims.Decode(launchData); err != nil {
+		l.fail(w, r, ltierror.ErrInvalidClaims, http.StatusBadRequest, err, rawToken, verifiedToken)
 		return
 	}
 
 	// Store the Launch data under a unique Launch ID for future reference.
 	launchID := launchIDPrefix + uuid.New().String()
-	l.cfg.LaunchData.StoreLaunchData(launchID, launchData)
+	if err = l.cfg.LaunchData.StoreLaunchData(launchID, launchData); err != nil {
+		l.fail(w, r, ltierror.ErrInternal, http.StatusInternalServerError, err, rawToken, verifiedToken)
+		return
+	}
 
 	// Put the launch ID in the request context for subsequent handlers.
-	r = r.WithContext(contextWithLaunchID(r.Context(), LaunchContext{launchID, verifiedToken}))
+	r = r.WithContext(ContextWithLaunchContext(r.Context(), LaunchContext{
+		LaunchId:   launchID,
+		Token:      verifiedToken,
+		Message:    message,
+		Claims:     claims,
+		Deployment: deployment,
+	}))
 
 	l.next(w, r)
 }
@@ -156,11 +292,15 @@ func validateRegistration(rawToken []byte, l *Launch, r *http.Request) (datastor
 	}
 
 	issuer := token.Issuer()
-	clientID := token.Audience()[0]
+	clientID, err := AuthorizedClientID(token)
+	if err != nil {
+		return datastore.Registration{}, http.StatusBadRequest, fmt.Errorf("validate registration: %w", err)
+	}
 	registration, err := l.cfg.Registrations.FindRegistrationByIssuerAndClientID(issuer, clientID)
 	if err != nil {
 		if err == datastore.ErrRegistrationNotFound {
-			return datastore.Registration{}, http.StatusBadRequest, fmt.Errorf("no registration found for iss %s", issuer)
+			return datastore.Registration{}, http.StatusBadRequest, fmt.Errorf("no registration found for iss %s: %w", issuer,
+				err)
 		}
 
 		return datastore.Registration{}, http.StatusInternalServerError, fmt.Errorf("validate registration: %w", err)
@@ -169,40 +309,38 @@ func validateRegistration(rawToken []byte, l *Launch, r *http.Request) (datastor
 	return registration, http.StatusOK, nil
 }
 
-// validateSignature checks the authenticity of the token.
-func validateSignature(rawToken []byte, registration datastore.Registration, r *http.Request) (jwt.Token, int, error) {
-	// Get keyset from the Platform for verification.
-	keyset, err := jwk.Fetch(context.Background(), registration.KeysetURI.String())
-	if err != nil {
-		// Since the KeysetURI is part of the registration, a failure to retrieve it should be reported as an
-		// internal server error.
-		return nil, http.StatusInternalServerError, fmt.Errorf("validate signature: %w", err)
-	}
-
-	// Perform the signature check.
-	verifiedToken, err := jwt.Parse(rawToken, jwt.WithKeySet(keyset))
+// validateSignature checks the authenticity of the token. The token must be signed with RS256, by the key that its
+// key ID (kid) header names in the keyset of the registration.
+func validateSignature(rawToken []byte, registration datastore.Registration, l *Launch) (jwt.Token, int, error) {
+	message, err := jws.Parse(rawToken)
 	if err != nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("validate signature: %w", err)
 	}
+	if len(message.Signatures()) != 1 {
+		return nil, http.StatusBadRequest, errors.New("validate signature: token must have a single signature")
+	}
+	headers := message.Signatures()[0].ProtectedHeaders()
+	if headers.Algorithm() != jwa.RS256 {
+		return nil, http.StatusBadRequest, fmt.Errorf("validate signature: unsupported algorithm %s", headers.Algorithm())
+	}
+	if headers.KeyID() == "" {
+		return nil, http.StatusBadRequest, errors.New("validate signature: token has no key ID")
+	}
 
-	return verifiedToken, http.StatusOK, nil
-}
-
-func validateRSASignature(rawToken []byte, registration datastore.Registration) (jwt.Token, int, error) {
-	var getPublicKey = func() string {
-		resp, err := http.Get(registration.KeysetURI.String())
-		if err != nil {
-			panic(errors.New("get public key failed"))
-		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			panic(errors.New("get public key failed"))
+	key, err := l.keys.Key(registration.KeysetURI.String(), headers.KeyID())
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, http.StatusBadRequest, fmt.Errorf("validate signature: %w", err)
 		}
-		return string(b)
+
+		// Since the KeysetURI is part of the registration, a failure to retrieve it should be reported as an
+		// internal server error.
+		return nil, http.StatusInternalServerError, ltierror.ErrKeySetUnavailable.Wrap(
+			fmt.Errorf("validate signature: %w", err))
 	}
+
 	// Perform the signature check.
-	verifiedToken, err := jwt.Parse(rawToken, jwt.WithDecrypt(jwa.RSA_OAEP_256, getPublicKey()))
+	verifiedToken, err := jwt.Parse(rawToken, jwt.WithVerify(jwa.RS256, key))
 	if err != nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("validate signature: %w", err)
 	}
@@ -228,7 +366,39 @@ func validateState(r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
-// validateClientID checks that the claimed client ID (aud) is listed for the claimed issuer.
+// validateTimes checks the expiration (exp), not-before (nbf) and issue (iat) times of the token against `now',
+// allowing for the launch's leeway. The expiration and issue times are required.
+// Source: https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation.
+func validateTimes(verifiedToken jwt.Token, l *Launch, now time.Time) (int, error) {
+	expiration := verifiedToken.Expiration()
+	if expiration.IsZero() {
+		return http.StatusBadRequest, ErrMissingExpiration
+	}
+	if now.After(expiration.Add(l.leeway)) {
+		return http.StatusBadRequest, ErrTokenExpired
+	}
+
+	notBefore := verifiedToken.NotBefore()
+	if !notBefore.IsZero() && now.Add(l.leeway).Before(notBefore) {
+		return http.StatusBadRequest, ErrTokenNotYetValid
+	}
+
+	issuedAt := verifiedToken.IssuedAt()
+	if issuedAt.IsZero() {
+		return http.StatusBadRequest, ErrMissingIssuedAt
+	}
+	if now.Add(l.leeway).Before(issuedAt) {
+		return http.StatusBadRequest, ErrTokenIssuedInFuture
+	}
+	if l.maxTokenAge > 0 && now.Sub(issuedAt) > l.maxTokenAge+l.leeway {
+		return http.StatusBadRequest, ErrTokenTooOld
+	}
+
+	return http.StatusOK, nil
+}
+
+// validateClientID checks that the claimed client ID (aud) is listed for the claimed issuer and, if the token has
+// several audiences, that it is the authorized party (azp).
 func validateClientID(verifiedToken jwt.Token, registration datastore.Registration) (int, error) {
 	audience := verifiedToken.Audience()
 	found := contains(registration.ClientID, audience)
@@ -236,9 +406,46 @@ func validateClientID(verifiedToken jwt.Token, registration datastore.Registrati
 		return http.StatusBadRequest, errors.New("client ID not registered for this issuer")
 	}
 
+	clientID, err := AuthorizedClientID(verifiedToken)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if clientID != registration.ClientID {
+		return http.StatusBadRequest, ErrAuthorizedPartyMismatch
+	}
+
 	return http.StatusOK, nil
 }
 
+// AuthorizedClientID returns the client ID that the token is issued to. A token with a single audience is issued to
+// that audience. A token with several audiences must name one of them as its authorized party (azp); if a token with
+// a single audience has an authorized party, the two must match.
+func AuthorizedClientID(token jwt.Token) (string, error) {
+	audience := token.Audience()
+	if len(audience) == 0 {
+		return "", ErrMissingAudience
+	}
+
+	var authorizedParty string
+	if azp, ok := token.Get("azp"); ok {
+		authorizedParty, _ = azp.(string)
+		if authorizedParty == "" {
+			return "", ErrAuthorizedPartyMismatch
+		}
+	}
+
+	switch {
+	case len(audience) == 1 && authorizedParty == "":
+		return audience[0], nil
+	case authorizedParty == "":
+		return "", ErrMissingAuthorizedParty
+	case !contains(authorizedParty, audience):
+		return "", ErrAuthorizedPartyMismatch
+	}
+
+	return authorizedParty, nil
+}
+
 // validateNonceAndTargetLinkURI verifies that the TargetLinkURI provided during the initial (login) auth request and
 // the id_token matches, and in the process, it checks that the nonce also exists.
 func validateNonceAndTargetLinkURI(verifiedToken jwt.Token, l *Launch) (int, error) {
@@ -263,16 +470,19 @@ func validateNonceAndTargetLinkURI(verifiedToken jwt.Token, l *Launch) (int, err
 	return http.StatusOK, nil
 }
 
-// validateDeploymentID verifies that the deployment ID exists under the issuer.
-func validateDeploymentID(verifiedToken jwt.Token, l *Launch) (int, error) {
-	deploymentID, ok := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/deployment_id")
-	if !ok {
-		return http.StatusBadRequest, errors.New("deployment not found in request")
+// validateTokenID records the id_token as used, identified by its issuer and JWT ID, and rejects a token that was used
+// before. A token without a JWT ID is identified by the SHA-256 hash of `rawToken' instead. The token is remembered
+// until it expires; validateTimes has already required an expiration time.
+func validateTokenID(rawToken []byte, verifiedToken jwt.Token, l *Launch) (int, error) {
+	tokenID := verifiedToken.JwtID()
+	if tokenID == "" {
+		hash := sha256.Sum256(rawToken)
+		tokenID = "sha256:" + hex.EncodeToString(hash[:])
 	}
 
-	_, err := l.cfg.Registrations.FindDeployment(verifiedToken.Issuer(), deploymentID.(string))
+	err := l.cfg.Replays.TestAndSetTokenID(verifiedToken.Issuer(), tokenID, verifiedToken.Expiration())
 	if err != nil {
-		if err == datastore.ErrDeploymentNotFound {
+		if err == datastore.ErrTokenReplayed {
 			return http.StatusBadRequest, err
 		}
 
@@ -282,14 +492,87 @@ func validateDeploymentID(verifiedToken jwt.Token, l *Launch) (int, error) {
 	return http.StatusOK, nil
 }
 
-// validateVersionAndMessageType checks for a valid version and message type. Only 'Resource link launch request'
-// (LtiResourceLinkRequest) is currently supported.
-func validateVersionAndMessageType(verifiedToken jwt.Token) (int, error) {
+// validateDeploymentID verifies that the deployment ID exists under the registration of the issuer and the client the
+// token is addressed to, so that a deployment of one client cannot authorize launches to another client of the same
+// issuer. It also enforces the deployment's policy: disabled deployments and contexts that the deployment does not
+// allow are rejected.
+//
+// An unknown deployment is provisioned if the registration's policy allows it. This is safe because the token's
+// signature has been verified with the registration's keyset, so the platform itself created the deployment.
+func validateDeploymentID(verifiedToken jwt.Token, registration datastore.Registration,
+	l *Launch) (datastore.Deployment, int, error) {
+	deploymentID, ok := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/deployment_id")
+	if !ok {
+		return datastore.Deployment{}, http.StatusBadRequest, errors.New("deployment not found in request")
+	}
+
+	deployment, err := l.cfg.Registrations.FindDeployment(verifiedToken.Issuer(), registration.ClientID,
+		deploymentID.(string))
+	if err == datastore.ErrDeploymentNotFound && registration.Provisioning != datastore.ProvisionNone {
+		deployment, err = provisionDeployment(registration, deploymentID.(string), l)
+	}
+	if err != nil {
+		if err == datastore.ErrDeploymentNotFound {
+			return datastore.Deployment{}, http.StatusBadRequest, err
+		}
+
+		return datastore.Deployment{}, http.StatusInternalServerError, err
+	}
+
+	if deployment.Pending {
+		return datastore.Deployment{}, http.StatusForbidden, datastore.ErrDeploymentPending
+	}
+	if deployment.Disabled {
+		return datastore.Deployment{}, http.StatusForbidden, datastore.ErrDeploymentDisabled
+	}
+
+	// A launch without a context claim is only allowed by deployments that do not restrict contexts.
+	var contextID string
+	if context, ok := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/context"); ok {
+		if contextClaim, ok := context.(map[string]interface{}); ok {
+			contextID, _ = contextClaim["id"].(string)
+		}
+	}
+	if len(deployment.AllowedContextIDs) > 0 && (contextID == "" || !deployment.AllowsContext(contextID)) {
+		return datastore.Deployment{}, http.StatusForbidden, datastore.ErrContextNotAllowed
+	}
+
+	return deployment, http.StatusOK, nil
+}
+
+// provisionDeployment stores the deployment identified by `deploymentID' for the registration, recording when it was
+// first seen. Under the ProvisionPending policy, the deployment is stored pending approval. An unrecognized policy
+// provisions nothing and returns datastore.ErrDeploymentNotFound.
+func provisionDeployment(registration datastore.Registration, deploymentID string,
+	l *Launch) (datastore.Deployment, error) {
+	deployment := datastore.Deployment{
+		DeploymentID: deploymentID,
+		FirstSeen:    l.now(),
+	}
+	switch registration.Provisioning {
+	case datastore.ProvisionAutomatic:
+	case datastore.ProvisionPending:
+		deployment.Pending = true
+	default:
+		return datastore.Deployment{}, datastore.ErrDeploymentNotFound
+	}
+
+	err := l.cfg.Registrations.StoreDeployment(registration.Issuer, registration.ClientID, deployment)
+	if err != nil {
+		return datastore.Deployment{}, fmt.Errorf("provision deployment: %w", err)
+	}
+
+	return deployment, nil
+}
+
+// validateVersionAndMessageType checks for a version and a message type accepted by the launch. By default, only
+// 'Resource link launch request' (LtiResourceLinkRequest) with LTI 1.3.0 is accepted.
+func validateVersionAndMessageType(verifiedToken jwt.Token, l *Launch) (int, error) {
 	ltiVersion, ok := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/version")
 	if !ok {
 		return http.StatusBadRequest, errors.New("LTI version not found in request")
 	}
-	if ltiVersion != supportedLTIVersion {
+	if version, _ := ltiVersion.(string); !contains(version, l.versions) {
 		return http.StatusBadRequest, errors.New("compatible version not found in request")
 	}
 
@@ -297,15 +580,21 @@ func validateVersionAndMessageType(verifiedToken jwt.Token) (int, error) {
 	if !ok {
 		return http.StatusBadRequest, errors.New("message type not found in request")
 	}
-	if messageType.(string) != "LtiResourceLinkRequest" {
+	if messageType, _ := messageType.(string); !contains(messageType, l.messageTypes) {
 		return http.StatusBadRequest, errors.New("supported message type not found in request")
 	}
 
 	return http.StatusOK, nil
 }
 
-// validateResourceLink verifies the resource link and ID.
+// validateResourceLink verifies the resource link and ID of resource link launch requests. Other message types do not
+// require a resource link.
 func validateResourceLink(verifiedToken jwt.Token) (int, error) {
+	messageType, _ := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/message_type")
+	if messageType != MessageTypeResourceLink {
+		return http.StatusOK, nil
+	}
+
 	rawResourceLink, ok := verifiedToken.Get("https://purl.imsglobal.org/spec/lti/claim/resource_link")
 	if !ok {
 		return http.StatusBadRequest, errors.New("resource link not found in request")
@@ -352,14 +641,64 @@ func contains(n string, s []string) bool {
 	return false
 }
 
+// A LaunchContext is attached to the request context after a successful launch. Message is the typed form of the
+// verified Token, and Claims holds the extension claims decoded by the launch's ClaimRegistry. Deployment is the
+// deployment the launch came through, e.g. to check its feature flags; it is only set for the launch request itself,
+// not in contexts restored with RestoreLaunchContext.
 type LaunchContext struct {
-	LaunchId string
-	Token jwt.Token
+	LaunchId   string
+	Token      jwt.Token
+	Message    LaunchMessage
+	Claims     map[string]interface{}
+	Deployment datastore.Deployment
 }
 
-// contextWithLaunchID puts the launch ID into the given context.
-func contextWithLaunchID(ctx context.Context, lc LaunchContext) context.Context {
+// Claim returns the decoded extension claim registered under `uri', if it was present in the launch.
+func (lc LaunchContext) Claim(uri string) (interface{}, bool) {
+	claim, ok := lc.Claims[uri]
+	return claim, ok
+}
+
+// ContextWithLaunchContext puts the launch context into the given context.
+func ContextWithLaunchContext(ctx context.Context, lc LaunchContext) context.Context {
 	key := ContextKey
 
 	return context.WithValue(ctx, key, lc)
 }
+
+// RestoreLaunchContext rebuilds the launch context of a previous launch from the launch data stored under `launchID'.
+// Extension claims are decoded with `claims', or with the DefaultClaimRegistry when `claims' is nil. It lets requests
+// that follow the launch, e.g. those of a tool session, use the same context as the launch's `next' handler.
+func RestoreLaunchContext(store datastore.LaunchDataStorer, claims *ClaimRegistry, launchID string) (LaunchContext, error) {
+	if claims == nil {
+		claims = DefaultClaimRegistry
+	}
+
+	launchData, err := store.FindLaunchData(launchID)
+	if err != nil {
+		return LaunchContext{}, err
+	}
+
+	// The stored launch data is the payload of an id_token whose authenticity was verified during the launch.
+	token, err := jwt.Parse(launchData)
+	if err != nil {
+		return LaunchContext{}, fmt.Errorf("restore launch context: %w", err)
+	}
+
+	message, err := MessageFromLaunchData(launchData)
+	if err != nil {
+		return LaunchContext{}, fmt.Errorf("restore launch context: %w", err)
+	}
+
+	decodedClaims, err := claims.Decode(launchData)
+	if err != nil {
+		return LaunchContext{}, fmt.Errorf("restore launch context: %w", err)
+	}
+
+	return LaunchContext{
+		LaunchId: launchID,
+		Token:    token,
+		Message:  message,
+		Claims:   decodedClaims,
+	}, nil
+}
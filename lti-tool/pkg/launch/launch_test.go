@@ -4,3 +4,397 @@
 // the LICENSE file in the root directory of this source tree.
 
 package launch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/login"
+)
+
+// A testLaunch is a platform, with a registration and deployment in a nonpersistent store, that signs launch requests.
+type testLaunch struct {
+	store    *nonpersistent.Store
+	platform *testPlatform
+	server   *httptest.Server
+	key      jwk.Key
+}
+
+func newTestLaunch(t *testing.T) *testLaunch {
+	t.Helper()
+
+	tl := &testLaunch{store: nonpersistent.New(), platform: &testPlatform{}}
+	tl.key = tl.platform.addKey(t, "key-1")
+	tl.server = httptest.NewServer(tl.platform)
+
+	err := tl.store.StoreRegistration(datastore.Registration{
+		Issuer:        "https://platform.tld",
+		ClientID:      "client-1",
+		AuthTokenURI:  mustParseURL(t, "https://platform.tld/token"),
+		AuthLoginURI:  mustParseURL(t, "https://platform.tld/auth"),
+		KeysetURI:     mustParseURL(t, tl.server.URL),
+		TargetLinkURI: mustParseURL(t, "https://tool.tld/launch"),
+	})
+	if err != nil {
+		t.Fatalf("cannot store registration: %v", err)
+	}
+	err = tl.store.StoreDeployment("https://platform.tld", "client-1", datastore.Deployment{DeploymentID: "1"})
+	if err != nil {
+		t.Fatalf("cannot store deployment: %v", err)
+	}
+
+	return tl
+}
+
+func (tl *testLaunch) Close() {
+	tl.server.Close()
+}
+
+// New returns a Launch using the test platform's store and keyset.
+func (tl *testLaunch) New(next http.HandlerFunc, options ...Option) *Launch {
+	options = append([]Option{WithKeySetCache(NewKeySetCache(tl.server.Client()))}, options...)
+	return New(datastore.Config{
+		Registrations: tl.store,
+		Nonces:        tl.store,
+		Replays:       tl.store,
+		LaunchData:    tl.store,
+	}, next, options...)
+}
+
+// Request returns a launch request with a signed id_token and a fresh nonce. The `claims' are added to, or replace,
+// those of a valid resource link launch request.
+func (tl *testLaunch) Request(t *testing.T, claims map[string]interface{}) *http.Request {
+	t.Helper()
+
+	nonce := "nonce-" + time.Now().Format(time.RFC3339Nano)
+	err := tl.store.StoreNonce(datastore.Nonce{Value: nonce, TargetLinkURI: "https://tool.tld/launch"})
+	if err != nil {
+		t.Fatalf("cannot store nonce: %v", err)
+	}
+
+	withNonce := map[string]interface{}{jwt.JwtIDKey: nonce, "nonce": nonce}
+	for name, value := range claims {
+		withNonce[name] = value
+	}
+	return tl.Post(t, tl.Sign(t, withNonce), "state-1")
+}
+
+// Sign returns a signed id_token of a valid resource link launch request, with the `claims' added or replaced.
+func (tl *testLaunch) Sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, "https://platform.tld")
+	token.Set(jwt.AudienceKey, "client-1")
+	token.Set(jwt.IssuedAtKey, time.Now())
+	token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/deployment_id", "1")
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/version", "1.3.0")
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/message_type", MessageTypeResourceLink)
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/target_link_uri", "https://tool.tld/launch")
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/resource_link", map[string]interface{}{"id": "link-1"})
+	for name, value := range claims {
+		token.Set(name, value)
+	}
+	signed, err := jwt.Sign(token, jwa.RS256, tl.key)
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+
+	return string(signed)
+}
+
+// Post returns a launch request posting the `idToken' with the `state', which is also set as the state cookie.
+func (tl *testLaunch) Post(t *testing.T, idToken, state string) *http.Request {
+	t.Helper()
+
+	form := url.Values{"id_token": {idToken}, "state": {state}}
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: login.StateCookieName, Value: state})
+	return r
+}
+
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("cannot parse URL %s: %v", rawURL, err)
+	}
+	return u
+}
+
+// Test that an id_token can be used only once.
+func TestValidateTokenID(t *testing.T) {
+	l := New(datastore.Config{Replays: nonpersistent.New()}, nil)
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, "https://platform.tld")
+	token.Set(jwt.JwtIDKey, "jti-1")
+	token.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+
+	if statusCode, err := validateTokenID([]byte("token-1"), token, l); err != nil {
+		t.Fatalf("got %d %v, wanted first use to be accepted", statusCode, err)
+	}
+	statusCode, err := validateTokenID([]byte("token-1"), token, l)
+	if err != datastore.ErrTokenReplayed || statusCode != http.StatusBadRequest {
+		t.Fatalf("got %d %v, wanted replay to be rejected", statusCode, err)
+	}
+
+	// Tokens without a JWT ID are tracked by their hash.
+	untracked := jwt.New()
+	untracked.Set(jwt.IssuerKey, "https://platform.tld")
+	untracked.Set(jwt.ExpirationKey, time.Now().Add(time.Hour))
+	if _, err := validateTokenID([]byte("token-2"), untracked, l); err != nil {
+		t.Fatalf("got %v, wanted first use of a token without jti to be accepted", err)
+	}
+	if _, err := validateTokenID([]byte("token-3"), untracked, l); err != nil {
+		t.Fatalf("got %v, wanted another token without jti to be accepted", err)
+	}
+	_, err = validateTokenID([]byte("token-2"), untracked, l)
+	if err != datastore.ErrTokenReplayed {
+		t.Fatalf("got %v, wanted replay of a token without jti to be rejected", err)
+	}
+}
+
+// Test that id_tokens are verified with the key named by their key ID in the registration's keyset.
+func TestValidateSignature(t *testing.T) {
+	platform := &testPlatform{}
+	key := platform.addKey(t, "key-1")
+	server := httptest.NewServer(platform)
+	defer server.Close()
+
+	keysetURI, _ := url.Parse(server.URL)
+	registration := datastore.Registration{Issuer: "https://platform.tld", ClientID: "client-1", KeysetURI: keysetURI}
+	l := New(datastore.Config{Registrations: nonpersistent.New()}, nil)
+	l.SetKeySetCache(NewKeySetCache(server.Client()))
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, "https://platform.tld")
+	signed, err := jwt.Sign(token, jwa.RS256, key)
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+	verifiedToken, statusCode, err := validateSignature(signed, registration, l)
+	if err != nil {
+		t.Fatalf("got %d %v, wanted the signature to be accepted", statusCode, err)
+	}
+	if verifiedToken.Issuer() != "https://platform.tld" {
+		t.Fatalf("got issuer %s, wanted https://platform.tld", verifiedToken.Issuer())
+	}
+
+	// A key of the platform that is not in its keyset cannot sign tokens.
+	other := (&testPlatform{}).addKey(t, "key-2")
+	signed, err = jwt.Sign(token, jwa.RS256, other)
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+	if _, statusCode, err = validateSignature(signed, registration, l); statusCode != http.StatusBadRequest {
+		t.Fatalf("got %d %v, wanted a token signed with an unknown key to be rejected", statusCode, err)
+	}
+
+	// A token that names a known key but is signed with another is rejected.
+	headers := jws.NewHeaders()
+	headers.Set(jws.KeyIDKey, "key-1")
+	signed, err = jwt.Sign(token, jwa.RS256, other, jwt.WithHeaders(headers))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+	if _, statusCode, err = validateSignature(signed, registration, l); statusCode != http.StatusBadRequest {
+		t.Fatalf("got %d %v, wanted a forged token to be rejected", statusCode, err)
+	}
+}
+
+// Test that a deployment only authorizes launches to the client it belongs to, and that its policy is enforced.
+func TestValidateDeploymentID(t *testing.T) {
+	store := nonpersistent.New()
+	deployments := []datastore.Deployment{
+		{DeploymentID: "1", Features: map[string]bool{"grades": true}},
+		{DeploymentID: "2", Disabled: true},
+		{DeploymentID: "3", AllowedContextIDs: []string{"course-1"}},
+	}
+	for _, deployment := range deployments {
+		err := store.StoreDeployment("https://platform.tld", "client-1", deployment)
+		if err != nil {
+			t.Fatalf("cannot store deployment: %v", err)
+		}
+	}
+	l := New(datastore.Config{Registrations: store}, nil)
+
+	token := jwt.New()
+	token.Set(jwt.IssuerKey, "https://platform.tld")
+	token.Set(jwt.AudienceKey, "client-1")
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/deployment_id", "1")
+	registration := datastore.Registration{Issuer: "https://platform.tld", ClientID: "client-1"}
+	deployment, statusCode, err := validateDeploymentID(token, registration, l)
+	if err != nil {
+		t.Fatalf("got %d %v, wanted the deployment to be accepted", statusCode, err)
+	}
+	if !deployment.HasFeature("grades") {
+		t.Fatalf("got %#v, wanted the deployment's features", deployment)
+	}
+
+	other := datastore.Registration{Issuer: "https://platform.tld", ClientID: "client-2"}
+	token.Set(jwt.AudienceKey, "client-2")
+	_, statusCode, err = validateDeploymentID(token, other, l)
+	if err != datastore.ErrDeploymentNotFound || statusCode != http.StatusBadRequest {
+		t.Fatalf("got %d %v, wanted a deployment of another client to be rejected", statusCode, err)
+	}
+
+	token.Set(jwt.AudienceKey, "client-1")
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/deployment_id", "2")
+	_, statusCode, err = validateDeploymentID(token, registration, l)
+	if err != datastore.ErrDeploymentDisabled || statusCode != http.StatusForbidden {
+		t.Fatalf("got %d %v, wanted a disabled deployment to be rejected", statusCode, err)
+	}
+
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/deployment_id", "3")
+	_, statusCode, err = validateDeploymentID(token, registration, l)
+	if err != datastore.ErrContextNotAllowed || statusCode != http.StatusForbidden {
+		t.Fatalf("got %d %v, wanted a launch without a context to be rejected", statusCode, err)
+	}
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/context", map[string]interface{}{"id": "course-2"})
+	_, statusCode, err = validateDeploymentID(token, registration, l)
+	if err != datastore.ErrContextNotAllowed || statusCode != http.StatusForbidden {
+		t.Fatalf("got %d %v, wanted a launch from another context to be rejected", statusCode, err)
+	}
+	token.Set("https://purl.imsglobal.org/spec/lti/claim/context", map[string]interface{}{"id": "course-1"})
+	if _, statusCode, err = validateDeploymentID(token, registration, l); err != nil {
+		t.Fatalf("got %d %v, wanted a launch from an allowed context to be accepted", statusCode, err)
+	}
+}
+
+// Test that unknown deployments are provisioned according to the registration's policy.
+func TestProvisionDeployment(t *testing.T) {
+	tests := []struct {
+		provisioning datastore.ProvisioningPolicy
+		statusCode   int
+		err          error
+		stored       bool
+	}{
+		{datastore.ProvisionNone, http.StatusBadRequest, datastore.ErrDeploymentNotFound, false},
+		{datastore.ProvisionAutomatic, http.StatusOK, nil, true},
+		{datastore.ProvisionPending, http.StatusForbidden, datastore.ErrDeploymentPending, true},
+	}
+
+	now := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		store := nonpersistent.New()
+		l := New(datastore.Config{Registrations: store}, nil, WithClock(func() time.Time { return now }))
+		registration := datastore.Registration{
+			Issuer:       "https://platform.tld",
+			ClientID:     "client-1",
+			Provisioning: test.provisioning,
+		}
+
+		token := jwt.New()
+		token.Set(jwt.IssuerKey, "https://platform.tld")
+		token.Set(jwt.AudienceKey, "client-1")
+		token.Set("https://purl.imsglobal.org/spec/lti/claim/deployment_id", "new")
+		_, statusCode, err := validateDeploymentID(token, registration, l)
+		if err != test.err || statusCode != test.statusCode {
+			t.Errorf("policy %q: got %d %v, wanted %d %v", test.provisioning, statusCode, err, test.statusCode, test.err)
+		}
+
+		deployment, err := store.FindDeployment("https://platform.tld", "client-1", "new")
+		if (err == nil) != test.stored {
+			t.Errorf("policy %q: got stored deployment %v, wanted %v", test.provisioning, err == nil, test.stored)
+		}
+		if test.stored && !deployment.FirstSeen.Equal(now) {
+			t.Errorf("policy %q: got first-seen time %v, wanted %v", test.provisioning, deployment.FirstSeen, now)
+		}
+	}
+}
+
+// Test the validation of the expiration, not-before and issue times.
+func TestValidateTimes(t *testing.T) {
+	now := time.Now()
+	l := New(datastore.Config{}, nil)
+	l.SetMaxTokenAge(time.Hour)
+
+	tests := []struct {
+		expiration, notBefore, issuedAt time.Time
+		err                             error
+	}{
+		{now.Add(time.Minute), time.Time{}, now, nil},
+		{now.Add(-30 * time.Second), now.Add(30 * time.Second), now.Add(30 * time.Second), nil},
+		{time.Time{}, time.Time{}, now, ErrMissingExpiration},
+		{now.Add(-2 * time.Minute), time.Time{}, now, ErrTokenExpired},
+		{now.Add(time.Hour), now.Add(2 * time.Minute), now, ErrTokenNotYetValid},
+		{now.Add(time.Hour), time.Time{}, time.Time{}, ErrMissingIssuedAt},
+		{now.Add(time.Hour), time.Time{}, now.Add(2 * time.Minute), ErrTokenIssuedInFuture},
+		{now.Add(time.Hour), time.Time{}, now.Add(-2 * time.Hour), ErrTokenTooOld},
+	}
+
+	for i, test := range tests {
+		token := jwt.New()
+		if !test.expiration.IsZero() {
+			token.Set(jwt.ExpirationKey, test.expiration)
+		}
+		if !test.notBefore.IsZero() {
+			token.Set(jwt.NotBeforeKey, test.notBefore)
+		}
+		if !test.issuedAt.IsZero() {
+			token.Set(jwt.IssuedAtKey, test.issuedAt)
+		}
+
+		statusCode, err := validateTimes(token, l, now)
+		if err != test.err {
+			t.Errorf("test %d: got %d %v, wanted %v", i, statusCode, err, test.err)
+		}
+	}
+}
+
+// Test that the client ID of tokens with several audiences is their authorized party.
+func TestAuthorizedClientID(t *testing.T) {
+	tests := []struct {
+		audience        []string
+		authorizedParty string
+		clientID        string
+		err             error
+	}{
+		{[]string{"client-1"}, "", "client-1", nil},
+		{[]string{"client-1"}, "client-1", "client-1", nil},
+		{[]string{"client-1"}, "client-2", "", ErrAuthorizedPartyMismatch},
+		{[]string{"client-1", "client-2"}, "client-2", "client-2", nil},
+		{[]string{"client-1", "client-2"}, "", "", ErrMissingAuthorizedParty},
+		{[]string{"client-1", "client-2"}, "client-3", "", ErrAuthorizedPartyMismatch},
+		{nil, "", "", ErrMissingAudience},
+	}
+
+	for _, test := range tests {
+		token := jwt.New()
+		if test.audience != nil {
+			token.Set(jwt.AudienceKey, test.audience)
+		}
+		if test.authorizedParty != "" {
+			token.Set("azp", test.authorizedParty)
+		}
+
+		clientID, err := AuthorizedClientID(token)
+		if clientID != test.clientID || err != test.err {
+			t.Errorf("aud %v, azp %q: got %q %v, wanted %q %v", test.audience, test.authorizedParty, clientID, err,
+				test.clientID, test.err)
+		}
+	}
+
+	// A registered client that is not the authorized party cannot launch.
+	token := jwt.New()
+	token.Set(jwt.AudienceKey, []string{"client-1", "client-2"})
+	token.Set("azp", "client-2")
+	registration := datastore.Registration{ClientID: "client-1"}
+	if _, err := validateClientID(token, registration); err != ErrAuthorizedPartyMismatch {
+		t.Fatalf("got %v, wanted ErrAuthorizedPartyMismatch", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LTI message types.
+const (
+	MessageTypeResourceLink     = "LtiResourceLinkRequest"
+	MessageTypeDeepLinking      = "LtiDeepLinkingRequest"
+	MessageTypeSubmissionReview = "LtiSubmissionReviewRequest"
+)
+
+// LTI context roles, i.e. the roles of the user in the context (course) of a launch.
+// Source: http://www.imsglobal.org/spec/lti/v1p3/#lis-vocabulary-for-context-roles
+const (
+	RoleAdministrator    = "http://purl.imsglobal.org/vocab/lis/v2/membership#Administrator"
+	RoleContentDeveloper = "http://purl.imsglobal.org/vocab/lis/v2/membership#ContentDeveloper"
+	RoleInstructor       = "http://purl.imsglobal.org/vocab/lis/v2/membership#Instructor"
+	RoleLearner          = "http://purl.imsglobal.org/vocab/lis/v2/membership#Learner"
+	RoleMentor           = "http://purl.imsglobal.org/vocab/lis/v2/membership#Mentor"
+)
+
+// An Audience holds the 'aud' claim of an id_token. The claim may be either a single string or an array of strings,
+// so it is always decoded into a slice.
+type Audience []string
+
+// UnmarshalJSON decodes an 'aud' claim in either its string or array form.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("audience must be a string or an array of strings: %w", err)
+	}
+	*a = Audience(multiple)
+
+	return nil
+}
+
+// A ContextClaim describes the context (typically a course) from which the launch was made.
+type ContextClaim struct {
+	ID    string   `json:"id"`
+	Label string   `json:"label,omitempty"`
+	Title string   `json:"title,omitempty"`
+	Type  []string `json:"type,omitempty"`
+}
+
+// A ResourceLinkClaim describes the resource link (placement) that was launched.
+type ResourceLinkClaim struct {
+	ID          string `json:"id"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// A CustomClaim holds the custom parameters of a launch. The values should be strings, but platforms also send numbers
+// and booleans, so any other value is kept as its JSON text, e.g. "3" for 3. A null value becomes the empty string.
+type CustomClaim map[string]string
+
+// UnmarshalJSON decodes a custom claim, converting values that are not strings to their JSON text.
+func (c *CustomClaim) UnmarshalJSON(data []byte) error {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("custom claim must be an object: %w", err)
+	}
+
+	custom := make(CustomClaim, len(values))
+	for name, value := range values {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			s = string(value)
+		}
+		if string(value) == "null" {
+			s = ""
+		}
+		custom[name] = s
+	}
+	*c = custom
+
+	return nil
+}
+
+// A LaunchPresentationClaim describes how the platform expects the tool to be presented. The height and width are in
+// pixels; fractional or quoted values sent by some platforms are truncated to whole pixels, and other values are
+// ignored.
+type LaunchPresentationClaim struct {
+	DocumentTarget string `json:"document_target,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	ReturnURL      string `json:"return_url,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+}
+
+// UnmarshalJSON decodes a launch presentation claim, leniently decoding its height and width.
+func (p *LaunchPresentationClaim) UnmarshalJSON(data []byte) error {
+	// The alias has the fields of a LaunchPresentationClaim without its UnmarshalJSON method.
+	type launchPresentationClaim LaunchPresentationClaim
+	var claim struct {
+		launchPresentationClaim
+		Height interface{} `json:"height,omitempty"`
+		Width  interface{} `json:"width,omitempty"`
+	}
+	if err := json.Unmarshal(data, &claim); err != nil {
+		return err
+	}
+
+	*p = LaunchPresentationClaim(claim.launchPresentationClaim)
+	p.Height = pixels(claim.Height)
+	p.Width = pixels(claim.Width)
+
+	return nil
+}
+
+// pixels converts a decoded JSON number or numeric string to whole pixels. Any other value is zero.
+func pixels(value interface{}) int {
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil {
+			return int(f)
+		}
+	}
+
+	return 0
+}
+
+// A LISClaim holds the Learning Information Services identifiers of the launching user and context.
+type LISClaim struct {
+	PersonSourcedID         string `json:"person_sourcedid,omitempty"`
+	CourseOfferingSourcedID string `json:"course_offering_sourcedid,omitempty"`
+	CourseSectionSourcedID  string `json:"course_section_sourcedid,omitempty"`
+}
+
+// A ToolPlatformClaim describes the platform instance that sent the launch.
+type ToolPlatformClaim struct {
+	GUID              string `json:"guid"`
+	ContactEmail      string `json:"contact_email,omitempty"`
+	Description       string `json:"description,omitempty"`
+	Name              string `json:"name,omitempty"`
+	URL               string `json:"url,omitempty"`
+	ProductFamilyCode string `json:"product_family_code,omitempty"`
+	Version           string `json:"version,omitempty"`
+}
+
+// An AGSEndpointClaim holds the Assignment & Grades Services endpoints and scopes available to the tool.
+type AGSEndpointClaim struct {
+	Scope     []string `json:"scope"`
+	LineItems string   `json:"lineitems,omitempty"`
+	LineItem  string   `json:"lineitem,omitempty"`
+}
+
+// An NRPSClaim holds the Names & Roles Provisioning Services endpoint available to the tool.
+type NRPSClaim struct {
+	ContextMembershipsURL string   `json:"context_memberships_url"`
+	ServiceVersions       []string `json:"service_versions"`
+}
+
+// A DeepLinkingSettingsClaim holds the settings of a deep linking request.
+type DeepLinkingSettingsClaim struct {
+	DeepLinkReturnURL                 string   `json:"deep_link_return_url"`
+	AcceptTypes                       []string `json:"accept_types"`
+	AcceptPresentationDocumentTargets []string `json:"accept_presentation_document_targets"`
+	AcceptMediaTypes                  string   `json:"accept_media_types,omitempty"`
+	AcceptMultiple                    bool     `json:"accept_multiple,omitempty"`
+	AcceptLineItem                    bool     `json:"accept_lineitem,omitempty"`
+	AutoCreate                        bool     `json:"auto_create,omitempty"`
+	Title                             string   `json:"title,omitempty"`
+	Text                              string   `json:"text,omitempty"`
+	Data                              string   `json:"data,omitempty"`
+}
+
+// A LaunchMessage is the typed form of a verified id_token. Optional service claims (AGS, NRPS and deep linking) are
+// nil when the platform did not send them. The message is decoded on a best-effort basis: an optional claim that does
+// not have the expected form is left at its zero value rather than failing the launch, since the claims of the
+// id_token remain available as they were sent.
+type LaunchMessage struct {
+	// User identity.
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        Audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	Nonce           string   `json:"nonce"`
+	Name            string   `json:"name,omitempty"`
+	GivenName       string   `json:"given_name,omitempty"`
+	FamilyName      string   `json:"family_name,omitempty"`
+	MiddleName      string   `json:"middle_name,omitempty"`
+	Picture         string   `json:"picture,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	Locale          string   `json:"locale,omitempty"`
+
+	// Core LTI claims.
+	MessageType        string                  `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Version            string                  `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
+	DeploymentID       string                  `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
+	TargetLinkURI      string                  `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri"`
+	Context            ContextClaim            `json:"https://purl.imsglobal.org/spec/lti/claim/context"`
+	ResourceLink       ResourceLinkClaim       `json:"https://purl.imsglobal.org/spec/lti/claim/resource_link"`
+	Roles              []string                `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
+	RoleScopeMentor    []string                `json:"https://purl.imsglobal.org/spec/lti/claim/role_scope_mentor,omitempty"`
+	Custom             CustomClaim             `json:"https://purl.imsglobal.org/spec/lti/claim/custom,omitempty"`
+	LaunchPresentation LaunchPresentationClaim `json:"https://purl.imsglobal.org/spec/lti/claim/launch_presentation"`
+	LIS                LISClaim                `json:"https://purl.imsglobal.org/spec/lti/claim/lis"`
+	ToolPlatform       ToolPlatformClaim       `json:"https://purl.imsglobal.org/spec/lti/claim/tool_platform"`
+
+	// LTI Advantage service claims.
+	AGS                 *AGSEndpointClaim         `json:"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint,omitempty"`
+	NRPS                *NRPSClaim                `json:"https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice,omitempty"`
+	DeepLinkingSettings *DeepLinkingSettingsClaim `json:"https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings,omitempty"`
+}
+
+// requiredClaims are the claims of a LaunchMessage that must decode for the message to be built. Every other claim is
+// optional.
+var requiredClaims = map[string]bool{
+	"iss":   true,
+	"sub":   true,
+	"aud":   true,
+	"nonce": true,
+	"https://purl.imsglobal.org/spec/lti/claim/message_type":  true,
+	"https://purl.imsglobal.org/spec/lti/claim/version":       true,
+	"https://purl.imsglobal.org/spec/lti/claim/deployment_id": true,
+	"https://purl.imsglobal.org/spec/lti/claim/roles":         true,
+}
+
+// UnmarshalJSON decodes a launch message, leaving out the optional claims that cannot be decoded.
+func (m *LaunchMessage) UnmarshalJSON(data []byte) error {
+	// The alias has the fields of a LaunchMessage without its UnmarshalJSON method.
+	type launchMessage LaunchMessage
+	var message launchMessage
+	err := json.Unmarshal(data, &message)
+	if err == nil {
+		*m = LaunchMessage(message)
+		return nil
+	}
+
+	// Find the optional claims that cannot be decoded on their own, and decode the message without them.
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	for name, value := range claims {
+		if requiredClaims[name] {
+			continue
+		}
+		claim, _ := json.Marshal(map[string]json.RawMessage{name: value})
+		if json.Unmarshal(claim, &launchMessage{}) != nil {
+			delete(claims, name)
+		}
+	}
+	data, err = json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	message = launchMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	*m = LaunchMessage(message)
+
+	return nil
+}
+
+// MessageFromLaunchData builds a LaunchMessage from launch data, i.e. the id_token payload stored under a launch ID.
+func MessageFromLaunchData(launchData json.RawMessage) (LaunchMessage, error) {
+	if len(launchData) == 0 {
+		return LaunchMessage{}, errors.New("received empty launch data")
+	}
+
+	var message LaunchMessage
+	err := json.Unmarshal(launchData, &message)
+	if err != nil {
+		return LaunchMessage{}, fmt.Errorf("could not decode launch message: %w", err)
+	}
+
+	return message, nil
+}
+
+// HasRole reports whether the launch's roles claim includes `role'. Context roles may also be sent in their deprecated
+// simple form, e.g. "Instructor" for RoleInstructor, which is matched as well.
+func (m LaunchMessage) HasRole(role string) bool {
+	simpleName := ""
+	if strings.HasPrefix(role, "http://purl.imsglobal.org/vocab/lis/v2/membership#") {
+		simpleName = role[strings.Index(role, "#")+1:]
+	}
+
+	for _, r := range m.Roles {
+		if r == role || (simpleName != "" && r == simpleName) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Set up test launch data, i.e. a verified id_token payload.
+func testLaunchData() json.RawMessage {
+	return json.RawMessage(`{
+  "iss": "https://platform.tld/instance",
+  "sub": "user-1",
+  "aud": "abcdef123456",
+  "nonce": "nonce-1",
+  "name": "Ada Lovelace",
+  "given_name": "Ada",
+  "family_name": "Lovelace",
+  "email": "ada@platform.tld",
+  "https://purl.imsglobal.org/spec/lti/claim/message_type": "LtiResourceLinkRequest",
+  "https://purl.imsglobal.org/spec/lti/claim/version": "1.3.0",
+  "https://purl.imsglobal.org/spec/lti/claim/deployment_id": "1",
+  "https://purl.imsglobal.org/spec/lti/claim/target_link_uri": "https://tool.tld/launcher",
+  "https://purl.imsglobal.org/spec/lti/claim/roles": [
+    "http://purl.imsglobal.org/vocab/lis/v2/membership#Learner"
+  ],
+  "https://purl.imsglobal.org/spec/lti/claim/context": {
+    "id": "course-1",
+    "label": "CS101",
+    "title": "Introduction to Computing",
+    "type": ["http://purl.imsglobal.org/vocab/lis/v2/course#CourseOffering"]
+  },
+  "https://purl.imsglobal.org/spec/lti/claim/resource_link": {"id": "link-1", "title": "Quiz 1"},
+  "https://purl.imsglobal.org/spec/lti/claim/custom": {"chapter": "3"},
+  "https://purl.imsglobal.org/spec/lti/claim/launch_presentation": {
+    "document_target": "iframe",
+    "return_url": "https://platform.tld/return"
+  },
+  "https://purl.imsglobal.org/spec/lti/claim/lis": {"person_sourcedid": "sis-1"},
+  "https://purl.imsglobal.org/spec/lti/claim/tool_platform": {"guid": "platform-guid", "name": "Platform"},
+  "https://purl.imsglobal.org/spec/lti-ags/claim/endpoint": {
+    "scope": ["https://purl.imsglobal.org/spec/lti-ags/scope/score"],
+    "lineitem": "https://platform.tld/lineitems/1"
+  }
+}`)
+}
+
+// Test building a typed launch message from launch data.
+func TestMessageFromLaunchData(t *testing.T) {
+	message, err := MessageFromLaunchData(testLaunchData())
+	if err != nil {
+		t.Fatalf("message from launch data error: %v", err)
+	}
+
+	if !reflect.DeepEqual(message.Audience, Audience{"abcdef123456"}) {
+		t.Errorf("got audience %#v, wanted single client ID", message.Audience)
+	}
+	if message.MessageType != MessageTypeResourceLink {
+		t.Errorf("got message type %q, wanted %q", message.MessageType, MessageTypeResourceLink)
+	}
+	if message.Context.Title != "Introduction to Computing" || message.ResourceLink.ID != "link-1" {
+		t.Errorf("context or resource link not decoded: %#v, %#v", message.Context, message.ResourceLink)
+	}
+	if message.Custom["chapter"] != "3" {
+		t.Errorf("custom claim not decoded: %#v", message.Custom)
+	}
+	if message.LaunchPresentation.ReturnURL != "https://platform.tld/return" {
+		t.Errorf("launch presentation not decoded: %#v", message.LaunchPresentation)
+	}
+	if message.AGS == nil || message.AGS.LineItem != "https://platform.tld/lineitems/1" {
+		t.Errorf("AGS endpoint not decoded: %#v", message.AGS)
+	}
+	if message.NRPS != nil || message.DeepLinkingSettings != nil {
+		t.Error("absent service claims should be nil")
+	}
+
+	_, err = MessageFromLaunchData(nil)
+	if err == nil {
+		t.Error("error not reported for empty launch data")
+	}
+
+	_, err = MessageFromLaunchData(json.RawMessage(`{"aud": 42}`))
+	if err == nil {
+		t.Error("error not reported for malformed audience")
+	}
+}
+
+// Test that optional claims of unexpected types are decoded leniently or left out, rather than failing the message.
+func TestMessageFromLooseLaunchData(t *testing.T) {
+	message, err := MessageFromLaunchData(json.RawMessage(`{
+  "iss": "https://platform.tld/instance",
+  "sub": "user-1",
+  "aud": ["abcdef123456"],
+  "nonce": "nonce-1",
+  "https://purl.imsglobal.org/spec/lti/claim/message_type": "LtiResourceLinkRequest",
+  "https://purl.imsglobal.org/spec/lti/claim/version": "1.3.0",
+  "https://purl.imsglobal.org/spec/lti/claim/deployment_id": "1",
+  "https://purl.imsglobal.org/spec/lti/claim/roles": [],
+  "https://purl.imsglobal.org/spec/lti/claim/custom": {"chapter": 3, "graded": true, "section": null, "name": "x"},
+  "https://purl.imsglobal.org/spec/lti/claim/launch_presentation": {
+    "height": 612.5,
+    "width": "800",
+    "return_url": "https://platform.tld/return"
+  },
+  "https://purl.imsglobal.org/spec/lti/claim/context": {"id": "course-1", "type": "CourseOffering"},
+  "https://purl.imsglobal.org/spec/lti-ags/claim/endpoint": "https://platform.tld/lineitems"
+}`))
+	if err != nil {
+		t.Fatalf("message from launch data error: %v", err)
+	}
+
+	wantCustom := CustomClaim{"chapter": "3", "graded": "true", "section": "", "name": "x"}
+	if !reflect.DeepEqual(message.Custom, wantCustom) {
+		t.Errorf("got custom claim %#v, wanted %#v", message.Custom, wantCustom)
+	}
+	wantPresentation := LaunchPresentationClaim{Height: 612, Width: 800, ReturnURL: "https://platform.tld/return"}
+	if message.LaunchPresentation != wantPresentation {
+		t.Errorf("got launch presentation %#v, wanted %#v", message.LaunchPresentation, wantPresentation)
+	}
+	if message.Context.ID != "" || message.AGS != nil {
+		t.Errorf("got malformed context %#v and AGS endpoint %#v, wanted them left out", message.Context, message.AGS)
+	}
+	if message.DeploymentID != "1" || message.Subject != "user-1" {
+		t.Errorf("required claims not decoded: %#v", message)
+	}
+
+	_, err = MessageFromLaunchData(json.RawMessage(`{"aud": "abcdef123456", ` +
+		`"https://purl.imsglobal.org/spec/lti/claim/roles": "Learner"}`))
+	if err == nil {
+		t.Error("error not reported for malformed roles")
+	}
+}
+
+// Test that a launch with loosely typed optional claims succeeds.
+func TestLaunchLooseClaims(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+
+	var message LaunchMessage
+	next := func(w http.ResponseWriter, r *http.Request) {
+		message = r.Context().Value(ContextKey).(LaunchContext).Message
+	}
+
+	w := httptest.NewRecorder()
+	tl.New(next).ServeHTTP(w, tl.Request(t, map[string]interface{}{
+		"https://purl.imsglobal.org/spec/lti/claim/custom":              map[string]interface{}{"chapter": 3},
+		"https://purl.imsglobal.org/spec/lti/claim/launch_presentation": map[string]interface{}{"height": 612.5},
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, wanted a successful launch", w.Code, w.Body)
+	}
+	if message.Custom["chapter"] != "3" || message.LaunchPresentation.Height != 612 {
+		t.Fatalf("got custom claim %v and launch presentation %+v, wanted them decoded", message.Custom,
+			message.LaunchPresentation)
+	}
+}
+
+// Test that the audience decodes from both its string and array forms.
+func TestAudienceUnmarshalJSON(t *testing.T) {
+	var audience Audience
+	err := json.Unmarshal([]byte(`["a", "b"]`), &audience)
+	if err != nil {
+		t.Fatalf("unmarshal audience error: %v", err)
+	}
+	if !reflect.DeepEqual(audience, Audience{"a", "b"}) {
+		t.Fatalf("got %#v, wanted %#v", audience, Audience{"a", "b"})
+	}
+}
+
+// Test matching roles in their full and simple forms.
+func TestHasRole(t *testing.T) {
+	message := LaunchMessage{
+		Roles: []string{"Learner", "http://purl.imsglobal.org/vocab/lis/v2/institution/person#Instructor"},
+	}
+	if !message.HasRole(RoleLearner) {
+		t.Errorf("simple role name not matched")
+	}
+	if message.HasRole(RoleInstructor) {
+		t.Errorf("institution role matched as a context role")
+	}
+}
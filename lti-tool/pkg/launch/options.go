@@ -0,0 +1,125 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
+)
+
+// A Validator checks a launch in addition to the built-in validations of a Launch. It receives the launch request, the
+// id_token whose signature has been verified, and the registration of its issuer and client. To reject the launch, it
+// returns an error and the HTTP status code of the response; a zero status code means http.StatusBadRequest. The error
+// is reported as ltierror.ErrRejected unless it is an *ltierror.Error, whose code and description are then shown.
+type Validator interface {
+	Validate(r *http.Request, verifiedToken jwt.Token, registration datastore.Registration) (int, error)
+}
+
+// ValidatorFunc is an adapter to allow the use of ordinary functions as Validators.
+type ValidatorFunc func(r *http.Request, verifiedToken jwt.Token, registration datastore.Registration) (int, error)
+
+// Validate calls f(r, verifiedToken, registration).
+func (f ValidatorFunc) Validate(r *http.Request, verifiedToken jwt.Token,
+	registration datastore.Registration) (int, error) {
+	return f(r, verifiedToken, registration)
+}
+
+// An Option configures a Launch. Options are passed to New.
+type Option func(*Launch)
+
+// WithMessageTypes sets the message types that the Launch accepts, e.g. MessageTypeResourceLink and
+// MessageTypeDeepLinking. By default, only resource link launch requests are accepted.
+func WithMessageTypes(messageTypes ...string) Option {
+	return func(l *Launch) {
+		l.messageTypes = messageTypes
+	}
+}
+
+// WithLTIVersions sets the LTI versions that the Launch accepts. By default, only LTI 1.3.0 is accepted.
+func WithLTIVersions(versions ...string) Option {
+	return func(l *Launch) {
+		l.versions = versions
+	}
+}
+
+// WithLeeway sets the clock skew allowed when validating the time claims of id_tokens; see Launch.SetLeeway.
+func WithLeeway(leeway time.Duration) Option {
+	return func(l *Launch) {
+		l.SetLeeway(leeway)
+	}
+}
+
+// WithMaxTokenAge limits how long after their issue time id_tokens are accepted; see Launch.SetMaxTokenAge.
+func WithMaxTokenAge(maxAge time.Duration) Option {
+	return func(l *Launch) {
+		l.SetMaxTokenAge(maxAge)
+	}
+}
+
+// WithClock sets the function that returns the current time for validating the time claims of id_tokens, e.g. to use
+// a clock synchronized with the platform, and for recording when provisioned deployments are first seen. By default, a
+// Launch uses time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(l *Launch) {
+		l.now = now
+	}
+}
+
+// WithClaimRegistry sets the registry used to decode extension claims; see Launch.SetClaimRegistry.
+func WithClaimRegistry(claims *ClaimRegistry) Option {
+	return func(l *Launch) {
+		l.SetClaimRegistry(claims)
+	}
+}
+
+// WithKeySetCache sets the cache of the platform keysets used to verify id_tokens; see Launch.SetKeySetCache.
+func WithKeySetCache(keys *KeySetCache) Option {
+	return func(l *Launch) {
+		l.SetKeySetCache(keys)
+	}
+}
+
+// WithErrorHandler sets the handler that responds to failed launches; see Launch.SetErrorHandler.
+func WithErrorHandler(handler ltierror.ErrorHandler) Option {
+	return func(l *Launch) {
+		l.SetErrorHandler(handler)
+	}
+}
+
+// WithValidatorsBefore adds validators that run, in order, as soon as the signature of the id_token has been verified
+// and before the built-in validations of its claims, the state and the nonce.
+func WithValidatorsBefore(validators ...Validator) Option {
+	return func(l *Launch) {
+		l.before = append(l.before, validators...)
+	}
+}
+
+// WithValidatorsAfter adds validators that run, in order, after all the built-in validations have passed.
+func WithValidatorsAfter(validators ...Validator) Option {
+	return func(l *Launch) {
+		l.after = append(l.after, validators...)
+	}
+}
+
+// runValidators runs the validators in order and stops at the first that rejects the launch.
+func runValidators(validators []Validator, r *http.Request, verifiedToken jwt.Token,
+	registration datastore.Registration) (int, error) {
+	for _, validator := range validators {
+		statusCode, err := validator.Validate(r, verifiedToken, registration)
+		if err != nil {
+			if statusCode == 0 {
+				statusCode = http.StatusBadRequest
+			}
+			return statusCode, err
+		}
+	}
+
+	return http.StatusOK, nil
+}
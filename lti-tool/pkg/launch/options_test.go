@@ -0,0 +1,112 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+)
+
+// Test that custom validators run before and after the built-in validations, and can reject a launch.
+func TestValidators(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+
+	var calls []string
+	record := func(name string) Validator {
+		return ValidatorFunc(func(r *http.Request, verifiedToken jwt.Token, registration datastore.Registration) (int,
+			error) {
+			if registration.ClientID != "client-1" || verifiedToken.Issuer() != "https://platform.tld" {
+				t.Errorf("validator %s got registration %#v and token of %s", name, registration, verifiedToken.Issuer())
+			}
+			calls = append(calls, name)
+			return http.StatusOK, nil
+		})
+	}
+	launched := false
+	next := func(w http.ResponseWriter, r *http.Request) {
+		launched = true
+	}
+
+	l := tl.New(next, WithValidatorsBefore(record("before")), WithValidatorsAfter(record("after-1"), record("after-2")))
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, tl.Request(t, nil))
+	if w.Code != http.StatusOK || !launched {
+		t.Fatalf("got %d %s, wanted a successful launch", w.Code, w.Body)
+	}
+	if len(calls) != 3 || calls[0] != "before" || calls[1] != "after-1" || calls[2] != "after-2" {
+		t.Fatalf("got validator calls %v, wanted before, after-1 and after-2", calls)
+	}
+
+	// A validator that rejects the launch stops it; a zero status code is a bad request.
+	rejectIssuer := ValidatorFunc(func(r *http.Request, verifiedToken jwt.Token,
+		registration datastore.Registration) (int, error) {
+		return http.StatusForbidden, errors.New("issuer not allowed")
+	})
+	rejectContext := ValidatorFunc(func(r *http.Request, verifiedToken jwt.Token,
+		registration datastore.Registration) (int, error) {
+		return 0, errors.New("context must be a course offering")
+	})
+	tests := []struct {
+		option     Option
+		statusCode int
+	}{
+		{WithValidatorsBefore(rejectIssuer), http.StatusForbidden},
+		{WithValidatorsAfter(rejectContext), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		launched = false
+		w = httptest.NewRecorder()
+		tl.New(next, test.option).ServeHTTP(w, tl.Request(t, nil))
+		if w.Code != test.statusCode || launched {
+			t.Errorf("got %d %s, wanted %d", w.Code, w.Body, test.statusCode)
+		}
+	}
+}
+
+// Test the options for the accepted message types, LTI versions and clock.
+func TestOptions(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+	next := func(w http.ResponseWriter, r *http.Request) {}
+
+	deepLinking := map[string]interface{}{
+		"https://purl.imsglobal.org/spec/lti/claim/message_type":  MessageTypeDeepLinking,
+		"https://purl.imsglobal.org/spec/lti/claim/resource_link": nil,
+	}
+	tests := []struct {
+		name       string
+		options    []Option
+		claims     map[string]interface{}
+		statusCode int
+	}{
+		{"default", nil, nil, http.StatusOK},
+		{"deep linking rejected by default", nil, deepLinking, http.StatusBadRequest},
+		{"deep linking", []Option{WithMessageTypes(MessageTypeResourceLink, MessageTypeDeepLinking)}, deepLinking,
+			http.StatusOK},
+		{"unsupported version", []Option{WithLTIVersions("1.3.1")}, nil, http.StatusBadRequest},
+		{"slow clock", []Option{WithClock(func() time.Time { return time.Now().Add(-time.Hour) })}, nil,
+			http.StatusBadRequest},
+		{"slow clock with leeway", []Option{WithClock(func() time.Time { return time.Now().Add(-time.Hour) }),
+			WithLeeway(2 * time.Hour)}, nil, http.StatusOK},
+		{"maximum token age", []Option{WithClock(func() time.Time { return time.Now().Add(time.Minute) }),
+			WithLeeway(0), WithMaxTokenAge(time.Second)}, nil, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		tl.New(next, test.options...).ServeHTTP(w, tl.Request(t, test.claims))
+		if w.Code != test.statusCode {
+			t.Errorf("%s: got %d %s, wanted %d", test.name, w.Code, w.Body, test.statusCode)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrReturnURLNotFound is the error returned when the launch did not include a launch_presentation return_url.
+var ErrReturnURLNotFound = errors.New("return URL not found in launch")
+
+// A ReturnMessage holds the messages a tool sends back to the platform when returning the user to it. Msg and ErrorMsg
+// are shown to the user; Log and ErrorLog are meant for the platform's logs. DeepLinkReturn is passed as
+// lti_deep_link_return when returning from a deep linking flow.
+//
+// Source: http://www.imsglobal.org/spec/lti/v1p3/#launch-presentation-claim
+type ReturnMessage struct {
+	Msg            string
+	Log            string
+	ErrorMsg       string
+	ErrorLog       string
+	DeepLinkReturn string
+}
+
+// ReturnURL builds the URL that returns the user to the platform, adding the non-empty messages as query parameters to
+// the launch_presentation return_url. Any query parameters already in the return_url are kept.
+func ReturnURL(message LaunchMessage, rm ReturnMessage) (string, error) {
+	if message.LaunchPresentation.ReturnURL == "" {
+		return "", ErrReturnURLNotFound
+	}
+
+	returnURL, err := url.Parse(message.LaunchPresentation.ReturnURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse return URL: %w", err)
+	}
+
+	query := returnURL.Query()
+	params := []struct {
+		name  string
+		value string
+	}{
+		{"lti_msg", rm.Msg},
+		{"lti_log", rm.Log},
+		{"lti_errormsg", rm.ErrorMsg},
+		{"lti_errorlog", rm.ErrorLog},
+		{"lti_deep_link_return", rm.DeepLinkReturn},
+	}
+	for _, param := range params {
+		if param.value != "" {
+			query.Set(param.name, param.value)
+		}
+	}
+	returnURL.RawQuery = query.Encode()
+
+	return returnURL.String(), nil
+}
+
+// RedirectToReturnURL redirects the user back to the platform using the launch_presentation return_url of the launch
+// message. It returns ErrReturnURLNotFound, without writing a response, when the launch did not include a return_url.
+func RedirectToReturnURL(w http.ResponseWriter, r *http.Request, message LaunchMessage, rm ReturnMessage) error {
+	returnURL, err := ReturnURL(message, rm)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, returnURL, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Test building the return URL from the launch presentation claim.
+func TestReturnURL(t *testing.T) {
+	message := LaunchMessage{
+		LaunchPresentation: LaunchPresentationClaim{ReturnURL: "https://platform.tld/return?course=1"},
+	}
+
+	returnURL, err := ReturnURL(message, ReturnMessage{Msg: "Saved!", ErrorLog: "minor issue"})
+	if err != nil {
+		t.Fatalf("return url error: %v", err)
+	}
+	parsed, err := url.Parse(returnURL)
+	if err != nil {
+		t.Fatalf("return url parse error: %v", err)
+	}
+
+	query := parsed.Query()
+	if query.Get("course") != "1" {
+		t.Errorf("existing query parameter not kept: %s", returnURL)
+	}
+	if query.Get("lti_msg") != "Saved!" || query.Get("lti_errorlog") != "minor issue" {
+		t.Errorf("messages not added to return url: %s", returnURL)
+	}
+	if _, ok := query["lti_errormsg"]; ok {
+		t.Errorf("empty message added to return url: %s", returnURL)
+	}
+
+	_, err = ReturnURL(LaunchMessage{}, ReturnMessage{Msg: "Saved!"})
+	if err != ErrReturnURLNotFound {
+		t.Errorf("got %v, wanted ErrReturnURLNotFound", err)
+	}
+}
+
+// Test the redirect to the platform.
+func TestRedirectToReturnURL(t *testing.T) {
+	message := LaunchMessage{
+		LaunchPresentation: LaunchPresentationClaim{ReturnURL: "https://platform.tld/return"},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "https://tool.tld/done", nil)
+	err := RedirectToReturnURL(w, r, message, ReturnMessage{DeepLinkReturn: "cancelled"})
+	if err != nil {
+		t.Fatalf("redirect error: %v", err)
+	}
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d, wanted %d", w.Code, http.StatusFound)
+	}
+	if location := w.Header().Get("Location"); location != "https://platform.tld/return?lti_deep_link_return=cancelled" {
+		t.Fatalf("unexpected redirect location %s", location)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A Route sends the launches that meet all of its non-empty conditions to its Handler. MessageType is an LTI message
+// type, e.g. MessageTypeDeepLinking. Path is matched against the path of the launch's target_link_uri like the
+// patterns of an http.ServeMux: a path ending in a slash matches its whole subtree. The login accepts any target link
+// URI on the origin of the registration's, and the launch checks that the id_token repeats it. Roles matches the
+// launches of users with any of the roles; see LaunchMessage.HasRole.
+type Route struct {
+	MessageType string
+	Path        string
+	Roles       []string
+	Handler     http.Handler
+}
+
+// A Router dispatches validated launches to the handler of the first matching route, in the order the routes were
+// given, and the other launches to its fallback handler. It is used as the `next' handler of a Launch, e.g.
+//
+//	router := launch.NewRouter(http.HandlerFunc(home),
+//		launch.Route{MessageType: launch.MessageTypeDeepLinking, Handler: picker},
+//		launch.Route{Path: "/quiz/", Roles: []string{launch.RoleInstructor}, Handler: quizEditor},
+//		launch.Route{Path: "/quiz/", Handler: quiz},
+//	)
+//	http.Handle("/launch", launch.New(cfg, router.ServeHTTP))
+type Router struct {
+	routes   []Route
+	fallback http.Handler
+}
+
+// NewRouter creates a *Router with the `routes' and the `fallback' handler. A nil fallback responds to unmatched
+// launches with 404 Not Found.
+func NewRouter(fallback http.Handler, routes ...Route) *Router {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+
+	return &Router{
+		routes:   routes,
+		fallback: fallback,
+	}
+}
+
+// ServeHTTP dispatches the launch in the request context to the handler of its route. A request without a launch
+// context, i.e. one that did not pass through a Launch, is an internal server error.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lc, ok := r.Context().Value(ContextKey).(LaunchContext)
+	if !ok {
+		http.Error(w, "launch context not found in request", http.StatusInternalServerError)
+		return
+	}
+
+	for _, route := range rt.routes {
+		if route.matches(lc.Message) {
+			route.Handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	rt.fallback.ServeHTTP(w, r)
+}
+
+// matches reports whether the launch `message' meets the conditions of the route.
+func (route Route) matches(message LaunchMessage) bool {
+	if route.MessageType != "" && message.MessageType != route.MessageType {
+		return false
+	}
+
+	if route.Path != "" {
+		targetLinkURI, err := url.Parse(message.TargetLinkURI)
+		if err != nil {
+			return false
+		}
+		path := targetLinkURI.Path
+		if path == "" {
+			path = "/"
+		}
+		if strings.HasSuffix(route.Path, "/") {
+			if !strings.HasPrefix(path, route.Path) {
+				return false
+			}
+		} else if path != route.Path {
+			return false
+		}
+	}
+
+	if len(route.Roles) > 0 {
+		for _, role := range route.Roles {
+			if message.HasRole(role) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
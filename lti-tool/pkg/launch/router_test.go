@@ -0,0 +1,142 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package launch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/login"
+)
+
+// Test dispatching launches by message type, target link URI path and role.
+func TestRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	router := NewRouter(handler("home"),
+		Route{MessageType: MessageTypeDeepLinking, Handler: handler("picker")},
+		Route{MessageType: MessageTypeSubmissionReview, Path: "/quiz/", Handler: handler("review")},
+		Route{Path: "/quiz/", Roles: []string{RoleInstructor, RoleContentDeveloper}, Handler: handler("editor")},
+		Route{Path: "/quiz/", Handler: handler("quiz")},
+		Route{Path: "/grades", Handler: handler("grades")},
+	)
+
+	tests := []struct {
+		message LaunchMessage
+		handler string
+	}{
+		{LaunchMessage{MessageType: MessageTypeDeepLinking, TargetLinkURI: "https://tool.tld/quiz/1"}, "picker"},
+		{LaunchMessage{MessageType: MessageTypeSubmissionReview, TargetLinkURI: "https://tool.tld/quiz/1"}, "review"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld/quiz/1",
+			Roles: []string{RoleInstructor}}, "editor"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld/quiz/1",
+			Roles: []string{"Instructor"}}, "editor"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld/quiz/1",
+			Roles: []string{RoleLearner}}, "quiz"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld/grades"}, "grades"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld/grades/1"}, "home"},
+		{LaunchMessage{MessageType: MessageTypeResourceLink, TargetLinkURI: "https://tool.tld"}, "home"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", nil)
+		r = r.WithContext(ContextWithLaunchContext(r.Context(), LaunchContext{Message: test.message}))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if got := w.Body.String(); got != test.handler {
+			t.Errorf("%s %s %v: got %s, wanted %s", test.message.MessageType, test.message.TargetLinkURI,
+				test.message.Roles, got, test.handler)
+		}
+	}
+
+	// Without a launch, there is nothing to route.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, wanted %d", w.Code, http.StatusInternalServerError)
+	}
+
+	// Unmatched launches are not found without a fallback handler.
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", nil)
+	r = r.WithContext(ContextWithLaunchContext(r.Context(), LaunchContext{}))
+	w = httptest.NewRecorder()
+	NewRouter(nil).ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, wanted %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// Test routing launches by path through a login and launch for target link URIs other than the registration's.
+func TestRouterLoginAndLaunch(t *testing.T) {
+	tl := newTestLaunch(t)
+	defer tl.Close()
+
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}
+	}
+	router := NewRouter(handler("home"),
+		Route{Path: "/quiz/", Handler: handler("quiz")},
+		Route{Path: "/grades", Handler: handler("grades")},
+	)
+	launch := tl.New(router.ServeHTTP)
+	logins := login.New(datastore.Config{Registrations: tl.store, Nonces: tl.store})
+
+	tests := []struct {
+		loginTarget  string
+		launchTarget string
+		status       int
+		handler      string
+	}{
+		{"https://tool.tld/quiz/1", "https://tool.tld/quiz/1", http.StatusOK, "quiz"},
+		{"https://tool.tld/grades", "https://tool.tld/grades", http.StatusOK, "grades"},
+		{"https://tool.tld/launch", "https://tool.tld/launch", http.StatusOK, "home"},
+		// The id_token must target the URI of the login.
+		{"https://tool.tld/quiz/1", "https://tool.tld/grades", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		form := url.Values{
+			"iss":             {"https://platform.tld"},
+			"client_id":       {"client-1"},
+			"login_hint":      {"user-1"},
+			"target_link_uri": {test.loginTarget},
+		}
+		r := httptest.NewRequest(http.MethodPost, "https://tool.tld/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		logins.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("%s: got login status %d, wanted %d", test.loginTarget, w.Code, http.StatusFound)
+		}
+		redirect, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("%s: cannot parse login redirect: %v", test.loginTarget, err)
+		}
+
+		nonce := redirect.Query().Get("nonce")
+		idToken := tl.Sign(t, map[string]interface{}{
+			jwt.JwtIDKey: nonce,
+			"nonce":      nonce,
+			"https://purl.imsglobal.org/spec/lti/claim/target_link_uri": test.launchTarget,
+		})
+		w = httptest.NewRecorder()
+		launch.ServeHTTP(w, tl.Post(t, idToken, redirect.Query().Get("state")))
+		if w.Code != test.status || (test.handler != "" && w.Body.String() != test.handler) {
+			t.Errorf("%s launched for %s: got %d %q, wanted %d %q", test.launchTarget, test.loginTarget, w.Code,
+				w.Body.String(), test.status, test.handler)
+		}
+	}
+}
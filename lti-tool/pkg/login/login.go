@@ -10,10 +10,13 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/macewan-cs/lti-example/pkg/datastore"
 	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
 )
 
 const (
@@ -21,11 +24,17 @@ const (
 	LegacyStateCookieName = StateCookieName + "-legacy"
 )
 
+// ErrTargetLinkURINotAllowed is the error returned when the target_link_uri of a login request is not on the tool's
+// origin, i.e. does not have the scheme and host of the registration's target link URI.
+var ErrTargetLinkURINotAllowed = errors.New("target link uri not allowed for registration")
+
 // New creates a new login object. If the passed Config has zero-value store interfaces, fall back on the in-memory
 // nonpersistent.DefaultStore.
 func New(cfg datastore.Config) *Login {
 	login := Login{
-		cfg: cfg,
+		cfg:          cfg,
+		nonceMaxAge:  datastore.DefaultNonceMaxAge,
+		errorHandler: ltierror.DefaultErrorHandler,
 	}
 
 	if login.cfg.Registrations == nil {
@@ -40,7 +49,21 @@ func New(cfg datastore.Config) *Login {
 
 // A Login implements an http.Handler that can be easily associated with a tool URI such as /services/lti/login/.
 type Login struct {
-	cfg datastore.Config
+	cfg          datastore.Config
+	nonceMaxAge  time.Duration
+	errorHandler ltierror.ErrorHandler
+}
+
+// SetNonceMaxAge sets how long the nonce of a login stays valid, i.e. the time the platform has to complete the launch.
+// By default, a Login uses datastore.DefaultNonceMaxAge.
+func (l *Login) SetNonceMaxAge(maxAge time.Duration) {
+	l.nonceMaxAge = maxAge
+}
+
+// SetErrorHandler sets the handler that responds to failed logins. By default, a Login uses
+// ltierror.DefaultErrorHandler.
+func (l *Login) SetErrorHandler(handler ltierror.ErrorHandler) {
+	l.errorHandler = handler
 }
 
 // RedirectURI extracts the form data from the initial login request and returns a auth redirect URI and state cookie.
@@ -65,11 +88,17 @@ func (l *Login) RedirectURI(r *http.Request) (string, http.Cookie, error) {
 		Secure:   true,
 	}
 
-	// Generate and store nonce.
+	// Generate and store nonce. The nonce is bound to the requested target_link_uri, which the id_token must repeat, so
+	// that launches can be routed by it.
 	nonce := uuid.New().String()
-	err = l.cfg.Nonces.StoreNonce(nonce, registration.TargetLinkURI.String())
+	err = l.cfg.Nonces.StoreNonce(datastore.Nonce{
+		Value:         nonce,
+		TargetLinkURI: r.FormValue("target_link_uri"),
+		IssuedAt:      time.Now(),
+		MaxAge:        l.nonceMaxAge,
+	})
 	if err != nil {
-		return "", http.Cookie{}, err
+		return "", http.Cookie{}, ltierror.ErrInternal.Wrap(err)
 	}
 
 	// Build auth response to initial login request.
@@ -110,7 +139,7 @@ func (l *Login) JSRedirect(w http.ResponseWriter, r *http.Request) (string, erro
 func (l *Login) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	redirectURI, stateCookie, err := l.RedirectURI(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		l.errorHandler(w, r, loginError(err))
 		return
 	}
 
@@ -131,7 +160,8 @@ func (l *Login) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectURI, http.StatusFound)
 }
 
-// validate checks for the presence of the issuer and login_hint, and existence of a registration for that issuer.
+// validate checks for the presence of the issuer and login_hint, existence of a registration for that issuer, and that
+// the target_link_uri is on the origin of the registration's target link URI.
 func (l *Login) validate(r *http.Request) (datastore.Registration, error) {
 	// Validate issuer.
 	if r.FormValue("iss") == "" {
@@ -151,8 +181,32 @@ func (l *Login) validate(r *http.Request) (datastore.Registration, error) {
 	// Find Registration by issuer and/or client ID.
 	registration, err := l.cfg.Registrations.FindRegistrationByIssuerAndClientID(r.FormValue("iss"), r.FormValue("client_id"))
 	if err != nil {
-		return datastore.Registration{}, err
+		if err == datastore.ErrRegistrationNotFound || err == datastore.ErrAmbiguousRegistration {
+			return datastore.Registration{}, err
+		}
+
+		return datastore.Registration{}, ltierror.ErrInternal.Wrap(err)
+	}
+
+	targetLinkURI, err := url.Parse(r.FormValue("target_link_uri"))
+	if err != nil || targetLinkURI.Scheme != registration.TargetLinkURI.Scheme ||
+		!strings.EqualFold(targetLinkURI.Host, registration.TargetLinkURI.Host) {
+		return datastore.Registration{}, ErrTargetLinkURINotAllowed
 	}
 
 	return registration, nil
 }
+
+// loginError returns the *ltierror.Error reported for a failed login. Errors of the tool's side are already
+// *ltierror.Errors; the others are caused by the platform's request.
+func loginError(err error) *ltierror.Error {
+	var report *ltierror.Error
+	if errors.As(err, &report) {
+		return report
+	}
+
+	if errors.Is(err, datastore.ErrRegistrationNotFound) || errors.Is(err, datastore.ErrAmbiguousRegistration) {
+		return ltierror.ErrUnknownRegistration.Wrap(err)
+	}
+	return ltierror.ErrInvalidRequest.Wrap(err)
+}
@@ -7,12 +7,14 @@ package login
 
 import (
 	"bytes"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/ltierror"
 )
 
 // Set up a test Registration.
@@ -81,6 +83,17 @@ func TestValidate(t *testing.T) {
 		t.Fatalf("validate error: %v", actual)
 	}
 
+	for _, targetLinkURI := range []string{"http://tool.tld/launcher", "https://other.tld/launcher", "%"} {
+		r = httptest.NewRequest(http.MethodPost, "https://tool.tld/login", bytes.NewReader(
+			[]byte("iss=https://platform.tld/instance&login_hint=1&client_id=abcdef123456&target_link_uri="+
+				url.QueryEscape(targetLinkURI))))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, actual = login.validate(r)
+		if actual != ErrTargetLinkURINotAllowed {
+			t.Fatalf("got %v for target link uri %s, wanted ErrTargetLinkURINotAllowed", actual, targetLinkURI)
+		}
+	}
+
 	r = httptest.NewRequest(http.MethodPost, "https://tool.tld/login", bytes.NewReader(
 		[]byte("iss=https://platform.tld/instance&login_hint=1&client_id=abcdef123456&target_link_uri=https://tool.tld")))
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -110,3 +123,34 @@ func TestRedirectURI(t *testing.T) {
 		t.Fatalf("redirect uri cookie error")
 	}
 }
+
+// Test that failed logins are reported to the error handler with their codes.
+func TestServeHTTPErrors(t *testing.T) {
+	login := New(datastore.Config{})
+	login.cfg.Registrations.StoreRegistration(getRegistration())
+	var reported *ltierror.Error
+	login.SetErrorHandler(func(w http.ResponseWriter, r *http.Request, err *ltierror.Error) {
+		reported = err
+		w.WriteHeader(err.StatusCode)
+	})
+
+	tests := []struct {
+		body string
+		err  *ltierror.Error
+	}{
+		{"iss=https://platform.tld/instance&login_hint=1", ltierror.ErrInvalidRequest},
+		{"iss=https://platform.tld/other&login_hint=1&target_link_uri=https://tool.tld", ltierror.ErrUnknownRegistration},
+		{"iss=https://platform.tld/instance&login_hint=1&target_link_uri=https://attacker.tld/launcher",
+			ltierror.ErrInvalidRequest},
+	}
+	for _, test := range tests {
+		reported = nil
+		r := httptest.NewRequest(http.MethodPost, "https://tool.tld/login", bytes.NewReader([]byte(test.body)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login.ServeHTTP(w, r)
+		if reported == nil || !errors.Is(reported, test.err) || w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %v, wanted %s", test.body, w.Code, reported, test.err.Code)
+		}
+	}
+}
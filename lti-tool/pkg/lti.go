@@ -19,9 +19,12 @@ import (
 	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/macewan-cs/lti-example/pkg/connector"
 	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
 	dssql "github.com/macewan-cs/lti-example/pkg/datastore/sql"
+	"github.com/macewan-cs/lti-example/pkg/handoff"
 	"github.com/macewan-cs/lti-example/pkg/launch"
 	"github.com/macewan-cs/lti-example/pkg/login"
+	"github.com/macewan-cs/lti-example/pkg/session"
 )
 
 // JSONWebKeySet provides configuration for a keyset handler implemented on this type. The ServeHTTP method is
@@ -49,6 +52,26 @@ func NewSQLDatastore(db *sql.DB, config dssql.Config) *dssql.Store {
 	return dssql.New(db, config)
 }
 
+// NewSQLMigrator returns a migrator that creates and updates the tables of the SQL datastore, using the table and field
+// names in the provided configuration.
+func NewSQLMigrator(db *sql.DB, config dssql.Config) *dssql.Migrator {
+	return dssql.NewMigrator(db, config)
+}
+
+// NewSQLDatastoreConfigFromStore returns a datastore configuration that keeps registrations, nonces, launch data,
+// access tokens, used id_tokens and hand-offs in the SQL datastore, so that tools running as several replicas share
+// them. Sessions remain internal/nonpersistent.
+func NewSQLDatastoreConfigFromStore(store *dssql.Store) datastore.Config {
+	return datastore.Config{
+		Registrations: store,
+		Nonces:        store,
+		Replays:       store,
+		LaunchData:    store,
+		AccessTokens:  store,
+		Handoffs:      store,
+	}
+}
+
 // NewDatastoreConfig returns a new datastore configuration. Unless specified otherwise, all of the data stores will be
 // internal/nonpersistent.
 func NewDatastoreConfig() datastore.Config {
@@ -69,8 +92,27 @@ func NewLogin(cfg datastore.Config) *login.Login {
 // tool implementation, the launch ID is attached to the *http.Request context immediately prior to calling
 // `next'. Convenience functions, like `LaunchIDFromRequest' and `LaunchIDFromContext', also available in this package,
 // simplify the retrieval of this launch ID.
-func NewLaunch(cfg datastore.Config, next http.HandlerFunc) *launch.Launch {
-	return launch.New(cfg, next)
+//
+// The `options', such as launch.WithMessageTypes and launch.WithValidatorsAfter, adjust the launch's validations.
+func NewLaunch(cfg datastore.Config, next http.HandlerFunc, options ...launch.Option) *launch.Launch {
+	return launch.New(cfg, next, options...)
+}
+
+// NewSessionManager returns a *session.Manager that issues tool sessions after a successful launch and restores the
+// launch context for follow-up requests. Its `IssueAfterLaunch' method wraps the `next' handler given to NewLaunch,
+// and its `Middleware' method protects the tool's other pages. The key signs the session tokens and must be kept
+// secret.
+func NewSessionManager(cfg datastore.Config, key []byte) *session.Manager {
+	return session.New(cfg, session.NewConfig(key))
+}
+
+// NewHandoff returns a *handoff.Handoff that hands launches over to a frontend served from another origin. Its
+// `RedirectAfterLaunch' method is the `next' handler given to NewLaunch, its `Exchange' method is the JSON endpoint
+// that trades hand-off codes for access tokens, and its `Middleware' method protects the tool's API.
+func NewHandoff(cfg datastore.Config, frontendURL string, allowedOrigins ...string) *handoff.Handoff {
+	handoffCfg := handoff.NewConfig(frontendURL)
+	handoffCfg.AllowedOrigins = allowedOrigins
+	return handoff.New(cfg, handoffCfg)
 }
 
 // GetLaunchContextKey returns the context key used for attaching the launch ID to the request context.
@@ -89,11 +131,28 @@ func LaunchCtxFromContext(ctx context.Context) launch.LaunchContext {
 	return v.(launch.LaunchContext)
 }
 
+// LaunchMessageFromLaunchID rebuilds the typed launch message from the launch data stored under the launch ID. It is
+// useful in requests that follow the launch, where the launch context is no longer attached to the request.
+func LaunchMessageFromLaunchID(cfg datastore.Config, launchID string) (launch.LaunchMessage, error) {
+	if cfg.LaunchData == nil {
+		cfg.LaunchData = nonpersistent.DefaultStore
+	}
+
+	launchData, err := cfg.LaunchData.FindLaunchData(launchID)
+	if err != nil {
+		return launch.LaunchMessage{}, err
+	}
+
+	return launch.MessageFromLaunchData(launchData)
+}
+
 // NewConnector returns a *connector.Connector (on success) that can be used for accessing LTI services. These services
 // include Names and Role Provisioning Services (NRPS) and Assignment and Grade Services (AGS). The returned connector
-// needs to be successfully `upgraded' (which returns a new type) before it can be used for these services.
-func NewConnector(cfg datastore.Config, launchID, keyID string) (*connector.Connector, error) {
-	return connector.New(cfg, launchID, keyID)
+// needs to be successfully `upgraded' (which returns a new type) before it can be used for these services. The
+// `options', e.g. connector.WithHTTPClient, configure how the connector reaches the platform.
+func NewConnector(cfg datastore.Config, launchID, keyID string, options ...connector.Option) (*connector.Connector,
+	error) {
+	return connector.New(cfg, launchID, keyID, options...)
 }
 
 // NewKeySet returns a *JSONWebKeySet that provides the key used to verify the sender authenticity of JSON Web Tokens
@@ -0,0 +1,204 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+// Package ltierror provides the errors of LTI's login and launch flows, and the handler that reports them to the user.
+package ltierror
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// An Error is a failed login or launch. Code is a stable identifier of the cause, e.g. for monitoring, and Description
+// is a message that is safe to show to the user. StatusCode is the HTTP status of the response and Err, if any, is the
+// underlying error, which may include details that should only be logged.
+//
+// ReturnURL is the platform's launch_presentation return_url, with the description and code added as the lti_errormsg
+// and lti_errorlog parameters. It is only set once the signature of the id_token has been verified, so that a forged
+// token cannot send the user elsewhere.
+type Error struct {
+	Code        string
+	Description string
+	StatusCode  int
+	Err         error
+	ReturnURL   string
+}
+
+// Error returns the code and, if any, the underlying error.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Code
+	}
+	return e.Code + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether `target' is an *Error with the same code, so that errors.Is matches an Error against the
+// sentinels of this package.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of the error with `err' as the underlying error. It is used to derive errors from the sentinels
+// of this package.
+func (e *Error) Wrap(err error) *Error {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+var (
+	// ErrInvalidRequest is the error of a login or launch request that is missing parameters or is malformed.
+	ErrInvalidRequest = &Error{
+		Code:        "invalid_request",
+		Description: "The request from the learning platform is incomplete or malformed.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrUnknownRegistration is the error of a login or launch from an issuer and client ID that are not registered.
+	ErrUnknownRegistration = &Error{
+		Code:        "unknown_registration",
+		Description: "This learning platform is not registered with the tool.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrSignatureInvalid is the error of an id_token whose signature cannot be verified with the platform's keyset.
+	ErrSignatureInvalid = &Error{
+		Code:        "signature_invalid",
+		Description: "The launch could not be verified.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrKeySetUnavailable is the error of a launch when the platform's keyset cannot be fetched.
+	ErrKeySetUnavailable = &Error{
+		Code:        "keyset_unavailable",
+		Description: "The launch could not be verified because the learning platform is not responding.",
+		StatusCode:  http.StatusInternalServerError,
+	}
+
+	// ErrInvalidToken is the error of an id_token whose time, audience or authorized party claims are not valid.
+	ErrInvalidToken = &Error{
+		Code:        "invalid_token",
+		Description: "The launch has expired or is not meant for this tool.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrStateMismatch is the error of a launch whose state does not match the state cookie set at login, e.g.
+	// because the browser blocked the cookie.
+	ErrStateMismatch = &Error{
+		Code:        "state_mismatch",
+		Description: "The launch could not be matched to a login. Your browser may be blocking cookies.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrNonceInvalid is the error of a launch whose nonce was not issued at login, has expired, or was issued for
+	// another target link URI.
+	ErrNonceInvalid = &Error{
+		Code:        "nonce_invalid",
+		Description: "The launch could not be matched to a login. Please launch the tool again.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrNonceReplay is the error of a launch with an id_token that has already been used.
+	ErrNonceReplay = &Error{
+		Code:        "nonce_replay",
+		Description: "This launch has already been used. Please launch the tool again.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrUnknownDeployment is the error of a launch through a deployment that is not known for the registration.
+	ErrUnknownDeployment = &Error{
+		Code:        "unknown_deployment",
+		Description: "This deployment of the tool is not registered.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrDeploymentPending is the error of a launch through a deployment that awaits approval.
+	ErrDeploymentPending = &Error{
+		Code:        "deployment_pending",
+		Description: "This deployment of the tool is awaiting approval.",
+		StatusCode:  http.StatusForbidden,
+	}
+
+	// ErrDeploymentDisabled is the error of a launch through a disabled deployment.
+	ErrDeploymentDisabled = &Error{
+		Code:        "deployment_disabled",
+		Description: "This deployment of the tool has been disabled.",
+		StatusCode:  http.StatusForbidden,
+	}
+
+	// ErrContextNotAllowed is the error of a launch from a context (course) that the deployment does not allow.
+	ErrContextNotAllowed = &Error{
+		Code:        "context_not_allowed",
+		Description: "The tool is not available in this course.",
+		StatusCode:  http.StatusForbidden,
+	}
+
+	// ErrUnsupportedMessage is the error of a launch with an LTI version or message type that the tool does not
+	// accept.
+	ErrUnsupportedMessage = &Error{
+		Code:        "unsupported_message",
+		Description: "The tool does not support this kind of launch.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrInvalidClaims is the error of a launch with missing or malformed LTI claims.
+	ErrInvalidClaims = &Error{
+		Code:        "invalid_claims",
+		Description: "The launch from the learning platform is incomplete or malformed.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrRejected is the error of a launch rejected by a custom validator that did not return an *Error.
+	ErrRejected = &Error{
+		Code:        "rejected",
+		Description: "The tool cannot be launched here.",
+		StatusCode:  http.StatusBadRequest,
+	}
+
+	// ErrInternal is the error of a login or launch that failed on the tool's side, e.g. because a store is down.
+	ErrInternal = &Error{
+		Code:        "internal_error",
+		Description: "The tool encountered an error. Please try again later.",
+		StatusCode:  http.StatusInternalServerError,
+	}
+)
+
+// An ErrorHandler responds to a failed login or launch.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err *Error)
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Launch failed</title>
+</head>
+<body>
+<h1>The tool could not be opened</h1>
+<p>{{.Description}}</p>
+<p><small>Error code: {{.Code}}</small></p>
+{{if .ReturnURL}}<p><a href="{{.ReturnURL}}" target="_top">Return to the course</a></p>{{end}}
+</body>
+</html>
+`))
+
+// DefaultErrorHandler responds with an HTML page that shows the error's description and code and, if the error has a
+// return URL, links back to the platform.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err *Error) {
+	statusCode := err.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	errorPage.Execute(w, err)
+}
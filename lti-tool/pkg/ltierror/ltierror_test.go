@@ -0,0 +1,65 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package ltierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that wrapped errors match their sentinel and their cause, and leave the sentinel unchanged.
+func TestWrap(t *testing.T) {
+	cause := errors.New("state validation failed")
+	err := fmt.Errorf("launch: %w", ErrStateMismatch.Wrap(cause))
+
+	if !errors.Is(err, ErrStateMismatch) || !errors.Is(err, cause) {
+		t.Fatalf("wrapped error %v does not match its sentinel and cause", err)
+	}
+	if errors.Is(err, ErrNonceInvalid) {
+		t.Fatalf("wrapped error %v matches another sentinel", err)
+	}
+	if ErrStateMismatch.Err != nil {
+		t.Fatalf("sentinel changed by Wrap")
+	}
+	if got := ErrStateMismatch.Wrap(cause).Error(); got != "state_mismatch: state validation failed" {
+		t.Fatalf("got message %q", got)
+	}
+}
+
+// Test the page of the default error handler.
+func TestDefaultErrorHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/launch", nil)
+	err := ErrDeploymentDisabled.Wrap(errors.New("deployment is disabled"))
+	err.ReturnURL = "https://platform.tld/return?lti_errorlog=deployment_disabled&lti_errormsg=Disabled"
+	DefaultErrorHandler(w, r, err)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, wanted %d", w.Code, http.StatusForbidden)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, ErrDeploymentDisabled.Description) || !strings.Contains(body, "deployment_disabled") {
+		t.Errorf("description or code missing from page: %s", body)
+	}
+	if strings.Contains(body, "deployment is disabled") {
+		t.Errorf("underlying error shown on page: %s", body)
+	}
+	if !strings.Contains(body, `href="https://platform.tld/return?lti_errorlog=deployment_disabled&amp;lti_errormsg=Disabled"`) {
+		t.Errorf("return link missing from page: %s", body)
+	}
+
+	// A return URL that is not a link to the platform is not rendered as one.
+	w = httptest.NewRecorder()
+	err.ReturnURL = "javascript:alert(1)"
+	DefaultErrorHandler(w, r, err)
+	if strings.Contains(w.Body.String(), "javascript:") {
+		t.Errorf("unsafe return link rendered: %s", w.Body)
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+// Package session provides tool sessions that follow a successful launch. A session is bound to the launch ID and is
+// carried by the user agent either in a cookie or, where third-party cookies are blocked inside the platform's iframe,
+// in a request header. The session middleware restores the launch context for every follow-up request.
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
+)
+
+const (
+	// DefaultCookieName is the name of the session cookie unless configured otherwise.
+	DefaultCookieName = "ltiSession"
+
+	// DefaultHeaderName is the request header carrying the session token unless configured otherwise.
+	DefaultHeaderName = "X-LTI-Session"
+
+	// DefaultTTL is the session lifetime unless configured otherwise.
+	DefaultTTL = time.Hour
+)
+
+var (
+	// ErrNoSession is the error returned when a request carries no session token.
+	ErrNoSession = errors.New("session token not found in request")
+
+	// ErrInvalidToken is the error returned when a session token is malformed or its signature does not match.
+	ErrInvalidToken = errors.New("invalid session token")
+)
+
+// Config holds the settings of a session Manager.
+type Config struct {
+	// Key signs the session tokens. It must be kept secret and should be at least 32 random bytes.
+	Key []byte
+
+	// TTL is the session lifetime. Sessions are refreshed (slid forward by TTL) when a request arrives after half of
+	// the lifetime has passed.
+	TTL time.Duration
+
+	// MaxLifetime caps how long a session lasts after it is issued, however often it is refreshed. A session cannot
+	// restore its launch context once the launch data has expired, so it should not exceed the launch data TTL of the
+	// store, which is datastore.DefaultLaunchDataTTL unless configured otherwise.
+	MaxLifetime time.Duration
+
+	// CookieName and CookiePath set the session cookie. HeaderName is the request header that may carry the session
+	// token instead of the cookie.
+	CookieName string
+	CookiePath string
+	HeaderName string
+
+	// Claims decodes extension claims when the launch context is restored. If nil, the launch package's
+	// DefaultClaimRegistry is used.
+	Claims *launch.ClaimRegistry
+}
+
+// NewConfig returns a new session configuration with default settings and the given signing key.
+func NewConfig(key []byte) Config {
+	return Config{
+		Key:         key,
+		TTL:         DefaultTTL,
+		MaxLifetime: datastore.DefaultLaunchDataTTL,
+		CookieName:  DefaultCookieName,
+		CookiePath:  "/",
+		HeaderName:  DefaultHeaderName,
+	}
+}
+
+// A Manager issues tool sessions and restores the launch context of requests that carry one.
+type Manager struct {
+	cfg      Config
+	sessions datastore.SessionStorer
+	launches datastore.LaunchDataStorer
+	now      func() time.Time
+}
+
+type tokenContextKeyType string
+
+const tokenContextKey = tokenContextKeyType("SessionToken")
+
+// New creates a *Manager. If the passed datastore.Config has zero-value Sessions or LaunchData stores, fall back on the
+// in-memory nonpersistent.DefaultStore. Zero-value settings in `cfg' are replaced by their defaults.
+func New(dsCfg datastore.Config, cfg Config) *Manager {
+	manager := Manager{
+		cfg:      cfg,
+		sessions: dsCfg.Sessions,
+		launches: dsCfg.LaunchData,
+		now:      time.Now,
+	}
+
+	if manager.sessions == nil {
+		manager.sessions = nonpersistent.DefaultStore
+	}
+	if manager.launches == nil {
+		manager.launches = nonpersistent.DefaultStore
+	}
+	if manager.cfg.TTL <= 0 {
+		manager.cfg.TTL = DefaultTTL
+	}
+	if manager.cfg.MaxLifetime <= 0 {
+		manager.cfg.MaxLifetime = datastore.DefaultLaunchDataTTL
+	}
+	if manager.cfg.CookieName == "" {
+		manager.cfg.CookieName = DefaultCookieName
+	}
+	if manager.cfg.CookiePath == "" {
+		manager.cfg.CookiePath = "/"
+	}
+	if manager.cfg.HeaderName == "" {
+		manager.cfg.HeaderName = DefaultHeaderName
+	}
+
+	return &manager
+}
+
+// Issue creates a session for the launch, sets the session cookie and returns the signed session token. The token can
+// also be handed to the page (e.g. embedded for use by scripts) and sent back in the configured header.
+func (m *Manager) Issue(w http.ResponseWriter, launchID string) (string, error) {
+	if len(m.cfg.Key) == 0 {
+		return "", errors.New("session signing key has not been set")
+	}
+	if launchID == "" {
+		return "", errors.New("received empty launch ID")
+	}
+
+	now := m.now()
+	session := datastore.Session{
+		ID:        "lti1p3-session-" + uuid.New().String(),
+		LaunchID:  launchID,
+		CreatedAt: now,
+	}
+	session.ExpiresAt = m.expiry(session, now)
+	err := m.sessions.StoreSession(session)
+	if err != nil {
+		return "", err
+	}
+
+	token := m.sign(session.ID)
+	m.setCookie(w, token, session.ExpiresAt)
+
+	return token, nil
+}
+
+// IssueAfterLaunch wraps the handler run after a successful launch so that a session is issued first. It is meant to
+// be passed as the `next' argument of launch.New. The session token is available to `next' through TokenFromContext.
+func (m *Manager) IssueAfterLaunch(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lc, ok := r.Context().Value(launch.ContextKey).(launch.LaunchContext)
+		if !ok || lc.LaunchId == "" {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		token, err := m.Issue(w, lc.LaunchId)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	}
+}
+
+// Middleware restores the launch context of requests carrying a valid session, refreshing the session when needed.
+// Requests without a valid session get a 401 Unauthorized response.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, session, err := m.sessionFromRequest(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		lc, err := launch.RestoreLaunchContext(m.launches, m.cfg.Claims, session.LaunchID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// Slide the session forward once half of its lifetime has passed, up to its maximum lifetime.
+		now := m.now()
+		if expiresAt := m.expiry(session, now); session.ExpiresAt.Sub(now) < m.cfg.TTL/2 &&
+			expiresAt.After(session.ExpiresAt) {
+			session.ExpiresAt = expiresAt
+			if err := m.sessions.StoreSession(session); err == nil {
+				m.setCookie(w, token, session.ExpiresAt)
+			}
+		}
+
+		ctx := launch.ContextWithLaunchContext(r.Context(), lc)
+		ctx = context.WithValue(ctx, tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// expiry returns the expiry time of `session' when it is issued or refreshed at `now': a TTL later, but no later than
+// MaxLifetime after the session was created.
+func (m *Manager) expiry(session datastore.Session, now time.Time) time.Time {
+	expiresAt := now.Add(m.cfg.TTL)
+	if session.CreatedAt.IsZero() {
+		return expiresAt
+	}
+	if maxExpiresAt := session.CreatedAt.Add(m.cfg.MaxLifetime); expiresAt.After(maxExpiresAt) {
+		return maxExpiresAt
+	}
+
+	return expiresAt
+}
+
+// Revoke deletes the session carried by the request and clears the session cookie.
+func (m *Manager) Revoke(w http.ResponseWriter, r *http.Request) error {
+	token := m.tokenFromRequest(r)
+	if token == "" {
+		return ErrNoSession
+	}
+	sessionID, err := m.verify(token)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cfg.CookieName,
+		Path:     m.cfg.CookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+
+	return m.sessions.DeleteSession(sessionID)
+}
+
+// TokenFromContext returns the session token attached to a request context by IssueAfterLaunch or Middleware.
+func TokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tokenContextKey).(string)
+	return token
+}
+
+// sessionFromRequest finds and verifies the session carried by the request.
+func (m *Manager) sessionFromRequest(r *http.Request) (string, datastore.Session, error) {
+	token := m.tokenFromRequest(r)
+	if token == "" {
+		return "", datastore.Session{}, ErrNoSession
+	}
+
+	sessionID, err := m.verify(token)
+	if err != nil {
+		return "", datastore.Session{}, err
+	}
+
+	session, err := m.sessions.FindSession(sessionID)
+	if err != nil {
+		return "", datastore.Session{}, err
+	}
+	if !session.ExpiresAt.After(m.now()) {
+		return "", datastore.Session{}, datastore.ErrSessionExpired
+	}
+
+	return token, session, nil
+}
+
+// tokenFromRequest gets the session token from the configured header or, failing that, from the session cookie.
+func (m *Manager) tokenFromRequest(r *http.Request) string {
+	if token := r.Header.Get(m.cfg.HeaderName); token != "" {
+		return token
+	}
+
+	cookie, err := r.Cookie(m.cfg.CookieName)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// setCookie sets the session cookie. Since tools usually run inside the platform's iframe, the cookie must be allowed
+// in third-party contexts.
+func (m *Manager) setCookie(w http.ResponseWriter, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cfg.CookieName,
+		Value:    token,
+		Path:     m.cfg.CookiePath,
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
+
+// sign returns the session token for a session ID: the ID and its HMAC-SHA256 signature.
+func (m *Manager) sign(sessionID string) string {
+	return sessionID + "." + base64.RawURLEncoding.EncodeToString(m.mac(sessionID))
+}
+
+// verify checks the signature of a session token and returns its session ID.
+func (m *Manager) verify(token string) (string, error) {
+	if len(m.cfg.Key) == 0 {
+		return "", errors.New("session signing key has not been set")
+	}
+
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return "", ErrInvalidToken
+	}
+	sessionID := token[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if !hmac.Equal(signature, m.mac(sessionID)) {
+		return "", ErrInvalidToken
+	}
+
+	return sessionID, nil
+}
+
+func (m *Manager) mac(sessionID string) []byte {
+	mac := hmac.New(sha256.New, m.cfg.Key)
+	mac.Write([]byte(sessionID))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 MacEwan University. All rights reserved.
+//
+// This source code is licensed under the MIT-style license found in
+// the LICENSE file in the root directory of this source tree.
+
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/macewan-cs/lti-example/pkg/datastore"
+	"github.com/macewan-cs/lti-example/pkg/datastore/nonpersistent"
+	"github.com/macewan-cs/lti-example/pkg/launch"
+)
+
+const testLaunchID = "lti1p3-launch-test"
+
+// Set up a manager backed by a fresh nonpersistent store holding one launch.
+func newManagerForTesting(t *testing.T) *Manager {
+	store := nonpersistent.New()
+	err := store.StoreLaunchData(testLaunchID, json.RawMessage(`{
+  "iss": "https://platform.tld/instance",
+  "sub": "user-1",
+  "aud": "abcdef123456",
+  "https://purl.imsglobal.org/spec/lti/claim/context": {"id": "course-1"}
+}`))
+	if err != nil {
+		t.Fatalf("store launch data error: %v", err)
+	}
+
+	return New(datastore.Config{Sessions: store, LaunchData: store}, NewConfig([]byte("0123456789abcdef0123456789abcdef")))
+}
+
+// echoLaunch responds with the launch ID and context ID of the restored launch context.
+var echoLaunch = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	lc := r.Context().Value(launch.ContextKey).(launch.LaunchContext)
+	w.Write([]byte(lc.LaunchId + " " + lc.Message.Context.ID))
+})
+
+func TestIssueAndMiddleware(t *testing.T) {
+	manager := newManagerForTesting(t)
+
+	w := httptest.NewRecorder()
+	token, err := manager.Issue(w, testLaunchID)
+	if err != nil {
+		t.Fatalf("issue error: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || cookies[0].SameSite != http.SameSiteNoneMode {
+		t.Fatalf("unexpected session cookies: %#v", cookies)
+	}
+
+	handler := manager.Middleware(echoLaunch)
+
+	// Session carried by the cookie.
+	r := httptest.NewRequest(http.MethodGet, "https://tool.tld/page", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != testLaunchID+" course-1" {
+		t.Fatalf("got %d %q, wanted restored launch context", w.Code, w.Body.String())
+	}
+
+	// Session carried by the header.
+	r = httptest.NewRequest(http.MethodGet, "https://tool.tld/page", nil)
+	r.Header.Set(DefaultHeaderName, token)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, wanted session from header to be accepted", w.Code)
+	}
+
+	// No session, tampered session.
+	for _, token := range []string{"", token + "x", "lti1p3-session-forged.c2lnbmF0dXJl"} {
+		r = httptest.NewRequest(http.MethodGet, "https://tool.tld/page", nil)
+		if token != "" {
+			r.Header.Set(DefaultHeaderName, token)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: got %d, wanted %d", token, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestSlidingRefreshAndExpiry(t *testing.T) {
+	manager := newManagerForTesting(t)
+	now := time.Now()
+	manager.now = func() time.Time { return now }
+
+	token, err := manager.Issue(httptest.NewRecorder(), testLaunchID)
+	if err != nil {
+		t.Fatalf("issue error: %v", err)
+	}
+	handler := manager.Middleware(echoLaunch)
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://tool.tld/page", nil)
+		r.Header.Set(DefaultHeaderName, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Past half of the lifetime, the session is slid forward.
+	now = now.Add(DefaultTTL * 3 / 4)
+	w := request()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, wanted session to be valid", w.Code)
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatal("refreshed session cookie not set")
+	}
+
+	// Still valid after the original expiry thanks to the refresh.
+	now = now.Add(DefaultTTL / 2)
+	if w := request(); w.Code != http.StatusOK {
+		t.Fatalf("got %d, wanted refreshed session to be valid", w.Code)
+	}
+
+	// Expired once a full lifetime passes without requests.
+	now = now.Add(DefaultTTL * 2)
+	if w := request(); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted expired session to be rejected", w.Code)
+	}
+}
+
+// Test that refreshes do not keep a session alive past its maximum lifetime, after which its launch data expires.
+func TestMaxLifetime(t *testing.T) {
+	manager := newManagerForTesting(t)
+	manager.cfg.MaxLifetime = DefaultTTL * 2
+	now := time.Now()
+	issuedAt := now
+	manager.now = func() time.Time { return now }
+
+	token, err := manager.Issue(httptest.NewRecorder(), testLaunchID)
+	if err != nil {
+		t.Fatalf("issue error: %v", err)
+	}
+	handler := manager.Middleware(echoLaunch)
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://tool.tld/page", nil)
+		r.Header.Set(DefaultHeaderName, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Refreshes slide the session forward up to the maximum lifetime, and no further.
+	maxExpiresAt := issuedAt.Add(manager.cfg.MaxLifetime)
+	for i := 0; i < 2; i++ {
+		now = now.Add(DefaultTTL * 3 / 4)
+		w := request()
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d, wanted session to be valid", i, w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Expires.After(maxExpiresAt) {
+			t.Fatalf("request %d: got session cookies %v, wanted one expiring by %v", i, cookies, maxExpiresAt)
+		}
+	}
+	now = now.Add(DefaultTTL / 4)
+	if w := request(); w.Code != http.StatusOK || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("got %d with cookies %v, wanted the session to be valid but not refreshed", w.Code,
+			w.Result().Cookies())
+	}
+
+	now = maxExpiresAt.Add(time.Second)
+	if w := request(); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted session past its maximum lifetime to be rejected", w.Code)
+	}
+
+	if New(datastore.Config{}, Config{}).cfg.MaxLifetime != datastore.DefaultLaunchDataTTL {
+		t.Fatal("maximum lifetime does not default to the launch data TTL")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	manager := newManagerForTesting(t)
+	token, err := manager.Issue(httptest.NewRecorder(), testLaunchID)
+	if err != nil {
+		t.Fatalf("issue error: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://tool.tld/logout", nil)
+	r.Header.Set(DefaultHeaderName, token)
+	err = manager.Revoke(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("revoke error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	manager.Middleware(echoLaunch).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted revoked session to be rejected", w.Code)
+	}
+}